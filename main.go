@@ -3,12 +3,26 @@ package main
 import (
 	"errors"
 	"os"
+	"path/filepath"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/mhrivnak/preheatbot/pkg/anomaly"
 	"github.com/mhrivnak/preheatbot/pkg/api"
 	"github.com/mhrivnak/preheatbot/pkg/bot"
+	"github.com/mhrivnak/preheatbot/pkg/calendar"
+	"github.com/mhrivnak/preheatbot/pkg/coap"
+	"github.com/mhrivnak/preheatbot/pkg/digest"
+	"github.com/mhrivnak/preheatbot/pkg/health"
 	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/metrics"
+	"github.com/mhrivnak/preheatbot/pkg/mqtt"
+	"github.com/mhrivnak/preheatbot/pkg/preheat"
+	"github.com/mhrivnak/preheatbot/pkg/scheduler"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+	"github.com/mhrivnak/preheatbot/pkg/thermostat"
+	"github.com/mhrivnak/preheatbot/pkg/weather"
+	"github.com/mhrivnak/preheatbot/pkg/webhook"
 )
 
 func main() {
@@ -32,8 +46,39 @@ func main() {
 	}
 
 	store := heaterstore.Store{Dir: datadir}
-	b := bot.New(token, &store)
-	server := api.New(b, &store, listenAddr)
+	telemetryStore := telemetry.Store{Dir: filepath.Join(datadir, telemetry.Dirname)}
+	var metars weather.Fetcher = &weather.HTTPFetcher{URL: weather.DefaultURL}
+	if dir := os.Getenv("METARDIR"); dir != "" {
+		metars = &weather.FileFetcher{Dir: dir}
+	} else if url := os.Getenv("METARURL"); url != "" {
+		metars = &weather.HTTPFetcher{URL: url}
+	}
+	calendars := calendar.New(&store)
+	webhooks := webhook.New(&store, &telemetryStore)
+	b := bot.New(token, &store, &telemetryStore, weather.NewService(metars), calendars, webhooks)
+	publicURL := os.Getenv("PUBLICURL")
+	if publicURL == "" {
+		publicURL = "https://preheatbot.hrivnak.org/api"
+	}
+	b.SetPublicURL(publicURL)
+	b.AddListener(webhooks)
+	bridge := mqtt.New(&store, b)
+	b.AddListener(bridge)
+	b.SetMQTT(bridge)
+	// serve heaters over CoAP for constrained devices, if configured
+	var coapServer *coap.Server
+	if coapAddr := os.Getenv("COAPADDR"); coapAddr != "" {
+		coapServer = coap.New(&store, &telemetryStore, coapAddr)
+		b.AddListener(coapServer)
+	}
+	sched := scheduler.New(&store, b, b)
+	checker := health.New()
+	checker.Add("datadir", health.ErrorCheck(store.CheckDir))
+	checker.Add("telegram", health.LoopCheck(b.PollerStatus, bot.MaxPollAge))
+	checker.Add("scheduler", health.LoopCheck(sched.Status, scheduler.MaxRunAge))
+	server := api.New(b, b, &store, &telemetryStore, checker, listenAddr)
+	metrics.RegisterHeaters(&store, &telemetryStore)
+	metrics.Default.SetToken(os.Getenv("METRICSTOKEN"))
 	exitChan := make(chan error)
 
 	// start bot
@@ -42,6 +87,35 @@ func main() {
 		exitChan <- errors.New("bot routine exited unexpectedly")
 	}()
 
+	// fire scheduled actions
+	go sched.Run()
+
+	// follow booking calendars
+	go calendars.Run()
+
+	// run thermostats
+	go thermostat.New(&store, &telemetryStore, b, b).Run()
+
+	// alert owners of heaters that are on but not working
+	go anomaly.New(&store, &telemetryStore, b).Run()
+
+	// deliver webhooks and watch for devices going offline
+	go webhooks.Run()
+
+	// bridge heaters to users' MQTT brokers
+	go bridge.Run()
+
+	// send weekly digests
+	go digest.New(&store, &telemetryStore, b).Run()
+
+	// learn preheat curves from past preheats
+	go preheat.NewLearner(&store, &telemetryStore).Run()
+
+	// downsample and expire old telemetry
+	go telemetryStore.RunCompactor(func(err error) {
+		log.WithError(err).Error("error compacting telemetry")
+	})
+
 	// start API
 	go func() {
 		err := server.ListenAndServe()
@@ -51,6 +125,12 @@ func main() {
 		exitChan <- errors.New("http listener returned unexpectedly")
 	}()
 
+	if coapServer != nil {
+		go func() {
+			exitChan <- coapServer.ListenAndServe()
+		}()
+	}
+
 	err := <-exitChan
 	log.WithError(err).Fatal("Exiting")
 }
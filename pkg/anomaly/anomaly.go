@@ -0,0 +1,224 @@
+// Package anomaly watches heaters that are on for signs that they aren't
+// working, such as a temperature that isn't rising or no current being drawn,
+// and alerts their owners.
+package anomaly
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+)
+
+const (
+	// MinRise is the least a heater's temperature must rise, in degrees
+	// Celsius, during the failure window after it is turned on.
+	MinRise = 1.0
+	// MinCurrent is the least current, in amps, a heater must draw at some
+	// point during the failure window.
+	MinCurrent = 0.5
+
+	interval = time.Minute
+	// lookback is how far back the history is searched for when the heater
+	// was turned on.
+	lookback = 24 * time.Hour
+	// startWindow is how far from the moment the heater turned on a reading
+	// may be and still count as the starting temperature.
+	startWindow = 15 * time.Minute
+)
+
+// Notifier sends a message to a user.
+type Notifier interface {
+	Notify(username, message string, options ...interface{})
+}
+
+// Detector checks every heater that is on for signs of failure.
+type Detector struct {
+	store     *heaterstore.Store
+	telemetry *telemetry.Store
+	notifier  Notifier
+}
+
+func New(store *heaterstore.Store, telemetry *telemetry.Store, notifier Notifier) *Detector {
+	return &Detector{
+		store:     store,
+		telemetry: telemetry,
+		notifier:  notifier,
+	}
+}
+
+// Run checks every heater periodically. It never returns.
+func (d *Detector) Run() {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		d.RunOnce(now)
+	}
+}
+
+// RunOnce checks every heater once.
+func (d *Detector) RunOnce(now time.Time) {
+	refs, err := d.store.AllHeaters()
+	if err != nil {
+		log.Errorf("error listing heaters for failure detection: %s", err.Error())
+		return
+	}
+	for _, ref := range refs {
+		err = d.check(ref, now)
+		if err != nil {
+			log.Errorf("error checking %s/%s for failure: %s", ref.Owner, ref.Heater, err.Error())
+		}
+	}
+}
+
+// check alerts the heater's owners if it has been on for at least the failure
+// window and its readings suggest it isn't working. Owners are alerted at
+// most once each time the heater is turned on.
+func (d *Detector) check(ref heaterstore.HeaterRef, now time.Time) error {
+	record, err := d.store.Get(ref.Owner, ref.Heater)
+	if err != nil {
+		return err
+	}
+	anomaly, alerted, err := d.store.GetAnomaly(ref.Owner, ref.Heater)
+	if err != nil {
+		return err
+	}
+	if record.Value != "on" {
+		if alerted {
+			return d.store.DelAnomaly(ref.Owner, ref.Heater)
+		}
+		return nil
+	}
+	window := d.store.FailureWindow(ref.Owner, ref.Heater)
+	if window < 0 {
+		return nil
+	}
+
+	history, err := d.store.History(ref.Owner, ref.Heater, now.Add(-lookback))
+	if err != nil {
+		return err
+	}
+	periods := heaterstore.OnPeriods(history, now)
+	if len(periods) == 0 || !periods[len(periods)-1].Ongoing {
+		return nil
+	}
+	onSince := periods[len(periods)-1].Start
+	if now.Sub(onSince) < window || (alerted && anomaly.OnSince.Equal(onSince)) {
+		return nil
+	}
+
+	reasons, err := d.Diagnose(ref, onSince, now, window)
+	if err != nil || len(reasons) == 0 {
+		return err
+	}
+	anomaly = heaterstore.Anomaly{
+		OnSince:    onSince,
+		DetectedAt: now,
+		Reason:     strings.Join(reasons, ", and "),
+	}
+	err = d.store.SetAnomaly(ref.Owner, ref.Heater, anomaly)
+	if err != nil {
+		return err
+	}
+	log.Infof("%s/%s may have failed: %s", ref.Owner, ref.Heater, anomaly.Reason)
+
+	owners, err := d.store.Owners(ref.Owner)
+	if err != nil {
+		return err
+	}
+	for _, username := range owners {
+		d.notifier.Notify(username, fmt.Sprintf(
+			"⚠️ %s has been on for %s but may not be working: %s. You may want to check its power and breaker.",
+			ref.Name(username), now.Sub(onSince).Round(time.Minute), anomaly.Reason))
+	}
+	return nil
+}
+
+// Diagnose looks for signs that a heater that has been on since onSince isn't
+// working, and returns a description of each one found. Its engine
+// temperature must rise during the first window after it was turned on, and
+// it must draw current at some point during the latest window. Readings that
+// a device doesn't report are not considered.
+func (d *Detector) Diagnose(ref heaterstore.HeaterRef, onSince, now time.Time, window time.Duration) ([]string, error) {
+	reasons := []string{}
+
+	// only the engine is expected to warm; the air outside doesn't
+	temps, err := d.telemetry.Query(ref.Owner, ref.Heater, telemetry.MetricEngineTemp, onSince.Add(-startWindow), onSince.Add(window))
+	if err != nil {
+		return reasons, err
+	}
+	if reason, ok := notWarming(temps, onSince, window); ok {
+		reasons = append(reasons, reason)
+	}
+
+	current, err := d.telemetry.Query(ref.Owner, ref.Heater, telemetry.MetricCurrent, now.Add(-window), now)
+	if err != nil {
+		return reasons, err
+	}
+	if reason, ok := noCurrent(current, window); ok {
+		reasons = append(reasons, reason)
+	}
+	return reasons, nil
+}
+
+// notWarming describes engine temperature readings that rose less than MinRise
+// during the window after onSince. ok is false if the temperature rose enough
+// or there aren't enough readings to tell.
+func notWarming(samples []telemetry.Sample, onSince time.Time, window time.Duration) (string, bool) {
+	start, ok := telemetry.Sample{}, false
+	for _, s := range samples {
+		if s.Time.After(onSince) {
+			break
+		}
+		start, ok = s, true
+	}
+	if !ok {
+		for _, s := range samples {
+			if s.Time.After(onSince) {
+				start, ok = s, s.Time.Sub(onSince) <= 5*time.Minute
+				break
+			}
+		}
+	}
+	if !ok || len(samples) == 0 {
+		return "", false
+	}
+	last := samples[len(samples)-1]
+	// without readings from late in the window, the heater may have been
+	// warming unseen
+	if last.Time.Before(onSince.Add(window / 2)) {
+		return "", false
+	}
+	highest := math.Inf(-1)
+	for _, s := range samples {
+		if s.Time.After(start.Time) {
+			highest = math.Max(highest, s.Value)
+		}
+	}
+	if math.IsInf(highest, -1) || highest-start.Value >= MinRise {
+		return "", false
+	}
+	return fmt.Sprintf("its engine temperature went from %.1f°C to %.1f°C in the %s after it was turned on",
+		start.Value, last.Value, window), true
+}
+
+// noCurrent describes current readings that never reached MinCurrent. ok is
+// false if any reading did or there are too few readings to tell.
+func noCurrent(samples []telemetry.Sample, window time.Duration) (string, bool) {
+	if len(samples) < 2 {
+		return "", false
+	}
+	highest := math.Inf(-1)
+	for _, s := range samples {
+		highest = math.Max(highest, s.Value)
+	}
+	if highest >= MinCurrent {
+		return "", false
+	}
+	return fmt.Sprintf("it drew at most %.1f A across %d readings in the last %s", highest, len(samples), window), true
+}
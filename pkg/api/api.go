@@ -10,22 +10,39 @@ import (
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/mhrivnak/preheatbot/pkg/health"
 	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/metrics"
+	"github.com/mhrivnak/preheatbot/pkg/preheat"
+	"github.com/mhrivnak/preheatbot/pkg/shortcut"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+	"github.com/mhrivnak/preheatbot/pkg/usage"
 )
 
 type API struct {
 	server     http.Server
 	store      *heaterstore.Store
+	telemetry  *telemetry.Store
+	planner    *preheat.Planner
+	usage      *usage.Reporter
 	subscriber Subscriber
+	controller shortcut.Controller
 }
 
 type Subscriber interface {
 	Subscribe(ctx context.Context, username, heater string) <-chan heaterstore.Record
 }
 
-func New(subscriber Subscriber, store *heaterstore.Store, listenAddr string) *http.Server {
+// New returns the API server. checker reports the health of the rest of the
+// server at /healthz and /readyz; if it is nil, they report only that the API
+// is up.
+func New(subscriber Subscriber, controller shortcut.Controller, store *heaterstore.Store, telemetry *telemetry.Store, checker *health.Checker, listenAddr string) *http.Server {
 	log.Info("Starting API")
 
+	if checker == nil {
+		checker = health.New()
+	}
+
 	r := mux.NewRouter()
 	api := API{
 		server: http.Server{
@@ -33,18 +50,51 @@ func New(subscriber Subscriber, store *heaterstore.Store, listenAddr string) *ht
 			Handler: r,
 		},
 		store:      store,
+		telemetry:  telemetry,
+		planner:    preheat.NewPlanner(store, telemetry),
+		usage:      usage.New(store),
 		subscriber: subscriber,
+		controller: controller,
 	}
 
 	r.HandleFunc("/v1/users/{username}/heaters/{heater}", api.HeaterHandler).Methods("GET")
+	r.HandleFunc("/v1/groups/{group}/heaters/{heater}", api.GroupHeaterHandler).Methods("GET")
+	r.HandleFunc("/v1/users/{username}/heaters/{heater}/telemetry", api.TelemetryHandler).Methods("POST")
+	r.HandleFunc("/v1/groups/{group}/heaters/{heater}/telemetry", api.TelemetryHandler).Methods("POST")
+	r.HandleFunc("/v1/users/{username}/heaters/{heater}/preheat", api.PreheatStatsHandler).Methods("GET")
+	r.HandleFunc("/v1/groups/{group}/heaters/{heater}/preheat", api.PreheatStatsHandler).Methods("GET")
+	r.HandleFunc("/v1/users/{username}/calendar.ics", api.CalendarFeedHandler).Methods("GET")
+	r.HandleFunc("/v1/users/{username}/usage", api.UsageHandler).Methods("GET")
+	r.HandleFunc("/v1/users/{username}/shortcuts/{id}", api.ShortcutHandler).Methods("GET", "POST")
+	r.HandleFunc("/v1/openapi.json", api.OpenAPIHandler).Methods("GET")
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	r.HandleFunc("/healthz", checker.LiveHandler).Methods("GET")
+	r.HandleFunc("/readyz", checker.ReadyHandler).Methods("GET")
+	api.routeV2(r)
+	r.Use(instrument)
 
 	return &api.server
 }
 
 func (a *API) HeaterHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	username := vars["username"]
-	heater := vars["heater"]
+	a.serveHeater(w, r, vars["username"], vars["heater"])
+}
+
+// GroupHeaterHandler serves heaters that belong to a group rather than to a
+// single user.
+func (a *API) GroupHeaterHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !heaterstore.ValidName(vars["group"]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	a.serveHeater(w, r, heaterstore.GroupNamespace(vars["group"]), vars["heater"])
+}
+
+// serveHeater responds with the record for the heater in the given owner
+// namespace, optionally waiting for it to change.
+func (a *API) serveHeater(w http.ResponseWriter, r *http.Request, username, heater string) {
 	hasVersion := -1
 	hasVersionString := r.URL.Query().Get("version")
 	if hasVersionString != "" {
@@ -69,17 +119,13 @@ func (a *API) HeaterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// If the client wants to long-poll and already has the current version,
-	// then wait for the next version before responding.
-	if r.URL.Query().Get("longpoll") != "" && record.Version == hasVersion {
-		log.Infof("starting long poll wait for %s/%s", username, heater)
-		myChan := a.subscriber.Subscribe(r.Context(), username, heater)
-		var stillOpen bool
-		record, stillOpen = <-myChan
-		if !stillOpen {
-			log.Infof("long poll request on %s was canceled", r.RequestURI)
-			return
-		}
+	record, ok := a.waitForChange(r, username, heater, record, hasVersion)
+	if !ok {
+		return
+	}
+
+	if checkModified(w, r, ETag(record.Version, nil), a.modified(username, heater)) {
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -91,3 +137,26 @@ func (a *API) HeaterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Infof("Sent version %d to %s/%s", record.Version, username, heater)
 }
+
+// waitForChange returns record, unless the client wants to long-poll and
+// already has the current version, in which case it waits for the next
+// version. Without the version parameter, the version may instead come from an
+// If-None-Match header. It returns false if the request was canceled while
+// waiting.
+func (a *API) waitForChange(r *http.Request, owner, heater string, record heaterstore.Record, hasVersion int) (heaterstore.Record, bool) {
+	if r.URL.Query().Get("version") == "" {
+		if v, ok := ifNoneMatchVersion(r); ok {
+			hasVersion = v
+		}
+	}
+	if r.URL.Query().Get("longpoll") == "" || record.Version != hasVersion {
+		return record, true
+	}
+	log.Infof("starting long poll wait for %s/%s", owner, heater)
+	record, stillOpen := <-a.subscriber.Subscribe(r.Context(), owner, heater)
+	if !stillOpen {
+		log.Infof("long poll request on %s was canceled", r.RequestURI)
+		return record, false
+	}
+	return record, true
+}
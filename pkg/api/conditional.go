@@ -0,0 +1,105 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ETag returns the entity tag of a heater record. Versions only go up, so the
+// version identifies the record. expires is the /v2 expiresAt, which can
+// change without the version changing; /v1 passes nil.
+func ETag(version int, expires *time.Time) string {
+	tag := strconv.Itoa(version)
+	if expires != nil {
+		tag += "-" + strconv.FormatInt(expires.Unix(), 10)
+	}
+	return `"` + tag + `"`
+}
+
+// etagVersion returns the record version in an entity tag made by ETag.
+func etagVersion(tag string) (int, bool) {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false
+	}
+	tag = tag[1 : len(tag)-1]
+	if i := strings.IndexByte(tag, '-'); i >= 0 {
+		tag = tag[:i]
+	}
+	version, err := strconv.Atoi(tag)
+	if err != nil {
+		return 0, false
+	}
+	return version, true
+}
+
+// ifNoneMatchVersion returns the version named by the request's
+// If-None-Match header, so that a long poll can be driven by it instead of by
+// the version query parameter.
+func ifNoneMatchVersion(r *http.Request) (int, bool) {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return 0, false
+	}
+	return etagVersion(strings.Split(header, ",")[0])
+}
+
+// notModified returns true if the request's conditional headers say the
+// client already has the representation with the given validators. As in
+// RFC 7232, If-Modified-Since is ignored when If-None-Match is present.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if header := r.Header.Get("If-Modified-Since"); header != "" && !modified.IsZero() {
+		since, err := http.ParseTime(header)
+		if err == nil && !modified.Truncate(time.Second).After(since) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkModified sets the ETag and Last-Modified headers, and responds with 304
+// Not Modified if the client already has the representation. It returns true
+// if it responded. modified may be zero if it isn't known.
+func checkModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if !notModified(r, etag, modified) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// modified returns when the latest of the given files in the owner's
+// namespace was written, or zero if that can't be determined.
+func (a *API) modified(owner string, names ...string) time.Time {
+	latest := time.Time{}
+	for _, name := range names {
+		t, err := a.store.Modified(owner, name)
+		if err != nil {
+			if !a.store.IsNotExist(err) {
+				log.WithError(err).Error("error reading modification time")
+			}
+			continue
+		}
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+)
+
+// changeSubscriber answers each subscription with the next record sent on
+// changes.
+type changeSubscriber struct {
+	changes chan heaterstore.Record
+}
+
+func (s changeSubscriber) Subscribe(ctx context.Context, username, heater string) <-chan heaterstore.Record {
+	c := make(chan heaterstore.Record, 1)
+	go func() {
+		defer close(c)
+		select {
+		case record := <-s.changes:
+			c <- record
+		case <-ctx.Done():
+		}
+	}()
+	return c
+}
+
+func TestConditionalGet(t *testing.T) {
+	server, _ := newTestServer(t)
+	for _, path := range []string{"/v1/users/alice/heaters/plane", "/v2/users/alice/heaters/plane"} {
+		resp, _ := get(t, server.URL+path, nil)
+		etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		if etag != `"1"` || lastModified == "" {
+			t.Fatalf("%s: got ETag %q and Last-Modified %q", path, etag, lastModified)
+		}
+
+		for _, tc := range []struct {
+			header http.Header
+			status int
+		}{
+			{http.Header{"If-None-Match": {etag}}, http.StatusNotModified},
+			{http.Header{"If-None-Match": {`"0", W/` + etag}}, http.StatusNotModified},
+			{http.Header{"If-None-Match": {`"0"`}}, http.StatusOK},
+			{http.Header{"If-Modified-Since": {lastModified}}, http.StatusNotModified},
+			{http.Header{"If-Modified-Since": {"Mon, 02 Jan 2006 15:04:05 GMT"}}, http.StatusOK},
+			// If-None-Match wins
+			{http.Header{"If-None-Match": {`"0"`}, "If-Modified-Since": {lastModified}}, http.StatusOK},
+		} {
+			resp, body := get(t, server.URL+path, tc.header)
+			if resp.StatusCode != tc.status {
+				t.Errorf("%s with %v: got %d, want %d", path, tc.header, resp.StatusCode, tc.status)
+			}
+			if resp.StatusCode == http.StatusNotModified && (len(body) != 0 || resp.Header.Get("ETag") != etag) {
+				t.Errorf("%s with %v: got body %q and ETag %q", path, tc.header, body, resp.Header.Get("ETag"))
+			}
+		}
+	}
+}
+
+func TestLongPollIfNoneMatch(t *testing.T) {
+	changes := make(chan heaterstore.Record)
+	server, _ := newTestServerWith(t, changeSubscriber{changes})
+
+	done := make(chan struct{})
+	var resp *http.Response
+	var body []byte
+	go func() {
+		defer close(done)
+		resp, body = get(t, server.URL+"/v1/users/alice/heaters/plane?longpoll=true", http.Header{"If-None-Match": {`"1"`}})
+	}()
+	select {
+	case <-done:
+		t.Fatal("long poll returned before the heater changed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	changes <- heaterstore.Record{Value: "on", Version: 2}
+	<-done
+
+	if resp.StatusCode != http.StatusOK || string(body) != "{\"value\":\"on\",\"version\":2}\n" || resp.Header.Get("ETag") != `"2"` {
+		t.Errorf("got %d %q with ETag %q", resp.StatusCode, body, resp.Header.Get("ETag"))
+	}
+
+	// a stale tag returns the current record at once
+	resp, _ = get(t, server.URL+"/v1/users/alice/heaters/plane?longpoll=true", http.Header{"If-None-Match": {`"0"`}})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d", resp.StatusCode)
+	}
+}
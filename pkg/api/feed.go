@@ -0,0 +1,158 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/ical"
+	"github.com/mhrivnak/preheatbot/pkg/preheat"
+)
+
+// feedHistory is how far back past on-periods are included in calendar feeds.
+const feedHistory = 90 * 24 * time.Hour
+
+// CalendarFeedHandler responds with an iCalendar feed of when the user's
+// heaters were on and when they are planned to be. The request must carry
+// the user's feed token as the "token" query parameter, since calendar
+// clients can't send headers.
+func (a *API) CalendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	if _, ok := a.checkFeedToken(w, r, username); !ok {
+		return
+	}
+
+	now := time.Now()
+	events, err := a.feedEvents(username, now)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.WithError(err).Error("error building calendar feed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	err = ical.Encode(w, "Preheats for "+username, events, now)
+	if err != nil {
+		log.WithError(err).Error("error writing calendar feed")
+	}
+}
+
+// checkFeedToken verifies the "token" query parameter against the user's
+// feed token and returns the user's profile. If it returns false, it has
+// already responded.
+func (a *API) checkFeedToken(w http.ResponseWriter, r *http.Request, username string) (heaterstore.Profile, bool) {
+	profile, err := a.store.GetProfile(username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.WithError(err).Error("error reading profile")
+		return profile, false
+	}
+	token := r.URL.Query().Get("token")
+	if profile.FeedToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(profile.FeedToken)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "invalid feed token")
+		return profile, false
+	}
+	return profile, true
+}
+
+// feedEvents returns an event for each period during which one of the user's
+// heaters was on or is planned to be on. UIDs are derived from the heater and
+// the start of the period so that clients update events rather than
+// duplicate them.
+func (a *API) feedEvents(username string, now time.Time) ([]ical.Event, error) {
+	events := []ical.Event{}
+	refs, err := a.store.Heaters(username)
+	if err != nil {
+		return events, err
+	}
+	schedules := make(map[string][]heaterstore.Action)
+	for _, ref := range refs {
+		name := ref.Name(username)
+		actions, ok := schedules[ref.Owner]
+		if !ok {
+			actions, err = a.store.Schedule(ref.Owner)
+			if err != nil {
+				return events, err
+			}
+			schedules[ref.Owner] = actions
+		}
+		planned := []heaterstore.Action{}
+		for _, action := range actions {
+			if action.Heater == ref.Heater {
+				planned = append(planned, action)
+			}
+		}
+
+		history, err := a.store.History(ref.Owner, ref.Heater, now.Add(-feedHistory))
+		if err != nil {
+			return events, err
+		}
+		for _, p := range heaterstore.OnPeriods(history, now) {
+			e := ical.Event{
+				UID:         feedUID(ref, "on", p.Start),
+				Summary:     name + " on",
+				Description: "Turned on by " + p.By,
+				Start:       p.Start,
+				End:         p.End,
+			}
+			// an ongoing period ends when it is planned to
+			if p.Ongoing && len(planned) > 0 && planned[0].Value != "on" {
+				e.End = planned[0].At
+			}
+			events = append(events, e)
+		}
+
+		var on *heaterstore.Action
+		for i, action := range planned {
+			if action.Value == "on" {
+				if on == nil {
+					on = &planned[i]
+				}
+				continue
+			}
+			if on == nil {
+				continue
+			}
+			events = append(events, plannedEvent(ref, name, *on, action.At))
+			on = nil
+		}
+		if on != nil {
+			events = append(events, plannedEvent(ref, name, *on, on.At))
+		}
+	}
+	return events, nil
+}
+
+func plannedEvent(ref heaterstore.HeaterRef, name string, on heaterstore.Action, end time.Time) ical.Event {
+	description := "Planned by " + on.CreatedBy
+	if on.Reason != "" {
+		description += ": " + on.Reason
+	}
+	uid := feedUID(ref, on.Source, on.At)
+	if on.Source == preheat.Source {
+		// a heater has at most one preheat plan, which may be moved
+		uid = feedUID(ref, on.Source, time.Time{})
+	}
+	return ical.Event{
+		UID:         uid,
+		Summary:     name + " preheat",
+		Description: description,
+		Start:       on.At,
+		End:         end,
+	}
+}
+
+func feedUID(ref heaterstore.HeaterRef, kind string, start time.Time) string {
+	heater := strings.Replace(strings.TrimPrefix(ref.Owner, "."), "/", ".", -1) + "." + ref.Heater
+	if start.IsZero() {
+		return fmt.Sprintf("%s.%s@preheatbot", kind, heater)
+	}
+	return fmt.Sprintf("%s.%d.%s@preheatbot", kind, start.Unix(), heater)
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/mhrivnak/preheatbot/pkg/metrics"
+)
+
+var (
+	requests = metrics.NewCounter("preheatbot_api_requests_total",
+		"API requests by route, method and status.",
+		"route", "method", "status")
+	requestDuration = metrics.NewHistogram("preheatbot_api_request_duration_seconds",
+		"How long API requests took by route and method, including time spent waiting in long polls.",
+		metrics.DefaultBuckets, "route", "method")
+)
+
+// statusRecorder remembers the status of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// instrument counts and times requests by the template of the route they
+// matched, which keeps the number of series small.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+		requests.Inc(route, r.Method, strconv.Itoa(recorder.status))
+		requestDuration.Observe(time.Since(start).Seconds(), route, r.Method)
+	})
+}
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	server, _ := newTestServer(t)
+	get(t, server.URL+"/v1/users/alice/heaters/plane", nil)
+	get(t, server.URL+"/v2/users/alice/heaters/boat", nil)
+
+	resp, body := get(t, server.URL+"/metrics", nil)
+	if resp.StatusCode != 200 || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	for _, line := range []string{
+		`preheatbot_api_requests_total{route="/v1/users/{username}/heaters/{heater}",method="GET",status="200"} `,
+		`preheatbot_api_requests_total{route="/v2/users/{username}/heaters/{heater}",method="GET",status="404"} `,
+		`preheatbot_api_request_duration_seconds_count{route="/v1/users/{username}/heaters/{heater}",method="GET"} `,
+	} {
+		if !strings.Contains(string(body), "\n"+line) {
+			t.Errorf("missing %s in\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,640 @@
+package api
+
+import (
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OpenAPIHandler responds with the OpenAPI 3 description of the API.
+func (a *API) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write([]byte(openAPISpec))
+	if err != nil {
+		log.WithError(err).Error("error writing openapi spec")
+	}
+}
+
+// openAPISpec describes every route registered by New. Keep it up to date
+// when adding routes; a test checks that none is missing.
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "preheatbot",
+    "description": "Lets devices attached to engine preheaters follow the state that users set through the Telegram bot, report telemetry, and fetch what the bot has learned. Heaters belong either to a user or to a group; each operation on a heater is available under both /v1/users/{username} and /v1/groups/{group}.",
+    "version": "1"
+  },
+  "servers": [
+    {"url": "https://preheatbot.hrivnak.org/api"}
+  ],
+  "paths": {
+    "/v1/users/{username}/heaters/{heater}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/username"},
+        {"$ref": "#/components/parameters/heater"}
+      ],
+      "get": {
+        "operationId": "getHeater",
+        "summary": "Get a heater's state, optionally waiting for it to change",
+        "parameters": [
+          {"$ref": "#/components/parameters/longpoll"},
+          {"$ref": "#/components/parameters/version"},
+          {"$ref": "#/components/parameters/ifNoneMatch"},
+          {"$ref": "#/components/parameters/ifModifiedSince"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Record"},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "500": {"$ref": "#/components/responses/InternalError"}
+        }
+      }
+    },
+    "/v1/groups/{group}/heaters/{heater}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/group"},
+        {"$ref": "#/components/parameters/heater"}
+      ],
+      "get": {
+        "operationId": "getGroupHeater",
+        "summary": "Get a group heater's state, optionally waiting for it to change",
+        "parameters": [
+          {"$ref": "#/components/parameters/longpoll"},
+          {"$ref": "#/components/parameters/version"},
+          {"$ref": "#/components/parameters/ifNoneMatch"},
+          {"$ref": "#/components/parameters/ifModifiedSince"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Record"},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "500": {"$ref": "#/components/responses/InternalError"}
+        }
+      }
+    },
+    "/v1/users/{username}/heaters/{heater}/telemetry": {
+      "parameters": [
+        {"$ref": "#/components/parameters/username"},
+        {"$ref": "#/components/parameters/heater"}
+      ],
+      "post": {
+        "operationId": "postTelemetry",
+        "summary": "Report readings from the heater's device",
+        "security": [{"deviceToken": []}],
+        "requestBody": {"$ref": "#/components/requestBodies/TelemetryBatch"},
+        "responses": {
+          "204": {"description": "The samples were stored."},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "500": {"$ref": "#/components/responses/InternalError"}
+        }
+      }
+    },
+    "/v1/groups/{group}/heaters/{heater}/telemetry": {
+      "parameters": [
+        {"$ref": "#/components/parameters/group"},
+        {"$ref": "#/components/parameters/heater"}
+      ],
+      "post": {
+        "operationId": "postGroupTelemetry",
+        "summary": "Report readings from a group heater's device",
+        "security": [{"deviceToken": []}],
+        "requestBody": {"$ref": "#/components/requestBodies/TelemetryBatch"},
+        "responses": {
+          "204": {"description": "The samples were stored."},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "500": {"$ref": "#/components/responses/InternalError"}
+        }
+      }
+    },
+    "/v1/users/{username}/heaters/{heater}/preheat": {
+      "parameters": [
+        {"$ref": "#/components/parameters/username"},
+        {"$ref": "#/components/parameters/heater"}
+      ],
+      "get": {
+        "operationId": "getPreheatStats",
+        "summary": "Get what has been learned about how long the heater takes to warm the engine",
+        "responses": {
+          "200": {"$ref": "#/components/responses/PreheatStats"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "500": {"$ref": "#/components/responses/InternalError"}
+        }
+      }
+    },
+    "/v1/groups/{group}/heaters/{heater}/preheat": {
+      "parameters": [
+        {"$ref": "#/components/parameters/group"},
+        {"$ref": "#/components/parameters/heater"}
+      ],
+      "get": {
+        "operationId": "getGroupPreheatStats",
+        "summary": "Get what has been learned about how long a group heater takes to warm the engine",
+        "responses": {
+          "200": {"$ref": "#/components/responses/PreheatStats"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "500": {"$ref": "#/components/responses/InternalError"}
+        }
+      }
+    },
+    "/v1/users/{username}/calendar.ics": {
+      "parameters": [
+        {"$ref": "#/components/parameters/username"}
+      ],
+      "get": {
+        "operationId": "getCalendarFeed",
+        "summary": "Get an iCalendar feed of when the user's heaters were and will be on",
+        "security": [{"feedToken": []}],
+        "responses": {
+          "200": {
+            "description": "The feed.",
+            "content": {"text/calendar": {"schema": {"type": "string"}}}
+          },
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "500": {"$ref": "#/components/responses/InternalError"}
+        }
+      }
+    },
+    "/v1/users/{username}/usage": {
+      "parameters": [
+        {"$ref": "#/components/parameters/username"}
+      ],
+      "get": {
+        "operationId": "getUsage",
+        "summary": "Get a month's energy usage of the user's heaters",
+        "security": [{"feedToken": []}],
+        "parameters": [
+          {
+            "name": "month",
+            "in": "query",
+            "description": "The month in the user's time zone, such as 2021-01, january or jan. Defaults to the current month.",
+            "schema": {"type": "string"}
+          },
+          {
+            "name": "format",
+            "in": "query",
+            "schema": {"type": "string", "enum": ["json", "csv"], "default": "json"}
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "The usage report, with a CSV row per heater and user who turned it on.",
+            "content": {
+              "application/json": {"schema": {"$ref": "#/components/schemas/UsageReport"}},
+              "text/csv": {"schema": {"type": "string"}}
+            }
+          },
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "500": {"$ref": "#/components/responses/InternalError"}
+        }
+      }
+    },
+    "/v1/users/{username}/shortcuts/{id}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/username"},
+        {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+        {
+          "name": "sig",
+          "in": "query",
+          "required": true,
+          "description": "Hex encoded HMAC-SHA256, keyed with the shortcut's secret, of the ID, a period and the expires parameter, or 0 if there is none.",
+          "schema": {"type": "string"}
+        },
+        {
+          "name": "expires",
+          "in": "query",
+          "description": "Unix time after which the link stops working.",
+          "schema": {"type": "integer", "format": "int64"}
+        }
+      ],
+      "get": {
+        "operationId": "runShortcut",
+        "summary": "Run a shortcut, for links opened from an NFC tag",
+        "responses": {
+          "200": {
+            "description": "What the shortcut did.",
+            "content": {"text/plain": {"schema": {"type": "string"}}}
+          },
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "500": {"$ref": "#/components/responses/InternalError"}
+        }
+      },
+      "post": {
+        "operationId": "postShortcut",
+        "summary": "Run a shortcut",
+        "responses": {
+          "200": {
+            "description": "What the shortcut did.",
+            "content": {"text/plain": {"schema": {"type": "string"}}}
+          },
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "500": {"$ref": "#/components/responses/InternalError"}
+        }
+      }
+    },
+    "/v2/users/{username}/heaters": {
+      "parameters": [
+        {"$ref": "#/components/parameters/username"}
+      ],
+      "get": {
+        "operationId": "listHeatersV2",
+        "summary": "List the heaters a user can see: their own, their groups' and those they were invited to",
+        "security": [{"feedToken": []}, {"feedBearer": []}],
+        "responses": {
+          "200": {
+            "description": "The heaters.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/HeaterList"}}}
+          },
+          "401": {"$ref": "#/components/responses/ErrorV2"},
+          "404": {"$ref": "#/components/responses/ErrorV2"},
+          "500": {"$ref": "#/components/responses/ErrorV2"}
+        }
+      }
+    },
+    "/v2/users/{username}/heaters/{heater}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/username"},
+        {"$ref": "#/components/parameters/heater"}
+      ],
+      "get": {
+        "operationId": "getHeaterV2",
+        "summary": "Get a heater, optionally waiting for it to change",
+        "parameters": [
+          {"$ref": "#/components/parameters/longpoll"},
+          {"$ref": "#/components/parameters/version"},
+          {"$ref": "#/components/parameters/ifNoneMatch"},
+          {"$ref": "#/components/parameters/ifModifiedSince"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/HeaterV2"},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/ErrorV2"},
+          "404": {"$ref": "#/components/responses/ErrorV2"},
+          "500": {"$ref": "#/components/responses/ErrorV2"}
+        }
+      }
+    },
+    "/v2/groups/{group}/heaters/{heater}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/group"},
+        {"$ref": "#/components/parameters/heater"}
+      ],
+      "get": {
+        "operationId": "getGroupHeaterV2",
+        "summary": "Get a group heater, optionally waiting for it to change",
+        "parameters": [
+          {"$ref": "#/components/parameters/longpoll"},
+          {"$ref": "#/components/parameters/version"},
+          {"$ref": "#/components/parameters/ifNoneMatch"},
+          {"$ref": "#/components/parameters/ifModifiedSince"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/HeaterV2"},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/ErrorV2"},
+          "404": {"$ref": "#/components/responses/ErrorV2"},
+          "500": {"$ref": "#/components/responses/ErrorV2"}
+        }
+      }
+    },
+    "/metrics": {
+      "get": {
+        "operationId": "getMetrics",
+        "summary": "Get metrics in the Prometheus text exposition format",
+        "description": "If the server has a metrics token, it must be sent as a bearer token.",
+        "responses": {
+          "200": {
+            "description": "The metrics.",
+            "content": {"text/plain": {"schema": {"type": "string"}}}
+          },
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/healthz": {
+      "get": {
+        "operationId": "getHealth",
+        "summary": "Report whether the server is alive",
+        "description": "Unhealthy if the data directory can't be read or written, or a background loop such as the Telegram poller or the scheduler has stopped.",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Health"},
+          "503": {"$ref": "#/components/responses/Health"}
+        }
+      }
+    },
+    "/readyz": {
+      "get": {
+        "operationId": "getReadiness",
+        "summary": "Report whether the server is ready for traffic",
+        "description": "Like /healthz, but also unhealthy if the Telegram poller or the scheduler hasn't succeeded recently.",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Health"},
+          "503": {"$ref": "#/components/responses/Health"}
+        }
+      }
+    },
+    "/v1/openapi.json": {
+      "get": {
+        "operationId": "getOpenAPI",
+        "summary": "Get this document",
+        "responses": {
+          "200": {
+            "description": "The OpenAPI document.",
+            "content": {"application/json": {"schema": {"type": "object"}}}
+          }
+        }
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "username": {"name": "username", "in": "path", "required": true, "schema": {"type": "string"}},
+      "group": {"name": "group", "in": "path", "required": true, "schema": {"type": "string", "pattern": "^[A-Za-z0-9_-]+$"}},
+      "heater": {"name": "heater", "in": "path", "required": true, "schema": {"type": "string"}},
+      "longpoll": {
+        "name": "longpoll",
+        "in": "query",
+        "description": "If set to any value and version, or without it the version in If-None-Match, matches the current version, wait for the next version before responding.",
+        "schema": {"type": "string"}
+      },
+      "version": {
+        "name": "version",
+        "in": "query",
+        "description": "The version the client already has.",
+        "schema": {"type": "integer"}
+      },
+      "ifNoneMatch": {
+        "name": "If-None-Match",
+        "in": "header",
+        "description": "The ETag of the representation the client has. If it is current, the response is 304, unless longpoll is set, in which case the server waits for the next version.",
+        "schema": {"type": "string"}
+      },
+      "ifModifiedSince": {
+        "name": "If-Modified-Since",
+        "in": "header",
+        "description": "The Last-Modified time of the representation the client has. Ignored if If-None-Match is set.",
+        "schema": {"type": "string"}
+      }
+    },
+    "securitySchemes": {
+      "deviceToken": {
+        "type": "http",
+        "scheme": "bearer",
+        "description": "The heater's device token, from the bot's /devicetoken command."
+      },
+      "feedToken": {
+        "type": "apiKey",
+        "in": "query",
+        "name": "token",
+        "description": "The user's feed token, from the bot's /feed command."
+      },
+      "feedBearer": {
+        "type": "http",
+        "scheme": "bearer",
+        "description": "The user's feed token, sent as a bearer token."
+      }
+    },
+    "headers": {
+      "ETag": {
+        "description": "Identifies the representation. It is the record's version, quoted, with the expiry appended in /v2.",
+        "schema": {"type": "string"}
+      },
+      "LastModified": {
+        "description": "When the heater was last written.",
+        "schema": {"type": "string"}
+      },
+      "RequestID": {
+        "description": "Identifies the request in the server's logs. It echoes the request's X-Request-ID if it had one.",
+        "schema": {"type": "string"}
+      }
+    },
+    "requestBodies": {
+      "TelemetryBatch": {
+        "required": true,
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TelemetryBatch"}}}
+      }
+    },
+    "responses": {
+      "Record": {
+        "description": "The heater's current state.",
+        "headers": {
+          "ETag": {"$ref": "#/components/headers/ETag"},
+          "Last-Modified": {"$ref": "#/components/headers/LastModified"}
+        },
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Record"}}}
+      },
+      "PreheatStats": {
+        "description": "The observations and the fit made from them.",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PreheatStats"}}}
+      },
+      "BadRequest": {
+        "description": "A parameter or the body is not valid.",
+        "content": {"text/plain": {"schema": {"type": "string"}}}
+      },
+      "Unauthorized": {
+        "description": "The token is missing or wrong.",
+        "content": {"text/plain": {"schema": {"type": "string"}}}
+      },
+      "Forbidden": {
+        "description": "The signature is wrong, the link has expired, or its maker may no longer control the heater.",
+        "content": {"text/plain": {"schema": {"type": "string"}}}
+      },
+      "Health": {
+        "description": "The status of each component. The status is 503 if any is unhealthy.",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/HealthReport"}}}
+      },
+      "NotModified": {
+        "description": "The client's copy is current. The body is empty.",
+        "headers": {
+          "ETag": {"$ref": "#/components/headers/ETag"},
+          "Last-Modified": {"$ref": "#/components/headers/LastModified"}
+        }
+      },
+      "NotFound": {"description": "The heater, user or group does not exist. The body may be empty."},
+      "HeaterV2": {
+        "description": "The heater.",
+        "headers": {
+          "ETag": {"$ref": "#/components/headers/ETag"},
+          "Last-Modified": {"$ref": "#/components/headers/LastModified"},
+          "X-Request-ID": {"$ref": "#/components/headers/RequestID"}
+        },
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Heater"}}}
+      },
+      "ErrorV2": {
+        "description": "The request failed. The error code says why.",
+        "headers": {"X-Request-ID": {"$ref": "#/components/headers/RequestID"}},
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      },
+      "InternalError": {"description": "The server failed. The body may be empty."}
+    },
+    "schemas": {
+      "HealthReport": {
+        "type": "object",
+        "required": ["status", "components"],
+        "properties": {
+          "status": {"type": "string", "enum": ["ok", "unhealthy"]},
+          "components": {
+            "type": "object",
+            "description": "Keyed by component, such as datadir, telegram or scheduler.",
+            "additionalProperties": {"$ref": "#/components/schemas/HealthComponent"}
+          }
+        }
+      },
+      "HealthComponent": {
+        "type": "object",
+        "required": ["status"],
+        "properties": {
+          "status": {"type": "string", "enum": ["ok", "unhealthy"]},
+          "message": {"type": "string", "description": "Why the component is unhealthy, or its last error."},
+          "lastSuccess": {"type": "string", "format": "date-time", "description": "When a background loop last did its work, such as the Telegram poller's last successful poll."}
+        }
+      },
+      "Record": {
+        "type": "object",
+        "required": ["value", "version"],
+        "properties": {
+          "value": {"type": "string", "enum": ["on", "off"]},
+          "version": {"type": "integer", "description": "Increases each time the value is set."}
+        }
+      },
+      "Heater": {
+        "type": "object",
+        "required": ["name", "displayName", "value", "version"],
+        "properties": {
+          "owner": {"type": "string", "description": "The user who owns the heater. Absent for group heaters."},
+          "group": {"type": "string", "description": "The group that owns the heater. Absent for users' heaters."},
+          "name": {"type": "string"},
+          "displayName": {"type": "string", "description": "How the bot shows the heater to the listing user, or to its owner."},
+          "value": {"type": "string", "enum": ["on", "off"]},
+          "version": {"type": "integer"},
+          "updatedAt": {"type": "string", "format": "date-time"},
+          "updatedBy": {"type": "string", "description": "The user or subsystem that made the last change."},
+          "expiresAt": {"type": "string", "format": "date-time", "description": "When a heater that is on is scheduled to be turned off."},
+          "role": {"type": "string", "enum": ["owner", "operator", "viewer"], "description": "The listing user's role. Only set in lists."}
+        }
+      },
+      "HeaterList": {
+        "type": "object",
+        "required": ["heaters"],
+        "properties": {
+          "heaters": {"type": "array", "items": {"$ref": "#/components/schemas/Heater"}}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {
+          "error": {
+            "type": "object",
+            "required": ["code", "message", "requestId"],
+            "properties": {
+              "code": {"type": "string", "enum": ["bad_request", "unauthorized", "not_found", "method_not_allowed", "internal"]},
+              "message": {"type": "string"},
+              "requestId": {"type": "string"}
+            }
+          }
+        }
+      },
+      "Sample": {
+        "type": "object",
+        "required": ["time", "value"],
+        "properties": {
+          "time": {"type": "string", "format": "date-time"},
+          "value": {"type": "number"}
+        }
+      },
+      "TelemetryBatch": {
+        "type": "object",
+        "required": ["metrics"],
+        "properties": {
+          "metrics": {
+            "type": "object",
+            "description": "Samples by metric name, such as ambient_temp, engine_temp or current. Temperatures are in degrees Celsius and current in amps.",
+            "additionalProperties": {"type": "array", "items": {"$ref": "#/components/schemas/Sample"}}
+          }
+        }
+      },
+      "Observation": {
+        "type": "object",
+        "properties": {
+          "start": {"type": "string", "format": "date-time"},
+          "ambient": {"type": "number"},
+          "engine": {"type": "number"},
+          "target": {"type": "number"},
+          "duration": {"type": "string", "description": "A Go duration such as 45m0s."}
+        }
+      },
+      "Fit": {
+        "type": "object",
+        "properties": {
+          "target": {"type": "number"},
+          "observations": {"type": "integer"},
+          "intercept": {"type": "number", "description": "Minutes at 0°C ambient."},
+          "slope": {"type": "number", "description": "Change in minutes per degree of ambient temperature."},
+          "rSquared": {"type": "number"},
+          "minAmbient": {"type": "number"},
+          "maxAmbient": {"type": "number"}
+        }
+      },
+      "CurvePoint": {
+        "type": "object",
+        "properties": {
+          "ambient": {"type": "number"},
+          "minutesPerDegree": {"type": "number"}
+        }
+      },
+      "PreheatStats": {
+        "type": "object",
+        "required": ["target", "observations", "usedForPlanning"],
+        "properties": {
+          "target": {"type": "number"},
+          "observations": {"type": "array", "items": {"$ref": "#/components/schemas/Observation"}},
+          "fit": {"$ref": "#/components/schemas/Fit"},
+          "curve": {"type": "array", "items": {"$ref": "#/components/schemas/CurvePoint"}},
+          "usedForPlanning": {"type": "boolean"}
+        }
+      },
+      "UserUsage": {
+        "type": "object",
+        "properties": {
+          "username": {"type": "string"},
+          "hours": {"type": "number"},
+          "kWh": {"type": "number"},
+          "cost": {"type": "number"}
+        }
+      },
+      "HeaterUsage": {
+        "type": "object",
+        "properties": {
+          "owner": {"type": "string"},
+          "heater": {"type": "string"},
+          "watts": {"type": "number"},
+          "priced": {"type": "boolean"},
+          "currency": {"type": "string"},
+          "hours": {"type": "number"},
+          "kWh": {"type": "number"},
+          "cost": {"type": "number"},
+          "byUser": {"type": "array", "items": {"$ref": "#/components/schemas/UserUsage"}}
+        }
+      },
+      "UsageReport": {
+        "type": "object",
+        "properties": {
+          "from": {"type": "string", "format": "date-time"},
+          "to": {"type": "string", "format": "date-time"},
+          "heaters": {"type": "array", "items": {"$ref": "#/components/schemas/HeaterUsage"}}
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+)
+
+type openAPIDocument struct {
+	Paths map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+func parseSpec(t *testing.T) (openAPIDocument, map[string]interface{}) {
+	doc := openAPIDocument{}
+	err := json.Unmarshal([]byte(openAPISpec), &doc)
+	if err != nil {
+		t.Fatalf("spec is not valid JSON: %s", err)
+	}
+	raw := make(map[string]interface{})
+	err = json.Unmarshal([]byte(openAPISpec), &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc, raw
+}
+
+// routes returns the methods of each path template registered by New.
+func routes(t *testing.T) map[string][]string {
+	server := New(nil, nil, &heaterstore.Store{}, &telemetry.Store{}, nil, "")
+	router, ok := server.Handler.(*mux.Router)
+	if !ok {
+		t.Fatalf("handler is a %T, not a router", server.Handler)
+	}
+	found := make(map[string][]string)
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		// a subrouter's prefix is not itself a route
+		if route.GetHandler() == nil {
+			return nil
+		}
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			t.Errorf("route %s does not restrict methods", path)
+			return nil
+		}
+		found[path] = append(found[path], methods...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestOpenAPIDescribesEveryRoute(t *testing.T) {
+	doc, _ := parseSpec(t)
+	found := routes(t)
+	if len(found) == 0 {
+		t.Fatal("no routes found")
+	}
+	for path, methods := range found {
+		for _, method := range methods {
+			if _, ok := doc.Paths[path][strings.ToLower(method)]; !ok {
+				t.Errorf("%s %s is not in the spec", method, path)
+			}
+		}
+	}
+	for path, operations := range doc.Paths {
+		for method := range operations {
+			if method == "parameters" {
+				continue
+			}
+			if !contains(found[path], strings.ToUpper(method)) {
+				t.Errorf("the spec describes %s %s, which is not a route", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+func TestOpenAPIReferencesResolve(t *testing.T) {
+	_, raw := parseSpec(t)
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok && !resolves(raw, ref) {
+				t.Errorf("%s does not resolve", ref)
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(raw)
+}
+
+func resolves(doc map[string]interface{}, ref string) bool {
+	if !strings.HasPrefix(ref, "#/") {
+		return false
+	}
+	var v interface{} = doc
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		v, ok = m[part]
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	server := httptest.NewServer(New(nil, nil, &heaterstore.Store{}, &telemetry.Store{}, nil, "").Handler)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/v1/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != openAPISpec {
+		t.Error("served document differs from the spec")
+	}
+}
+
+func contains(s []string, v string) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
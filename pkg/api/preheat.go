@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/preheat"
+)
+
+// PreheatStats describes what has been learned about how long a heater takes
+// to warm its engine.
+type PreheatStats struct {
+	// Target is the engine temperature, in degrees Celsius, that the fit
+	// estimates the time to reach.
+	Target       float64                   `json:"target"`
+	Observations []heaterstore.Observation `json:"observations"`
+	// Fit and Curve are omitted if there are no observations.
+	Fit   *preheat.Fit             `json:"fit,omitempty"`
+	Curve []heaterstore.CurvePoint `json:"curve,omitempty"`
+	// UsedForPlanning is true once there are enough observations for the
+	// fit to be used to plan preheats.
+	UsedForPlanning bool `json:"usedForPlanning"`
+}
+
+// PreheatStatsHandler responds with the heater's learned preheat curve.
+func (a *API) PreheatStatsHandler(w http.ResponseWriter, r *http.Request) {
+	owner, heater, ok := heaterFromVars(mux.Vars(r))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_, err := a.store.Get(owner, heater)
+	if err != nil {
+		if a.store.IsNotExist(err) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		log.WithError(err).Error("error reading current value")
+		return
+	}
+
+	resp, err := NewPreheatStats(a.store, a.planner, heaterstore.HeaterRef{Owner: owner, Heater: heater})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.WithError(err).Error("error reading preheat stats")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.WithError(err).Error("error serializing preheat stats")
+	}
+}
+
+// NewPreheatStats returns what has been learned about the heater. It is
+// shared with other protocols that serve the same resource.
+func NewPreheatStats(store *heaterstore.Store, planner *preheat.Planner, ref heaterstore.HeaterRef) (PreheatStats, error) {
+	stats, err := store.GetPreheatStats(ref.Owner, ref.Heater)
+	if err != nil {
+		return PreheatStats{}, err
+	}
+	fit, used, err := planner.Learned(ref)
+	if err != nil {
+		return PreheatStats{}, err
+	}
+	resp := PreheatStats{
+		Target:          fit.Target,
+		Observations:    stats.Observations,
+		UsedForPlanning: used,
+	}
+	if resp.Observations == nil {
+		resp.Observations = []heaterstore.Observation{}
+	}
+	if fit.Observations > 0 {
+		resp.Fit = &fit
+		resp.Curve = fit.Model().Curve
+	}
+	return resp, nil
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mhrivnak/preheatbot/pkg/shortcut"
+)
+
+// ShortcutHandler runs a shortcut if the request is signed for it. GET is
+// accepted as well as POST so that the URL works when opened from an NFC tag.
+func (a *API) ShortcutHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	username := vars["username"]
+	s, ok, err := a.store.GetShortcut(username, vars["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.WithError(err).Error("error reading shortcut")
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "no such shortcut")
+		return
+	}
+	now := time.Now()
+	err = shortcut.Verify(s, r.URL.Query(), now)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	message, err := shortcut.Run(a.store, a.controller, username, s, now)
+	if err == shortcut.ErrNotAllowed {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "error running shortcut")
+		log.WithError(err).Error("error running shortcut")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, message)
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+)
+
+// maxTelemetryBody limits the size of a single telemetry upload.
+const maxTelemetryBody = 1 << 20
+
+// TelemetryBatch is the body of a telemetry upload. It maps each metric name
+// to the samples of that metric.
+type TelemetryBatch struct {
+	Metrics map[string][]telemetry.Sample `json:"metrics"`
+}
+
+// Validate returns an error if any metric name or sample in the batch is not
+// valid, so that a batch can be rejected before any of it is stored.
+func (b TelemetryBatch) Validate() error {
+	metrics := make([]string, 0, len(b.Metrics))
+	for metric := range b.Metrics {
+		metrics = append(metrics, metric)
+	}
+	// report the same error each time for the same batch
+	sort.Strings(metrics)
+	for _, metric := range metrics {
+		err := telemetry.Validate(metric, b.Metrics[metric])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TelemetryHandler accepts a batch of samples from the device attached to a
+// heater. The device must authenticate with the heater's device token.
+func (a *API) TelemetryHandler(w http.ResponseWriter, r *http.Request) {
+	owner, heater, ok := heaterFromVars(mux.Vars(r))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !a.authorizeDevice(w, r, owner, heater) {
+		return
+	}
+
+	batch := TelemetryBatch{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTelemetryBody)).Decode(&batch)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "error parsing telemetry")
+		return
+	}
+	err = batch.Validate()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	for metric, samples := range batch.Metrics {
+		err = a.telemetry.Append(owner, heater, metric, samples)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error storing %s", metric)
+			log.WithError(err).Errorf("error storing telemetry for %s/%s", owner, heater)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorizeDevice checks that the request carries the heater's device token
+// as a bearer token, and then that the heater exists. If not, it writes an
+// error response and returns false. A heater that doesn't exist has no token,
+// so the response doesn't reveal which heaters exist.
+func (a *API) authorizeDevice(w http.ResponseWriter, r *http.Request, owner, heater string) bool {
+	config, err := a.store.GetConfig(owner, heater)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.WithError(err).Error("error reading heater config")
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if config.DeviceToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(config.DeviceToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "invalid device token")
+		return false
+	}
+	_, err = a.store.Get(owner, heater)
+	if err != nil {
+		if a.store.IsNotExist(err) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.WithError(err).Error("error reading current value")
+		}
+		return false
+	}
+	return true
+}
+
+// heaterFromVars returns the owner namespace and heater named by the route
+// variables of either the user or group form of a heater URL.
+func heaterFromVars(vars map[string]string) (string, string, bool) {
+	if group, ok := vars["group"]; ok {
+		if !heaterstore.ValidName(group) {
+			return "", "", false
+		}
+		return heaterstore.GroupNamespace(group), vars["heater"], true
+	}
+	if !heaterstore.ValidName(vars["username"]) {
+		return "", "", false
+	}
+	return vars["username"], vars["heater"], true
+}
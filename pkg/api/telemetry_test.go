@@ -0,0 +1,96 @@
+package api
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+)
+
+func postTelemetry(t *testing.T, url, token, body string) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestTelemetryAuthentication(t *testing.T) {
+	server, store := newTestServer(t)
+	err := store.SetConfig("alice", "plane", heaterstore.HeaterConfig{DeviceToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a token left behind by a heater that was removed
+	err = store.SetConfig("alice", "boat", heaterstore.HeaterConfig{DeviceToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"metrics":{"engine_temp":[{"time":"2020-12-29T16:29:41Z","value":-3.5}]}}`
+	for _, tc := range []struct {
+		path   string
+		token  string
+		status int
+	}{
+		{"/v1/users/alice/heaters/plane", "secret", http.StatusNoContent},
+		{"/v1/users/alice/heaters/plane", "wrong", http.StatusUnauthorized},
+		{"/v1/users/alice/heaters/plane", "", http.StatusUnauthorized},
+		// heaters that don't exist look the same as a wrong token
+		{"/v1/users/alice/heaters/glider", "secret", http.StatusUnauthorized},
+		{"/v1/users/bob/heaters/plane", "secret", http.StatusUnauthorized},
+		{"/v1/groups/club/heaters/plane", "secret", http.StatusUnauthorized},
+		{"/v1/users/alice/heaters/boat", "secret", http.StatusNotFound},
+	} {
+		resp := postTelemetry(t, server.URL+tc.path+"/telemetry", tc.token, body)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s with %q: got %d, want %d", tc.path, tc.token, resp.StatusCode, tc.status)
+		}
+	}
+}
+
+func TestTelemetryBatchIsAllOrNothing(t *testing.T) {
+	server, store := newTestServer(t)
+	err := store.SetConfig("alice", "plane", heaterstore.HeaterConfig{DeviceToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := server.URL + "/v1/users/alice/heaters/plane/telemetry"
+	good := `"ambient_temp":[{"time":"2020-12-29T16:29:41Z","value":-10}]`
+	for _, bad := range []string{
+		`"engine_temp":[{"time":"2020-12-29T16:29:41Z","value":-3.5},{"value":-3}]`,
+		`"engine temp":[{"time":"2020-12-29T16:29:41Z","value":-3.5}]`,
+	} {
+		// the good metric sorts before and after the bad ones
+		for _, body := range []string{`{"metrics":{` + good + `,` + bad + `}}`, `{"metrics":{` + bad + `,` + good + `}}`} {
+			resp := postTelemetry(t, url, "secret", body)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("%s: got %d", body, resp.StatusCode)
+			}
+		}
+	}
+	ts := &telemetry.Store{Dir: filepath.Join(store.Dir, telemetry.Dirname)}
+	metrics, err := ts.Metrics("alice", "plane")
+	if err != nil || len(metrics) != 0 {
+		t.Errorf("expected nothing to be stored, got %v (%v)", metrics, err)
+	}
+
+	resp := postTelemetry(t, url, "secret", `{"metrics":{`+good+`}}`)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("got %d", resp.StatusCode)
+	}
+	metrics, err = ts.Metrics("alice", "plane")
+	if err != nil || len(metrics) != 1 {
+		t.Errorf("got %v (%v)", metrics, err)
+	}
+}
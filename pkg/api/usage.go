@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mhrivnak/preheatbot/pkg/usage"
+)
+
+// UsageHandler responds with a month's energy usage of every heater the user
+// can see, as JSON or, with "format=csv", as CSV with a row per heater and
+// user who turned it on. The month is given as "month=2021-01" in the user's
+// time zone and defaults to the current one. Like the calendar feed, the
+// request must carry the user's feed token.
+func (a *API) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	profile, ok := a.checkFeedToken(w, r, username)
+	if !ok {
+		return
+	}
+	loc := profile.Location()
+	now := time.Now()
+	month, err := usage.ParseMonth(r.URL.Query().Get("month"), now, loc)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	from, to := usage.Month(month, loc)
+	report, err := a.usage.Report(username, from, to, now, loc)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.WithError(err).Error("error computing usage")
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(report)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"usage-%s.csv\"", from.Format("2006-01")))
+		w.WriteHeader(http.StatusOK)
+		err = writeUsageCSV(w, report)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "format must be json or csv")
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("error writing usage report")
+	}
+}
+
+func writeUsageCSV(w http.ResponseWriter, report usage.Report) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"month", "owner", "heater", "user", "hours", "kwh", "cost", "currency"})
+	month := report.From.Format("2006-01")
+	format := func(f float64) string { return strconv.FormatFloat(f, 'f', 3, 64) }
+	for _, heater := range report.Heaters {
+		for _, u := range heater.ByUser {
+			cost := ""
+			if heater.Priced {
+				cost = strconv.FormatFloat(u.Cost, 'f', 2, 64)
+			}
+			out.Write([]string{month, heater.Owner, heater.Heater, u.Username,
+				format(u.Hours), format(u.KWh), cost, heater.Currency})
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
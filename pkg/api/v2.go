@@ -0,0 +1,266 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+)
+
+// RequestIDHeader carries the ID of a /v2 request. A client may set it to
+// correlate its logs with the server's; otherwise the server picks one.
+const RequestIDHeader = "X-Request-ID"
+
+// Error codes returned by /v2.
+const (
+	CodeBadRequest       = "bad_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeInternal         = "internal"
+)
+
+// Error is the body of every /v2 response that is not a success.
+type Error struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	// Code is one of the Code constants, and is what clients should check.
+	Code string `json:"code"`
+	// Message describes the problem for people.
+	Message   string `json:"message"`
+	RequestID string `json:"requestId"`
+}
+
+// Heater is the /v2 representation of a heater.
+type Heater struct {
+	// Exactly one of Owner and Group is set.
+	Owner string `json:"owner,omitempty"`
+	Group string `json:"group,omitempty"`
+	Name  string `json:"name"`
+	// DisplayName is how the bot shows the heater to the user it is listed
+	// for, or to its owner.
+	DisplayName string `json:"displayName"`
+	Value       string `json:"value"`
+	Version     int    `json:"version"`
+	// UpdatedAt and UpdatedBy describe the last change, if it is known.
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+	UpdatedBy string     `json:"updatedBy,omitempty"`
+	// ExpiresAt is when a heater that is on is scheduled to be turned off,
+	// if it is.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Role is the listing user's role for the heater. It is only set in
+	// lists.
+	Role heaterstore.Role `json:"role,omitempty"`
+}
+
+// HeaterList is the body of a list of heaters.
+type HeaterList struct {
+	Heaters []Heater `json:"heaters"`
+}
+
+type requestIDKey struct{}
+
+// withRequestID gives each request an ID, which is returned in a header and
+// in any error.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = uuid.New().String()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func requestID(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return uuid.New().String()
+}
+
+// writeError writes a structured error response.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	id := requestID(r)
+	w.Header().Set(RequestIDHeader, id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(Error{ErrorDetail{Code: code, Message: message, RequestID: id}})
+	if err != nil {
+		log.WithError(err).Error("error serializing error")
+	}
+}
+
+// writeInternalError logs err and writes an error response that doesn't
+// reveal it.
+func writeInternalError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	log.WithError(err).WithField("requestID", requestID(r)).Error(message)
+	writeError(w, r, http.StatusInternalServerError, CodeInternal, message)
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.WithError(err).WithField("requestID", requestID(r)).Error("error serializing response")
+	}
+}
+
+// routeV2 registers the /v2 routes on r.
+func (a *API) routeV2(r *mux.Router) {
+	v2 := r.PathPrefix("/v2").Subrouter()
+	v2.Use(withRequestID)
+	// middleware only runs for matched routes, so these need their own
+	v2.NotFoundHandler = withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "no such resource")
+	}))
+	v2.MethodNotAllowedHandler = withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, r.Method+" is not allowed here")
+	}))
+
+	v2.HandleFunc("/users/{username}/heaters", a.HeaterListHandlerV2).Methods("GET")
+	v2.HandleFunc("/users/{username}/heaters/{heater}", a.HeaterHandlerV2).Methods("GET")
+	v2.HandleFunc("/groups/{group}/heaters/{heater}", a.HeaterHandlerV2).Methods("GET")
+}
+
+// HeaterHandlerV2 responds with a heater, optionally waiting for it to change
+// just as the /v1 handler does, and supports the same conditional requests.
+func (a *API) HeaterHandlerV2(w http.ResponseWriter, r *http.Request) {
+	owner, heater, ok := heaterFromVars(mux.Vars(r))
+	if !ok {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "no such group")
+		return
+	}
+	hasVersion := -1
+	if v := r.URL.Query().Get("version"); v != "" {
+		var err error
+		hasVersion, err = strconv.Atoi(v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "version must be an integer")
+			return
+		}
+	}
+
+	record, err := a.store.Get(owner, heater)
+	if err != nil && a.store.IsNotExist(err) {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "no such heater")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, "error reading current value", err)
+		return
+	}
+	record, ok = a.waitForChange(r, owner, heater, record, hasVersion)
+	if !ok {
+		return
+	}
+
+	ref := heaterstore.HeaterRef{Owner: owner, Heater: heater}
+	resource, err := a.heaterV2(ref, record, owner, time.Now())
+	if err != nil {
+		writeInternalError(w, r, "error reading heater", err)
+		return
+	}
+	// expiresAt comes from the schedule, so a change to it is a change too
+	if checkModified(w, r, ETag(resource.Version, resource.ExpiresAt), a.modified(owner, heater, heaterstore.ScheduleFilename)) {
+		return
+	}
+	writeJSON(w, r, resource)
+}
+
+// HeaterListHandlerV2 responds with every heater the user can see. Like the
+// calendar feed, the request must carry the user's feed token, either as the
+// "token" query parameter or as a bearer token.
+func (a *API) HeaterListHandlerV2(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	profile, err := a.store.GetProfile(username)
+	if err != nil {
+		writeInternalError(w, r, "error reading profile", err)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if profile.FeedToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(profile.FeedToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "invalid feed token")
+		return
+	}
+
+	refs, err := a.store.Heaters(username)
+	if err != nil {
+		writeInternalError(w, r, "error listing heaters", err)
+		return
+	}
+	now := time.Now()
+	list := HeaterList{Heaters: []Heater{}}
+	for _, ref := range refs {
+		record, err := a.store.Get(ref.Owner, ref.Heater)
+		if err != nil {
+			writeInternalError(w, r, "error reading current value", err)
+			return
+		}
+		resource, err := a.heaterV2(ref, record, username, now)
+		if err != nil {
+			writeInternalError(w, r, "error reading heater", err)
+			return
+		}
+		resource.Role = ref.Role
+		list.Heaters = append(list.Heaters, resource)
+	}
+	writeJSON(w, r, list)
+}
+
+// heaterV2 builds the representation of a heater as seen by username.
+func (a *API) heaterV2(ref heaterstore.HeaterRef, record heaterstore.Record, username string, now time.Time) (Heater, error) {
+	resource := Heater{
+		Name:        ref.Heater,
+		DisplayName: ref.Name(username),
+		Value:       record.Value,
+		Version:     record.Version,
+	}
+	if group, ok := heaterstore.GroupFromNamespace(ref.Owner); ok {
+		resource.Group = group
+	} else {
+		resource.Owner = ref.Owner
+	}
+
+	change, err := a.store.LastChange(ref.Owner, ref.Heater)
+	if err != nil && !a.store.IsNotExist(err) {
+		return resource, err
+	}
+	// the history may lag the record if it was written by something else
+	if err == nil && change.Version == record.Version {
+		resource.UpdatedAt = &change.Time
+		resource.UpdatedBy = change.By
+	}
+
+	if record.Value == "on" {
+		actions, err := a.store.Schedule(ref.Owner)
+		if err != nil {
+			return resource, err
+		}
+		for _, action := range actions {
+			if action.Heater == ref.Heater && action.Value == "off" && action.At.After(now) {
+				at := action.At
+				resource.ExpiresAt = &at
+				break
+			}
+		}
+	}
+	return resource, nil
+}
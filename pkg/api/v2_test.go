@@ -0,0 +1,193 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+)
+
+// newTestServer serves the API from a temporary store in which alice owns a
+// heater named plane.
+func newTestServer(t *testing.T) (*httptest.Server, *heaterstore.Store) {
+	return newTestServerWith(t, nil)
+}
+
+func newTestServerWith(t *testing.T, subscriber Subscriber) (*httptest.Server, *heaterstore.Store) {
+	dir, err := ioutil.TempDir("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	err = os.MkdirAll(filepath.Join(dir, "alice"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "alice", "plane"), []byte(`{"value":"off","version":1}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &heaterstore.Store{Dir: dir}
+	server := httptest.NewServer(New(subscriber, nil, store, &telemetry.Store{Dir: filepath.Join(dir, telemetry.Dirname)}, nil, "").Handler)
+	t.Cleanup(server.Close)
+	return server, store
+}
+
+func get(t *testing.T, url string, header http.Header) (*http.Response, []byte) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+// TestV1Unchanged pins the bytes that existing devices depend on.
+func TestV1Unchanged(t *testing.T) {
+	server, _ := newTestServer(t)
+	for _, tc := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/v1/users/alice/heaters/plane", http.StatusOK, "{\"value\":\"off\",\"version\":1}\n"},
+		{"/v1/users/alice/heaters/plane?version=x", http.StatusBadRequest, "error parsing version string"},
+		{"/v1/users/alice/heaters/boat", http.StatusNotFound, ""},
+		{"/v1/groups/no.such/heaters/plane", http.StatusNotFound, ""},
+		{"/v1/nothing", http.StatusNotFound, "404 page not found\n"},
+	} {
+		resp, body := get(t, server.URL+tc.path, nil)
+		if resp.StatusCode != tc.status || string(body) != tc.body {
+			t.Errorf("%s: got %d %q, want %d %q", tc.path, resp.StatusCode, body, tc.status, tc.body)
+		}
+	}
+}
+
+func TestV2Heater(t *testing.T) {
+	server, store := newTestServer(t)
+	_, err := store.Set("alice", "plane", "on", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	offAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	_, err = store.ReplaceActions("alice", "plane", "test", []heaterstore.Action{{At: offAt, Value: "off", CreatedBy: "alice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body := get(t, server.URL+"/v2/users/alice/heaters/plane", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %s", resp.StatusCode, body)
+	}
+	heater := Heater{}
+	err = json.Unmarshal(body, &heater)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if heater.Owner != "alice" || heater.Name != "plane" || heater.DisplayName != "plane" || heater.Value != "on" || heater.Version != 2 {
+		t.Errorf("got %+v", heater)
+	}
+	if heater.UpdatedAt == nil || heater.UpdatedBy != "alice" {
+		t.Errorf("expected the last change, got %v by %q", heater.UpdatedAt, heater.UpdatedBy)
+	}
+	if heater.ExpiresAt == nil || !heater.ExpiresAt.Equal(offAt) {
+		t.Errorf("expected to expire at %s, got %v", offAt, heater.ExpiresAt)
+	}
+	if resp.Header.Get(RequestIDHeader) == "" {
+		t.Error("expected a request ID")
+	}
+}
+
+func TestV2Errors(t *testing.T) {
+	server, store := newTestServer(t)
+	err := store.SetProfile("alice", heaterstore.Profile{FeedToken: "feed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{"/v2/users/alice/heaters/plane?version=x", http.StatusBadRequest, CodeBadRequest},
+		{"/v2/users/alice/heaters/boat", http.StatusNotFound, CodeNotFound},
+		{"/v2/groups/no.such/heaters/plane", http.StatusNotFound, CodeNotFound},
+		{"/v2/nothing", http.StatusNotFound, CodeNotFound},
+		{"/v2/users/alice/heaters", http.StatusUnauthorized, CodeUnauthorized},
+		{"/v2/users/alice/heaters?token=wrong", http.StatusUnauthorized, CodeUnauthorized},
+	} {
+		resp, body := get(t, server.URL+tc.path, http.Header{RequestIDHeader: {"abc123"}})
+		e := Error{}
+		err := json.Unmarshal(body, &e)
+		if err != nil {
+			t.Errorf("%s: %s in %q", tc.path, err, body)
+			continue
+		}
+		if resp.StatusCode != tc.status || e.Error.Code != tc.code || e.Error.Message == "" {
+			t.Errorf("%s: got %d %+v, want %d %s", tc.path, resp.StatusCode, e, tc.status, tc.code)
+		}
+		if e.Error.RequestID != "abc123" || resp.Header.Get(RequestIDHeader) != "abc123" {
+			t.Errorf("%s: request ID is %q in the body and %q in the header", tc.path, e.Error.RequestID, resp.Header.Get(RequestIDHeader))
+		}
+	}
+}
+
+func TestV2HeaterList(t *testing.T) {
+	server, store := newTestServer(t)
+	err := store.SetProfile("alice", heaterstore.Profile{FeedToken: "feed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.CreateGroup("club", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(store.Dir, heaterstore.GroupNamespace("club"), "hangar"), []byte(`{"value":"off","version":4}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, header := range []http.Header{nil, {"Authorization": {"Bearer feed"}}} {
+		url := server.URL + "/v2/users/alice/heaters"
+		if header == nil {
+			url += "?token=feed"
+		}
+		resp, body := get(t, url, header)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got %d %s", resp.StatusCode, body)
+		}
+		list := HeaterList{}
+		err = json.Unmarshal(body, &list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Heaters) != 2 {
+			t.Fatalf("got %+v", list)
+		}
+		plane, hangar := list.Heaters[0], list.Heaters[1]
+		if plane.Owner != "alice" || plane.DisplayName != "plane" || plane.Role != heaterstore.RoleOwner || plane.UpdatedAt != nil {
+			t.Errorf("got %+v", plane)
+		}
+		if hangar.Group != "club" || hangar.Owner != "" || hangar.DisplayName != "club/hangar" || hangar.Version != 4 || hangar.Role != heaterstore.RoleOwner {
+			t.Errorf("got %+v", hangar)
+		}
+	}
+}
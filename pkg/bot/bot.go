@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,25 +13,49 @@ import (
 	log "github.com/sirupsen/logrus"
 	tb "gopkg.in/tucnak/telebot.v2"
 
+	"github.com/mhrivnak/preheatbot/pkg/calendar"
 	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/mqtt"
+	"github.com/mhrivnak/preheatbot/pkg/preheat"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+	"github.com/mhrivnak/preheatbot/pkg/usage"
+	"github.com/mhrivnak/preheatbot/pkg/weather"
+	"github.com/mhrivnak/preheatbot/pkg/webhook"
 )
 
 type Bot struct {
 	sync.Mutex
-	tbBot *tb.Bot
-	store *heaterstore.Store
+	tbBot     *tb.Bot
+	store     *heaterstore.Store
+	telemetry *telemetry.Store
+	planner   *preheat.Planner
+	weather   *weather.Service
+	calendar  *calendar.Syncer
+	usage     *usage.Reporter
+	webhooks  *webhook.Dispatcher
+	// mqtt, if set, connects users to their MQTT brokers.
+	mqtt *mqtt.Bridge
+	// listeners are told about every change to a heater.
+	listeners []Listener
+	// publicURL is the address at which the API can be reached, used in
+	// links sent to users.
+	publicURL string
 	// {"<username>/<heaterID>": {"<randomUUID>": <channel>}}
 	// Stores the channel used to tell an API handler that a value has
 	// been set. The UUID is internally used to identify a channel when
 	// the http client disconnects.
 	heaterChanMap map[string]map[string]chan<- heaterstore.Record
+	// poller records the health of the Telegram poller.
+	poller *pollRecorder
 }
 
-func New(token string, store *heaterstore.Store) *Bot {
+func New(token string, store *heaterstore.Store, telemetry *telemetry.Store, weather *weather.Service, calendars *calendar.Syncer, webhooks *webhook.Dispatcher) *Bot {
+	poller := &pollRecorder{next: http.DefaultTransport}
 	b, err := tb.NewBot(tb.Settings{
 		Token:    token,
 		Poller:   &tb.LongPoller{Timeout: 10 * time.Second},
 		Reporter: tbdebug,
+		Client:   &http.Client{Transport: poller},
 	})
 	if err != nil {
 		log.Fatal(err.Error())
@@ -38,14 +64,21 @@ func New(token string, store *heaterstore.Store) *Bot {
 	bot := Bot{
 		tbBot:         b,
 		store:         store,
+		telemetry:     telemetry,
+		planner:       preheat.NewPlanner(store, telemetry),
+		weather:       weather,
+		calendar:      calendars,
+		usage:         usage.New(store),
+		webhooks:      webhooks,
 		heaterChanMap: make(map[string]map[string]chan<- heaterstore.Record),
+		poller:        poller,
 	}
 
 	b.Handle("/hello", func(m *tb.Message) {
-		if m.Private() && bot.store.UserExists(m.Sender.Username) {
-			b.Send(m.Sender, "Hello from the hangar!")
+		if bot.recognize(m) {
+			bot.send(m.Sender, "Hello from the hangar!")
 		} else {
-			b.Send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+			bot.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
 		}
 	})
 
@@ -59,10 +92,60 @@ func New(token string, store *heaterstore.Store) *Bot {
 
 	b.Handle("/status", bot.StatusHandler)
 	b.Handle("status", bot.StatusHandler)
+
+	b.Handle("/group", bot.GroupHandler)
+
+	b.Handle("/start", bot.StartHandler)
+	b.Handle("/invite", bot.InviteHandler)
+	b.Handle("/invites", bot.InvitesHandler)
+	b.Handle(&revokeInviteButton, bot.RevokeInviteCallback)
+
+	b.Handle("/watch", bot.WatchHandler)
+
+	b.Handle("/remind", bot.RemindHandler)
+	b.Handle(&extendButton, bot.ExtendCallback)
+	b.Handle(&offButton, bot.OffCallback)
+	b.Handle(&snoozeButton, bot.SnoozeCallback)
+
+	b.Handle("/temps", bot.TempsHandler)
+	b.Handle("/devicetoken", bot.DeviceTokenHandler)
+
+	b.Handle("/hold", bot.HoldHandler)
+	b.Handle("/timezone", bot.TimezoneHandler)
+
+	b.Handle("/ready", bot.ReadyHandler)
+	b.Handle("/preheat", bot.PreheatHandler)
+	b.Handle("/preheatstats", bot.PreheatStatsHandler)
+	b.Handle("/failure", bot.FailureHandler)
+	b.Handle("/location", bot.LocationHandler)
+	b.Handle("/sun", bot.SunHandler)
+	b.Handle("/weather", bot.WeatherHandler)
+	b.Handle("/flight", bot.FlightHandler)
+	b.Handle(&preheatButton, bot.PreheatCallback)
+	b.Handle("/calendar", bot.CalendarHandler)
+	b.Handle(tb.OnDocument, bot.CalendarFileHandler)
+	b.Handle("/upcoming", bot.UpcomingHandler)
+	b.Handle("/feed", bot.FeedHandler)
+	b.Handle("/usage", bot.UsageHandler)
+	b.Handle("/digest", bot.DigestHandler)
+	b.Handle("/webhook", bot.WebhookHandler)
+	b.Handle("/shortcut", bot.ShortcutHandler)
+	b.Handle("/mqtt", bot.MQTTHandler)
+	bot.registerMetrics()
 	return &bot
 }
 
+// SetPublicURL sets the address at which the API can be reached, such as
+// "https://preheatbot.hrivnak.org/api".
+func (b *Bot) SetPublicURL(url string) {
+	b.publicURL = strings.TrimSuffix(url, "/")
+}
+
 func (b *Bot) Start() {
+	go b.runReminders()
+	go b.runWeatherAdvice()
+	b.poller.setRunning(true)
+	defer b.poller.setRunning(false)
 	b.tbBot.Start()
 }
 
@@ -104,8 +187,47 @@ func (b *Bot) unsubscribe(ctx context.Context, heaterID, chanID string) {
 }
 
 // Publish sends the Record to each channel that corresponds to the specified
-// heater. It then removes each channel from the heaterChanMap.
-func (b *Bot) Publish(username, heater string, r heaterstore.Record) int {
+// heater. It then removes each channel from the heaterChanMap. Finally it
+// tells each user with access to the heater, and each of its watchers, that
+// the change was made by the user named by, subject to their notification
+// preferences.
+func (b *Bot) Publish(username, heater string, r heaterstore.Record, by string) int {
+	count := b.wake(username, heater, r)
+	b.tellListeners(username, heater, r, by)
+	b.notifyChange(username, heater, r, by)
+	return count
+}
+
+// PublishQuietly is like Publish, but does not send any messages to users.
+// It is for changes that happen routinely without anyone asking, such as a
+// thermostat cycling the heater.
+func (b *Bot) PublishQuietly(username, heater string, r heaterstore.Record, by string) int {
+	count := b.wake(username, heater, r)
+	b.tellListeners(username, heater, r, by)
+	return count
+}
+
+// Listener is told about every change to a heater, whether or not users are
+// notified of it.
+type Listener interface {
+	HeaterChanged(ref heaterstore.HeaterRef, r heaterstore.Record, by string)
+}
+
+// AddListener registers a Listener. It must be called before Start.
+func (b *Bot) AddListener(l Listener) {
+	b.listeners = append(b.listeners, l)
+}
+
+func (b *Bot) tellListeners(owner, heater string, r heaterstore.Record, by string) {
+	b.countChange(r, by)
+	ref := heaterstore.HeaterRef{Owner: owner, Heater: heater}
+	for _, l := range b.listeners {
+		l.HeaterChanged(ref, r, by)
+	}
+}
+
+// wake sends the Record to the channels of API clients waiting on the heater.
+func (b *Bot) wake(username, heater string, r heaterstore.Record) int {
 	b.Lock()
 	defer b.Unlock()
 	var count int
@@ -123,37 +245,74 @@ func (b *Bot) Publish(username, heater string, r heaterstore.Record) int {
 	return count
 }
 
+func (b *Bot) notifyChange(owner, heater string, r heaterstore.Record, by string) {
+	id := heaterID(owner, heater)
+	audience, err := b.store.Audience(owner, heater)
+	if err != nil {
+		log.Errorf("error getting audience for %s: %s", id, err.Error())
+	}
+	watchers, err := b.store.Watchers(owner, heater)
+	if err != nil {
+		log.Errorf("error getting watchers for %s: %s", id, err.Error())
+	}
+
+	ref := heaterstore.HeaterRef{Owner: owner, Heater: heater}
+	notified := make(map[string]bool)
+	for _, username := range append(audience, watchers...) {
+		if notified[username] {
+			continue
+		}
+		notified[username] = true
+		profile, err := b.store.GetProfile(username)
+		if err != nil {
+			log.Errorf("error getting profile for %s: %s", username, err.Error())
+			continue
+		}
+		if !profile.Notify.Wants(username, by) {
+			continue
+		}
+		who := by
+		if username == by {
+			who = "You"
+		}
+		b.Notify(username, fmt.Sprintf("%s set %s to %s", who, ref.Name(username), r.Value))
+	}
+}
+
 func (b *Bot) OnOffHandler(value string) func(*tb.Message) {
 	return func(m *tb.Message) {
-		if m.Private() && b.store.UserExists(m.Sender.Username) {
-			ids, err := b.store.IDs(m.Sender.Username)
+		if b.recognize(m) {
+			refs, err := b.controllable(m.Sender.Username)
 			if err != nil {
-				log.Errorf("error getting IDs: %s", err.Error())
+				log.Errorf("error getting heaters: %s", err.Error())
+				return
+			}
+			if len(refs) == 0 {
+				b.send(m.Sender, "You don't have any heaters that you can control.")
 				return
 			}
 			// If the user has just one heater, assume that's the one to act on
-			if len(ids) == 1 {
-				record, err := b.store.Set(m.Sender.Username, ids[0], value)
+			if len(refs) == 1 {
+				_, err := b.SetHeater(refs[0], value, m.Sender.Username)
 				if err != nil {
 					log.Errorf("error setting pending value: %s", err.Error())
 					return
 				}
-				b.Publish(m.Sender.Username, ids[0], record)
-				b.tbBot.Send(m.Sender, fmt.Sprintf("I set %s to %s", ids[0], value))
+				b.send(m.Sender, fmt.Sprintf("I set %s to %s", refs[0].Name(m.Sender.Username), value))
 				return
 			}
 
 			b.store.SetPendingValue(m.Sender.Username, value)
 
-			b.tbBot.Send(m.Sender, "Which heater?", menu(ids))
+			b.send(m.Sender, "Which heater?", menu(names(refs, m.Sender.Username)))
 		} else {
-			b.tbBot.Send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+			b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
 		}
 	}
 }
 
 func (b *Bot) TextHandler(m *tb.Message) {
-	if m.Private() && b.store.UserExists(m.Sender.Username) {
+	if b.recognize(m) {
 		msg, err := json.Marshal(m)
 		if err != nil {
 			log.Errorf("error marshaling JSON: %s", err.Error())
@@ -169,7 +328,16 @@ func (b *Bot) TextHandler(m *tb.Message) {
 			return
 		}
 		log.Debugf("found pending value \"%s\" for user %s", pendingValue, m.Sender.Username)
-		record, err := b.store.Set(m.Sender.Username, m.Text, pendingValue)
+		ref, ok := b.lookup(m.Sender.Username, m.Text)
+		if !ok {
+			b.send(m.Sender, fmt.Sprintf("I don't know of a heater named %s", m.Text))
+			return
+		}
+		if !ref.Role.CanControl() {
+			b.send(m.Sender, fmt.Sprintf("You may view %s but not control it", m.Text))
+			return
+		}
+		_, err = b.SetHeater(ref, pendingValue, m.Sender.Username)
 		if err != nil {
 			log.Errorf("error setting pending value: %s", err.Error())
 			return
@@ -178,32 +346,194 @@ func (b *Bot) TextHandler(m *tb.Message) {
 		if err != nil {
 			log.Errorf("failed to remove pending value for %s: %s", m.Sender.Username, err.Error())
 		}
-		count := b.Publish(m.Sender.Username, m.Text, record)
-		b.tbBot.Send(m.Sender, fmt.Sprintf("I set %d connections for %s to %s", count, m.Text, pendingValue))
+		b.send(m.Sender, fmt.Sprintf("I set %s to %s", m.Text, pendingValue))
 	}
 }
 
 func (b *Bot) StatusHandler(m *tb.Message) {
-	if m.Private() && b.store.UserExists(m.Sender.Username) {
+	if b.recognize(m) {
 		message := ""
-		ids, err := b.store.IDs(m.Sender.Username)
+		refs, err := b.store.Heaters(m.Sender.Username)
 		if err != nil {
-			log.Errorf("error getting IDs: %s", err.Error())
+			log.Errorf("error getting heaters: %s", err.Error())
 			return
 		}
-		for _, heater := range ids {
-			record, err := b.store.Get(m.Sender.Username, heater)
+		for _, ref := range refs {
+			record, err := b.store.Get(ref.Owner, ref.Heater)
 			if err != nil {
 				log.Errorf("error getting record: %s", err.Error())
 				return
 			}
-			message = message + fmt.Sprintf("%s: %s\n", heater, record.Value)
+			message = message + fmt.Sprintf("%s: %s", ref.Name(m.Sender.Username), record.Value)
+			if !ref.Role.CanControl() {
+				message = message + " (view only)"
+			}
+			if anomaly, ok, _ := b.store.GetAnomaly(ref.Owner, ref.Heater); ok && record.Value == "on" {
+				message = message + " ⚠️ may not be working: " + anomaly.Reason
+			}
+			message = message + "\n"
+			if config, err := b.store.GetConfig(ref.Owner, ref.Heater); err == nil && config.WeatherStation != "" {
+				if line := b.weatherLine(config.WeatherStation, m.Sender.Username); line != "" {
+					message = message + "  " + line + "\n"
+				}
+			}
+		}
+		if message == "" {
+			message = "You don't have access to any heaters."
 		}
-		b.tbBot.Send(m.Sender, message)
+		b.send(m.Sender, message)
 	} else {
 		log.Infof("Got message from unknown user %s", m.Sender.Username)
-		b.tbBot.Send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+	}
+}
+
+// SetHeater sets the heater's value and publishes the change on behalf of
+// the user named by.
+func (b *Bot) SetHeater(ref heaterstore.HeaterRef, value, by string) (heaterstore.Record, error) {
+	record, err := b.store.Set(ref.Owner, ref.Heater, value, by)
+	if err != nil {
+		return record, err
+	}
+	b.Publish(ref.Owner, ref.Heater, record, by)
+	return record, nil
+}
+
+// SetHeaterQuietly is like SetHeater, but uses PublishQuietly and records
+// forUser as the user that by made the change for.
+func (b *Bot) SetHeaterQuietly(ref heaterstore.HeaterRef, value, by, forUser string) (heaterstore.Record, error) {
+	record, err := b.store.SetFor(ref.Owner, ref.Heater, value, by, forUser)
+	if err != nil {
+		return record, err
+	}
+	b.PublishQuietly(ref.Owner, ref.Heater, record, by)
+	return record, nil
+}
+
+// Notify sends a message to a user who is not necessarily talking to the bot
+// right now. It only works for users who have messaged the bot before.
+func (b *Bot) Notify(username, message string, options ...interface{}) {
+	err := b.notify(username, message, options...)
+	if err != nil {
+		log.Errorf("error notifying %s: %s", username, err.Error())
+	}
+}
+
+// notify is Notify for callers that need to know whether the message was
+// sent. A user who has not messaged the bot yet can't be sent anything, which
+// is not an error.
+func (b *Bot) notify(username, message string, options ...interface{}) error {
+	profile, err := b.store.GetProfile(username)
+	if err != nil {
+		return err
+	}
+	if profile.ChatID == 0 {
+		log.Debugf("cannot notify %s, who has not messaged the bot yet", username)
+		return nil
+	}
+	_, err = b.tbBot.Send(tb.ChatID(profile.ChatID), message, options...)
+	if err != nil {
+		telegramErrors.Inc()
+	}
+	return err
+}
+
+// send sends a message in reply to a user. telebot doesn't report failed
+// sends, so they are counted and logged here.
+func (b *Bot) send(to tb.Recipient, what interface{}, options ...interface{}) {
+	_, err := b.tbBot.Send(to, what, options...)
+	if err != nil {
+		telegramErrors.Inc()
+		log.Errorf("error sending message: %s", err.Error())
+	}
+}
+
+// maxCallbackData is the most data, in bytes, that Telegram accepts for an
+// inline button.
+const maxCallbackData = 64
+
+// withData returns the button carrying data, or an error if the data that
+// telebot sends for it would be longer than Telegram accepts.
+func withData(button tb.InlineButton, data string) (*tb.InlineButton, error) {
+	with := button.With(data)
+	if n := len(with.CallbackUnique() + "|" + data); n > maxCallbackData {
+		return nil, fmt.Errorf("data of %s button is %d bytes, more than %d", button.Unique, n, maxCallbackData)
+	}
+	return with, nil
+}
+
+// updateConfig applies change to the heater's config under the store lock,
+// so that changes made meanwhile by others, such as the thermostat, aren't
+// lost. It returns the config as saved. change must not call the store.
+func (b *Bot) updateConfig(ref heaterstore.HeaterRef, change func(*heaterstore.HeaterConfig)) (heaterstore.HeaterConfig, error) {
+	var updated heaterstore.HeaterConfig
+	err := b.store.UpdateConfig(ref.Owner, ref.Heater, func(config heaterstore.HeaterConfig) heaterstore.HeaterConfig {
+		change(&config)
+		updated = config
+		return config
+	})
+	return updated, err
+}
+
+// recognize returns true if the message is a private message from a known
+// user. It also remembers the user's chat so they can be sent notifications
+// later.
+func (b *Bot) recognize(m *tb.Message) bool {
+	if !m.Private() || !b.store.Recognized(m.Sender.Username) {
+		return false
+	}
+	profile, err := b.store.GetProfile(m.Sender.Username)
+	if err != nil {
+		log.Errorf("error getting profile for %s: %s", m.Sender.Username, err.Error())
+		return true
+	}
+	if profile.ChatID != m.Chat.ID {
+		err = b.store.UpdateProfile(m.Sender.Username, func(profile *heaterstore.Profile) {
+			profile.ChatID = m.Chat.ID
+		})
+		if err != nil {
+			log.Errorf("error saving profile for %s: %s", m.Sender.Username, err.Error())
+		}
+	}
+	return true
+}
+
+// controllable returns the heaters that username is allowed to change.
+func (b *Bot) controllable(username string) ([]heaterstore.HeaterRef, error) {
+	refs, err := b.store.Heaters(username)
+	if err != nil {
+		return refs, err
+	}
+	allowed := []heaterstore.HeaterRef{}
+	for _, ref := range refs {
+		if ref.Role.CanControl() {
+			allowed = append(allowed, ref)
+		}
+	}
+	return allowed, nil
+}
+
+// lookup finds the heater that username refers to by name.
+func (b *Bot) lookup(username, name string) (heaterstore.HeaterRef, bool) {
+	refs, err := b.store.Heaters(username)
+	if err != nil {
+		log.Errorf("error getting heaters: %s", err.Error())
+		return heaterstore.HeaterRef{}, false
+	}
+	for _, ref := range refs {
+		if ref.Name(username) == name {
+			return ref, true
+		}
+	}
+	return heaterstore.HeaterRef{}, false
+}
+
+func names(refs []heaterstore.HeaterRef, username string) []string {
+	n := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		n = append(n, ref.Name(username))
 	}
+	return n
 }
 
 // menu creates a telegram keyboard with options for each heater
@@ -228,5 +558,6 @@ func heaterID(username, heater string) string {
 // errors with stack traces, which we don't want. More info:
 // https://github.com/tucnak/telebot/issues/342
 func tbdebug(err error) {
+	telegramErrors.Inc()
 	log.WithFields(log.Fields{"error_source": "telebot"}).Error(err.Error())
 }
@@ -0,0 +1,285 @@
+package bot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/mhrivnak/preheatbot/pkg/calendar"
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/netguard"
+)
+
+// maxCalendarUpload is the largest calendar file that may be uploaded.
+const maxCalendarUpload = 5 << 20
+
+const calendarUsage = `Usage:
+/calendar - show your heaters' booking calendars
+/calendar <url> [heater] - turn a heater on before each booking in an iCalendar feed
+/calendar lead <duration> [heater] - how long before each booking to turn it on
+/calendar max <duration|off> [heater] - keep it on this long in total, instead of turning it off when the booking starts
+/calendar off [heater] - stop using the calendar
+You can also send an .ics file, with the heater's name as the caption if you have more than one.`
+
+// CalendarHandler shows and configures heaters' booking calendars.
+func (b *Bot) CalendarHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	username := m.Sender.Username
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 {
+		b.send(m.Sender, b.describeCalendars(username))
+		return
+	}
+
+	var rest []string
+	switch {
+	case args[0] == "off":
+		rest = args[1:]
+	case (args[0] == "lead" || args[0] == "max") && len(args) >= 2:
+		rest = args[2:]
+	case strings.Contains(args[0], "://"):
+		rest = args[1:]
+	default:
+		b.send(m.Sender, calendarUsage)
+		return
+	}
+	if len(rest) > 1 {
+		b.send(m.Sender, calendarUsage)
+		return
+	}
+	ref, err := b.chooseHeater(username, rest)
+	if err != nil {
+		b.send(m.Sender, err.Error())
+		return
+	}
+	config, err := b.store.GetConfig(ref.Owner, ref.Heater)
+	if err != nil {
+		log.Errorf("error getting config: %s", err.Error())
+		return
+	}
+
+	switch args[0] {
+	case "off":
+		_, err = b.updateConfig(ref, func(config *heaterstore.HeaterConfig) { config.Calendar = nil })
+		if err != nil {
+			log.Errorf("error saving config: %s", err.Error())
+			return
+		}
+		err = b.store.DelCalendarFile(ref.Owner, ref.Heater)
+		if err != nil {
+			log.Errorf("error removing calendar file: %s", err.Error())
+		}
+		_, err = b.store.ReplaceActions(ref.Owner, ref.Heater, calendar.Source, []heaterstore.Action{})
+		if err != nil {
+			log.Errorf("error canceling calendar actions: %s", err.Error())
+			return
+		}
+		b.send(m.Sender, fmt.Sprintf("%s no longer follows a calendar.", ref.Name(username)))
+		return
+	case "lead", "max":
+		if config.Calendar == nil {
+			b.send(m.Sender, fmt.Sprintf("%s doesn't have a calendar yet.", ref.Name(username)))
+			return
+		}
+		var d time.Duration
+		if !(args[0] == "max" && args[1] == "off") {
+			d, err = parseDuration(args[1])
+			if err != nil || d <= 0 {
+				b.send(m.Sender, calendarUsage)
+				return
+			}
+		}
+		if args[0] == "lead" {
+			config.Calendar.Lead = heaterstore.Duration(d)
+		} else {
+			config.Calendar.MaxOn = heaterstore.Duration(d)
+		}
+	default:
+		u, err := url.Parse(args[0])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "webcal") {
+			b.send(m.Sender, "That doesn't look like a calendar URL.")
+			return
+		}
+		err = netguard.CheckHost(u.Hostname())
+		if err != nil {
+			b.send(m.Sender, "I can't fetch that URL: "+err.Error())
+			return
+		}
+		config.Calendar = newCalendar(config.Calendar, username)
+		config.Calendar.URL = args[0]
+		err = b.store.DelCalendarFile(ref.Owner, ref.Heater)
+		if err != nil {
+			log.Errorf("error removing calendar file: %s", err.Error())
+		}
+	}
+	b.saveCalendar(m.Sender, ref, config)
+}
+
+// CalendarFileHandler accepts an uploaded .ics file as a heater's calendar.
+func (b *Bot) CalendarFileHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	username := m.Sender.Username
+	if m.Document == nil || !strings.HasSuffix(strings.ToLower(m.Document.FileName), ".ics") {
+		b.send(m.Sender, "I only accept calendar files ending in .ics")
+		return
+	}
+	if m.Document.FileSize > maxCalendarUpload {
+		b.send(m.Sender, "That file is too big.")
+		return
+	}
+	ref, err := b.chooseHeater(username, strings.Fields(m.Caption))
+	if err != nil {
+		b.send(m.Sender, err.Error())
+		return
+	}
+	reader, err := b.tbBot.GetFile(&m.Document.File)
+	if err != nil {
+		log.Errorf("error downloading calendar: %s", err.Error())
+		b.send(m.Sender, "Sorry, I couldn't download that file.")
+		return
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		log.Errorf("error downloading calendar: %s", err.Error())
+		b.send(m.Sender, "Sorry, I couldn't download that file.")
+		return
+	}
+	config, err := b.store.GetConfig(ref.Owner, ref.Heater)
+	if err != nil {
+		log.Errorf("error getting config: %s", err.Error())
+		return
+	}
+	err = b.store.SetCalendarFile(ref.Owner, ref.Heater, data)
+	if err != nil {
+		log.Errorf("error saving calendar file: %s", err.Error())
+		return
+	}
+	config.Calendar = newCalendar(config.Calendar, username)
+	config.Calendar.URL = ""
+	b.saveCalendar(m.Sender, ref, config)
+}
+
+// newCalendar returns a calendar added by username, keeping the settings of
+// the existing one if there is one.
+func newCalendar(existing *heaterstore.Calendar, username string) *heaterstore.Calendar {
+	cal := heaterstore.Calendar{Lead: heaterstore.Duration(calendar.DefaultLead)}
+	if existing != nil {
+		cal = *existing
+	}
+	cal.AddedBy = username
+	return &cal
+}
+
+// saveCalendar syncs the heater's calendar right away, so the user learns
+// whether it works, and saves it.
+func (b *Bot) saveCalendar(to *tb.User, ref heaterstore.HeaterRef, config heaterstore.HeaterConfig) {
+	username := to.Username
+	bookings, err := b.calendar.Bookings(ref, config, time.Now())
+	if err != nil {
+		// the error may describe the server's network, so only log it
+		log.Infof("error reading calendar for %s/%s: %s", ref.Owner, ref.Heater, err.Error())
+		b.send(to, "Sorry, I couldn't read that calendar. Check that it is a public iCalendar feed or .ics file.")
+		return
+	}
+	_, err = b.updateConfig(ref, func(saved *heaterstore.HeaterConfig) { saved.Calendar = config.Calendar })
+	if err != nil {
+		log.Errorf("error saving config: %s", err.Error())
+		return
+	}
+	_, err = b.calendar.Sync(ref, config, time.Now())
+	if err != nil {
+		log.Errorf("error syncing calendar: %s", err.Error())
+	}
+	b.send(to, fmt.Sprintf("OK. %s: %s. There are %d bookings in the next week; see /upcoming.",
+		ref.Name(username), describeCalendar(config.Calendar), len(bookings)))
+}
+
+func (b *Bot) describeCalendars(username string) string {
+	refs, err := b.store.Heaters(username)
+	if err != nil {
+		log.Errorf("error getting heaters: %s", err.Error())
+		return "Sorry, I couldn't look up your heaters."
+	}
+	var sb strings.Builder
+	for _, ref := range refs {
+		config, err := b.store.GetConfig(ref.Owner, ref.Heater)
+		if err != nil || config.Calendar == nil {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s: %s, added by %s\n", ref.Name(username), describeCalendar(config.Calendar), config.Calendar.AddedBy)
+	}
+	if sb.Len() == 0 {
+		return "None of your heaters follow a calendar.\n\n" + calendarUsage
+	}
+	return sb.String() + "\n" + calendarUsage
+}
+
+func describeCalendar(cal *heaterstore.Calendar) string {
+	source := "uploaded calendar"
+	if cal.URL != "" {
+		source = "calendar feed"
+	}
+	lead := time.Duration(cal.Lead)
+	if lead <= 0 {
+		lead = calendar.DefaultLead
+	}
+	if cal.MaxOn > 0 {
+		return fmt.Sprintf("%s, on %s before each booking for %s", source, lead, time.Duration(cal.MaxOn))
+	}
+	return fmt.Sprintf("%s, on %s before each booking until it starts", source, lead)
+}
+
+// UpcomingHandler lists the scheduled changes to the user's heaters.
+func (b *Bot) UpcomingHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	username := m.Sender.Username
+	refs, err := b.store.Heaters(username)
+	if err != nil {
+		log.Errorf("error getting heaters: %s", err.Error())
+		return
+	}
+	loc := b.location(username)
+	var sb strings.Builder
+	schedules := make(map[string][]heaterstore.Action)
+	for _, ref := range refs {
+		actions, ok := schedules[ref.Owner]
+		if !ok {
+			actions, err = b.store.Schedule(ref.Owner)
+			if err != nil {
+				log.Errorf("error getting schedule for %s: %s", ref.Owner, err.Error())
+				return
+			}
+			schedules[ref.Owner] = actions
+		}
+		for _, action := range actions {
+			if action.Heater != ref.Heater {
+				continue
+			}
+			fmt.Fprintf(&sb, "%s: %s %s", action.At.In(loc).Format("Mon Jan 2 15:04"), ref.Name(username), action.Value)
+			if action.Reason != "" {
+				fmt.Fprintf(&sb, " (%s)", action.Reason)
+			}
+			sb.WriteString("\n")
+		}
+	}
+	if sb.Len() == 0 {
+		b.send(m.Sender, "Nothing is planned for your heaters.")
+		return
+	}
+	b.send(m.Sender, sb.String())
+}
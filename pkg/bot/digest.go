@@ -0,0 +1,109 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/mhrivnak/preheatbot/pkg/digest"
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+)
+
+const digestUsage = `Usage:
+/digest <day> <time> [timezone] - get a summary of the past week every week, e.g. /digest sunday 18:00
+/digest now - get the summary right away
+/digest off - stop the weekly summary`
+
+// DigestHandler shows and configures the user's weekly digest.
+func (b *Bot) DigestHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	username := m.Sender.Username
+	args := strings.Fields(m.Payload)
+	profile, err := b.store.GetProfile(username)
+	if err != nil {
+		log.Errorf("error getting profile for %s: %s", username, err.Error())
+		return
+	}
+
+	switch {
+	case len(args) == 0:
+		b.send(m.Sender, describeDigest(profile)+"\n\n"+digestUsage)
+		return
+	case len(args) == 1 && args[0] == "now":
+		message, err := digest.New(b.store, b.telemetry, b).Message(username, time.Now(), profile.Location())
+		if err != nil {
+			log.Errorf("error building digest for %s: %s", username, err.Error())
+			b.send(m.Sender, "Sorry, I couldn't put that together.")
+			return
+		}
+		b.send(m.Sender, message)
+		return
+	case len(args) == 1 && args[0] == "off":
+		profile.Digest = nil
+	case len(args) == 2 || len(args) == 3:
+		day, ok := parseWeekday(args[0])
+		if !ok {
+			b.send(m.Sender, fmt.Sprintf("I don't know the day %q. Use a day of the week such as sunday.", args[0]))
+			return
+		}
+		if len(args) == 3 {
+			_, err = time.LoadLocation(args[2])
+			if err != nil {
+				b.send(m.Sender, fmt.Sprintf("I don't know the time zone %s. Use a name such as America/Denver.", args[2]))
+				return
+			}
+			profile.Timezone = args[2]
+		}
+		at, err := parseClock(args[1], time.Now(), profile.Location())
+		if err != nil {
+			b.send(m.Sender, err.Error())
+			return
+		}
+		// the first digest is the next one due, not one that was due earlier
+		profile.Digest = &heaterstore.Digest{Day: day, Time: at.Format("15:04"), LastSent: time.Now()}
+	default:
+		b.send(m.Sender, digestUsage)
+		return
+	}
+
+	// save only what changed, in case the rest changed meanwhile
+	err = b.store.UpdateProfile(username, func(saved *heaterstore.Profile) {
+		saved.Digest = profile.Digest
+		if len(args) == 3 {
+			saved.Timezone = profile.Timezone
+		}
+		profile = *saved
+	})
+	if err != nil {
+		log.Errorf("error saving profile for %s: %s", username, err.Error())
+		return
+	}
+	b.send(m.Sender, "OK. "+describeDigest(profile))
+}
+
+func describeDigest(profile heaterstore.Profile) string {
+	if profile.Digest == nil {
+		return "You don't get a weekly summary."
+	}
+	return fmt.Sprintf("You get a summary of the past week every %s at %s, %s time.",
+		profile.Digest.Day, profile.Digest.Time, profile.Location())
+}
+
+// parseWeekday parses the name of a day of the week, such as "sunday" or
+// "sun".
+func parseWeekday(s string) (time.Weekday, bool) {
+	s = strings.ToLower(s)
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		name := strings.ToLower(day.String())
+		if s == name || (len(s) >= 3 && strings.HasPrefix(name, s)) {
+			return day, true
+		}
+	}
+	return time.Sunday, false
+}
@@ -0,0 +1,84 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+)
+
+const failureUsage = `Usage:
+/failure - show how long each heater may be on without warming or drawing current before its owners are alerted
+/failure <duration|off|default> <heater> - change it for a heater`
+
+// FailureHandler shows and configures failure detection.
+func (b *Bot) FailureHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	username := m.Sender.Username
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 {
+		var sb strings.Builder
+		refs, err := b.store.Heaters(username)
+		if err != nil {
+			log.Errorf("error getting heaters: %s", err.Error())
+			return
+		}
+		for _, ref := range refs {
+			fmt.Fprintf(&sb, "%s: %s\n", ref.Name(username),
+				describeFailureWindow(b.store.FailureWindow(ref.Owner, ref.Heater)))
+		}
+		sb.WriteString("\n" + failureUsage)
+		b.send(m.Sender, sb.String())
+		return
+	}
+	if len(args) != 2 {
+		b.send(m.Sender, failureUsage)
+		return
+	}
+
+	var window heaterstore.Duration
+	switch args[0] {
+	case "default":
+	case "off":
+		window = -1
+	default:
+		d, err := parseDuration(args[0])
+		if err != nil || d <= 0 {
+			b.send(m.Sender, failureUsage)
+			return
+		}
+		window = heaterstore.Duration(d)
+	}
+
+	ref, ok := b.lookup(username, args[1])
+	if !ok {
+		b.send(m.Sender, fmt.Sprintf("I don't know of a heater named %s", args[1]))
+		return
+	}
+	if ref.Role != heaterstore.RoleOwner {
+		b.send(m.Sender, "Only an owner of "+args[1]+" can do that.")
+		return
+	}
+	_, err := b.updateConfig(ref, func(config *heaterstore.HeaterConfig) {
+		config.FailureWindow = window
+	})
+	if err != nil {
+		log.Errorf("error saving config: %s", err.Error())
+		return
+	}
+	b.send(m.Sender, fmt.Sprintf("OK. %s", describeFailureWindow(b.store.FailureWindow(ref.Owner, ref.Heater))))
+}
+
+func describeFailureWindow(d time.Duration) string {
+	if d < 0 {
+		return "no failure detection"
+	}
+	return "alert if not working after " + d.String() + " on"
+}
@@ -0,0 +1,46 @@
+package bot
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+)
+
+// FeedHandler shows the address of the user's calendar feed, creating its
+// token if needed. "/feed reset" replaces the token, so that anyone who has
+// the old address loses access.
+func (b *Bot) FeedHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	username := m.Sender.Username
+	reset := strings.TrimSpace(m.Payload) == "reset"
+	if !reset && strings.TrimSpace(m.Payload) != "" {
+		b.send(m.Sender, "Usage: /feed [reset]")
+		return
+	}
+	token, err := heaterstore.NewToken()
+	if err != nil {
+		log.Errorf("error generating feed token: %s", err.Error())
+		return
+	}
+	err = b.store.UpdateProfile(username, func(profile *heaterstore.Profile) {
+		if profile.FeedToken == "" || reset {
+			profile.FeedToken = token
+		}
+		token = profile.FeedToken
+	})
+	if err != nil {
+		log.Errorf("error saving profile for %s: %s", username, err.Error())
+		return
+	}
+	address := fmt.Sprintf("%s/v1/users/%s/calendar.ics?token=%s", b.publicURL, url.PathEscape(username), token)
+	b.send(m.Sender, "Subscribe to this address in your calendar app to see when your heaters were on and are planned to be. "+
+		"Keep it secret; use /feed reset if it leaks.\n\n"+address)
+}
@@ -0,0 +1,119 @@
+package bot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+)
+
+const groupUsage = `Usage:
+/group - list your groups and their members
+/group add <group> <username> <owner|operator|viewer> - add a member or change their role
+/group remove <group> <username> - remove a member`
+
+// GroupHandler lets users see the groups they belong to, and lets group
+// owners manage membership.
+func (b *Bot) GroupHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 {
+		b.send(m.Sender, b.describeGroups(m.Sender.Username))
+		return
+	}
+
+	switch {
+	case args[0] == "add" && len(args) == 4:
+		role, err := heaterstore.ParseRole(args[3])
+		if err != nil {
+			b.send(m.Sender, err.Error())
+			return
+		}
+		if !b.isGroupOwner(m.Sender.Username, args[1]) {
+			b.send(m.Sender, "Only an owner of "+args[1]+" can do that.")
+			return
+		}
+		username := strings.TrimPrefix(args[2], "@")
+		err = b.store.SetMember(args[1], username, role)
+		if err != nil {
+			log.Errorf("error adding %s to %s: %s", username, args[1], err.Error())
+			b.send(m.Sender, "Sorry, I couldn't do that: "+err.Error())
+			return
+		}
+		b.send(m.Sender, fmt.Sprintf("%s is now %s of %s", username, article(role), args[1]))
+		b.Notify(username, fmt.Sprintf("%s made you %s of %s", m.Sender.Username, article(role), args[1]))
+	case args[0] == "remove" && len(args) == 3:
+		username := strings.TrimPrefix(args[2], "@")
+		if username != m.Sender.Username && !b.isGroupOwner(m.Sender.Username, args[1]) {
+			b.send(m.Sender, "Only an owner of "+args[1]+" can do that.")
+			return
+		}
+		err := b.store.RemoveMember(args[1], username)
+		if err != nil {
+			b.send(m.Sender, "Sorry, I couldn't do that: "+err.Error())
+			return
+		}
+		b.send(m.Sender, fmt.Sprintf("%s is no longer a member of %s", username, args[1]))
+	default:
+		b.send(m.Sender, groupUsage)
+	}
+}
+
+func (b *Bot) isGroupOwner(username, group string) bool {
+	members, err := b.store.Members(group)
+	if err != nil {
+		return false
+	}
+	return members[username] == heaterstore.RoleOwner
+}
+
+// describeGroups returns a human-readable summary of each group the user
+// belongs to.
+func (b *Bot) describeGroups(username string) string {
+	groups, err := b.store.Groups(username)
+	if err != nil {
+		log.Errorf("error getting groups for %s: %s", username, err.Error())
+		return "Sorry, I couldn't look up your groups."
+	}
+	if len(groups) == 0 {
+		return "You aren't a member of any groups."
+	}
+	names := make([]string, 0, len(groups))
+	for group := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, group := range names {
+		fmt.Fprintf(&sb, "%s (you are %s)\n", group, article(groups[group]))
+		members, err := b.store.Members(group)
+		if err != nil {
+			log.Errorf("error getting members of %s: %s", group, err.Error())
+			continue
+		}
+		usernames := make([]string, 0, len(members))
+		for member := range members {
+			usernames = append(usernames, member)
+		}
+		sort.Strings(usernames)
+		for _, member := range usernames {
+			fmt.Fprintf(&sb, "  %s: %s\n", member, members[member])
+		}
+	}
+	return sb.String()
+}
+
+func article(role heaterstore.Role) string {
+	if role == heaterstore.RoleOwner || role == heaterstore.RoleOperator {
+		return "an " + string(role)
+	}
+	return "a " + string(role)
+}
@@ -0,0 +1,59 @@
+package bot
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhrivnak/preheatbot/pkg/health"
+)
+
+// MaxPollAge is how long the Telegram poller may go without a successful
+// poll before it is reported as not ready. Each poll waits up to 10 seconds
+// for updates.
+const MaxPollAge = time.Minute
+
+// pollRecorder is the transport of telebot's HTTP client. It records when
+// the poller last got a response from Telegram, which telebot doesn't expose.
+type pollRecorder struct {
+	sync.Mutex
+	next   http.RoundTripper
+	status health.Loop
+}
+
+func (p *pollRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := p.next.RoundTrip(req)
+	if !strings.HasSuffix(req.URL.Path, "/getUpdates") {
+		return resp, err
+	}
+	p.Lock()
+	defer p.Unlock()
+	if err == nil && resp.StatusCode == http.StatusOK {
+		p.status.LastSuccess = time.Now()
+		p.status.Err = nil
+	} else if err != nil {
+		p.status.Err = err
+	} else {
+		p.status.Err = fmt.Errorf("getUpdates returned %s", resp.Status)
+	}
+	return resp, err
+}
+
+// setRunning records whether the poller is running.
+func (p *pollRecorder) setRunning(running bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.status.Running = running
+	if running {
+		p.status.Started = time.Now()
+	}
+}
+
+// PollerStatus returns the state of the Telegram poller started by Start.
+func (b *Bot) PollerStatus() health.Loop {
+	b.poller.Lock()
+	defer b.poller.Unlock()
+	return b.poller.status
+}
@@ -0,0 +1,221 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+	"github.com/mhrivnak/preheatbot/pkg/thermostat"
+)
+
+const holdUsage = `Usage:
+/hold - show the holds on your heaters
+/hold <temp> until <time> [±<temp>] [heater] - hold a temperature until a time of day, e.g. /hold 40F until 07:00
+/hold <temp> for <duration> [±<temp>] [heater] - hold a temperature for a while, e.g. /hold 5C for 3h
+/hold off [heater] - end a hold and turn the heater off`
+
+// HoldHandler puts a heater into thermostat mode, in which the server turns
+// it on and off to hold a temperature.
+func (b *Bot) HoldHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	username := m.Sender.Username
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 {
+		b.send(m.Sender, b.describeHolds(username))
+		return
+	}
+	if args[0] == "off" {
+		if len(args) > 2 {
+			b.send(m.Sender, holdUsage)
+			return
+		}
+		ref, err := b.chooseHeater(username, args[1:])
+		if err != nil {
+			b.send(m.Sender, err.Error())
+			return
+		}
+		_, err = b.updateConfig(ref, func(config *heaterstore.HeaterConfig) { config.Thermostat = nil })
+		if err != nil {
+			log.Errorf("error saving config: %s", err.Error())
+			return
+		}
+		_, err = b.SetHeater(ref, "off", username)
+		if err != nil {
+			log.Errorf("error setting value: %s", err.Error())
+			return
+		}
+		b.send(m.Sender, fmt.Sprintf("I ended the hold on %s and turned it off", ref.Name(username)))
+		return
+	}
+
+	if len(args) < 3 || len(args) > 5 {
+		b.send(m.Sender, holdUsage)
+		return
+	}
+	target, err := parseTemperature(args[0])
+	if err != nil {
+		b.send(m.Sender, err.Error())
+		return
+	}
+	now := time.Now()
+	var until time.Time
+	switch args[1] {
+	case "until":
+		until, err = parseClock(args[2], now, b.location(username))
+	case "for":
+		var d time.Duration
+		d, err = parseDuration(args[2])
+		if err == nil && d <= 0 {
+			err = errors.New(holdUsage)
+		}
+		until = now.Add(d)
+	default:
+		err = errors.New(holdUsage)
+	}
+	if err != nil {
+		b.send(m.Sender, err.Error())
+		return
+	}
+	rest := args[3:]
+	hysteresis := thermostat.DefaultHysteresis
+	if len(rest) > 0 && (strings.HasPrefix(rest[0], "±") || strings.HasPrefix(rest[0], "+-")) {
+		delta, err := parseTemperatureDelta(strings.TrimPrefix(strings.TrimPrefix(rest[0], "±"), "+-"))
+		if err != nil || delta <= 0 {
+			b.send(m.Sender, holdUsage)
+			return
+		}
+		hysteresis = 2 * delta
+		rest = rest[1:]
+	}
+	ref, err := b.chooseHeater(username, rest)
+	if err != nil {
+		b.send(m.Sender, err.Error())
+		return
+	}
+
+	hold := &heaterstore.Thermostat{
+		Target:     target,
+		Hysteresis: hysteresis,
+		Until:      until,
+		Metric:     b.thermostatMetric(ref),
+		SetBy:      username,
+	}
+	_, err = b.updateConfig(ref, func(config *heaterstore.HeaterConfig) { config.Thermostat = hold })
+	if err != nil {
+		log.Errorf("error saving config: %s", err.Error())
+		return
+	}
+	b.send(m.Sender, fmt.Sprintf("I will hold %s at %s until %s using its %s readings",
+		ref.Name(username), formatValue(telemetry.MetricEngineTemp, target),
+		until.In(b.location(username)).Format("Mon 15:04"), hold.Metric))
+}
+
+// describeHolds summarizes the active holds on the user's heaters.
+func (b *Bot) describeHolds(username string) string {
+	refs, err := b.store.Heaters(username)
+	if err != nil {
+		log.Errorf("error getting heaters: %s", err.Error())
+		return "Sorry, I couldn't look up your heaters."
+	}
+	var sb strings.Builder
+	for _, ref := range refs {
+		config, err := b.store.GetConfig(ref.Owner, ref.Heater)
+		if err != nil || config.Thermostat == nil {
+			continue
+		}
+		t := config.Thermostat
+		fmt.Fprintf(&sb, "%s: holding %s until %s, set by %s", ref.Name(username),
+			formatValue(telemetry.MetricEngineTemp, t.Target), t.Until.In(b.location(username)).Format("Mon 15:04"), t.SetBy)
+		if t.FailSafe {
+			sb.WriteString(" (off until readings resume)")
+		}
+		sb.WriteString("\n")
+	}
+	if sb.Len() == 0 {
+		return "None of your heaters are holding a temperature.\n\n" + holdUsage
+	}
+	return sb.String()
+}
+
+// thermostatMetric chooses the temperature to hold: the engine's if the device
+// reports it, otherwise the ambient temperature.
+func (b *Bot) thermostatMetric(ref heaterstore.HeaterRef) string {
+	metrics, err := b.telemetry.Metrics(ref.Owner, ref.Heater)
+	if err == nil && !contains(metrics, telemetry.MetricEngineTemp) && contains(metrics, telemetry.MetricAmbientTemp) {
+		return telemetry.MetricAmbientTemp
+	}
+	return telemetry.MetricEngineTemp
+}
+
+// chooseHeater returns the heater named by args, which has at most one
+// element, or the user's only controllable heater if args is empty.
+func (b *Bot) chooseHeater(username string, args []string) (heaterstore.HeaterRef, error) {
+	if len(args) == 1 {
+		ref, ok := b.lookup(username, args[0])
+		if !ok {
+			return ref, fmt.Errorf("I don't know of a heater named %s", args[0])
+		}
+		if !ref.Role.CanControl() {
+			return ref, fmt.Errorf("You may view %s but not control it", args[0])
+		}
+		return ref, nil
+	}
+	refs, err := b.controllable(username)
+	if err != nil {
+		log.Errorf("error getting heaters: %s", err.Error())
+		return heaterstore.HeaterRef{}, errors.New("Sorry, I couldn't look up your heaters.")
+	}
+	switch len(refs) {
+	case 0:
+		return heaterstore.HeaterRef{}, errors.New("You don't have any heaters that you can control.")
+	case 1:
+		return refs[0], nil
+	}
+	return heaterstore.HeaterRef{}, fmt.Errorf("Which heater? Add one of: %s", strings.Join(names(refs, username), ", "))
+}
+
+// location returns the user's time zone.
+func (b *Bot) location(username string) *time.Location {
+	profile, err := b.store.GetProfile(username)
+	if err != nil {
+		log.Errorf("error getting profile for %s: %s", username, err.Error())
+		return time.Local
+	}
+	return profile.Location()
+}
+
+// TimezoneHandler shows or sets the user's time zone.
+func (b *Bot) TimezoneHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	name := strings.TrimSpace(m.Payload)
+	if name == "" {
+		b.send(m.Sender, fmt.Sprintf("Your time zone is %s. Change it with /timezone <name>, such as /timezone America/New_York",
+			b.location(m.Sender.Username)))
+		return
+	}
+	_, err := time.LoadLocation(name)
+	if err != nil {
+		b.send(m.Sender, fmt.Sprintf("I don't know the time zone %s. Use a name such as America/Denver.", name))
+		return
+	}
+	err = b.store.UpdateProfile(m.Sender.Username, func(profile *heaterstore.Profile) {
+		profile.Timezone = name
+	})
+	if err != nil {
+		log.Errorf("error saving profile for %s: %s", m.Sender.Username, err.Error())
+		return
+	}
+	b.send(m.Sender, "Your time zone is now "+name)
+}
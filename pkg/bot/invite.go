@@ -0,0 +1,177 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+)
+
+const inviteUsage = `Usage: /invite <heater> <duration> [view|control]
+For example, "/invite cub 1d control" lets someone turn cub on and off for the next day.`
+
+// revokeInviteButton is the inline button shown next to each invite listed
+// by /invites. Its data is the invite ID.
+var revokeInviteButton = tb.InlineButton{Unique: "revoke_invite", Text: "Revoke"}
+
+// InviteHandler creates an invite link that grants temporary access to one
+// of the sender's heaters.
+func (b *Bot) InviteHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	args := strings.Fields(m.Payload)
+	if len(args) < 2 || len(args) > 3 {
+		b.send(m.Sender, inviteUsage)
+		return
+	}
+	ref, ok := b.lookup(m.Sender.Username, args[0])
+	if !ok {
+		b.send(m.Sender, fmt.Sprintf("I don't know of a heater named %s", args[0]))
+		return
+	}
+	if ref.Role != heaterstore.RoleOwner {
+		b.send(m.Sender, "Only an owner of "+args[0]+" can invite others to use it.")
+		return
+	}
+	duration, err := parseDuration(args[1])
+	if err != nil || duration <= 0 {
+		b.send(m.Sender, inviteUsage)
+		return
+	}
+	role := heaterstore.RoleViewer
+	if len(args) == 3 {
+		switch args[2] {
+		case "view":
+		case "control":
+			role = heaterstore.RoleOperator
+		default:
+			b.send(m.Sender, inviteUsage)
+			return
+		}
+	}
+
+	invite, err := b.store.CreateInvite(ref, role, m.Sender.Username, time.Now().Add(duration))
+	if err != nil {
+		log.Errorf("error creating invite: %s", err.Error())
+		b.send(m.Sender, "Sorry, I couldn't create the invite.")
+		return
+	}
+	b.send(m.Sender, fmt.Sprintf("Anyone who opens this link before %s can %s %s:\nhttps://t.me/%s?start=%s",
+		invite.Expires.Format(time.RFC1123), verb(role), args[0], b.tbBot.Me.Username, invite.ID))
+}
+
+// StartHandler greets new users, and accepts an invite when the user arrives
+// by way of an invite link.
+func (b *Bot) StartHandler(m *tb.Message) {
+	if !m.Private() {
+		return
+	}
+	if m.Payload == "" {
+		if b.recognize(m) {
+			b.send(m.Sender, "Hello from the hangar! Send /status to see your heaters.")
+		} else {
+			b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		}
+		return
+	}
+	if m.Sender.Username == "" {
+		b.send(m.Sender, "You need to set a telegram username before you can accept an invite.")
+		return
+	}
+
+	invite, err := b.store.AcceptInvite(m.Payload, m.Sender.Username, time.Now())
+	if err != nil {
+		log.Infof("%s could not accept invite %s: %s", m.Sender.Username, m.Payload, err.Error())
+		b.send(m.Sender, "Sorry, that invite is no longer valid.")
+		return
+	}
+	b.recognize(m)
+	ref := heaterstore.HeaterRef{Owner: invite.Owner, Heater: invite.Heater, Role: invite.Role}
+	b.send(m.Sender, fmt.Sprintf("Welcome! You can %s %s until %s. Send /status to see it.",
+		verb(invite.Role), ref.Name(m.Sender.Username), invite.Expires.Format(time.RFC1123)))
+	b.Notify(invite.CreatedBy, fmt.Sprintf("%s accepted your invite to %s", m.Sender.Username, ref.Name(invite.CreatedBy)))
+}
+
+// InvitesHandler lists the outstanding invites for heaters the sender owns,
+// each with a button to revoke it.
+func (b *Bot) InvitesHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	invites, err := b.ownedInvites(m.Sender.Username)
+	if err != nil {
+		log.Errorf("error listing invites: %s", err.Error())
+		return
+	}
+	if len(invites) == 0 {
+		b.send(m.Sender, "There are no outstanding invites for your heaters.")
+		return
+	}
+	for _, invite := range invites {
+		ref := heaterstore.HeaterRef{Owner: invite.Owner, Heater: invite.Heater}
+		accepted := "not accepted yet"
+		if len(invite.AcceptedBy) > 0 {
+			accepted = "accepted by " + strings.Join(invite.AcceptedBy, ", ")
+		}
+		markup := &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{{*revokeInviteButton.With(invite.ID)}}}
+		b.send(m.Sender, fmt.Sprintf("%s: %s until %s, created by %s, %s",
+			ref.Name(m.Sender.Username), verb(invite.Role), invite.Expires.Format(time.RFC1123), invite.CreatedBy, accepted), markup)
+	}
+}
+
+// RevokeInviteCallback handles a press of the button shown by /invites.
+func (b *Bot) RevokeInviteCallback(c *tb.Callback) {
+	invite, err := b.store.GetInvite(c.Data)
+	if err != nil {
+		b.tbBot.Respond(c, &tb.CallbackResponse{Text: "That invite no longer exists."})
+		return
+	}
+	role, ok := b.store.Role(c.Sender.Username, invite.Owner, invite.Heater)
+	if !ok || role != heaterstore.RoleOwner {
+		b.tbBot.Respond(c, &tb.CallbackResponse{Text: "Only an owner of the heater can revoke its invites."})
+		return
+	}
+	err = b.store.RevokeInvite(invite.ID)
+	if err != nil {
+		log.Errorf("error revoking invite %s: %s", invite.ID, err.Error())
+		b.tbBot.Respond(c, &tb.CallbackResponse{Text: "Sorry, I couldn't revoke that invite."})
+		return
+	}
+	b.tbBot.Respond(c, &tb.CallbackResponse{Text: "Revoked"})
+	b.tbBot.Edit(c.Message, c.Message.Text+"\n(revoked)")
+	ref := heaterstore.HeaterRef{Owner: invite.Owner, Heater: invite.Heater}
+	for _, username := range invite.AcceptedBy {
+		b.Notify(username, fmt.Sprintf("Your access to %s has been revoked", ref.Name(username)))
+	}
+}
+
+// ownedInvites returns the outstanding invites for heaters that username
+// owns.
+func (b *Bot) ownedInvites(username string) ([]heaterstore.Invite, error) {
+	owned := []heaterstore.Invite{}
+	invites, err := b.store.Invites(time.Now())
+	if err != nil {
+		return owned, err
+	}
+	for _, invite := range invites {
+		role, ok := b.store.Role(username, invite.Owner, invite.Heater)
+		if ok && role == heaterstore.RoleOwner {
+			owned = append(owned, invite)
+		}
+	}
+	return owned, nil
+}
+
+func verb(role heaterstore.Role) string {
+	if role.CanControl() {
+		return "control"
+	}
+	return "view"
+}
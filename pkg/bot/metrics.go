@@ -0,0 +1,41 @@
+package bot
+
+import (
+	"strings"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/metrics"
+)
+
+var (
+	stateChanges = metrics.NewCounter("preheatbot_state_changes_total",
+		"Changes to heaters by source, which is user for changes a person made or scheduled, or the name of the subsystem that made them on its own.",
+		"source", "value")
+	telegramErrors = metrics.NewCounter("preheatbot_telegram_errors_total",
+		"Errors talking to Telegram: failed sends and polls, and handler panics.")
+)
+
+// registerMetrics registers the gauge of API clients waiting on each heater.
+func (b *Bot) registerMetrics() {
+	metrics.NewGaugeFunc("preheatbot_longpoll_subscribers", "API clients long-polling the heater.", metrics.HeaterLabels, func(emit func(float64, ...string)) {
+		b.Lock()
+		defer b.Unlock()
+		for id, chans := range b.heaterChanMap {
+			if len(chans) == 0 {
+				continue
+			}
+			i := strings.LastIndex(id, "/")
+			ref := heaterstore.HeaterRef{Owner: id[:i], Heater: id[i+1:]}
+			emit(float64(len(chans)), metrics.HeaterLabelValues(ref)...)
+		}
+	})
+}
+
+// countChange counts a change made by the user or subsystem named by.
+func (b *Bot) countChange(r heaterstore.Record, by string) {
+	source := "user"
+	if !b.store.Recognized(by) {
+		source = by
+	}
+	stateChanges.Inc(source, r.Value)
+}
@@ -0,0 +1,75 @@
+package bot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseDuration is like time.ParseDuration, but also accepts a whole number
+// of days such as "2d".
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// parseTemperature parses a temperature such as "40F", "4.5C" or "40°F" and
+// returns it in degrees Celsius.
+func parseTemperature(s string) (float64, error) {
+	s = strings.ToUpper(strings.Replace(s, "°", "", 1))
+	if len(s) < 2 {
+		return 0, fmt.Errorf("invalid temperature %q; use a unit, as in 40F or 4C", s)
+	}
+	value, err := strconv.ParseFloat(s[:len(s)-1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid temperature %q; use a unit, as in 40F or 4C", s)
+	}
+	switch s[len(s)-1] {
+	case 'C':
+		return value, nil
+	case 'F':
+		return (value - 32) * 5 / 9, nil
+	}
+	return 0, fmt.Errorf("invalid temperature %q; use a unit, as in 40F or 4C", s)
+}
+
+// parseTemperatureDelta is like parseTemperature, but for a difference
+// between temperatures, so that 9F is 5C.
+func parseTemperatureDelta(s string) (float64, error) {
+	s = strings.ToUpper(strings.Replace(s, "°", "", 1))
+	if strings.HasSuffix(s, "F") {
+		c, err := parseTemperature(s)
+		return c + 32*5.0/9, err
+	}
+	return parseTemperature(s)
+}
+
+// parseClock parses a time of day such as "07:00", "7:30", "0730", "6am" or
+// "6:15pm" and returns its next occurrence after now in loc.
+func parseClock(s string, now time.Time, loc *time.Location) (time.Time, error) {
+	s = strings.ToLower(s)
+	var t time.Time
+	var err error
+	for _, layout := range []string{"15:04", "1504", "3pm", "3:04pm"} {
+		t, err = time.ParseInLocation(layout, s, loc)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q; use a time of day such as 07:00", s)
+	}
+	now = now.In(loc)
+	next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next, nil
+}
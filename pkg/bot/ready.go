@@ -0,0 +1,278 @@
+package bot
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/preheat"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+)
+
+const readyUsage = `Usage:
+/ready <time> [heater] - have the engine warm at a time of day, e.g. /ready 07:30
+/ready cancel [heater] - cancel a planned preheat`
+
+const preheatUsage = `Usage:
+/preheat [heater] - show the model used to plan preheats
+/preheat target <temp> [heater] - the engine temperature that counts as warm
+/preheat curve <temp>=<minutes per °C>... [heater] - e.g. /preheat curve -20C=4 0C=3 10C=2
+/preheat reset [heater] - go back to the default model`
+
+// ReadyHandler plans and schedules a preheat so the engine is warm at the
+// requested time.
+func (b *Bot) ReadyHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	username := m.Sender.Username
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 || len(args) > 2 {
+		b.send(m.Sender, readyUsage)
+		return
+	}
+	ref, err := b.chooseHeater(username, args[1:])
+	if err != nil {
+		b.send(m.Sender, err.Error())
+		return
+	}
+
+	if args[0] == "cancel" {
+		_, err = b.store.ReplaceActions(ref.Owner, ref.Heater, preheat.Source, []heaterstore.Action{})
+		if err != nil {
+			log.Errorf("error canceling preheat: %s", err.Error())
+			return
+		}
+		b.send(m.Sender, fmt.Sprintf("I canceled the planned preheat for %s", ref.Name(username)))
+		return
+	}
+
+	readyAt, err := parseClock(args[0], time.Now(), b.location(username))
+	if err != nil {
+		b.send(m.Sender, err.Error())
+		return
+	}
+	message, err := b.scheduleReady(ref, readyAt, username)
+	if err != nil {
+		log.Errorf("error scheduling preheat: %s", err.Error())
+		b.send(m.Sender, "Sorry, I couldn't schedule that.")
+		return
+	}
+	b.send(m.Sender, message)
+}
+
+// scheduleReady plans a preheat so the heater's engine is warm at readyAt and
+// schedules it on behalf of username, replacing any earlier plan. If there
+// isn't enough time, the heater is turned on right away. It returns a
+// description of the plan for username.
+func (b *Bot) scheduleReady(ref heaterstore.HeaterRef, readyAt time.Time, username string) (string, error) {
+	loc := b.location(username)
+	now := time.Now()
+	plan, err := b.planner.Plan(ref, readyAt, now)
+	if err != nil {
+		return "", err
+	}
+
+	reason := "ready by " + readyAt.In(loc).Format("15:04")
+	actions := []heaterstore.Action{{At: plan.Off, Value: "off", CreatedBy: username, Reason: reason}}
+	startNow := !plan.Start.After(now)
+	if !startNow {
+		actions = append(actions, heaterstore.Action{At: plan.Start, Value: "on", CreatedBy: username, Reason: reason})
+	}
+	_, err = b.store.ReplaceActions(ref.Owner, ref.Heater, preheat.Source, actions)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	if startNow {
+		_, err = b.SetHeater(ref, "on", username)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sb, "There isn't quite enough time, so I turned %s on now.", ref.Name(username))
+	} else {
+		fmt.Fprintf(&sb, "To have %s warm by %s, I will turn it on at %s.", ref.Name(username),
+			readyAt.In(loc).Format("15:04"), plan.Start.In(loc).Format("Mon 15:04"))
+	}
+	fmt.Fprintf(&sb, " I will turn it off at %s.\n", plan.Off.In(loc).Format("15:04"))
+	if plan.HaveAmbient {
+		fmt.Fprintf(&sb, "Preheat estimate: %s at %s ambient, from %s.",
+			plan.Duration, formatValue(telemetry.MetricAmbientTemp, plan.Ambient), plan.Basis)
+	} else {
+		fmt.Fprintf(&sb, "Preheat estimate: %s, from %s.", plan.Duration, plan.Basis)
+	}
+	return sb.String(), nil
+}
+
+// PreheatHandler shows and configures a heater's preheat model.
+func (b *Bot) PreheatHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	username := m.Sender.Username
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 || (len(args) == 1 && args[0] != "reset") {
+		ref, err := b.chooseHeater(username, args)
+		if err != nil {
+			b.send(m.Sender, err.Error())
+			return
+		}
+		model, configured, err := b.planner.Model(ref)
+		if err != nil {
+			log.Errorf("error getting preheat model: %s", err.Error())
+			return
+		}
+		b.send(m.Sender, describeModel(ref.Name(username), model, configured)+"\n\n"+preheatUsage)
+		return
+	}
+
+	// the last argument is a heater name if it isn't part of the command
+	var heaterArgs []string
+	last := args[len(args)-1]
+	if _, ok := b.lookup(username, last); ok && len(args) > 1 {
+		heaterArgs = []string{last}
+		args = args[:len(args)-1]
+	}
+	ref, err := b.chooseHeater(username, heaterArgs)
+	if err != nil {
+		b.send(m.Sender, err.Error())
+		return
+	}
+	if ref.Role != heaterstore.RoleOwner {
+		b.send(m.Sender, "Only an owner of "+ref.Name(username)+" can do that.")
+		return
+	}
+	// changeModel changes the heater's model, starting from the default one
+	changeModel := func(update func(*heaterstore.PreheatModel)) func(*heaterstore.HeaterConfig) {
+		return func(config *heaterstore.HeaterConfig) {
+			model := preheat.DefaultModel
+			if config.Preheat != nil {
+				model = *config.Preheat
+			}
+			update(&model)
+			config.Preheat = &model
+		}
+	}
+
+	var change func(*heaterstore.HeaterConfig)
+	switch {
+	case args[0] == "reset" && len(args) == 1:
+		change = func(config *heaterstore.HeaterConfig) { config.Preheat = nil }
+	case args[0] == "target" && len(args) == 2:
+		target, err := parseTemperature(args[1])
+		if err != nil {
+			b.send(m.Sender, err.Error())
+			return
+		}
+		change = changeModel(func(model *heaterstore.PreheatModel) { model.Target = target })
+	case args[0] == "curve" && len(args) >= 2:
+		curve := []heaterstore.CurvePoint{}
+		for _, arg := range args[1:] {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) != 2 {
+				b.send(m.Sender, preheatUsage)
+				return
+			}
+			ambient, err := parseTemperature(parts[0])
+			if err != nil {
+				b.send(m.Sender, err.Error())
+				return
+			}
+			rate, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil || rate < 0 {
+				b.send(m.Sender, preheatUsage)
+				return
+			}
+			curve = append(curve, heaterstore.CurvePoint{Ambient: ambient, MinutesPerDegree: rate})
+		}
+		sort.Slice(curve, func(i, j int) bool { return curve[i].Ambient < curve[j].Ambient })
+		change = changeModel(func(model *heaterstore.PreheatModel) { model.Curve = curve })
+	default:
+		b.send(m.Sender, preheatUsage)
+		return
+	}
+
+	_, err = b.updateConfig(ref, change)
+	if err != nil {
+		log.Errorf("error saving config: %s", err.Error())
+		return
+	}
+	model, configured, _ := b.planner.Model(ref)
+	b.send(m.Sender, "OK. "+describeModel(ref.Name(username), model, configured))
+}
+
+func describeModel(name string, model heaterstore.PreheatModel, configured bool) string {
+	var sb strings.Builder
+	kind := "the default model"
+	if configured {
+		kind = "its own model"
+	}
+	fmt.Fprintf(&sb, "%s uses %s, which warms the engine to %s:\n", name, kind,
+		formatValue(telemetry.MetricEngineTemp, model.Target))
+	for _, point := range model.Curve {
+		fmt.Fprintf(&sb, "  at %s ambient: %.1f minutes per °C, so %s\n",
+			formatValue(telemetry.MetricAmbientTemp, point.Ambient), point.MinutesPerDegree,
+			preheat.Duration(model, point.Ambient))
+	}
+	return sb.String()
+}
+
+// PreheatStatsHandler shows what has been learned from a heater's past
+// preheats.
+func (b *Bot) PreheatStatsHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	username := m.Sender.Username
+	args := strings.Fields(m.Payload)
+	if len(args) > 1 {
+		b.send(m.Sender, "Usage: /preheatstats [heater]")
+		return
+	}
+	ref, err := b.chooseHeater(username, args)
+	if err != nil {
+		b.send(m.Sender, err.Error())
+		return
+	}
+	fit, used, err := b.planner.Learned(ref)
+	if err != nil {
+		log.Errorf("error getting learned preheat curve: %s", err.Error())
+		return
+	}
+	b.send(m.Sender, describeFit(ref.Name(username), fit, used))
+}
+
+func describeFit(name string, fit preheat.Fit, used bool) string {
+	if fit.Observations == 0 {
+		return fmt.Sprintf("I haven't observed any preheats of %s yet. I learn from times it was on while its device reported engine and ambient temperatures.", name)
+	}
+	var sb strings.Builder
+	noun := "preheats"
+	if fit.Observations == 1 {
+		noun = "preheat"
+	}
+	fmt.Fprintf(&sb, "From %d %s of %s, the time to warm the engine to %s is about:\n", fit.Observations,
+		noun, name, formatValue(telemetry.MetricEngineTemp, fit.Target))
+	for _, ambient := range []float64{-20, -10, 0, 10} {
+		fmt.Fprintf(&sb, "  at %s ambient: %s\n", formatValue(telemetry.MetricAmbientTemp, ambient),
+			fit.Duration(ambient).Round(time.Minute))
+	}
+	fmt.Fprintf(&sb, "Observed ambient temperatures range from %s to %s, and the fit has r² = %.2f.\n",
+		formatValue(telemetry.MetricAmbientTemp, fit.MinAmbient), formatValue(telemetry.MetricAmbientTemp, fit.MaxAmbient), fit.RSquared)
+	if used {
+		sb.WriteString("I use this to plan preheats with /ready.")
+	} else {
+		fmt.Fprintf(&sb, "I will use this to plan preheats once I have observed %d.", preheat.MinObservations)
+	}
+	return sb.String()
+}
@@ -0,0 +1,410 @@
+package bot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+)
+
+const (
+	// SystemUser is recorded as the author of changes the bot makes on its
+	// own, rather than on behalf of a user.
+	SystemUser = "preheatbot"
+
+	reminderInterval = time.Minute
+	// escalateAfter is how long a reminder may go unanswered before it is
+	// also sent to the heater's other users.
+	escalateAfter = 30 * time.Minute
+	snoozeFor     = 30 * time.Minute
+	extendBy      = time.Hour
+)
+
+// The inline buttons attached to each reminder. Their data is
+// "<owner>|<heater>|<version>".
+var (
+	extendButton = tb.InlineButton{Unique: "reminder_extend", Text: "Extend 1h"}
+	offButton    = tb.InlineButton{Unique: "reminder_off", Text: "Turn off now"}
+	snoozeButton = tb.InlineButton{Unique: "reminder_snooze", Text: "Snooze 30m"}
+)
+
+const remindUsage = `Usage:
+/remind - show when you will be asked whether a heater is still needed
+/remind <duration|off|default> - set your own preference
+/remind <duration|off|default> <heater> - set the heater's preference, which takes precedence`
+
+// runReminders periodically checks every heater to see whether a reminder is
+// due. It never returns.
+func (b *Bot) runReminders() {
+	ticker := time.NewTicker(reminderInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		refs, err := b.store.AllHeaters()
+		if err != nil {
+			log.Errorf("error listing heaters for reminders: %s", err.Error())
+			continue
+		}
+		for _, ref := range refs {
+			b.checkReminder(ref, now)
+		}
+	}
+}
+
+// checkReminder sends, escalates or acts on the reminder for one heater as
+// needed.
+func (b *Bot) checkReminder(ref heaterstore.HeaterRef, now time.Time) {
+	id := heaterID(ref.Owner, ref.Heater)
+	record, err := b.store.Get(ref.Owner, ref.Heater)
+	if err != nil {
+		log.Errorf("error getting record for %s: %s", id, err.Error())
+		return
+	}
+	_, ok, err := b.store.GetReminder(ref.Owner, ref.Heater)
+	if err != nil {
+		log.Errorf("error getting reminder for %s: %s", id, err.Error())
+		return
+	}
+	// a thermostat turns the heater off on its own when the hold ends
+	config, err := b.store.GetConfig(ref.Owner, ref.Heater)
+	if err != nil {
+		log.Errorf("error getting config for %s: %s", id, err.Error())
+		return
+	}
+	if record.Value != "on" || config.Thermostat != nil {
+		if ok {
+			err = b.store.DelReminder(ref.Owner, ref.Heater)
+			if err != nil {
+				log.Errorf("error removing reminder for %s: %s", id, err.Error())
+			}
+		}
+		return
+	}
+
+	by := b.turnedOnBy(ref, record)
+	onSince := now
+	change, err := b.store.LastChange(ref.Owner, ref.Heater)
+	if err == nil && change.Version == record.Version {
+		onSince = change.Time
+	}
+	after := b.store.ReminderAfter(ref.Owner, ref.Heater, by)
+	controllers := b.controllers(ref)
+	recipients := []string{by}
+	if role, ok := b.store.Role(by, ref.Owner, ref.Heater); !ok || !role.CanControl() {
+		recipients = controllers
+	}
+
+	// decide while the state is locked, so that an answer to the reminder
+	// given meanwhile isn't lost, and act afterward
+	turnOff := false
+	send, prefix := []string{}, ""
+	err = b.store.UpdateReminder(ref.Owner, ref.Heater, func(state heaterstore.ReminderState, ok bool) (heaterstore.ReminderState, bool) {
+		if !ok || state.Version != record.Version {
+			state = heaterstore.ReminderState{Version: record.Version}
+			if after >= 0 {
+				state.NextAt = onSince.Add(after)
+			}
+		}
+		switch {
+		case !state.OffAt.IsZero() && !now.Before(state.OffAt):
+			turnOff = true
+		case state.SentAt.IsZero() && !state.NextAt.IsZero() && !now.Before(state.NextAt):
+			send = recipients
+			state.SentAt = now
+			state.SentTo = recipients
+		case !state.SentAt.IsZero() && !state.Escalated && !now.Before(state.SentAt.Add(escalateAfter)):
+			for _, username := range controllers {
+				if !contains(state.SentTo, username) {
+					send = append(send, username)
+				}
+			}
+			prefix = fmt.Sprintf("%s hasn't answered. ", strings.Join(state.SentTo, ", "))
+			state.SentTo = append(state.SentTo, send...)
+			state.Escalated = true
+		}
+		return state, true
+	})
+	if err != nil {
+		log.Errorf("error saving reminder for %s: %s", id, err.Error())
+		return
+	}
+
+	if turnOff {
+		_, err = b.SetHeater(ref, "off", SystemUser)
+		if err != nil {
+			log.Errorf("error turning off %s after extension: %s", id, err.Error())
+			return
+		}
+		err = b.store.DelReminder(ref.Owner, ref.Heater)
+		if err != nil {
+			log.Errorf("error removing reminder for %s: %s", id, err.Error())
+		}
+		return
+	}
+	for _, username := range send {
+		b.sendReminder(username, ref, record, prefix)
+	}
+}
+
+func (b *Bot) sendReminder(username string, ref heaterstore.HeaterRef, record heaterstore.Record, prefix string) {
+	data := strings.Join([]string{ref.Owner, ref.Heater, strconv.Itoa(record.Version)}, "|")
+	markup := &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{{
+		*extendButton.With(data),
+		*offButton.With(data),
+		*snoozeButton.With(data),
+	}}}
+	message := fmt.Sprintf("%s%s is still on. Is it still needed?", prefix, ref.Name(username))
+	if change, err := b.store.LastChange(ref.Owner, ref.Heater); err == nil && change.Version == record.Version {
+		message = fmt.Sprintf("%s%s has been on since %s, when %s turned it on. Is it still needed?",
+			prefix, ref.Name(username), change.Time.Format("15:04"), change.By)
+	}
+	b.Notify(username, message, markup)
+}
+
+// ExtendCallback keeps the heater on for another hour, then turns it off.
+func (b *Bot) ExtendCallback(c *tb.Callback) {
+	ref, state, ok := b.reminderFromCallback(c)
+	if !ok {
+		return
+	}
+	state, ok = b.updateReminder(c, ref, state.Version, func(state heaterstore.ReminderState) heaterstore.ReminderState {
+		start := time.Now()
+		if state.OffAt.After(start) {
+			start = state.OffAt
+		}
+		state.OffAt = start.Add(extendBy)
+		state.NextAt = time.Time{}
+		state.SentAt = time.Time{}
+		state.SentTo = nil
+		state.Escalated = false
+		return state
+	})
+	if !ok {
+		return
+	}
+	b.answerReminder(c, fmt.Sprintf("%s extended it; it will turn off at %s.", c.Sender.Username, state.OffAt.Format("15:04")))
+}
+
+// OffCallback turns the heater off right away.
+func (b *Bot) OffCallback(c *tb.Callback) {
+	ref, _, ok := b.reminderFromCallback(c)
+	if !ok {
+		return
+	}
+	_, err := b.SetHeater(ref, "off", c.Sender.Username)
+	if err != nil {
+		log.Errorf("error turning off %s: %s", heaterID(ref.Owner, ref.Heater), err.Error())
+		b.tbBot.Respond(c, &tb.CallbackResponse{Text: "Sorry, something went wrong."})
+		return
+	}
+	b.answerReminder(c, fmt.Sprintf("%s turned it off.", c.Sender.Username))
+}
+
+// SnoozeCallback asks again a little later.
+func (b *Bot) SnoozeCallback(c *tb.Callback) {
+	ref, state, ok := b.reminderFromCallback(c)
+	if !ok {
+		return
+	}
+	state, ok = b.updateReminder(c, ref, state.Version, func(state heaterstore.ReminderState) heaterstore.ReminderState {
+		state.NextAt = time.Now().Add(snoozeFor)
+		state.SentAt = time.Time{}
+		state.SentTo = nil
+		state.Escalated = false
+		return state
+	})
+	if !ok {
+		return
+	}
+	b.answerReminder(c, fmt.Sprintf("%s snoozed it until %s.", c.Sender.Username, state.NextAt.Format("15:04")))
+}
+
+// reminderFromCallback validates a press of one of the reminder buttons. It
+// responds to the callback itself and returns false if the press should be
+// ignored.
+func (b *Bot) reminderFromCallback(c *tb.Callback) (heaterstore.HeaterRef, heaterstore.ReminderState, bool) {
+	ref := heaterstore.HeaterRef{}
+	parts := strings.Split(c.Data, "|")
+	if len(parts) != 3 {
+		b.tbBot.Respond(c, &tb.CallbackResponse{Text: "I don't understand that button."})
+		return ref, heaterstore.ReminderState{}, false
+	}
+	ref.Owner, ref.Heater = parts[0], parts[1]
+	version, err := strconv.Atoi(parts[2])
+	if err != nil {
+		b.tbBot.Respond(c, &tb.CallbackResponse{Text: "I don't understand that button."})
+		return ref, heaterstore.ReminderState{}, false
+	}
+
+	role, ok := b.store.Role(c.Sender.Username, ref.Owner, ref.Heater)
+	if !ok || !role.CanControl() {
+		b.tbBot.Respond(c, &tb.CallbackResponse{Text: "You aren't allowed to control this heater."})
+		return ref, heaterstore.ReminderState{}, false
+	}
+	ref.Role = role
+	record, err := b.store.Get(ref.Owner, ref.Heater)
+	if err != nil {
+		log.Errorf("error getting record: %s", err.Error())
+		b.tbBot.Respond(c, &tb.CallbackResponse{Text: "Sorry, something went wrong."})
+		return ref, heaterstore.ReminderState{}, false
+	}
+	state, ok, err := b.store.GetReminder(ref.Owner, ref.Heater)
+	if err != nil || !ok || record.Version != version || state.Version != version || record.Value != "on" {
+		b.tbBot.Respond(c, &tb.CallbackResponse{Text: "This reminder is out of date."})
+		return ref, state, false
+	}
+	return ref, state, true
+}
+
+// updateReminder applies a button press to the reminder state, unless
+// the reminder has been replaced since the button was sent. It responds to the
+// callback itself and returns false if the press had no effect.
+func (b *Bot) updateReminder(c *tb.Callback, ref heaterstore.HeaterRef, version int, update func(heaterstore.ReminderState) heaterstore.ReminderState) (heaterstore.ReminderState, bool) {
+	var updated heaterstore.ReminderState
+	current := false
+	err := b.store.UpdateReminder(ref.Owner, ref.Heater, func(state heaterstore.ReminderState, ok bool) (heaterstore.ReminderState, bool) {
+		if !ok || state.Version != version {
+			return state, ok
+		}
+		current = true
+		updated = update(state)
+		return updated, true
+	})
+	if err != nil {
+		log.Errorf("error saving reminder: %s", err.Error())
+		b.tbBot.Respond(c, &tb.CallbackResponse{Text: "Sorry, something went wrong."})
+		return updated, false
+	}
+	if !current {
+		b.tbBot.Respond(c, &tb.CallbackResponse{Text: "This reminder is out of date."})
+		return updated, false
+	}
+	return updated, true
+}
+
+// answerReminder acknowledges a button press and updates the reminder message
+// to say what was done.
+func (b *Bot) answerReminder(c *tb.Callback, result string) {
+	b.tbBot.Respond(c, &tb.CallbackResponse{Text: "OK"})
+	if c.Message != nil {
+		b.tbBot.Edit(c.Message, c.Message.Text+"\n"+result)
+	}
+}
+
+// RemindHandler shows and changes how long heaters may stay on before a
+// reminder is sent.
+func (b *Bot) RemindHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 {
+		var sb strings.Builder
+		refs, err := b.store.Heaters(m.Sender.Username)
+		if err != nil {
+			log.Errorf("error getting heaters: %s", err.Error())
+			return
+		}
+		for _, ref := range refs {
+			fmt.Fprintf(&sb, "%s: %s\n", ref.Name(m.Sender.Username),
+				describeReminderAfter(b.store.ReminderAfter(ref.Owner, ref.Heater, m.Sender.Username)))
+		}
+		sb.WriteString("\n" + remindUsage)
+		b.send(m.Sender, sb.String())
+		return
+	}
+	if len(args) > 2 {
+		b.send(m.Sender, remindUsage)
+		return
+	}
+
+	var after heaterstore.Duration
+	switch args[0] {
+	case "default":
+	case "off":
+		after = -1
+	default:
+		d, err := parseDuration(args[0])
+		if err != nil || d <= 0 {
+			b.send(m.Sender, remindUsage)
+			return
+		}
+		after = heaterstore.Duration(d)
+	}
+
+	if len(args) == 1 {
+		err := b.store.UpdateProfile(m.Sender.Username, func(profile *heaterstore.Profile) {
+			profile.ReminderAfter = after
+		})
+		if err != nil {
+			log.Errorf("error saving profile for %s: %s", m.Sender.Username, err.Error())
+			return
+		}
+		b.send(m.Sender, "OK. Heaters that set their own reminder time are not affected.")
+		return
+	}
+
+	ref, ok := b.lookup(m.Sender.Username, args[1])
+	if !ok {
+		b.send(m.Sender, fmt.Sprintf("I don't know of a heater named %s", args[1]))
+		return
+	}
+	if ref.Role != heaterstore.RoleOwner {
+		b.send(m.Sender, "Only an owner of "+args[1]+" can do that.")
+		return
+	}
+	_, err := b.updateConfig(ref, func(config *heaterstore.HeaterConfig) {
+		config.ReminderAfter = after
+	})
+	if err != nil {
+		log.Errorf("error saving config: %s", err.Error())
+		return
+	}
+	b.send(m.Sender, fmt.Sprintf("OK. %s", describeReminderAfter(b.store.ReminderAfter(ref.Owner, ref.Heater, m.Sender.Username))))
+}
+
+func describeReminderAfter(d time.Duration) string {
+	if d < 0 {
+		return "no reminders"
+	}
+	return "reminder after " + d.String() + " on"
+}
+
+// turnedOnBy returns the user who made the change to record, if known.
+func (b *Bot) turnedOnBy(ref heaterstore.HeaterRef, record heaterstore.Record) string {
+	change, err := b.store.LastChange(ref.Owner, ref.Heater)
+	if err != nil || change.Version != record.Version {
+		return ""
+	}
+	return change.By
+}
+
+// controllers returns the users who may turn the heater on and off.
+func (b *Bot) controllers(ref heaterstore.HeaterRef) []string {
+	users := []string{}
+	audience, err := b.store.Audience(ref.Owner, ref.Heater)
+	if err != nil {
+		log.Errorf("error getting audience for %s: %s", heaterID(ref.Owner, ref.Heater), err.Error())
+		return users
+	}
+	for _, username := range audience {
+		if role, ok := b.store.Role(username, ref.Owner, ref.Heater); ok && role.CanControl() {
+			users = append(users, username)
+		}
+	}
+	return users
+}
+
+func contains(s []string, v string) bool {
+	for _, item := range s {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package bot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/shortcut"
+)
+
+const shortcutUsage = `Usage:
+/shortcut on [for <duration>] [heater] - make a link that turns the heater on, e.g. /shortcut on for 2h
+/shortcut off [heater] - make a link that turns the heater off
+/shortcut link <number> <duration> - make a link to a shortcut that stops working after a while, to share with someone
+/shortcut revoke <number> - stop a shortcut's links from working
+/shortcut - list your shortcuts`
+
+// ShortcutHandler makes, lists and revokes the user's shortcuts.
+func (b *Bot) ShortcutHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	username := m.Sender.Username
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 {
+		b.send(m.Sender, b.describeShortcuts(username)+"\n\n"+shortcutUsage, tb.NoPreview)
+		return
+	}
+
+	switch args[0] {
+	case "on", "off":
+		s := heaterstore.Shortcut{Value: args[0]}
+		args = args[1:]
+		if s.Value == "on" && len(args) >= 2 && args[0] == "for" {
+			d, err := parseDuration(args[1])
+			if err != nil || d <= 0 {
+				b.send(m.Sender, shortcutUsage)
+				return
+			}
+			s.For = heaterstore.Duration(d)
+			args = args[2:]
+		}
+		if len(args) > 1 {
+			b.send(m.Sender, shortcutUsage)
+			return
+		}
+		ref, err := b.chooseHeater(username, args)
+		if err != nil {
+			b.send(m.Sender, err.Error())
+			return
+		}
+		s.Owner, s.Heater = ref.Owner, ref.Heater
+		s, err = b.store.AddShortcut(username, s)
+		if err != nil {
+			log.Errorf("error adding shortcut: %s", err.Error())
+			return
+		}
+		// without a preview, Telegram won't open the link and run it
+		b.send(m.Sender, fmt.Sprintf("Opening this link will %s. Put it on an NFC tag or in a phone shortcut, and keep it private; "+
+			"anyone with it can run it until you use /shortcut revoke.\n\n%s",
+			shortcut.Describe(s, username), shortcut.URL(b.publicURL, username, s, time.Time{})), tb.NoPreview)
+		return
+	case "link", "revoke":
+	default:
+		b.send(m.Sender, shortcutUsage)
+		return
+	}
+
+	if (args[0] == "link" && len(args) != 3) || (args[0] == "revoke" && len(args) != 2) {
+		b.send(m.Sender, shortcutUsage)
+		return
+	}
+	shortcuts, err := b.store.Shortcuts(username)
+	if err != nil {
+		log.Errorf("error getting shortcuts: %s", err.Error())
+		return
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 1 || n > len(shortcuts) {
+		b.send(m.Sender, "Use the number of a shortcut from /shortcut.")
+		return
+	}
+	s := shortcuts[n-1]
+
+	if args[0] == "revoke" {
+		err = b.store.RemoveShortcut(username, s.ID)
+		if err != nil {
+			log.Errorf("error removing shortcut: %s", err.Error())
+			return
+		}
+		b.send(m.Sender, "OK. The links to "+shortcut.Describe(s, username)+" no longer work.")
+		return
+	}
+	d, err := parseDuration(args[2])
+	if err != nil || d <= 0 {
+		b.send(m.Sender, shortcutUsage)
+		return
+	}
+	expires := time.Now().Add(d)
+	b.send(m.Sender, fmt.Sprintf("This link will %s until %s:\n\n%s", shortcut.Describe(s, username),
+		expires.In(b.location(username)).Format("Mon Jan 2 15:04"), shortcut.URL(b.publicURL, username, s, expires)), tb.NoPreview)
+}
+
+func (b *Bot) describeShortcuts(username string) string {
+	shortcuts, err := b.store.Shortcuts(username)
+	if err != nil {
+		log.Errorf("error getting shortcuts: %s", err.Error())
+		return "Sorry, I couldn't look up your shortcuts."
+	}
+	if len(shortcuts) == 0 {
+		return "You don't have any shortcuts."
+	}
+	var sb strings.Builder
+	for i, s := range shortcuts {
+		fmt.Fprintf(&sb, "%d. %s: %s\n", i+1, shortcut.Describe(s, username), shortcut.URL(b.publicURL, username, s, time.Time{}))
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
@@ -0,0 +1,223 @@
+package bot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/scheduler"
+	"github.com/mhrivnak/preheatbot/pkg/solar"
+)
+
+const locationUsage = `Usage:
+/location - show where your heaters are
+/location <latitude> <longitude> [heater] - set where a heater is, e.g. /location 61.17 -149.99`
+
+const sunUsage = `Usage:
+/sun - show your heaters' sun rules
+/sun <on|off> <duration> <before|after> <event> [heater] - e.g. /sun on 90m before sunrise
+/sun <on|off> at <event> [heater] - e.g. /sun off at sunset
+/sun clear [heater] - remove a heater's sun rules
+Events are dawn, sunrise, sunset and dusk. Dawn and dusk are the start and end of civil twilight.`
+
+// LocationHandler shows and sets where heaters are.
+func (b *Bot) LocationHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	username := m.Sender.Username
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 {
+		refs, err := b.store.Heaters(username)
+		if err != nil {
+			log.Errorf("error getting heaters: %s", err.Error())
+			return
+		}
+		var sb strings.Builder
+		for _, ref := range refs {
+			config, err := b.store.GetConfig(ref.Owner, ref.Heater)
+			if err != nil {
+				log.Errorf("error getting config: %s", err.Error())
+				return
+			}
+			fmt.Fprintf(&sb, "%s: %s\n", ref.Name(username), describeSite(config.Site))
+		}
+		sb.WriteString("\n" + locationUsage)
+		b.send(m.Sender, sb.String())
+		return
+	}
+	if len(args) < 2 || len(args) > 3 {
+		b.send(m.Sender, locationUsage)
+		return
+	}
+	latitude, err := strconv.ParseFloat(strings.TrimSuffix(args[0], ","), 64)
+	if err != nil || latitude < -90 || latitude > 90 {
+		b.send(m.Sender, locationUsage)
+		return
+	}
+	longitude, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || longitude < -180 || longitude > 180 {
+		b.send(m.Sender, locationUsage)
+		return
+	}
+	ref, err := b.chooseHeater(username, args[2:])
+	if err != nil {
+		b.send(m.Sender, err.Error())
+		return
+	}
+	if ref.Role != heaterstore.RoleOwner {
+		b.send(m.Sender, "Only an owner of "+ref.Name(username)+" can do that.")
+		return
+	}
+	timezone := b.location(username).String()
+	if timezone == "Local" {
+		timezone = ""
+	}
+	config, err := b.updateConfig(ref, func(config *heaterstore.HeaterConfig) {
+		site := heaterstore.Site{}
+		if config.Site != nil {
+			// keep any other details already known about the site
+			site = *config.Site
+		}
+		site.Latitude, site.Longitude, site.Timezone = latitude, longitude, timezone
+		config.Site = &site
+	})
+	if err != nil {
+		log.Errorf("error saving config: %s", err.Error())
+		return
+	}
+	b.send(m.Sender, fmt.Sprintf("OK. %s: %s", ref.Name(username), describeSite(config.Site)))
+}
+
+// SunHandler shows and changes rules that turn heaters on or off at times
+// relative to sunrise, sunset and civil twilight.
+func (b *Bot) SunHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	username := m.Sender.Username
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 {
+		b.send(m.Sender, b.describeSunRules(username))
+		return
+	}
+
+	var rule heaterstore.SunRule
+	var rest []string
+	switch {
+	case args[0] == "clear":
+		rest = args[1:]
+	case (args[0] == "on" || args[0] == "off") && len(args) >= 3 && args[1] == "at":
+		rule.Event, rest = args[2], args[3:]
+	case (args[0] == "on" || args[0] == "off") && len(args) >= 4:
+		d, err := parseDuration(args[1])
+		if err != nil || d <= 0 {
+			b.send(m.Sender, sunUsage)
+			return
+		}
+		switch args[2] {
+		case "before":
+			d = -d
+		case "after":
+		default:
+			b.send(m.Sender, sunUsage)
+			return
+		}
+		rule.Offset = heaterstore.Duration(d)
+		rule.Event, rest = args[3], args[4:]
+	default:
+		b.send(m.Sender, sunUsage)
+		return
+	}
+	if len(rest) > 1 {
+		b.send(m.Sender, sunUsage)
+		return
+	}
+	if rule.Event != "" {
+		if _, err := solar.ParseEvent(rule.Event); err != nil {
+			b.send(m.Sender, sunUsage)
+			return
+		}
+	}
+	ref, err := b.chooseHeater(username, rest)
+	if err != nil {
+		b.send(m.Sender, err.Error())
+		return
+	}
+	config, err := b.store.GetConfig(ref.Owner, ref.Heater)
+	if err != nil {
+		log.Errorf("error getting config: %s", err.Error())
+		return
+	}
+
+	if args[0] == "clear" {
+		_, err = b.updateConfig(ref, func(config *heaterstore.HeaterConfig) { config.SunRules = nil })
+		if err != nil {
+			log.Errorf("error saving config: %s", err.Error())
+			return
+		}
+		b.send(m.Sender, fmt.Sprintf("I removed the sun rules for %s", ref.Name(username)))
+		return
+	}
+	if config.Site == nil {
+		b.send(m.Sender, fmt.Sprintf("I don't know where %s is. An owner can set that with /location.", ref.Name(username)))
+		return
+	}
+	rule.Value = args[0]
+	rule.CreatedBy = username
+	config, err = b.updateConfig(ref, func(config *heaterstore.HeaterConfig) {
+		config.SunRules = append(config.SunRules, rule)
+	})
+	if err != nil {
+		log.Errorf("error saving config: %s", err.Error())
+		return
+	}
+	message := fmt.Sprintf("OK. I will turn %s %s every day %s.", ref.Name(username), rule.Value, scheduler.DescribeSunRule(rule))
+	if next, ok := scheduler.NextSunTime(rule, *config.Site, time.Now()); ok {
+		message += " Next: " + next.In(config.Site.Location()).Format("Mon 15:04 MST")
+	}
+	b.send(m.Sender, message)
+}
+
+// describeSunRules lists the sun rules of each of the user's heaters.
+func (b *Bot) describeSunRules(username string) string {
+	refs, err := b.store.Heaters(username)
+	if err != nil {
+		log.Errorf("error getting heaters: %s", err.Error())
+		return "Sorry, I couldn't look up your heaters."
+	}
+	now := time.Now()
+	var sb strings.Builder
+	for _, ref := range refs {
+		config, err := b.store.GetConfig(ref.Owner, ref.Heater)
+		if err != nil || config.Site == nil || len(config.SunRules) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s:\n", ref.Name(username))
+		for _, rule := range config.SunRules {
+			fmt.Fprintf(&sb, "  %s %s, set by %s", rule.Value, scheduler.DescribeSunRule(rule), rule.CreatedBy)
+			if next, ok := scheduler.NextSunTime(rule, *config.Site, now); ok {
+				fmt.Fprintf(&sb, ", next %s", next.In(config.Site.Location()).Format("Mon 15:04 MST"))
+			}
+			sb.WriteString("\n")
+		}
+	}
+	if sb.Len() == 0 {
+		return "None of your heaters have sun rules.\n\n" + sunUsage
+	}
+	return sb.String()
+}
+
+func describeSite(site *heaterstore.Site) string {
+	if site == nil {
+		return "location not set"
+	}
+	return fmt.Sprintf("%.4f, %.4f in time zone %s", site.Latitude, site.Longitude, site.Location())
+}
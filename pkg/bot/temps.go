@@ -0,0 +1,151 @@
+package bot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+)
+
+// trendWindow is how far back /temps looks to compute each metric's trend.
+const trendWindow = time.Hour
+
+// TempsHandler shows the latest reading and trend of each metric reported by
+// the devices of the user's heaters.
+func (b *Bot) TempsHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	refs, err := b.store.Heaters(m.Sender.Username)
+	if err != nil {
+		log.Errorf("error getting heaters: %s", err.Error())
+		return
+	}
+	now := time.Now()
+	var sb strings.Builder
+	for _, ref := range refs {
+		metrics, err := b.telemetry.Metrics(ref.Owner, ref.Heater)
+		if err != nil {
+			log.Errorf("error listing metrics for %s: %s", heaterID(ref.Owner, ref.Heater), err.Error())
+			continue
+		}
+		if len(metrics) == 0 {
+			continue
+		}
+		sort.Strings(metrics)
+		fmt.Fprintf(&sb, "%s:\n", ref.Name(m.Sender.Username))
+		for _, metric := range metrics {
+			line, err := b.describeMetric(ref, metric, now)
+			if err != nil {
+				log.Errorf("error reading %s for %s: %s", metric, heaterID(ref.Owner, ref.Heater), err.Error())
+				continue
+			}
+			sb.WriteString("  " + line + "\n")
+		}
+	}
+	if sb.Len() == 0 {
+		b.send(m.Sender, "None of your heaters have reported any readings.")
+		return
+	}
+	b.send(m.Sender, sb.String())
+}
+
+// describeMetric returns the latest reading of the metric, how long ago it
+// was reported, and its trend over the trendWindow.
+func (b *Bot) describeMetric(ref heaterstore.HeaterRef, metric string, now time.Time) (string, error) {
+	latest, ok, err := b.telemetry.Latest(ref.Owner, ref.Heater, metric)
+	if err != nil || !ok {
+		return metric + ": no readings", err
+	}
+	line := fmt.Sprintf("%s: %s (%s ago)", metric, formatValue(metric, latest.Value), now.Sub(latest.Time).Round(time.Minute))
+
+	samples, err := b.telemetry.Query(ref.Owner, ref.Heater, metric, latest.Time.Add(-trendWindow), latest.Time)
+	if err != nil {
+		return line, err
+	}
+	if len(samples) < 2 {
+		return line, nil
+	}
+	span := latest.Time.Sub(samples[0].Time)
+	if span < 10*time.Minute {
+		return line, nil
+	}
+	perHour := (latest.Value - samples[0].Value) / span.Hours()
+	arrow := "→"
+	if perHour > 0.05 {
+		arrow = "↑"
+	} else if perHour < -0.05 {
+		arrow = "↓"
+	}
+	return fmt.Sprintf("%s %s %+.1f%s/h", line, arrow, perHour, unit(metric)), nil
+}
+
+// formatValue formats a reading for display, including both Celsius and
+// Fahrenheit for temperatures.
+func formatValue(metric string, value float64) string {
+	if isTemperature(metric) {
+		return fmt.Sprintf("%.1f°C (%.0f°F)", value, celsiusToFahrenheit(value))
+	}
+	return fmt.Sprintf("%.2f%s", value, unit(metric))
+}
+
+func unit(metric string) string {
+	switch {
+	case isTemperature(metric):
+		return "°C"
+	case metric == telemetry.MetricCurrent:
+		return "A"
+	}
+	return ""
+}
+
+func isTemperature(metric string) bool {
+	return strings.HasSuffix(metric, "_temp")
+}
+
+func celsiusToFahrenheit(c float64) float64 {
+	return c*9/5 + 32
+}
+
+// DeviceTokenHandler creates a new device token for one of the user's
+// heaters, replacing any previous one.
+func (b *Bot) DeviceTokenHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	name := strings.TrimSpace(m.Payload)
+	if name == "" {
+		b.send(m.Sender, "Usage: /devicetoken <heater>")
+		return
+	}
+	ref, ok := b.lookup(m.Sender.Username, name)
+	if !ok {
+		b.send(m.Sender, fmt.Sprintf("I don't know of a heater named %s", name))
+		return
+	}
+	if ref.Role != heaterstore.RoleOwner {
+		b.send(m.Sender, "Only an owner of "+name+" can do that.")
+		return
+	}
+	token, err := heaterstore.NewDeviceToken()
+	if err != nil {
+		log.Errorf("error creating device token: %s", err.Error())
+		return
+	}
+	_, err = b.updateConfig(ref, func(config *heaterstore.HeaterConfig) {
+		config.DeviceToken = token
+	})
+	if err != nil {
+		log.Errorf("error saving config: %s", err.Error())
+		return
+	}
+	b.send(m.Sender, fmt.Sprintf("The device token for %s is now:\n%s\nAny previous token no longer works.", name, token))
+}
@@ -0,0 +1,183 @@
+package bot
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/usage"
+)
+
+const usageUsage = `Usage:
+/usage [month] - show how long your heaters were on, the energy they used and what it cost, e.g. /usage 2021-01 or /usage january
+/usage watts <watts> [heater] - how much power the heater draws
+/usage tariff <price per kWh> [<from>-<to>=<price>...] [heater] - e.g. /usage tariff $0.15 22:00-06:00=0.08
+/usage tariff off [heater] - stop pricing the heater's energy`
+
+// UsageHandler shows a month's energy usage and configures the wattage and
+// tariff used to compute it.
+func (b *Bot) UsageHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	username := m.Sender.Username
+	args := strings.Fields(m.Payload)
+	if len(args) > 0 && (args[0] == "watts" || args[0] == "tariff") {
+		b.configureUsage(m, args)
+		return
+	}
+	if len(args) > 1 {
+		b.send(m.Sender, usageUsage)
+		return
+	}
+
+	loc := b.location(username)
+	now := time.Now()
+	month := ""
+	if len(args) == 1 {
+		month = args[0]
+	}
+	start, err := usage.ParseMonth(month, now, loc)
+	if err != nil {
+		b.send(m.Sender, err.Error())
+		return
+	}
+	from, to := usage.Month(start, loc)
+	report, err := b.usage.Report(username, from, to, now, loc)
+	if err != nil {
+		log.Errorf("error computing usage: %s", err.Error())
+		return
+	}
+	b.send(m.Sender, b.describeUsage(username, report))
+}
+
+func (b *Bot) describeUsage(username string, report usage.Report) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Usage in %s:\n", report.From.Format("January 2006"))
+	unpowered := false
+	for _, heater := range report.Heaters {
+		ref := heaterstore.HeaterRef{Owner: heater.Owner, Heater: heater.Heater}
+		fmt.Fprintf(&sb, "\n%s: %s\n", ref.Name(username), describeUsageLine(heater, heater.Usage))
+		for _, u := range heater.ByUser {
+			fmt.Fprintf(&sb, "  %s: %s\n", u.Username, describeUsageLine(heater, u.Usage))
+		}
+		if heater.Watts == 0 {
+			unpowered = true
+		}
+	}
+	if unpowered {
+		sb.WriteString("\nSet a heater's wattage with /usage watts to see its energy use.")
+	}
+	profile, err := b.store.GetProfile(username)
+	if err == nil && profile.FeedToken != "" {
+		fmt.Fprintf(&sb, "\nDownload as CSV: %s/v1/users/%s/usage?month=%s&format=csv&token=%s", b.publicURL,
+			url.PathEscape(username), report.From.Format("2006-01"), profile.FeedToken)
+	}
+	return sb.String()
+}
+
+func describeUsageLine(heater usage.HeaterUsage, u usage.Usage) string {
+	on := time.Duration(u.Hours * float64(time.Hour)).Round(time.Minute)
+	if heater.Watts == 0 {
+		return fmt.Sprintf("on for %s", on)
+	}
+	if !heater.Priced {
+		return fmt.Sprintf("on for %s, %.1f kWh", on, u.KWh)
+	}
+	return fmt.Sprintf("on for %s, %.1f kWh, %s", on, u.KWh, usage.FormatPrice(heater.Currency, u.Cost, 2))
+}
+
+// configureUsage handles "/usage watts" and "/usage tariff".
+func (b *Bot) configureUsage(m *tb.Message, args []string) {
+	username := m.Sender.Username
+	// the last argument is a heater name if it isn't part of the command
+	var heaterArgs []string
+	last := args[len(args)-1]
+	if _, ok := b.lookup(username, last); ok && len(args) > 2 {
+		heaterArgs = []string{last}
+		args = args[:len(args)-1]
+	}
+	if len(args) < 2 {
+		b.send(m.Sender, usageUsage)
+		return
+	}
+	ref, err := b.chooseHeater(username, heaterArgs)
+	if err != nil {
+		b.send(m.Sender, err.Error())
+		return
+	}
+	if ref.Role != heaterstore.RoleOwner {
+		b.send(m.Sender, "Only an owner of "+ref.Name(username)+" can do that.")
+		return
+	}
+	var change func(*heaterstore.HeaterConfig)
+	switch {
+	case args[0] == "watts" && len(args) == 2:
+		watts, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(args[1]), "w"), 64)
+		if err != nil || watts < 0 {
+			b.send(m.Sender, usageUsage)
+			return
+		}
+		change = func(config *heaterstore.HeaterConfig) { config.Watts = watts }
+	case args[0] == "tariff" && len(args) == 2 && args[1] == "off":
+		change = func(config *heaterstore.HeaterConfig) { config.Tariff = nil }
+	case args[0] == "tariff":
+		rate, currency, err := usage.ParseRate(args[1])
+		if err != nil {
+			b.send(m.Sender, err.Error())
+			return
+		}
+		tariff := heaterstore.Tariff{Currency: currency, Rate: rate}
+		for _, arg := range args[2:] {
+			period, err := usage.ParseTariffPeriod(arg)
+			if err != nil {
+				b.send(m.Sender, err.Error())
+				return
+			}
+			tariff.Periods = append(tariff.Periods, period)
+		}
+		change = func(config *heaterstore.HeaterConfig) { config.Tariff = &tariff }
+	default:
+		b.send(m.Sender, usageUsage)
+		return
+	}
+
+	config, err := b.updateConfig(ref, change)
+	if err != nil {
+		log.Errorf("error saving config: %s", err.Error())
+		return
+	}
+	b.send(m.Sender, "OK. "+describeEnergyConfig(ref.Name(username), config))
+}
+
+func describeEnergyConfig(name string, config heaterstore.HeaterConfig) string {
+	var sb strings.Builder
+	if config.Watts > 0 {
+		fmt.Fprintf(&sb, "%s draws %g W", name, config.Watts)
+	} else {
+		fmt.Fprintf(&sb, "%s has no wattage set", name)
+	}
+	if config.Tariff == nil {
+		sb.WriteString(" and its energy is not priced.")
+		return sb.String()
+	}
+	tariff := config.Tariff
+	fmt.Fprintf(&sb, ", and energy costs %s per kWh", usage.FormatPrice(tariff.Currency, tariff.Rate, -1))
+	for i, period := range tariff.Periods {
+		if i == 0 {
+			sb.WriteString(", except")
+		} else {
+			sb.WriteString(",")
+		}
+		fmt.Fprintf(&sb, " %s from %s to %s", usage.FormatPrice(tariff.Currency, period.Rate, -1), period.From, period.To)
+	}
+	sb.WriteString(".")
+	return sb.String()
+}
@@ -0,0 +1,142 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+)
+
+const watchUsage = `Usage:
+/watch - list the watchers of your heaters and your notification preference
+/watch add <username> <heater> - tell someone whenever the heater changes
+/watch remove <username> <heater> - stop telling someone about the heater
+/watch notify <all|others|none> - choose which changes you are told about`
+
+// WatchHandler lets heater owners manage who is told about changes to their
+// heaters, and lets anyone choose which changes they are told about.
+func (b *Bot) WatchHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	args := strings.Fields(m.Payload)
+	switch {
+	case len(args) == 0:
+		b.send(m.Sender, b.describeWatchers(m.Sender.Username))
+	case args[0] == "notify" && len(args) == 2:
+		pref, err := heaterstore.ParseNotifyPreference(args[1])
+		if err != nil {
+			b.send(m.Sender, err.Error())
+			return
+		}
+		err = b.store.UpdateProfile(m.Sender.Username, func(profile *heaterstore.Profile) {
+			profile.Notify = pref
+		})
+		if err != nil {
+			log.Errorf("error saving profile for %s: %s", m.Sender.Username, err.Error())
+			return
+		}
+		b.send(m.Sender, "I will tell you about "+describePreference(pref))
+	case (args[0] == "add" || args[0] == "remove") && len(args) == 3:
+		username := strings.TrimPrefix(args[1], "@")
+		// anyone may stop watching, but only owners may add watchers or
+		// remove others
+		self := args[0] == "remove" && username == m.Sender.Username
+		var ref heaterstore.HeaterRef
+		var ok bool
+		if self {
+			// a watcher may not otherwise be able to see the heater
+			ref, ok = b.lookupWatched(m.Sender.Username, args[2])
+		} else {
+			ref, ok = b.lookup(m.Sender.Username, args[2])
+		}
+		if !ok {
+			b.send(m.Sender, fmt.Sprintf("I don't know of a heater named %s", args[2]))
+			return
+		}
+		if ref.Role != heaterstore.RoleOwner && !self {
+			b.send(m.Sender, "Only an owner of "+args[2]+" can do that.")
+			return
+		}
+		if args[0] == "add" {
+			err := b.store.AddWatcher(ref.Owner, ref.Heater, username)
+			if err != nil {
+				b.send(m.Sender, "Sorry, I couldn't do that: "+err.Error())
+				return
+			}
+			b.send(m.Sender, fmt.Sprintf("%s is now watching %s", username, args[2]))
+			b.Notify(username, fmt.Sprintf("%s added you as a watcher of %s", m.Sender.Username, ref.Name(username)))
+			return
+		}
+		err := b.store.RemoveWatcher(ref.Owner, ref.Heater, username)
+		if err != nil {
+			b.send(m.Sender, "Sorry, I couldn't do that: "+err.Error())
+			return
+		}
+		b.send(m.Sender, fmt.Sprintf("%s is no longer watching %s", username, args[2]))
+	default:
+		b.send(m.Sender, watchUsage)
+	}
+}
+
+// lookupWatched returns the heater named name among those username watches.
+func (b *Bot) lookupWatched(username, name string) (heaterstore.HeaterRef, bool) {
+	refs, err := b.store.Watching(username)
+	if err != nil {
+		log.Errorf("error getting watched heaters: %s", err.Error())
+		return heaterstore.HeaterRef{}, false
+	}
+	for _, ref := range refs {
+		if ref.Name(username) == name {
+			return ref, true
+		}
+	}
+	return heaterstore.HeaterRef{}, false
+}
+
+// describeWatchers returns a summary of the watchers of each heater that
+// username owns, and of username's own notification preference.
+func (b *Bot) describeWatchers(username string) string {
+	var sb strings.Builder
+	refs, err := b.store.Heaters(username)
+	if err != nil {
+		log.Errorf("error getting heaters: %s", err.Error())
+		return "Sorry, I couldn't look up your heaters."
+	}
+	for _, ref := range refs {
+		if ref.Role != heaterstore.RoleOwner {
+			continue
+		}
+		watchers, err := b.store.Watchers(ref.Owner, ref.Heater)
+		if err != nil {
+			log.Errorf("error getting watchers: %s", err.Error())
+			continue
+		}
+		if len(watchers) > 0 {
+			fmt.Fprintf(&sb, "%s: %s\n", ref.Name(username), strings.Join(watchers, ", "))
+		}
+	}
+	if sb.Len() == 0 {
+		sb.WriteString("None of your heaters have watchers.\n")
+	}
+	profile, err := b.store.GetProfile(username)
+	if err == nil {
+		fmt.Fprintf(&sb, "You are told about %s.", describePreference(profile.Notify))
+	}
+	return sb.String()
+}
+
+func describePreference(pref heaterstore.NotifyPreference) string {
+	switch pref {
+	case heaterstore.NotifyAll:
+		return "all changes to heaters you use or watch"
+	case heaterstore.NotifyNone:
+		return "no changes to heaters"
+	default:
+		return "changes made by others to heaters you use or watch"
+	}
+}
@@ -0,0 +1,444 @@
+package bot
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/preheat"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+	"github.com/mhrivnak/preheatbot/pkg/weather"
+)
+
+const (
+	weatherInterval = 5 * time.Minute
+	// adviseAhead is how long before a planned preheat would start that the
+	// weather is checked.
+	adviseAhead = time.Hour
+)
+
+// preheatButton is attached to preheat suggestions. Its data is the flight
+// ID, since the heater's owner and name could make it too long for Telegram.
+var preheatButton = tb.InlineButton{Unique: "weather_preheat", Text: "Preheat"}
+
+const weatherUsage = `Usage:
+/weather - show the latest weather at your heaters
+/weather station <ICAO> [heater] - set the nearest station that issues METARs, e.g. /weather station PANC
+/weather below <temp> [heater] - before each /flight, suggest a preheat when it is colder than this
+/weather auto <on|off> [heater] - start the preheat without asking
+/weather off [heater] - stop checking the weather before flights`
+
+const flightUsage = `Usage:
+/flight - list your upcoming flights
+/flight <time> [heater] - plan a flight, e.g. /flight 07:30
+/flight cancel <number> - cancel a flight from the list`
+
+// WeatherHandler shows the weather at heaters and configures preheat
+// suggestions based on it.
+func (b *Bot) WeatherHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	username := m.Sender.Username
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 {
+		b.send(m.Sender, b.describeWeather(username))
+		return
+	}
+
+	var rest []string
+	switch {
+	case args[0] == "off":
+		rest = args[1:]
+	case (args[0] == "station" || args[0] == "below" || args[0] == "auto") && len(args) >= 2:
+		rest = args[2:]
+	default:
+		b.send(m.Sender, weatherUsage)
+		return
+	}
+	if len(rest) > 1 {
+		b.send(m.Sender, weatherUsage)
+		return
+	}
+	ref, err := b.chooseHeater(username, rest)
+	if err != nil {
+		b.send(m.Sender, err.Error())
+		return
+	}
+	if ref.Role != heaterstore.RoleOwner {
+		b.send(m.Sender, "Only an owner of "+ref.Name(username)+" can do that.")
+		return
+	}
+	config, err := b.store.GetConfig(ref.Owner, ref.Heater)
+	if err != nil {
+		log.Errorf("error getting config: %s", err.Error())
+		return
+	}
+
+	var change func(*heaterstore.HeaterConfig)
+	switch args[0] {
+	case "off":
+		change = func(config *heaterstore.HeaterConfig) { config.ColdWeather = nil }
+	case "station":
+		station := strings.ToUpper(args[1])
+		if !weather.ValidStation(station) {
+			b.send(m.Sender, station+" isn't an ICAO code. Use the four letter code of the station, such as PANC.")
+			return
+		}
+		if _, err := b.weather.Latest(station, time.Now()); err != nil {
+			log.Infof("error fetching weather for %s: %s", station, err.Error())
+			b.send(m.Sender, fmt.Sprintf("I couldn't get a METAR for %s.", station))
+			return
+		}
+		change = func(config *heaterstore.HeaterConfig) { config.WeatherStation = station }
+	case "below":
+		below, err := parseTemperature(args[1])
+		if err != nil {
+			b.send(m.Sender, err.Error())
+			return
+		}
+		change = func(config *heaterstore.HeaterConfig) {
+			if config.ColdWeather == nil {
+				config.ColdWeather = &heaterstore.ColdWeather{}
+			}
+			config.ColdWeather.Below = below
+		}
+	case "auto":
+		if config.ColdWeather == nil {
+			b.send(m.Sender, "First set a temperature with /weather below <temp>")
+			return
+		}
+		if args[1] != "on" && args[1] != "off" {
+			b.send(m.Sender, weatherUsage)
+			return
+		}
+		auto := args[1] == "on"
+		change = func(config *heaterstore.HeaterConfig) {
+			if config.ColdWeather != nil {
+				config.ColdWeather.Auto = auto
+			}
+		}
+	}
+	config, err = b.updateConfig(ref, change)
+	if err != nil {
+		log.Errorf("error saving config: %s", err.Error())
+		return
+	}
+	b.send(m.Sender, fmt.Sprintf("OK. %s: %s", ref.Name(username), describeColdWeather(config)))
+}
+
+// describeWeather shows the latest weather and preheat suggestion settings of
+// each of the user's heaters that has a weather station.
+func (b *Bot) describeWeather(username string) string {
+	refs, err := b.store.Heaters(username)
+	if err != nil {
+		log.Errorf("error getting heaters: %s", err.Error())
+		return "Sorry, I couldn't look up your heaters."
+	}
+	var sb strings.Builder
+	for _, ref := range refs {
+		config, err := b.store.GetConfig(ref.Owner, ref.Heater)
+		if err != nil || config.WeatherStation == "" {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s: %s\n", ref.Name(username), describeColdWeather(config))
+		if line := b.weatherLine(config.WeatherStation, username); line != "" {
+			fmt.Fprintf(&sb, "  %s\n", line)
+		}
+	}
+	if sb.Len() == 0 {
+		return "None of your heaters have a weather station.\n\n" + weatherUsage
+	}
+	return sb.String() + "\n" + weatherUsage
+}
+
+// weatherLine describes the latest report from the station in one line, or
+// returns "" if there is none.
+func (b *Bot) weatherLine(station, username string) string {
+	now := time.Now()
+	report, err := b.weather.Latest(station, now)
+	if err != nil {
+		log.Errorf("error getting weather for %s: %s", station, err.Error())
+		return ""
+	}
+	line := report.Station + ": "
+	if report.HaveTemperature {
+		line += formatValue(telemetry.MetricAmbientTemp, report.Temperature) + ", "
+	}
+	line += report.Summary()
+	return fmt.Sprintf("%s (observed %s)", line, report.Time.In(b.location(username)).Format("15:04"))
+}
+
+func describeColdWeather(config heaterstore.HeaterConfig) string {
+	station := config.WeatherStation
+	if station == "" {
+		station = "no weather station"
+	}
+	if config.ColdWeather == nil {
+		return station + ", no preheat suggestions"
+	}
+	action := "suggest"
+	if config.ColdWeather.Auto {
+		action = "start"
+	}
+	return fmt.Sprintf("%s, %s a preheat before flights when below %s", station, action,
+		formatValue(telemetry.MetricAmbientTemp, config.ColdWeather.Below))
+}
+
+// FlightHandler lists, plans and cancels flights.
+func (b *Bot) FlightHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	username := m.Sender.Username
+	args := strings.Fields(m.Payload)
+	loc := b.location(username)
+	if len(args) == 0 {
+		flights := b.upcomingFlights(username)
+		if len(flights) == 0 {
+			b.send(m.Sender, "You don't have any upcoming flights.\n\n"+flightUsage)
+			return
+		}
+		var sb strings.Builder
+		for i, f := range flights {
+			fmt.Fprintf(&sb, "%d. %s at %s, planned by %s\n", i+1, f.ref.Name(username),
+				f.flight.At.In(loc).Format("Mon Jan 2 15:04"), f.flight.CreatedBy)
+		}
+		b.send(m.Sender, sb.String())
+		return
+	}
+	if len(args) > 2 {
+		b.send(m.Sender, flightUsage)
+		return
+	}
+
+	if args[0] == "cancel" {
+		flights := b.upcomingFlights(username)
+		n, err := strconv.Atoi(strings.Join(args[1:], ""))
+		if err != nil || n < 1 || n > len(flights) {
+			b.send(m.Sender, flightUsage)
+			return
+		}
+		f := flights[n-1]
+		if !f.ref.Role.CanControl() {
+			b.send(m.Sender, "You may view "+f.ref.Name(username)+" but not control it")
+			return
+		}
+		err = b.store.RemoveFlight(f.ref.Owner, f.flight.ID)
+		if err != nil {
+			log.Errorf("error removing flight: %s", err.Error())
+			return
+		}
+		b.send(m.Sender, fmt.Sprintf("I canceled the flight at %s.", f.flight.At.In(loc).Format("Mon 15:04")))
+		return
+	}
+
+	at, err := parseClock(args[0], time.Now(), loc)
+	if err != nil {
+		b.send(m.Sender, err.Error())
+		return
+	}
+	ref, err := b.chooseHeater(username, args[1:])
+	if err != nil {
+		b.send(m.Sender, err.Error())
+		return
+	}
+	_, err = b.store.AddFlight(ref.Owner, heaterstore.Flight{Heater: ref.Heater, At: at, CreatedBy: username})
+	if err != nil {
+		log.Errorf("error adding flight: %s", err.Error())
+		return
+	}
+	message := fmt.Sprintf("OK. You are flying at %s.", at.In(loc).Format("Mon 15:04"))
+	if config, err := b.store.GetConfig(ref.Owner, ref.Heater); err == nil && config.ColdWeather != nil && config.WeatherStation != "" {
+		message += " I will check the weather at " + config.WeatherStation + " before then."
+	}
+	b.send(m.Sender, message)
+}
+
+type plannedFlight struct {
+	ref    heaterstore.HeaterRef
+	flight heaterstore.Flight
+}
+
+// upcomingFlights returns the flights on the user's heaters that haven't
+// departed yet, earliest first.
+func (b *Bot) upcomingFlights(username string) []plannedFlight {
+	planned := []plannedFlight{}
+	refs, err := b.store.Heaters(username)
+	if err != nil {
+		log.Errorf("error getting heaters: %s", err.Error())
+		return planned
+	}
+	now := time.Now()
+	for _, ref := range refs {
+		flights, err := b.store.Flights(ref.Owner)
+		if err != nil {
+			log.Errorf("error getting flights for %s: %s", ref.Owner, err.Error())
+			continue
+		}
+		for _, flight := range flights {
+			if flight.Heater == ref.Heater && flight.At.After(now) {
+				planned = append(planned, plannedFlight{ref: ref, flight: flight})
+			}
+		}
+	}
+	sort.SliceStable(planned, func(i, j int) bool { return planned[i].flight.At.Before(planned[j].flight.At) })
+	return planned
+}
+
+// runWeatherAdvice periodically checks the weather before each upcoming
+// flight. It never returns.
+func (b *Bot) runWeatherAdvice() {
+	ticker := time.NewTicker(weatherInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		namespaces, err := b.store.Namespaces()
+		if err != nil {
+			log.Errorf("error listing namespaces for weather advice: %s", err.Error())
+			continue
+		}
+		for _, owner := range namespaces {
+			b.adviseNamespace(owner, now)
+		}
+	}
+}
+
+func (b *Bot) adviseNamespace(owner string, now time.Time) {
+	err := b.store.PruneFlights(owner, now.Add(-time.Hour))
+	if err != nil {
+		log.Errorf("error pruning flights for %s: %s", owner, err.Error())
+	}
+	flights, err := b.store.Flights(owner)
+	if err != nil {
+		log.Errorf("error getting flights for %s: %s", owner, err.Error())
+		return
+	}
+	for _, flight := range flights {
+		if flight.Advised || !flight.At.After(now) {
+			continue
+		}
+		done, err := b.adviseFlight(heaterstore.HeaterRef{Owner: owner, Heater: flight.Heater}, flight, now)
+		if err != nil {
+			log.Errorf("error checking weather for flight %s: %s", flight.ID, err.Error())
+			continue
+		}
+		if done {
+			flight.Advised = true
+			err = b.store.SetFlight(owner, flight)
+			if err != nil {
+				log.Errorf("error saving flight %s: %s", flight.ID, err.Error())
+			}
+		}
+	}
+}
+
+// adviseFlight suggests or starts a preheat for the flight if it is time to
+// and the weather is cold. It returns true once nothing more needs to be done
+// for the flight.
+func (b *Bot) adviseFlight(ref heaterstore.HeaterRef, flight heaterstore.Flight, now time.Time) (bool, error) {
+	config, err := b.store.GetConfig(ref.Owner, ref.Heater)
+	if err != nil {
+		return false, err
+	}
+	if config.ColdWeather == nil || config.WeatherStation == "" {
+		return false, nil
+	}
+	plan, err := b.planner.Plan(ref, flight.At, now)
+	if err != nil {
+		return false, err
+	}
+	if now.Before(plan.Start.Add(-adviseAhead)) {
+		return false, nil
+	}
+	report, err := b.weather.Latest(config.WeatherStation, now)
+	if err != nil {
+		return false, err
+	}
+	if !report.HaveTemperature || report.Temperature >= config.ColdWeather.Below {
+		// it may still get colder before the preheat would start
+		return !now.Before(plan.Start), nil
+	}
+
+	// someone may have planned a preheat already
+	record, err := b.store.Get(ref.Owner, ref.Heater)
+	if err != nil {
+		return false, err
+	}
+	scheduled, err := b.store.Schedule(ref.Owner)
+	if err != nil {
+		return false, err
+	}
+	for _, action := range scheduled {
+		if action.Heater == ref.Heater && action.Source == preheat.Source {
+			return true, nil
+		}
+	}
+	if record.Value == "on" {
+		return true, nil
+	}
+
+	role, ok := b.store.Role(flight.CreatedBy, ref.Owner, ref.Heater)
+	if !ok || !role.CanControl() {
+		return true, nil
+	}
+	ref.Role = role
+	loc := b.location(flight.CreatedBy)
+	cold := fmt.Sprintf("It is %s at %s, and you are flying at %s.",
+		formatValue(telemetry.MetricAmbientTemp, report.Temperature), report.Station, flight.At.In(loc).Format("15:04"))
+	if config.ColdWeather.Auto {
+		message, err := b.scheduleReady(ref, flight.At, flight.CreatedBy)
+		if err != nil {
+			return false, err
+		}
+		b.Notify(flight.CreatedBy, cold+" "+message)
+		return true, nil
+	}
+	button, err := withData(preheatButton, flight.ID)
+	if err != nil {
+		return false, err
+	}
+	markup := &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{{*button}}}
+	// if the suggestion can't be sent, try again next time
+	err = b.notify(flight.CreatedBy, fmt.Sprintf("%s Preheat %s? It would take about %s.", cold, ref.Name(flight.CreatedBy), plan.Duration), markup)
+	return err == nil, err
+}
+
+// PreheatCallback schedules the preheat suggested before a flight.
+func (b *Bot) PreheatCallback(c *tb.Callback) {
+	owner, flight, err := b.store.FindFlight(c.Data)
+	if err != nil {
+		if !b.store.IsNotExist(err) {
+			log.Errorf("error finding flight: %s", err.Error())
+			b.tbBot.Respond(c, &tb.CallbackResponse{Text: "Sorry, something went wrong."})
+			return
+		}
+		b.tbBot.Respond(c, &tb.CallbackResponse{Text: "This flight has already departed or was canceled."})
+		return
+	}
+	ref := heaterstore.HeaterRef{Owner: owner, Heater: flight.Heater}
+	role, ok := b.store.Role(c.Sender.Username, ref.Owner, ref.Heater)
+	if !ok || !role.CanControl() {
+		b.tbBot.Respond(c, &tb.CallbackResponse{Text: "You aren't allowed to control this heater."})
+		return
+	}
+	ref.Role = role
+	if !flight.At.After(time.Now()) {
+		b.tbBot.Respond(c, &tb.CallbackResponse{Text: "This flight has already departed or was canceled."})
+		return
+	}
+	message, err := b.scheduleReady(ref, flight.At, c.Sender.Username)
+	if err != nil {
+		log.Errorf("error scheduling preheat: %s", err.Error())
+		b.tbBot.Respond(c, &tb.CallbackResponse{Text: "Sorry, something went wrong."})
+		return
+	}
+	b.answerReminder(c, message)
+}
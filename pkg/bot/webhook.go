@@ -0,0 +1,135 @@
+package bot
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/netguard"
+)
+
+const webhookUsage = `Usage:
+/webhook - list your webhooks
+/webhook add <url> - post an event to the URL whenever one of your heaters changes or its device goes offline or comes back
+/webhook test <number> - post a test event to a webhook now
+/webhook remove <number> - stop posting to a webhook`
+
+// WebhookHandler lists, adds, tests and removes the user's webhooks.
+func (b *Bot) WebhookHandler(m *tb.Message) {
+	if !b.recognize(m) {
+		b.send(m.Sender, "I don't recognize you, "+m.Sender.Username)
+		return
+	}
+	username := m.Sender.Username
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 {
+		b.send(m.Sender, b.describeWebhooks(username)+"\n\n"+webhookUsage)
+		return
+	}
+	if len(args) != 2 {
+		b.send(m.Sender, webhookUsage)
+		return
+	}
+
+	if args[0] == "add" {
+		u, err := url.Parse(args[1])
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			b.send(m.Sender, "That doesn't look like an http or https URL.")
+			return
+		}
+		err = netguard.CheckHost(u.Hostname())
+		if err != nil {
+			b.send(m.Sender, "I can't post to that URL: "+err.Error())
+			return
+		}
+		webhook, err := b.store.AddWebhook(username, u.String())
+		if err != nil {
+			log.Errorf("error adding webhook: %s", err.Error())
+			return
+		}
+		b.send(m.Sender, fmt.Sprintf("OK. I will post events to %s. Each is signed with this secret, "+
+			"which you need to check the X-Preheatbot-Signature header:\n\n%s\n\nUse /webhook test to try it.", webhook.URL, webhook.Secret))
+		return
+	}
+
+	webhooks, err := b.store.Webhooks(username)
+	if err != nil {
+		log.Errorf("error getting webhooks: %s", err.Error())
+		return
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 1 || n > len(webhooks) {
+		b.send(m.Sender, "Use the number of a webhook from /webhook.")
+		return
+	}
+	webhook := webhooks[n-1]
+
+	switch args[0] {
+	case "test":
+		err = b.webhooks.SendTest(webhook, username)
+		if err != nil {
+			b.send(m.Sender, "The test failed: "+err.Error())
+			return
+		}
+		b.send(m.Sender, "The test event was delivered to "+webhook.URL)
+	case "remove":
+		err = b.store.RemoveWebhook(username, webhook.ID)
+		if err != nil {
+			log.Errorf("error removing webhook: %s", err.Error())
+			return
+		}
+		b.send(m.Sender, "OK. I stopped posting to "+webhook.URL)
+	default:
+		b.send(m.Sender, webhookUsage)
+	}
+}
+
+func (b *Bot) describeWebhooks(username string) string {
+	webhooks, err := b.store.Webhooks(username)
+	if err != nil {
+		log.Errorf("error getting webhooks: %s", err.Error())
+		return "Sorry, I couldn't look up your webhooks."
+	}
+	if len(webhooks) == 0 {
+		return "You don't have any webhooks."
+	}
+	deliveries, err := b.store.Deliveries(username)
+	if err != nil {
+		log.Errorf("error getting webhook deliveries: %s", err.Error())
+	}
+	var sb strings.Builder
+	for i, webhook := range webhooks {
+		fmt.Fprintf(&sb, "%d. %s", i+1, webhook.URL)
+		pending, lastError := pendingDeliveries(deliveries, webhook.ID)
+		if pending > 0 {
+			fmt.Fprintf(&sb, " (%d waiting", pending)
+			if lastError != "" {
+				fmt.Fprintf(&sb, ", last error: %s", lastError)
+			}
+			sb.WriteString(")")
+		}
+		sb.WriteString("\n")
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// pendingDeliveries counts the deliveries waiting for the webhook and returns
+// the most recent error from trying to deliver them.
+func pendingDeliveries(deliveries []heaterstore.Delivery, webhookID string) (int, string) {
+	count, lastError := 0, ""
+	for _, delivery := range deliveries {
+		if delivery.WebhookID != webhookID {
+			continue
+		}
+		count++
+		if delivery.LastError != "" {
+			lastError = delivery.LastError
+		}
+	}
+	return count, lastError
+}
@@ -0,0 +1,212 @@
+// Package calendar turns heaters on before the bookings in their iCalendar
+// feeds, such as those a flying club's scheduling system publishes.
+package calendar
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/ical"
+	"github.com/mhrivnak/preheatbot/pkg/netguard"
+)
+
+const (
+	// Source identifies scheduled actions created from calendar feeds.
+	Source = "calendar"
+	// DefaultLead is how long before a booking the heater is turned on,
+	// unless the calendar says otherwise.
+	DefaultLead = 2 * time.Hour
+	// Horizon is how far ahead bookings are scheduled.
+	Horizon = 7 * 24 * time.Hour
+
+	interval = 15 * time.Minute
+	// maxFeedSize is the largest feed that will be read.
+	maxFeedSize = 5 << 20
+)
+
+// Syncer periodically fetches each heater's calendar feed and schedules the
+// heater to turn on and off around its bookings.
+type Syncer struct {
+	store  *heaterstore.Store
+	client *http.Client
+}
+
+func New(store *heaterstore.Store) *Syncer {
+	return &Syncer{
+		store:  store,
+		client: newClient(),
+	}
+}
+
+// newClient returns a client that refuses to connect to private addresses,
+// since anyone can ask for a calendar URL to be fetched.
+func newClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: netguard.Control}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: 30 * time.Second, Transport: transport}
+}
+
+// Run syncs every calendar periodically. It never returns.
+func (s *Syncer) Run() {
+	s.RunOnce(time.Now())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.RunOnce(now)
+	}
+}
+
+// RunOnce syncs every calendar once.
+func (s *Syncer) RunOnce(now time.Time) {
+	refs, err := s.store.AllHeaters()
+	if err != nil {
+		log.Errorf("error listing heaters for calendars: %s", err.Error())
+		return
+	}
+	for _, ref := range refs {
+		config, err := s.store.GetConfig(ref.Owner, ref.Heater)
+		if err != nil {
+			log.Errorf("error getting config for %s/%s: %s", ref.Owner, ref.Heater, err.Error())
+			continue
+		}
+		if config.Calendar == nil {
+			continue
+		}
+		_, err = s.Sync(ref, config, now)
+		if err != nil {
+			log.Errorf("error syncing calendar for %s/%s: %s", ref.Owner, ref.Heater, err.Error())
+		}
+	}
+}
+
+// Sync schedules the heater around the bookings in its calendar that start
+// within the Horizon, replacing what was scheduled before. It returns the
+// bookings. If the feed can't be read, the schedule is left as it was.
+func (s *Syncer) Sync(ref heaterstore.HeaterRef, config heaterstore.HeaterConfig, now time.Time) ([]ical.Occurrence, error) {
+	bookings, err := s.Bookings(ref, config, now)
+	if err != nil {
+		return bookings, err
+	}
+	actions := Actions(bookings, *config.Calendar, now, s.userLocation(config.Calendar.AddedBy))
+	_, err = s.store.ReplaceActions(ref.Owner, ref.Heater, Source, actions)
+	return bookings, err
+}
+
+// Bookings returns the bookings in the heater's calendar that start between
+// now and the Horizon.
+func (s *Syncer) Bookings(ref heaterstore.HeaterRef, config heaterstore.HeaterConfig, now time.Time) ([]ical.Occurrence, error) {
+	bookings := []ical.Occurrence{}
+	feed, err := s.read(ref, *config.Calendar)
+	if err != nil {
+		return bookings, err
+	}
+	events, err := ical.Parse(bytes.NewReader(feed), s.location(config))
+	if err != nil {
+		return bookings, err
+	}
+	for _, o := range ical.Occurrences(events, now, now.Add(Horizon)) {
+		if o.Start.After(now) {
+			bookings = append(bookings, o)
+		}
+	}
+	return bookings, nil
+}
+
+// Actions returns the actions that turn the heater on Lead before each
+// booking and off again. Bookings close enough together that the heater
+// would be on for both are merged, and actions before now are left out.
+// Times in reasons are shown in loc.
+func Actions(bookings []ical.Occurrence, cal heaterstore.Calendar, now time.Time, loc *time.Location) []heaterstore.Action {
+	type window struct {
+		on, off time.Time
+		reason  string
+	}
+	lead := time.Duration(cal.Lead)
+	if lead <= 0 {
+		lead = DefaultLead
+	}
+	windows := []window{}
+	for _, b := range bookings {
+		w := window{on: b.Start.Add(-lead), off: b.Start}
+		if cal.MaxOn > 0 {
+			w.off = w.on.Add(time.Duration(cal.MaxOn))
+		}
+		w.reason = fmt.Sprintf("booking at %s", b.Start.In(loc).Format("Mon 15:04"))
+		if b.Summary != "" {
+			w.reason = fmt.Sprintf("%s at %s", b.Summary, b.Start.In(loc).Format("Mon 15:04"))
+		}
+		windows = append(windows, w)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].on.Before(windows[j].on) })
+
+	merged := []window{}
+	for _, w := range windows {
+		if n := len(merged); n > 0 && !w.on.After(merged[n-1].off) {
+			if w.off.After(merged[n-1].off) {
+				merged[n-1].off = w.off
+			}
+			continue
+		}
+		merged = append(merged, w)
+	}
+
+	actions := []heaterstore.Action{}
+	for _, w := range merged {
+		if w.on.After(now) {
+			actions = append(actions, heaterstore.Action{At: w.on, Value: "on", CreatedBy: cal.AddedBy, Reason: w.reason})
+		}
+		if w.off.After(now) {
+			actions = append(actions, heaterstore.Action{At: w.off, Value: "off", CreatedBy: cal.AddedBy, Reason: w.reason})
+		}
+	}
+	return actions
+}
+
+// read returns the calendar's feed, fetching it if it has a URL.
+func (s *Syncer) read(ref heaterstore.HeaterRef, cal heaterstore.Calendar) ([]byte, error) {
+	if cal.URL == "" {
+		return s.store.CalendarFile(ref.Owner, ref.Heater)
+	}
+	url := cal.URL
+	if strings.HasPrefix(url, "webcal://") {
+		url = "https://" + strings.TrimPrefix(url, "webcal://")
+	}
+	resp, err := s.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching calendar: %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxFeedSize))
+}
+
+// location returns the time zone for times in the feed that don't have one:
+// the heater's site's, if known.
+func (s *Syncer) location(config heaterstore.HeaterConfig) *time.Location {
+	if config.Site != nil {
+		return config.Site.Location()
+	}
+	return s.userLocation(config.Calendar.AddedBy)
+}
+
+func (s *Syncer) userLocation(username string) *time.Location {
+	profile, err := s.store.GetProfile(username)
+	if err != nil {
+		return time.Local
+	}
+	return profile.Location()
+}
@@ -0,0 +1,337 @@
+// Package client is a Go client for the preheatbot HTTP API. It wraps each
+// endpoint with typed requests and responses, and provides Watch, a long-poll
+// loop that tracks the heater's version and retries with jittered backoff, so
+// that devices don't each need their own.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mhrivnak/preheatbot/pkg/api"
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/usage"
+)
+
+// DefaultURL is the base URL of the public API.
+const DefaultURL = "https://preheatbot.hrivnak.org/api"
+
+const (
+	// DefaultPollTimeout is how long a single long poll may wait before it
+	// is abandoned and a new one started, so that a connection silently
+	// dropped by a proxy doesn't stall a watch forever.
+	DefaultPollTimeout = 5 * time.Minute
+	// DefaultMinBackoff is how long Watch waits after the first failed
+	// poll. The wait doubles after each consecutive failure up to
+	// DefaultMaxBackoff, and each wait is randomized to between half and
+	// all of that.
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = 2 * time.Minute
+
+	// maxErrorBody limits how much of an error response is kept.
+	maxErrorBody = 1 << 10
+)
+
+// Heater identifies a heater by the user or group that owns it.
+type Heater struct {
+	// Exactly one of User and Group is set.
+	User  string
+	Group string
+	Name  string
+}
+
+// UserHeater returns the heater that belongs to the user.
+func UserHeater(username, heater string) Heater {
+	return Heater{User: username, Name: heater}
+}
+
+// GroupHeater returns the heater that belongs to the group.
+func GroupHeater(group, heater string) Heater {
+	return Heater{Group: group, Name: heater}
+}
+
+func (h Heater) path() string {
+	if h.Group != "" {
+		return fmt.Sprintf("/v1/groups/%s/heaters/%s", url.PathEscape(h.Group), url.PathEscape(h.Name))
+	}
+	return fmt.Sprintf("/v1/users/%s/heaters/%s", url.PathEscape(h.User), url.PathEscape(h.Name))
+}
+
+func (h Heater) String() string {
+	if h.Group != "" {
+		return h.Group + "/" + h.Name
+	}
+	return h.User + "/" + h.Name
+}
+
+// Error is a response with a status other than success.
+type Error struct {
+	StatusCode int
+	// Message is the body of the response, which is usually a short
+	// description of the problem.
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound returns true if err is a response saying that the heater or
+// other resource does not exist.
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+// IsUnauthorized returns true if err is a response saying that a token was
+// missing or wrong.
+func IsUnauthorized(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusUnauthorized
+}
+
+// Client makes requests to the API. The zero value of each field other than
+// BaseURL means its default.
+type Client struct {
+	// BaseURL is the address of the API, such as DefaultURL.
+	BaseURL    string
+	HTTPClient *http.Client
+	// DeviceToken authenticates telemetry uploads. It is the token the bot
+	// gives out with /devicetoken.
+	DeviceToken string
+	// FeedToken authenticates requests for a user's calendar feed and
+	// usage. It is the token in the links the bot gives out with /feed.
+	FeedToken string
+
+	PollTimeout time.Duration
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+// New returns a Client for the API at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Get returns the heater's current record.
+func (c *Client) Get(ctx context.Context, h Heater) (heaterstore.Record, error) {
+	record := heaterstore.Record{}
+	err := c.getJSON(ctx, h.path(), nil, &record)
+	return record, err
+}
+
+// Poll waits for the heater's version to differ from version and returns the
+// new record. If it already differs, Poll returns right away. It gives up
+// when ctx is done.
+func (c *Client) Poll(ctx context.Context, h Heater, version int) (heaterstore.Record, error) {
+	record := heaterstore.Record{}
+	query := url.Values{"longpoll": {"true"}, "version": {strconv.Itoa(version)}}
+	err := c.getJSON(ctx, h.path(), query, &record)
+	return record, err
+}
+
+// Watch calls changed with the heater's record now and then each time it
+// changes, until ctx is done or the heater doesn't exist. Failed polls are
+// retried with backoff. Watch returns ctx.Err() when ctx is done.
+func (c *Client) Watch(ctx context.Context, h Heater, changed func(heaterstore.Record)) error {
+	// no record has a negative version, so the first poll returns at once
+	version := -1
+	failures := 0
+	for {
+		pollCtx, cancel := context.WithTimeout(ctx, c.pollTimeout())
+		record, err := c.Poll(pollCtx, h, version)
+		timedOut := pollCtx.Err() == context.DeadlineExceeded
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		switch {
+		case err == nil:
+			failures = 0
+			if record.Version != version {
+				version = record.Version
+				changed(record)
+			}
+			continue
+		case timedOut:
+			// an idle long poll, not a failure
+			continue
+		case IsNotFound(err):
+			return err
+		}
+
+		failures++
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.backoff(failures)):
+		}
+	}
+}
+
+// backoff returns how long to wait after the given number of consecutive
+// failures.
+func (c *Client) backoff(failures int) time.Duration {
+	min, max := c.MinBackoff, c.MaxBackoff
+	if min <= 0 {
+		min = DefaultMinBackoff
+	}
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+	d := min
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (c *Client) pollTimeout() time.Duration {
+	if c.PollTimeout > 0 {
+		return c.PollTimeout
+	}
+	return DefaultPollTimeout
+}
+
+// PostTelemetry uploads samples from the heater's device. It needs
+// DeviceToken.
+func (c *Client) PostTelemetry(ctx context.Context, h Heater, batch api.TelemetryBatch) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := c.request(ctx, http.MethodPost, h.path()+"/telemetry", nil, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.DeviceToken)
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// PreheatStats returns what has been learned about how long the heater takes
+// to warm its engine.
+func (c *Client) PreheatStats(ctx context.Context, h Heater) (api.PreheatStats, error) {
+	stats := api.PreheatStats{}
+	err := c.getJSON(ctx, h.path()+"/preheat", nil, &stats)
+	return stats, err
+}
+
+// CalendarFeed returns the user's iCalendar feed. It needs FeedToken.
+func (c *Client) CalendarFeed(ctx context.Context, username string) ([]byte, error) {
+	return c.getBytes(ctx, "/v1/users/"+url.PathEscape(username)+"/calendar.ics", url.Values{"token": {c.FeedToken}})
+}
+
+// Usage returns the user's energy usage in a month, such as "2021-01", or the
+// current month if it is empty. It needs FeedToken.
+func (c *Client) Usage(ctx context.Context, username, month string) (usage.Report, error) {
+	report := usage.Report{}
+	err := c.getJSON(ctx, "/v1/users/"+url.PathEscape(username)+"/usage", usageQuery(c.FeedToken, month, ""), &report)
+	return report, err
+}
+
+// UsageCSV is like Usage but returns the report as CSV.
+func (c *Client) UsageCSV(ctx context.Context, username, month string) ([]byte, error) {
+	return c.getBytes(ctx, "/v1/users/"+url.PathEscape(username)+"/usage", usageQuery(c.FeedToken, month, "csv"))
+}
+
+func usageQuery(token, month, format string) url.Values {
+	query := url.Values{"token": {token}}
+	if month != "" {
+		query.Set("month", month)
+	}
+	if format != "" {
+		query.Set("format", format)
+	}
+	return query
+}
+
+// RunShortcut runs the shortcut at the link the bot made for it, which
+// carries its own signature, and returns the description of what it did.
+func (c *Client) RunShortcut(ctx context.Context, link string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, link, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	return string(data), err
+}
+
+func (c *Client) request(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return http.NewRequestWithContext(ctx, method, u, body)
+}
+
+// do sends the request and returns an *Error for any status but success.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return nil, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+	}
+	return resp, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	req, err := c.request(ctx, http.MethodGet, path, query, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *Client) getBytes(ctx context.Context, path string, query url.Values) ([]byte, error) {
+	req, err := c.request(ctx, http.MethodGet, path, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
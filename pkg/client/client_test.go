@@ -0,0 +1,421 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mhrivnak/preheatbot/pkg/api"
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/shortcut"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+)
+
+// fakeBot stands in for the bot: it hands records to long polls and sets
+// heaters for shortcuts.
+type fakeBot struct {
+	store *heaterstore.Store
+
+	lock  sync.Mutex
+	chans map[string][]chan heaterstore.Record
+}
+
+func (f *fakeBot) Subscribe(ctx context.Context, username, heater string) <-chan heaterstore.Record {
+	c := make(chan heaterstore.Record, 1)
+	f.lock.Lock()
+	f.chans[username+"/"+heater] = append(f.chans[username+"/"+heater], c)
+	f.lock.Unlock()
+	go func() {
+		<-ctx.Done()
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		chans := f.chans[username+"/"+heater]
+		for i := range chans {
+			if chans[i] == c {
+				f.chans[username+"/"+heater] = append(chans[:i], chans[i+1:]...)
+				close(c)
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (f *fakeBot) SetHeater(ref heaterstore.HeaterRef, value, by string) (heaterstore.Record, error) {
+	r, err := f.store.Set(ref.Owner, ref.Heater, value, by)
+	if err != nil {
+		return r, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, c := range f.chans[ref.Owner+"/"+ref.Heater] {
+		c <- r
+	}
+	delete(f.chans, ref.Owner+"/"+ref.Heater)
+	return r, nil
+}
+
+func (f *fakeBot) Notify(username, message string, options ...interface{}) {}
+
+// subscribers returns how many long polls are waiting on the heater.
+func (f *fakeBot) subscribers(owner, heater string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.chans[owner+"/"+heater])
+}
+
+type fixture struct {
+	store     *heaterstore.Store
+	telemetry *telemetry.Store
+	bot       *fakeBot
+	server    *httptest.Server
+	client    *Client
+}
+
+// newFixture serves the real API from a temporary store in which alice has a
+// heater named plane, and the group club has one named hangar.
+func newFixture(t *testing.T, wrap func(http.Handler) http.Handler) *fixture {
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for _, path := range []string{"alice/plane", heaterstore.GroupNamespace("club") + "/hangar"} {
+		err = os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, path), []byte(`{"value":"off","version":1}`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := &fixture{
+		store:     &heaterstore.Store{Dir: dir},
+		telemetry: &telemetry.Store{Dir: filepath.Join(dir, telemetry.Dirname)},
+	}
+	f.bot = &fakeBot{store: f.store, chans: make(map[string][]chan heaterstore.Record)}
+	var handler http.Handler = api.New(f.bot, f.bot, f.store, f.telemetry, nil, "").Handler
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+	f.server = httptest.NewServer(handler)
+	t.Cleanup(f.server.Close)
+	f.client = New(f.server.URL)
+	return f
+}
+
+func TestGet(t *testing.T) {
+	f := newFixture(t, nil)
+	ctx := context.Background()
+
+	record, err := f.client.Get(ctx, UserHeater("alice", "plane"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Value != "off" || record.Version != 1 {
+		t.Errorf("got %+v", record)
+	}
+
+	record, err = f.client.Get(ctx, GroupHeater("club", "hangar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Value != "off" || record.Version != 1 {
+		t.Errorf("got %+v", record)
+	}
+
+	_, err = f.client.Get(ctx, UserHeater("alice", "boat"))
+	if !IsNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	f := newFixture(t, nil)
+	ctx := context.Background()
+	heater := UserHeater("alice", "plane")
+
+	// a stale version returns right away
+	record, err := f.client.Poll(ctx, heater, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Version != 1 {
+		t.Errorf("got version %d", record.Version)
+	}
+
+	done := make(chan heaterstore.Record)
+	go func() {
+		record, err := f.client.Poll(ctx, heater, 1)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- record
+	}()
+	waitFor(t, func() bool { return f.bot.subscribers("alice", "plane") == 1 })
+	_, err = f.bot.SetHeater(heaterstore.HeaterRef{Owner: "alice", Heater: "plane"}, "on", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record = <-done
+	if record.Value != "on" || record.Version != 2 {
+		t.Errorf("got %+v", record)
+	}
+
+	// giving up on a poll cancels it on the server
+	pollCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = f.client.Poll(pollCtx, heater, 2)
+	if err == nil {
+		t.Error("expected the poll to time out")
+	}
+	waitFor(t, func() bool { return f.bot.subscribers("alice", "plane") == 0 })
+}
+
+func TestWatch(t *testing.T) {
+	f := newFixture(t, nil)
+	f.client.PollTimeout = 100 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	records := make(chan heaterstore.Record, 10)
+	done := make(chan error)
+	go func() {
+		done <- f.client.Watch(ctx, GroupHeater("club", "hangar"), func(r heaterstore.Record) {
+			records <- r
+		})
+	}()
+
+	r := <-records
+	if r.Value != "off" || r.Version != 1 {
+		t.Errorf("got %+v first", r)
+	}
+	// let at least one poll time out and be restarted
+	time.Sleep(250 * time.Millisecond)
+	waitFor(t, func() bool { return f.bot.subscribers(heaterstore.GroupNamespace("club"), "hangar") == 1 })
+	_, err := f.bot.SetHeater(heaterstore.HeaterRef{Owner: heaterstore.GroupNamespace("club"), Heater: "hangar"}, "on", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = <-records
+	if r.Value != "on" || r.Version != 2 {
+		t.Errorf("got %+v second", r)
+	}
+	select {
+	case r = <-records:
+		t.Errorf("got %+v after the idle polls, which should not be reported", r)
+	default:
+	}
+
+	cancel()
+	err = <-done
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestWatchRetries(t *testing.T) {
+	var requests int32
+	f := newFixture(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// fail the first three requests like an overloaded proxy would
+			if atomic.AddInt32(&requests, 1) <= 3 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	f.client.MinBackoff = 10 * time.Millisecond
+	f.client.MaxBackoff = 20 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	records := make(chan heaterstore.Record, 1)
+	go f.client.Watch(ctx, UserHeater("alice", "plane"), func(r heaterstore.Record) {
+		records <- r
+	})
+	select {
+	case r := <-records:
+		if r.Version != 1 {
+			t.Errorf("got %+v", r)
+		}
+	case <-ctx.Done():
+		t.Fatal("watch did not recover from failed polls")
+	}
+	waitFor(t, func() bool { return f.bot.subscribers("alice", "plane") == 1 })
+	if n := atomic.LoadInt32(&requests); n != 5 {
+		t.Errorf("expected 3 failed polls, then one that succeeded and one that waits; got %d requests", n)
+	}
+}
+
+func TestWatchNotFound(t *testing.T) {
+	f := newFixture(t, nil)
+	err := f.client.Watch(context.Background(), UserHeater("alice", "boat"), func(heaterstore.Record) {
+		t.Error("no record expected")
+	})
+	if !IsNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	c := &Client{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	for failures, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 50: 10 * time.Second} {
+		for i := 0; i < 20; i++ {
+			d := c.backoff(failures)
+			if d < max/2 || d > max {
+				t.Errorf("backoff after %d failures is %s, not between %s and %s", failures, d, max/2, max)
+			}
+		}
+	}
+}
+
+func TestPostTelemetry(t *testing.T) {
+	f := newFixture(t, nil)
+	ctx := context.Background()
+	heater := UserHeater("alice", "plane")
+	err := f.store.SetConfig("alice", "plane", heaterstore.HeaterConfig{DeviceToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Now().Add(-time.Minute).Truncate(time.Second).UTC()
+	batch := api.TelemetryBatch{Metrics: map[string][]telemetry.Sample{
+		"engine_temp": {{Time: at, Value: -3.5}},
+	}}
+
+	f.client.DeviceToken = "wrong"
+	err = f.client.PostTelemetry(ctx, heater, batch)
+	if !IsUnauthorized(err) {
+		t.Errorf("expected unauthorized, got %v", err)
+	}
+
+	f.client.DeviceToken = "secret"
+	err = f.client.PostTelemetry(ctx, heater, batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample, ok, err := f.telemetry.Latest("alice", "plane", "engine_temp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !sample.Time.Equal(at) || sample.Value != -3.5 {
+		t.Errorf("got %+v", sample)
+	}
+}
+
+func TestPreheatStats(t *testing.T) {
+	f := newFixture(t, nil)
+	stats, err := f.client.PreheatStats(context.Background(), UserHeater("alice", "plane"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Observations == nil || len(stats.Observations) != 0 || stats.UsedForPlanning {
+		t.Errorf("expected no observations, got %+v", stats)
+	}
+	if stats.Target == 0 {
+		t.Error("expected a target temperature")
+	}
+}
+
+func TestFeeds(t *testing.T) {
+	f := newFixture(t, nil)
+	ctx := context.Background()
+	err := f.store.SetProfile("alice", heaterstore.Profile{FeedToken: "feed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.client.CalendarFeed(ctx, "alice")
+	if !IsUnauthorized(err) {
+		t.Errorf("expected unauthorized, got %v", err)
+	}
+	_, err = f.client.Usage(ctx, "alice", "")
+	if !IsUnauthorized(err) {
+		t.Errorf("expected unauthorized, got %v", err)
+	}
+
+	f.client.FeedToken = "feed"
+	feed, err := f.client.CalendarFeed(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(feed), "BEGIN:VCALENDAR") {
+		t.Errorf("got feed %q", feed)
+	}
+
+	report, err := f.client.Usage(ctx, "alice", "2021-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Heaters) != 1 || report.Heaters[0].Heater != "plane" || report.From.Month() != time.January {
+		t.Errorf("got %+v", report)
+	}
+
+	csv, err := f.client.UsageCSV(ctx, "alice", "2021-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(csv), "month,owner,heater,user,") {
+		t.Errorf("got csv %q", csv)
+	}
+
+	_, err = f.client.Usage(ctx, "alice", "not a month")
+	var e *Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad request, got %v", err)
+	}
+}
+
+func TestRunShortcut(t *testing.T) {
+	f := newFixture(t, nil)
+	ctx := context.Background()
+	s, err := f.store.AddShortcut("alice", heaterstore.Shortcut{Owner: "alice", Heater: "plane", Value: "on"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := f.client.RunShortcut(ctx, shortcut.URL(f.server.URL, "alice", s, time.Time{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message != "I set plane to on." {
+		t.Errorf("got message %q", message)
+	}
+	record, err := f.client.Get(ctx, UserHeater("alice", "plane"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Value != "on" {
+		t.Errorf("got %+v", record)
+	}
+
+	_, err = f.client.RunShortcut(ctx, shortcut.URL(f.server.URL, "alice", s, time.Now().Add(-time.Minute)))
+	var e *Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusForbidden {
+		t.Errorf("expected forbidden for an expired link, got %v", err)
+	}
+}
+
+// waitFor waits up to a second for cond to be true.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
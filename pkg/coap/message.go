@@ -0,0 +1,244 @@
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Message types.
+const (
+	Confirmable     = 0
+	NonConfirmable  = 1
+	Acknowledgement = 2
+	Reset           = 3
+)
+
+// Code is a method or response code, written class.detail, such as 2.05.
+type Code byte
+
+func code(class, detail byte) Code {
+	return Code(class<<5 | detail)
+}
+
+func (c Code) String() string {
+	return fmt.Sprintf("%d.%02d", c>>5, c&0x1f)
+}
+
+// Methods and response codes used by the server.
+var (
+	Empty = code(0, 0)
+	GET   = code(0, 1)
+	POST  = code(0, 2)
+
+	Changed          = code(2, 4)
+	Content          = code(2, 5)
+	BadRequest       = code(4, 0)
+	Unauthorized     = code(4, 1)
+	NotFound         = code(4, 4)
+	MethodNotAllowed = code(4, 5)
+	InternalError    = code(5, 0)
+)
+
+// Option numbers.
+const (
+	OptionObserve       = 6
+	OptionURIPath       = 11
+	OptionContentFormat = 12
+	OptionURIQuery      = 15
+)
+
+// Content formats.
+const (
+	FormatText = 0
+	FormatJSON = 50
+)
+
+// Option is a single option of a message. Options that repeat, such as the
+// parts of a path, appear once for each value.
+type Option struct {
+	Number uint16
+	Value  []byte
+}
+
+// Message is a CoAP message as described by RFC 7252.
+type Message struct {
+	Type      byte
+	Code      Code
+	MessageID uint16
+	Token     []byte
+	Options   []Option
+	Payload   []byte
+}
+
+// Parse decodes a datagram.
+func Parse(data []byte) (Message, error) {
+	m := Message{}
+	if len(data) < 4 {
+		return m, errors.New("message too short")
+	}
+	if data[0]>>6 != 1 {
+		return m, errors.New("unsupported version")
+	}
+	m.Type = (data[0] >> 4) & 0x03
+	tkl := int(data[0] & 0x0f)
+	if tkl > 8 {
+		return m, errors.New("invalid token length")
+	}
+	m.Code = Code(data[1])
+	m.MessageID = binary.BigEndian.Uint16(data[2:4])
+	data = data[4:]
+	if len(data) < tkl {
+		return m, errors.New("message too short")
+	}
+	m.Token = append([]byte(nil), data[:tkl]...)
+	data = data[tkl:]
+
+	number := 0
+	for len(data) > 0 {
+		if data[0] == 0xff {
+			if len(data) == 1 {
+				return m, errors.New("payload marker without payload")
+			}
+			m.Payload = append([]byte(nil), data[1:]...)
+			break
+		}
+		delta, length := int(data[0]>>4), int(data[0]&0x0f)
+		data = data[1:]
+		var err error
+		delta, data, err = extended(delta, data)
+		if err != nil {
+			return m, err
+		}
+		length, data, err = extended(length, data)
+		if err != nil {
+			return m, err
+		}
+		if len(data) < length {
+			return m, errors.New("option too long")
+		}
+		number += delta
+		if number > 0xffff {
+			return m, errors.New("invalid option number")
+		}
+		m.Options = append(m.Options, Option{Number: uint16(number), Value: append([]byte(nil), data[:length]...)})
+		data = data[length:]
+	}
+	return m, nil
+}
+
+// extended decodes the extended form of an option delta or length.
+func extended(n int, data []byte) (int, []byte, error) {
+	switch n {
+	case 13:
+		if len(data) < 1 {
+			return 0, nil, errors.New("message too short")
+		}
+		return int(data[0]) + 13, data[1:], nil
+	case 14:
+		if len(data) < 2 {
+			return 0, nil, errors.New("message too short")
+		}
+		return int(binary.BigEndian.Uint16(data)) + 269, data[2:], nil
+	case 15:
+		return 0, nil, errors.New("invalid option")
+	}
+	return n, data, nil
+}
+
+// Encode returns the message as sent on the wire.
+func (m Message) Encode() []byte {
+	out := []byte{1<<6 | (m.Type&0x03)<<4 | byte(len(m.Token)), byte(m.Code), 0, 0}
+	binary.BigEndian.PutUint16(out[2:], m.MessageID)
+	out = append(out, m.Token...)
+
+	options := append([]Option(nil), m.Options...)
+	sort.SliceStable(options, func(i, j int) bool { return options[i].Number < options[j].Number })
+	number := 0
+	for _, o := range options {
+		delta, dext := nibble(int(o.Number) - number)
+		length, lext := nibble(len(o.Value))
+		out = append(out, delta<<4|length)
+		out = append(out, dext...)
+		out = append(out, lext...)
+		out = append(out, o.Value...)
+		number = int(o.Number)
+	}
+	if len(m.Payload) > 0 {
+		out = append(out, 0xff)
+		out = append(out, m.Payload...)
+	}
+	return out
+}
+
+// nibble returns the 4-bit form of an option delta or length and any
+// extended bytes that follow it.
+func nibble(n int) (byte, []byte) {
+	switch {
+	case n < 13:
+		return byte(n), nil
+	case n < 269:
+		return 13, []byte{byte(n - 13)}
+	}
+	ext := make([]byte, 2)
+	binary.BigEndian.PutUint16(ext, uint16(n-269))
+	return 14, ext
+}
+
+// Option returns the first value of the option, if present.
+func (m Message) Option(number uint16) ([]byte, bool) {
+	for _, o := range m.Options {
+		if o.Number == number {
+			return o.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Path returns the Uri-Path options joined into a path with a leading slash.
+func (m Message) Path() string {
+	parts := []string{}
+	for _, o := range m.Options {
+		if o.Number == OptionURIPath {
+			parts = append(parts, string(o.Value))
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// Query returns the value of the Uri-Query option named key, such as "ts"
+// for "ts=1609459200".
+func (m Message) Query(key string) string {
+	for _, o := range m.Options {
+		if o.Number == OptionURIQuery && strings.HasPrefix(string(o.Value), key+"=") {
+			return strings.TrimPrefix(string(o.Value), key+"=")
+		}
+	}
+	return ""
+}
+
+// AddOption appends an option.
+func (m *Message) AddOption(number uint16, value []byte) {
+	m.Options = append(m.Options, Option{Number: number, Value: value})
+}
+
+// AddUint appends an option whose value is an unsigned integer, encoded in
+// as few bytes as possible.
+func (m *Message) AddUint(number uint16, n uint32) {
+	value := []byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	for len(value) > 0 && value[0] == 0 {
+		value = value[1:]
+	}
+	m.AddOption(number, value)
+}
+
+// Uint decodes an option value that is an unsigned integer.
+func Uint(value []byte) uint32 {
+	var n uint32
+	for _, b := range value {
+		n = n<<8 | uint32(b)
+	}
+	return n
+}
@@ -0,0 +1,115 @@
+package coap
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	m := Message{
+		Type:      Confirmable,
+		Code:      POST,
+		MessageID: 0x1234,
+		Token:     []byte{1, 2, 3, 4},
+		Payload:   []byte(`{"metrics":{}}`),
+	}
+	m.AddOption(OptionURIPath, []byte("v1"))
+	m.AddOption(OptionURIPath, []byte("users"))
+	m.AddOption(OptionURIQuery, []byte("ts=1609259381"))
+	m.AddUint(OptionObserve, 0)
+	m.AddUint(OptionContentFormat, FormatJSON)
+
+	parsed, err := Parse(m.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// options come back in order of their numbers
+	expected := m
+	expected.Options = []Option{
+		{OptionObserve, nil},
+		{OptionURIPath, []byte("v1")},
+		{OptionURIPath, []byte("users")},
+		{OptionContentFormat, []byte{FormatJSON}},
+		{OptionURIQuery, []byte("ts=1609259381")},
+	}
+	if !reflect.DeepEqual(parsed, expected) {
+		t.Errorf("got  %+v\nwant %+v", parsed, expected)
+	}
+	if parsed.Path() != "/v1/users" || parsed.Query("ts") != "1609259381" {
+		t.Errorf("got path %q and ts %q", parsed.Path(), parsed.Query("ts"))
+	}
+}
+
+func TestEncode(t *testing.T) {
+	m := Message{Type: Acknowledgement, Code: Content, MessageID: 0xbeef, Token: []byte{0xaa}}
+	m.AddUint(OptionContentFormat, FormatText)
+	expected := []byte{0x61, 0x45, 0xbe, 0xef, 0xaa, 0xc0}
+	if got := m.Encode(); !bytes.Equal(got, expected) {
+		t.Errorf("got % x, want % x", got, expected)
+	}
+}
+
+func TestExtendedOptions(t *testing.T) {
+	for _, tc := range []struct {
+		number uint16
+		length int
+		header []byte
+	}{
+		// delta and length of 13 to 268 take one extra byte
+		{13, 13, []byte{0xdd, 0x00, 0x00}},
+		{268, 268, []byte{0xdd, 0xff, 0xff}},
+		// and from 269 on, two
+		{269, 269, []byte{0xee, 0x00, 0x00, 0x00, 0x00}},
+		{2048, 1000, []byte{0xee, 0x06, 0xf3, 0x02, 0xdb}},
+	} {
+		value := bytes.Repeat([]byte{'x'}, tc.length)
+		m := Message{Type: NonConfirmable, Code: GET, MessageID: 1}
+		m.AddOption(tc.number, value)
+		data := m.Encode()
+		if header := data[4 : 4+len(tc.header)]; !bytes.Equal(header, tc.header) {
+			t.Errorf("option %d of %d bytes: got header % x, want % x", tc.number, tc.length, header, tc.header)
+		}
+		parsed, err := Parse(data)
+		if err != nil {
+			t.Errorf("option %d of %d bytes: %s", tc.number, tc.length, err.Error())
+			continue
+		}
+		if len(parsed.Options) != 1 || parsed.Options[0].Number != tc.number || !bytes.Equal(parsed.Options[0].Value, value) {
+			t.Errorf("option %d of %d bytes: got %+v", tc.number, tc.length, parsed.Options)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"too short":           {0x40, 0x01, 0x00},
+		"wrong version":       {0x80, 0x01, 0x00, 0x01},
+		"token length over 8": {0x49, 0x01, 0x00, 0x01, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		"truncated token":     {0x44, 0x01, 0x00, 0x01, 1, 2},
+		"delta of 15":         {0x40, 0x01, 0x00, 0x01, 0xf0},
+		"length of 15":        {0x40, 0x01, 0x00, 0x01, 0x0f},
+		"truncated delta":     {0x40, 0x01, 0x00, 0x01, 0xd0},
+		"truncated length":    {0x40, 0x01, 0x00, 0x01, 0x0e, 0x01},
+		"truncated value":     {0x40, 0x01, 0x00, 0x01, 0xb3, 'v', '1'},
+		"marker alone":        {0x40, 0x01, 0x00, 0x01, 0xff},
+		"option number":       {0x40, 0x01, 0x00, 0x01, 0xe0, 0xff, 0xff, 0xe0, 0xff, 0xff},
+	} {
+		if _, err := Parse(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParsePayload(t *testing.T) {
+	m, err := Parse([]byte{0x50, 0x02, 0x00, 0x01, 0xb2, 'v', '1', 0xff, 'h', 'i'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != NonConfirmable || m.Code != POST || m.Path() != "/v1" || string(m.Payload) != "hi" {
+		t.Errorf("got %+v", m)
+	}
+	if len(m.Token) != 0 {
+		t.Errorf("got token % x", m.Token)
+	}
+}
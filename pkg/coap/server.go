@@ -0,0 +1,445 @@
+// Package coap serves heaters over CoAP (RFC 7252) for devices too small to
+// long-poll the HTTP API. It exposes the same resources as pkg/api under the
+// same paths, and pushes changes to heaters using Observe (RFC 7641), with the
+// Observe sequence number taken from the record's version.
+//
+// There is no DTLS in the standard library, so instead each request is
+// authenticated with the heater's device token as a pre-shared key: the
+// device adds the Unix time and an HMAC of the request, keyed with the token,
+// as the "ts" and "sig" query options. The token itself is never sent.
+// Responses are not encrypted.
+package coap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mhrivnak/preheatbot/pkg/api"
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/preheat"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+)
+
+const (
+	// MaxSkew is how far the "ts" of a request may be from the server's
+	// clock.
+	MaxSkew = 5 * time.Minute
+	// ObserveLifetime is how long an observation lasts unless the device
+	// registers again, which renews it.
+	ObserveLifetime = 24 * time.Hour
+	// ExchangeLifetime is how long a response is kept to answer a
+	// retransmitted confirmable request without handling it again.
+	ExchangeLifetime = 247 * time.Second
+
+	maxDatagram = 65507
+)
+
+// Server serves heaters over UDP.
+type Server struct {
+	addr      string
+	store     *heaterstore.Store
+	telemetry *telemetry.Store
+	planner   *preheat.Planner
+
+	conn net.PacketConn
+
+	lock      sync.Mutex
+	messageID uint16
+	// observers are keyed by the device's address and the heater, so that
+	// a device that registers again replaces its earlier observation.
+	observers map[string]*observer
+	// responses are keyed by the device's address and the message ID of the
+	// request they answer.
+	responses map[string]response
+	// signatures holds, until they are too old to be accepted anyway, the
+	// signatures of POST requests that have been handled, keyed by the
+	// heater and the signature, so that they can't be replayed.
+	signatures map[string]time.Time
+	lastSweep  time.Time
+}
+
+type observer struct {
+	addr       net.Addr
+	token      []byte
+	ref        heaterstore.HeaterRef
+	registered time.Time
+	// messageID is that of the last notification, which the device
+	// rejects with a Reset once it no longer wants them.
+	messageID uint16
+}
+
+type response struct {
+	data []byte
+	at   time.Time
+}
+
+func New(store *heaterstore.Store, telemetry *telemetry.Store, addr string) *Server {
+	return &Server{
+		addr:       addr,
+		store:      store,
+		telemetry:  telemetry,
+		planner:    preheat.NewPlanner(store, telemetry),
+		observers:  make(map[string]*observer),
+		responses:  make(map[string]response),
+		signatures: make(map[string]time.Time),
+		messageID:  uint16(time.Now().UnixNano()),
+	}
+}
+
+// Sign returns the signature of a request for the path, such as
+// "/v1/users/alice/heaters/plane", made at the Unix time ts, keyed with the
+// heater's device token. It is the hex encoded HMAC-SHA256 of the method
+// code, the path and ts separated by spaces, a newline, and the payload.
+func Sign(token string, method Code, path string, ts int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	fmt.Fprintf(mac, "%s %s %d\n", method, path, ts)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ListenAndServe handles requests until the connection fails.
+func (s *Server) ListenAndServe() error {
+	log.Infof("Starting CoAP server on %s", s.addr)
+	conn, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.conn = conn
+	s.lock.Unlock()
+	defer conn.Close()
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		m, err := Parse(buf[:n])
+		if err != nil {
+			log.Debugf("ignoring invalid coap message from %s: %s", addr, err.Error())
+			continue
+		}
+		s.receive(addr, m, time.Now())
+	}
+}
+
+func (s *Server) receive(addr net.Addr, m Message, now time.Time) {
+	switch {
+	case m.Type == Reset:
+		s.forget(addr, m.MessageID)
+		return
+	case m.Type == Acknowledgement:
+		return
+	case m.Code == Empty:
+		// a ping
+		if m.Type == Confirmable {
+			s.send(addr, Message{Type: Reset, MessageID: m.MessageID})
+		}
+		return
+	case m.Code>>5 != 0:
+		// only requests are expected
+		return
+	}
+
+	key := fmt.Sprintf("%s %d", addr, m.MessageID)
+	if m.Type == Confirmable {
+		s.lock.Lock()
+		s.sweep(now)
+		cached, ok := s.responses[key]
+		s.lock.Unlock()
+		if ok {
+			s.write(addr, cached.data)
+			return
+		}
+	}
+
+	resp := s.handle(addr, m, now)
+	resp.Token = m.Token
+	if m.Type == Confirmable {
+		resp.Type = Acknowledgement
+		resp.MessageID = m.MessageID
+	} else {
+		resp.Type = NonConfirmable
+		resp.MessageID = s.nextMessageID()
+	}
+	data := resp.Encode()
+	if m.Type == Confirmable {
+		s.lock.Lock()
+		s.responses[key] = response{data: data, at: now}
+		s.lock.Unlock()
+	}
+	s.write(addr, data)
+}
+
+// sweep drops cached responses, observations and signatures that are too old
+// to be needed. The caller must hold the lock.
+func (s *Server) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, r := range s.responses {
+		if now.Sub(r.at) > ExchangeLifetime {
+			delete(s.responses, key)
+		}
+	}
+	for key, o := range s.observers {
+		if now.Sub(o.registered) > ObserveLifetime {
+			delete(s.observers, key)
+		}
+	}
+	for key, expires := range s.signatures {
+		if now.After(expires) {
+			delete(s.signatures, key)
+		}
+	}
+}
+
+// handle returns the response to a request, without its type, message ID or
+// token.
+func (s *Server) handle(addr net.Addr, m Message, now time.Time) Message {
+	path := m.Path()
+	ref, resource, ok := route(path)
+	if !ok {
+		return textResponse(NotFound, "no such resource")
+	}
+	// authenticate first, so that the response doesn't reveal which
+	// heaters exist
+	if !s.authorize(m, ref, path, now) {
+		return textResponse(Unauthorized, "invalid signature")
+	}
+	if m.Code == POST && !s.firstUse(ref, m, now) {
+		return textResponse(Unauthorized, "replayed request")
+	}
+	record, err := s.store.Get(ref.Owner, ref.Heater)
+	if err != nil {
+		if s.store.IsNotExist(err) {
+			return textResponse(NotFound, "no such heater")
+		}
+		log.WithError(err).Error("error reading current value")
+		return textResponse(InternalError, "error reading current value")
+	}
+
+	switch {
+	case resource == "" && m.Code == GET:
+		return s.serveHeater(addr, m, ref, record, now)
+	case resource == "telemetry" && m.Code == POST:
+		return s.storeTelemetry(m, ref)
+	case resource == "preheat" && m.Code == GET:
+		stats, err := api.NewPreheatStats(s.store, s.planner, ref)
+		if err != nil {
+			log.WithError(err).Error("error reading preheat stats")
+			return textResponse(InternalError, "error reading preheat stats")
+		}
+		return jsonResponse(Content, stats)
+	}
+	return textResponse(MethodNotAllowed, "method not allowed")
+}
+
+// route returns the heater and sub-resource named by a path of the same form
+// as the HTTP API's.
+func route(path string) (heaterstore.HeaterRef, string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) < 5 || len(parts) > 6 || parts[0] != "v1" || parts[3] != "heaters" {
+		return heaterstore.HeaterRef{}, "", false
+	}
+	ref := heaterstore.HeaterRef{Heater: parts[4]}
+	switch parts[1] {
+	case "users":
+		ref.Owner = parts[2]
+	case "groups":
+		ref.Owner = heaterstore.GroupNamespace(parts[2])
+	default:
+		return ref, "", false
+	}
+	if !heaterstore.ValidName(parts[2]) || !heaterstore.ValidName(ref.Heater) {
+		return ref, "", false
+	}
+	if len(parts) == 6 {
+		if parts[5] != "telemetry" && parts[5] != "preheat" {
+			return ref, "", false
+		}
+		return ref, parts[5], true
+	}
+	return ref, "", true
+}
+
+// authorize checks the request's signature against the heater's device
+// token.
+func (s *Server) authorize(m Message, ref heaterstore.HeaterRef, path string, now time.Time) bool {
+	config, err := s.store.GetConfig(ref.Owner, ref.Heater)
+	if err != nil {
+		log.WithError(err).Error("error reading heater config")
+		return false
+	}
+	if config.DeviceToken == "" {
+		return false
+	}
+	ts, err := strconv.ParseInt(m.Query("ts"), 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := now.Sub(time.Unix(ts, 0))
+	if skew > MaxSkew || skew < -MaxSkew {
+		return false
+	}
+	expected := Sign(config.DeviceToken, m.Code, path, ts, m.Payload)
+	return hmac.Equal([]byte(expected), []byte(m.Query("sig")))
+}
+
+// firstUse records the signature of an authorized request, and returns false
+// if it was already used. A signature is only remembered until its "ts" is
+// outside MaxSkew, after which authorize rejects it.
+func (s *Server) firstUse(ref heaterstore.HeaterRef, m Message, now time.Time) bool {
+	ts, err := strconv.ParseInt(m.Query("ts"), 10, 64)
+	if err != nil {
+		return false
+	}
+	key := fmt.Sprintf("%s/%s %s", ref.Owner, ref.Heater, m.Query("sig"))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sweep(now)
+	if _, ok := s.signatures[key]; ok {
+		return false
+	}
+	s.signatures[key] = time.Unix(ts, 0).Add(MaxSkew)
+	return true
+}
+
+// serveHeater responds with the heater's record, and registers or
+// deregisters an observation if asked to.
+func (s *Server) serveHeater(addr net.Addr, m Message, ref heaterstore.HeaterRef, record heaterstore.Record, now time.Time) Message {
+	resp := jsonResponse(Content, record)
+	observe, ok := m.Option(OptionObserve)
+	if !ok {
+		return resp
+	}
+	key := fmt.Sprintf("%s %s/%s", addr, ref.Owner, ref.Heater)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if Uint(observe) == 1 {
+		delete(s.observers, key)
+		return resp
+	}
+	s.observers[key] = &observer{addr: addr, token: m.Token, ref: ref, registered: now}
+	resp.AddUint(OptionObserve, sequence(record))
+	log.Infof("%s is observing %s/%s over coap", addr, ref.Owner, ref.Heater)
+	return resp
+}
+
+func (s *Server) storeTelemetry(m Message, ref heaterstore.HeaterRef) Message {
+	batch := api.TelemetryBatch{}
+	err := json.Unmarshal(m.Payload, &batch)
+	if err != nil {
+		return textResponse(BadRequest, "error parsing telemetry")
+	}
+	err = batch.Validate()
+	if err != nil {
+		return textResponse(BadRequest, err.Error())
+	}
+	for metric, samples := range batch.Metrics {
+		err = s.telemetry.Append(ref.Owner, ref.Heater, metric, samples)
+		if err != nil {
+			log.WithError(err).Errorf("error storing telemetry for %s/%s", ref.Owner, ref.Heater)
+			return textResponse(InternalError, fmt.Sprintf("error storing %s", metric))
+		}
+	}
+	return Message{Code: Changed}
+}
+
+// HeaterChanged notifies the devices observing the heater.
+func (s *Server) HeaterChanged(ref heaterstore.HeaterRef, r heaterstore.Record, by string) {
+	s.lock.Lock()
+	notify := []*observer{}
+	for _, o := range s.observers {
+		if o.ref.Owner == ref.Owner && o.ref.Heater == ref.Heater {
+			o.messageID = s.nextMessageIDLocked()
+			notify = append(notify, o)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, o := range notify {
+		m := jsonResponse(Content, r)
+		m.Type = NonConfirmable
+		m.MessageID = o.messageID
+		m.Token = o.token
+		m.AddUint(OptionObserve, sequence(r))
+		s.send(o.addr, m)
+	}
+}
+
+// forget removes the observation whose notification a device rejected.
+func (s *Server) forget(addr net.Addr, messageID uint16) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, o := range s.observers {
+		if o.addr.String() == addr.String() && o.messageID == messageID {
+			delete(s.observers, key)
+			log.Infof("%s stopped observing %s/%s over coap", addr, o.ref.Owner, o.ref.Heater)
+		}
+	}
+}
+
+func (s *Server) nextMessageID() uint16 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.nextMessageIDLocked()
+}
+
+func (s *Server) nextMessageIDLocked() uint16 {
+	s.messageID++
+	return s.messageID
+}
+
+func (s *Server) send(addr net.Addr, m Message) {
+	s.write(addr, m.Encode())
+}
+
+func (s *Server) write(addr net.Addr, data []byte) {
+	s.lock.Lock()
+	conn := s.conn
+	s.lock.Unlock()
+	if conn == nil {
+		return
+	}
+	_, err := conn.WriteTo(data, addr)
+	if err != nil {
+		log.Errorf("error sending coap message to %s: %s", addr, err.Error())
+	}
+}
+
+// sequence is the Observe option value for a record. It is the record's
+// version, which only increases, truncated to the option's 24 bits.
+func sequence(r heaterstore.Record) uint32 {
+	return uint32(r.Version) & 0xffffff
+}
+
+func jsonResponse(c Code, v interface{}) Message {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.WithError(err).Error("error serializing coap response")
+		return textResponse(InternalError, "error serializing response")
+	}
+	m := Message{Code: c, Payload: data}
+	m.AddUint(OptionContentFormat, FormatJSON)
+	return m
+}
+
+// textResponse returns a response with a diagnostic payload.
+func textResponse(c Code, message string) Message {
+	m := Message{Code: c, Payload: []byte(message)}
+	m.AddUint(OptionContentFormat, FormatText)
+	return m
+}
@@ -0,0 +1,106 @@
+package coap
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+)
+
+func newTestServer(t *testing.T) *Server {
+	dir, err := ioutil.TempDir("", "coap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	err = os.MkdirAll(filepath.Join(dir, "alice"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "alice", "plane"), []byte(`{"value":"off","version":1}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &heaterstore.Store{Dir: dir}
+	err = store.SetConfig("alice", "plane", heaterstore.HeaterConfig{DeviceToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(store, &telemetry.Store{Dir: filepath.Join(dir, telemetry.Dirname)}, "")
+}
+
+// request returns a request signed with token at ts.
+func request(method Code, path, token string, ts time.Time, payload string) Message {
+	m := Message{Type: Confirmable, Code: method, Payload: []byte(payload)}
+	for _, part := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		m.AddOption(OptionURIPath, []byte(part))
+	}
+	m.AddOption(OptionURIQuery, []byte("ts="+strconv.FormatInt(ts.Unix(), 10)))
+	m.AddOption(OptionURIQuery, []byte("sig="+Sign(token, method, path, ts.Unix(), []byte(payload))))
+	return m
+}
+
+func TestAuthentication(t *testing.T) {
+	s := newTestServer(t)
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+	now := time.Now()
+	for _, tc := range []struct {
+		m    Message
+		code Code
+	}{
+		{request(GET, "/v1/users/alice/heaters/plane", "secret", now, ""), Content},
+		{request(GET, "/v1/users/alice/heaters/plane", "wrong", now, ""), Unauthorized},
+		{request(GET, "/v1/users/alice/heaters/plane", "secret", now.Add(-MaxSkew-time.Minute), ""), Unauthorized},
+		// heaters that don't exist look the same as a bad signature
+		{request(GET, "/v1/users/alice/heaters/glider", "secret", now, ""), Unauthorized},
+		{request(GET, "/v1/users/bob/heaters/plane", "secret", now, ""), Unauthorized},
+		{request(GET, "/v1/nothing", "secret", now, ""), NotFound},
+	} {
+		resp := s.handle(addr, tc.m, now)
+		if resp.Code != tc.code {
+			t.Errorf("%s: got %s %q, want %s", tc.m.Path(), resp.Code, resp.Payload, tc.code)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	s := newTestServer(t)
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5683}
+	now := time.Now()
+	path := "/v1/users/alice/heaters/plane/telemetry"
+	payload := `{"metrics":{"engine_temp":[{"time":"2020-12-29T16:29:41Z","value":-3.5}]}}`
+	post := request(POST, path, "secret", now, payload)
+
+	if resp := s.handle(addr, post, now); resp.Code != Changed {
+		t.Fatalf("got %s %q", resp.Code, resp.Payload)
+	}
+	// from anywhere, at any time while the signature would still be valid
+	other := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 5683}
+	for _, at := range []time.Time{now, now.Add(MaxSkew)} {
+		if resp := s.handle(other, post, at); resp.Code != Unauthorized {
+			t.Errorf("replay at %s: got %s %q", at, resp.Code, resp.Payload)
+		}
+	}
+	if resp := s.handle(addr, request(POST, path, "secret", now.Add(time.Second), payload), now); resp.Code != Changed {
+		t.Errorf("a new request: got %s %q", resp.Code, resp.Payload)
+	}
+	samples, err := s.telemetry.Query("alice", "plane", "engine_temp", time.Time{}, now.Add(time.Hour))
+	if err != nil || len(samples) != 2 {
+		t.Errorf("got %v, %v", samples, err)
+	}
+
+	// GETs are safe to repeat
+	get := request(GET, "/v1/users/alice/heaters/plane", "secret", now, "")
+	for i := 0; i < 2; i++ {
+		if resp := s.handle(addr, get, now); resp.Code != Content {
+			t.Errorf("got %s %q", resp.Code, resp.Payload)
+		}
+	}
+}
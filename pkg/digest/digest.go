@@ -0,0 +1,288 @@
+// Package digest sends users who ask for it a weekly summary of their heaters:
+// how often and how long each was on, the energy used, times its device was
+// offline or it seemed to fail, and what is planned for it.
+package digest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+	"github.com/mhrivnak/preheatbot/pkg/thermostat"
+	"github.com/mhrivnak/preheatbot/pkg/usage"
+)
+
+const (
+	// Period is how much time each digest covers, and how far ahead it
+	// looks for planned changes.
+	Period = 7 * 24 * time.Hour
+	// OfflineAfter is how long a device that reports telemetry may go
+	// without reporting before it counts as offline.
+	OfflineAfter = 2 * time.Hour
+
+	interval = 5 * time.Minute
+)
+
+// Notifier sends a message to a user.
+type Notifier interface {
+	Notify(username, message string, options ...interface{})
+}
+
+// Sender sends each user's digest when it is due.
+type Sender struct {
+	store     *heaterstore.Store
+	telemetry *telemetry.Store
+	usage     *usage.Reporter
+	notifier  Notifier
+}
+
+func New(store *heaterstore.Store, telemetry *telemetry.Store, notifier Notifier) *Sender {
+	return &Sender{
+		store:     store,
+		telemetry: telemetry,
+		usage:     usage.New(store),
+		notifier:  notifier,
+	}
+}
+
+// Run sends digests as they come due. It never returns.
+func (s *Sender) Run() {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.RunOnce(now)
+	}
+}
+
+// RunOnce sends every digest that has come due since it was last sent.
+func (s *Sender) RunOnce(now time.Time) {
+	users, err := s.store.Users()
+	if err != nil {
+		log.Errorf("error listing users for digests: %s", err.Error())
+		return
+	}
+	for _, username := range users {
+		err = s.check(username, now)
+		if err != nil {
+			log.Errorf("error sending digest to %s: %s", username, err.Error())
+		}
+	}
+}
+
+func (s *Sender) check(username string, now time.Time) error {
+	profile, err := s.store.GetProfile(username)
+	if err != nil || profile.Digest == nil {
+		return err
+	}
+	due, err := Scheduled(*profile.Digest, now, profile.Location())
+	if err != nil || !due.After(profile.Digest.LastSent) {
+		return err
+	}
+	message, err := s.Message(username, now, profile.Location())
+	if err != nil {
+		return err
+	}
+	s.notifier.Notify(username, message)
+
+	// the profile may have changed while the digest was built
+	return s.store.UpdateProfile(username, func(profile *heaterstore.Profile) {
+		if profile.Digest != nil {
+			profile.Digest.LastSent = now
+		}
+	})
+}
+
+// Scheduled returns the most recent time at or before now at which the digest
+// was due.
+func Scheduled(d heaterstore.Digest, now time.Time, loc *time.Location) (time.Time, error) {
+	clock, err := time.Parse("15:04", d.Time)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a time of day like 18:00", d.Time)
+	}
+	now = now.In(loc)
+	year, month, day := now.Date()
+	at := time.Date(year, month, day, clock.Hour(), clock.Minute(), 0, 0, loc)
+	for at.Weekday() != d.Day || at.After(now) {
+		day--
+		at = time.Date(year, month, day, clock.Hour(), clock.Minute(), 0, 0, loc)
+	}
+	return at, nil
+}
+
+// Summary is what happened to one heater during the period a digest covers,
+// and what is planned for it.
+type Summary struct {
+	Ref heaterstore.HeaterRef
+	// Preheats counts the times someone turned the heater on. Cycles made
+	// by the thermostat are not counted.
+	Preheats  int
+	Usage     usage.HeaterUsage
+	Offline   []heaterstore.Period
+	Anomalies []heaterstore.Anomaly
+	Upcoming  []heaterstore.Action
+}
+
+// Summarize returns a summary of each of the user's heaters for the Period
+// before now.
+func (s *Sender) Summarize(username string, now time.Time, loc *time.Location) ([]Summary, error) {
+	summaries := []Summary{}
+	refs, err := s.store.Heaters(username)
+	if err != nil {
+		return summaries, err
+	}
+	from := now.Add(-Period)
+	schedules := make(map[string][]heaterstore.Action)
+	for _, ref := range refs {
+		summary := Summary{Ref: ref}
+		history, err := s.store.History(ref.Owner, ref.Heater, from)
+		if err != nil {
+			return summaries, err
+		}
+		for _, period := range heaterstore.OnPeriods(history, now) {
+			if period.By != thermostat.User {
+				summary.Preheats++
+			}
+		}
+		summary.Usage, err = s.usage.Heater(ref, from, now, now, loc)
+		if err != nil {
+			return summaries, err
+		}
+		summary.Offline, err = s.offline(ref, from, now)
+		if err != nil {
+			return summaries, err
+		}
+		summary.Anomalies, err = s.store.PastAnomalies(ref.Owner, ref.Heater, from)
+		if err != nil {
+			return summaries, err
+		}
+
+		actions, ok := schedules[ref.Owner]
+		if !ok {
+			actions, err = s.store.Schedule(ref.Owner)
+			if err != nil {
+				return summaries, err
+			}
+			schedules[ref.Owner] = actions
+		}
+		for _, action := range actions {
+			if action.Heater == ref.Heater && action.At.Before(now.Add(Period)) {
+				summary.Upcoming = append(summary.Upcoming, action)
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// offline returns the periods between from and to during which the heater's
+// device reported no telemetry for longer than OfflineAfter. A device that
+// has never reported is not considered offline.
+func (s *Sender) offline(ref heaterstore.HeaterRef, from, to time.Time) ([]heaterstore.Period, error) {
+	gaps := []heaterstore.Period{}
+	metrics, err := s.telemetry.Metrics(ref.Owner, ref.Heater)
+	if err != nil || len(metrics) == 0 {
+		return gaps, err
+	}
+	times := []time.Time{}
+	reportedBefore := false
+	for _, metric := range metrics {
+		samples, err := s.telemetry.Query(ref.Owner, ref.Heater, metric, from.Add(-Period), to)
+		if err != nil {
+			return gaps, err
+		}
+		for _, sample := range samples {
+			if sample.Time.Before(from) {
+				reportedBefore = true
+				continue
+			}
+			times = append(times, sample.Time)
+		}
+	}
+	if len(times) == 0 && !reportedBefore {
+		return gaps, nil
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	last := from
+	if !reportedBefore {
+		// the device started reporting during the period
+		last = times[0]
+	}
+	for _, t := range times {
+		if t.Sub(last) > OfflineAfter {
+			gaps = append(gaps, heaterstore.Period{Start: last, End: t})
+		}
+		last = t
+	}
+	if to.Sub(last) > OfflineAfter {
+		gaps = append(gaps, heaterstore.Period{Start: last, End: to, Ongoing: true})
+	}
+	return gaps, nil
+}
+
+// Message returns the text of the user's digest for the Period before now.
+func (s *Sender) Message(username string, now time.Time, loc *time.Location) (string, error) {
+	summaries, err := s.Summarize(username, now, loc)
+	if err != nil {
+		return "", err
+	}
+	return Format(username, summaries, now, loc), nil
+}
+
+// Format describes the summaries for username, with times in loc.
+func Format(username string, summaries []Summary, now time.Time, loc *time.Location) string {
+	const layout = "Mon Jan 2 15:04"
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Your week from %s to %s:\n", now.Add(-Period).In(loc).Format("Mon Jan 2"), now.In(loc).Format("Mon Jan 2"))
+	if len(summaries) == 0 {
+		sb.WriteString("\nYou don't have any heaters.")
+		return sb.String()
+	}
+	for _, summary := range summaries {
+		fmt.Fprintf(&sb, "\n%s: %s\n", summary.Ref.Name(username), describeUse(summary))
+		for _, gap := range summary.Offline {
+			if gap.Ongoing {
+				fmt.Fprintf(&sb, "  device offline since %s\n", gap.Start.In(loc).Format(layout))
+			} else {
+				fmt.Fprintf(&sb, "  device offline from %s for %s\n", gap.Start.In(loc).Format(layout),
+					gap.End.Sub(gap.Start).Round(time.Minute))
+			}
+		}
+		for _, anomaly := range summary.Anomalies {
+			fmt.Fprintf(&sb, "  ⚠️ may not have been working at %s: %s\n", anomaly.DetectedAt.In(loc).Format(layout), anomaly.Reason)
+		}
+		for _, action := range summary.Upcoming {
+			fmt.Fprintf(&sb, "  planned: %s %s", action.At.In(loc).Format(layout), action.Value)
+			if action.Reason != "" {
+				fmt.Fprintf(&sb, " (%s)", action.Reason)
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+func describeUse(summary Summary) string {
+	u := summary.Usage
+	if summary.Preheats == 0 && u.Hours == 0 {
+		return "not used"
+	}
+	noun := "preheats"
+	if summary.Preheats == 1 {
+		noun = "preheat"
+	}
+	on := time.Duration(u.Hours * float64(time.Hour)).Round(time.Minute)
+	description := fmt.Sprintf("%d %s, on for %s", summary.Preheats, noun, on)
+	if u.Watts > 0 {
+		description += fmt.Sprintf(", about %.1f kWh", u.KWh)
+	}
+	if u.Watts > 0 && u.Priced {
+		description += " costing " + usage.FormatPrice(u.Currency, u.Cost, 2)
+	}
+	return description
+}
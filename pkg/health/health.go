@@ -0,0 +1,165 @@
+// Package health reports whether each part of the server is working, for
+// load balancers and orchestrators.
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	StatusOK        = "ok"
+	StatusUnhealthy = "unhealthy"
+)
+
+// Component is the status of one part of the server.
+type Component struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	// LastSuccess is when a background loop last did its work.
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+}
+
+// Report is the status of the server as a whole, which is unhealthy if any
+// component is.
+type Report struct {
+	Status     string               `json:"status"`
+	Components map[string]Component `json:"components"`
+}
+
+// Check returns the status of a component. ready is true when asking whether
+// the server should get traffic, which may be stricter than whether it is
+// alive.
+type Check func(ready bool) Component
+
+// Checker runs the checks of every component.
+type Checker struct {
+	sync.Mutex
+	checks map[string]Check
+}
+
+func New() *Checker {
+	return &Checker{checks: make(map[string]Check)}
+}
+
+// Add registers the check of the named component.
+func (c *Checker) Add(name string, check Check) {
+	c.Lock()
+	defer c.Unlock()
+	c.checks[name] = check
+}
+
+// Report runs every check.
+func (c *Checker) Report(ready bool) Report {
+	c.Lock()
+	names := make([]string, 0, len(c.checks))
+	for name := range c.checks {
+		names = append(names, name)
+	}
+	checks := c.checks
+	c.Unlock()
+	sort.Strings(names)
+
+	report := Report{Status: StatusOK, Components: make(map[string]Component)}
+	for _, name := range names {
+		component := checks[name](ready)
+		if component.Status != StatusOK {
+			report.Status = StatusUnhealthy
+		}
+		report.Components[name] = component
+	}
+	return report
+}
+
+// LiveHandler responds with the Report of whether the server is alive, with
+// status 503 if it isn't.
+func (c *Checker) LiveHandler(w http.ResponseWriter, r *http.Request) {
+	c.serve(w, false)
+}
+
+// ReadyHandler responds with the Report of whether the server is ready, with
+// status 503 if it isn't.
+func (c *Checker) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	c.serve(w, true)
+}
+
+func (c *Checker) serve(w http.ResponseWriter, ready bool) {
+	report := c.Report(ready)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status == StatusOK {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(report)
+	if err != nil {
+		log.WithError(err).Error("error serializing health report")
+	}
+}
+
+// ErrorCheck returns a Check that is healthy when check returns nil.
+func ErrorCheck(check func() error) Check {
+	return func(ready bool) Component {
+		err := check()
+		if err != nil {
+			return Component{Status: StatusUnhealthy, Message: err.Error()}
+		}
+		return Component{Status: StatusOK}
+	}
+}
+
+// Loop is the state of a background loop that does its work periodically.
+type Loop struct {
+	Running bool
+	// Started is when the loop started.
+	Started time.Time
+	// LastSuccess is when the loop last did its work, or zero if it hasn't.
+	LastSuccess time.Time
+	// Err is why the last attempt failed, if it did.
+	Err error
+}
+
+// LoopCheck returns a Check for a background loop. The loop is alive while it
+// is running, and ready once it has also succeeded within maxAge, or is
+// still within maxAge of starting.
+func LoopCheck(status func() Loop, maxAge time.Duration) Check {
+	return func(ready bool) Component {
+		return loopComponent(status(), maxAge, ready, time.Now())
+	}
+}
+
+func loopComponent(loop Loop, maxAge time.Duration, ready bool, now time.Time) Component {
+	component := Component{Status: StatusOK}
+	if !loop.LastSuccess.IsZero() {
+		last := loop.LastSuccess
+		component.LastSuccess = &last
+	}
+	if loop.Err != nil {
+		component.Message = loop.Err.Error()
+	}
+	if !loop.Running {
+		component.Status = StatusUnhealthy
+		component.Message = "not running"
+		return component
+	}
+	if !ready {
+		return component
+	}
+	since := loop.LastSuccess
+	if since.IsZero() {
+		since = loop.Started
+	}
+	if now.Sub(since) > maxAge {
+		component.Status = StatusUnhealthy
+		if component.Message == "" {
+			component.Message = "no success in " + maxAge.String()
+		}
+	}
+	return component
+}
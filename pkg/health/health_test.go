@@ -0,0 +1,66 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoopComponent(t *testing.T) {
+	now := time.Date(2021, 1, 9, 8, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name         string
+		loop         Loop
+		alive, ready string
+	}{
+		{"stopped", Loop{LastSuccess: now}, StatusUnhealthy, StatusUnhealthy},
+		{"fresh", Loop{Running: true, LastSuccess: now.Add(-time.Second)}, StatusOK, StatusOK},
+		{"stale", Loop{Running: true, LastSuccess: now.Add(-time.Hour)}, StatusOK, StatusUnhealthy},
+		{"starting", Loop{Running: true, Started: now.Add(-time.Second)}, StatusOK, StatusOK},
+		{"never succeeded", Loop{Running: true, Started: now.Add(-time.Hour), Err: errors.New("boom")}, StatusOK, StatusUnhealthy},
+	} {
+		alive := loopComponent(tc.loop, time.Minute, false, now)
+		ready := loopComponent(tc.loop, time.Minute, true, now)
+		if alive.Status != tc.alive || ready.Status != tc.ready {
+			t.Errorf("%s: got alive %s and ready %s, want %s and %s", tc.name, alive.Status, ready.Status, tc.alive, tc.ready)
+		}
+		if (ready.LastSuccess != nil) != !tc.loop.LastSuccess.IsZero() {
+			t.Errorf("%s: got last success %v", tc.name, ready.LastSuccess)
+		}
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	stale := Loop{Running: true, LastSuccess: time.Now().Add(-time.Hour)}
+	c := New()
+	c.Add("datadir", ErrorCheck(func() error { return nil }))
+	c.Add("poller", LoopCheck(func() Loop { return stale }, time.Minute))
+
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		status  int
+	}{
+		{c.LiveHandler, http.StatusOK},
+		{c.ReadyHandler, http.StatusServiceUnavailable},
+	} {
+		w := httptest.NewRecorder()
+		tc.handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != tc.status {
+			t.Errorf("got %d, want %d", w.Code, tc.status)
+		}
+		report := Report{}
+		err := json.Unmarshal(w.Body.Bytes(), &report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Components) != 2 || report.Components["datadir"].Status != StatusOK {
+			t.Errorf("got %+v", report)
+		}
+		if (report.Status == StatusOK) != (tc.status == http.StatusOK) {
+			t.Errorf("got status %s with %d", report.Status, w.Code)
+		}
+	}
+}
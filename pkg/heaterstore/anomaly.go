@@ -0,0 +1,113 @@
+package heaterstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// AnomaliesFilename holds the suspected failure of each heater in a namespace
+// as a JSON object mapping heater ID to Anomaly.
+const AnomaliesFilename = ".anomalies"
+
+// AnomalyLogDirname is the directory within each namespace that holds one
+// file per heater, recording every suspected failure as a line of JSON.
+const AnomalyLogDirname = ".anomalylog"
+
+// DefaultFailureWindow is how long a heater may be on without warming or
+// drawing current before it is suspected of having failed.
+const DefaultFailureWindow = 30 * time.Minute
+
+// Anomaly records that a heater appeared to fail while it was on, so that the
+// owners are alerted only once per period during which it is on.
+type Anomaly struct {
+	// OnSince is when the heater was turned on.
+	OnSince    time.Time `json:"onSince"`
+	DetectedAt time.Time `json:"detectedAt"`
+	// Reason describes the readings that triggered the alert.
+	Reason string `json:"reason"`
+}
+
+// GetAnomaly returns the heater's most recent suspected failure. The second
+// return value is false if there is none.
+func (h *Store) GetAnomaly(owner, heater string) (Anomaly, bool, error) {
+	anomalies, err := h.readAnomalies(owner)
+	if err != nil {
+		return Anomaly{}, false, err
+	}
+	anomaly, ok := anomalies[heater]
+	return anomaly, ok, nil
+}
+
+// SetAnomaly saves the heater's suspected failure and adds it to the
+// heater's log of past failures.
+func (h *Store) SetAnomaly(owner, heater string, anomaly Anomaly) error {
+	err := h.updateAnomalies(owner, func(anomalies map[string]Anomaly) {
+		anomalies[heater] = anomaly
+	})
+	if err != nil {
+		return err
+	}
+	return appendLine(filepath.Join(h.Dir, owner, AnomalyLogDirname), heater, anomaly)
+}
+
+// PastAnomalies returns the heater's suspected failures, oldest first, that
+// were detected at or after since.
+func (h *Store) PastAnomalies(owner, heater string, since time.Time) ([]Anomaly, error) {
+	anomalies := []Anomaly{}
+	err := readLines(filepath.Join(h.Dir, owner, AnomalyLogDirname, heater), func(line []byte) {
+		a := Anomaly{}
+		if json.Unmarshal(line, &a) == nil && !a.DetectedAt.Before(since) {
+			anomalies = append(anomalies, a)
+		}
+	})
+	return anomalies, err
+}
+
+// DelAnomaly removes the heater's suspected failure.
+func (h *Store) DelAnomaly(owner, heater string) error {
+	return h.updateAnomalies(owner, func(anomalies map[string]Anomaly) {
+		delete(anomalies, heater)
+	})
+}
+
+// FailureWindow returns how long the heater may be on without warming or
+// drawing current before its owners are alerted. A negative value means
+// never.
+func (h *Store) FailureWindow(owner, heater string) time.Duration {
+	config, err := h.GetConfig(owner, heater)
+	if err == nil && config.FailureWindow != 0 {
+		return time.Duration(config.FailureWindow)
+	}
+	return DefaultFailureWindow
+}
+
+func (h *Store) updateAnomalies(owner string, update func(map[string]Anomaly)) error {
+	h.Lock()
+	defer h.Unlock()
+	anomalies, err := h.readAnomalies(owner)
+	if err != nil {
+		return err
+	}
+	update(anomalies)
+	data, err := json.Marshal(anomalies)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(h.Dir, owner, AnomaliesFilename), data, 0644)
+}
+
+func (h *Store) readAnomalies(owner string) (map[string]Anomaly, error) {
+	anomalies := make(map[string]Anomaly)
+	data, err := ioutil.ReadFile(filepath.Join(h.Dir, owner, AnomaliesFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return anomalies, nil
+		}
+		return anomalies, err
+	}
+	err = json.Unmarshal(data, &anomalies)
+	return anomalies, err
+}
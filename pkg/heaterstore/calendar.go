@@ -0,0 +1,36 @@
+package heaterstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// CalendarsDirname is the directory within each namespace that holds the
+// uploaded iCalendar feed of each heater that has one, named after the
+// heater.
+const CalendarsDirname = ".calendars"
+
+// CalendarFile returns the heater's uploaded calendar feed.
+func (h *Store) CalendarFile(owner, heater string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(h.Dir, owner, CalendarsDirname, heater))
+}
+
+// SetCalendarFile saves an uploaded calendar feed for the heater.
+func (h *Store) SetCalendarFile(owner, heater string, data []byte) error {
+	dir := filepath.Join(h.Dir, owner, CalendarsDirname)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, heater), data, 0644)
+}
+
+// DelCalendarFile removes the heater's uploaded calendar feed, if any.
+func (h *Store) DelCalendarFile(owner, heater string) error {
+	err := os.Remove(filepath.Join(h.Dir, owner, CalendarsDirname, heater))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package heaterstore
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ConfigFilename holds the settings for each heater in a namespace as a JSON
+// object mapping heater ID to HeaterConfig.
+const ConfigFilename = ".config"
+
+// HeaterConfig holds per-heater settings. The zero value of each field means
+// that the default, or the user's preference, applies.
+type HeaterConfig struct {
+	// ReminderAfter is how long the heater may be on before the bot asks
+	// whether it is still needed. A negative value disables reminders.
+	ReminderAfter Duration `json:"reminderAfter,omitempty"`
+	// DeviceToken authenticates the device attached to the heater when it
+	// reports telemetry.
+	DeviceToken string `json:"deviceToken,omitempty"`
+	// Thermostat, if set, means the server turns the heater on and off to
+	// hold a temperature.
+	Thermostat *Thermostat `json:"thermostat,omitempty"`
+	// Preheat, if set, replaces the default model of how long the heater
+	// takes to warm the engine.
+	Preheat *PreheatModel `json:"preheat,omitempty"`
+	// FailureWindow is how long the heater may be on without warming or
+	// drawing current before its owners are alerted. A negative value
+	// disables failure detection.
+	FailureWindow Duration `json:"failureWindow,omitempty"`
+	// Site is where the heater is.
+	Site *Site `json:"site,omitempty"`
+	// SunRules turn the heater on or off every day at times relative to
+	// sunrise, sunset or civil twilight at its site.
+	SunRules []SunRule `json:"sunRules,omitempty"`
+	// WeatherStation is the ICAO code of the nearest station that issues
+	// METARs, such as PANC.
+	WeatherStation string `json:"weatherStation,omitempty"`
+	// ColdWeather, if set, means the bot checks the weather at the
+	// WeatherStation before each flight and suggests or starts a preheat if
+	// it is cold.
+	ColdWeather *ColdWeather `json:"coldWeather,omitempty"`
+	// Calendar, if set, is a feed of bookings before which the heater is
+	// turned on.
+	Calendar *Calendar `json:"calendar,omitempty"`
+	// Watts is how much power the heater draws while on.
+	Watts float64 `json:"watts,omitempty"`
+	// Tariff, if set, is the price of the electricity the heater uses.
+	Tariff *Tariff `json:"tariff,omitempty"`
+}
+
+// Tariff is the price of electricity, which may depend on the time of day.
+type Tariff struct {
+	// Currency is shown with costs, such as "$" or "EUR".
+	Currency string `json:"currency,omitempty"`
+	// Rate is the price of a kWh at times not covered by Periods.
+	Rate float64 `json:"rate"`
+	// Periods are times of day with their own rate. If periods overlap, the
+	// first one applies.
+	Periods []TariffPeriod `json:"periods,omitempty"`
+}
+
+// TariffPeriod is a time of day during which electricity has its own price.
+type TariffPeriod struct {
+	// From and To are times of day such as "22:00" in the heater's time
+	// zone. A period that ends before it starts spans midnight.
+	From string  `json:"from"`
+	To   string  `json:"to"`
+	Rate float64 `json:"rate"`
+}
+
+// Calendar is an iCalendar feed of bookings of the aircraft that a heater
+// warms.
+type Calendar struct {
+	// URL is where the feed is fetched from. Empty means the feed was
+	// uploaded; see CalendarFile.
+	URL string `json:"url,omitempty"`
+	// Lead is how long before each booking starts the heater is turned on.
+	Lead Duration `json:"lead"`
+	// MaxOn, if set, is how long the heater stays on, even past the start of
+	// the booking. Zero means it is turned off when the booking starts.
+	MaxOn Duration `json:"maxOn,omitempty"`
+	// AddedBy is the user on whose behalf the heater is turned on and off.
+	AddedBy string `json:"addedBy"`
+}
+
+// ColdWeather configures preheat suggestions based on the weather.
+type ColdWeather struct {
+	// Below is the temperature, in degrees Celsius, under which a preheat
+	// is needed.
+	Below float64 `json:"below"`
+	// Auto is true if the preheat should be started without asking.
+	Auto bool `json:"auto,omitempty"`
+}
+
+// Site is the location of a heater.
+type Site struct {
+	// Latitude and Longitude are in degrees, with north and east positive.
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// Timezone is the IANA name of the site's time zone. Empty means the
+	// server's local time zone.
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// Location returns the site's time zone, or the server's local time zone if
+// none is set or it is not valid.
+func (s Site) Location() *time.Location {
+	return loadLocation(s.Timezone)
+}
+
+// SunRule sets a heater to Value every day at Offset from a solar event, such
+// as 90 minutes before sunrise.
+type SunRule struct {
+	Value string `json:"value"`
+	// Event is a solar event such as "sunrise"; see package solar.
+	Event string `json:"event"`
+	// Offset is added to the time of the event, so it is negative for
+	// times before the event.
+	Offset Duration `json:"offset"`
+	// CreatedBy is the user on whose behalf the change is made.
+	CreatedBy string `json:"createdBy"`
+}
+
+// PreheatModel describes how long a heater takes to warm an engine, as a
+// number of minutes per degree of warming that depends on the ambient
+// temperature. Temperatures are in degrees Celsius.
+type PreheatModel struct {
+	// Target is the engine temperature that counts as warm.
+	Target float64 `json:"target"`
+	// Curve is interpolated linearly between points, and held constant
+	// beyond the first and last point.
+	Curve []CurvePoint `json:"curve"`
+}
+
+// CurvePoint is the rate of warming at one ambient temperature.
+type CurvePoint struct {
+	Ambient          float64 `json:"ambient"`
+	MinutesPerDegree float64 `json:"minutesPerDegree"`
+}
+
+// Thermostat holds a heater near a target temperature until a deadline,
+// using temperatures reported by the heater's device. Temperatures are in
+// degrees Celsius.
+type Thermostat struct {
+	Target float64 `json:"target"`
+	// Hysteresis is the width of the band centered on Target within which
+	// the heater is left as it is.
+	Hysteresis float64   `json:"hysteresis"`
+	Until      time.Time `json:"until"`
+	// Metric is the telemetry metric to control on.
+	Metric string `json:"metric"`
+	SetBy  string `json:"setBy"`
+	// FailSafe is true while the heater has been turned off because
+	// readings are missing or stale.
+	FailSafe bool `json:"failSafe,omitempty"`
+}
+
+// NewDeviceToken returns a new random secret suitable for
+// HeaterConfig.DeviceToken.
+func NewDeviceToken() (string, error) {
+	return NewToken()
+}
+
+// NewToken returns a new random secret that is safe to use in a URL.
+func NewToken() (string, error) {
+	buf := make([]byte, 24)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Duration is a time.Duration that is stored in JSON as a string such as
+// "1h30m0s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// GetConfig returns the heater's settings.
+func (h *Store) GetConfig(owner, heater string) (HeaterConfig, error) {
+	configs, err := h.readConfigs(owner)
+	if err != nil {
+		return HeaterConfig{}, err
+	}
+	return configs[heater], nil
+}
+
+// SetConfig saves the heater's settings.
+func (h *Store) SetConfig(owner, heater string, c HeaterConfig) error {
+	return h.UpdateConfig(owner, heater, func(HeaterConfig) HeaterConfig { return c })
+}
+
+// UpdateConfig replaces the heater's settings with the result of update,
+// which is passed the current settings. Use it to change some settings
+// without overwriting others that changed since they were read.
+func (h *Store) UpdateConfig(owner, heater string, update func(HeaterConfig) HeaterConfig) error {
+	h.Lock()
+	defer h.Unlock()
+	configs, err := h.readConfigs(owner)
+	if err != nil {
+		return err
+	}
+	configs[heater] = update(configs[heater])
+	data, err := json.Marshal(configs)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(h.Dir, owner, ConfigFilename), data, 0644)
+}
+
+func (h *Store) readConfigs(owner string) (map[string]HeaterConfig, error) {
+	configs := make(map[string]HeaterConfig)
+	data, err := ioutil.ReadFile(filepath.Join(h.Dir, owner, ConfigFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return configs, nil
+		}
+		return configs, err
+	}
+	err = json.Unmarshal(data, &configs)
+	return configs, err
+}
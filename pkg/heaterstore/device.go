@@ -0,0 +1,41 @@
+package heaterstore
+
+import (
+	"path/filepath"
+	"time"
+)
+
+// DevicesFilename holds whether the device attached to each heater in a
+// namespace is reporting, as a JSON object mapping heater ID to DeviceState.
+const DevicesFilename = ".devices"
+
+// DeviceState is whether a heater's device was last known to be reporting
+// telemetry.
+type DeviceState struct {
+	Online bool `json:"online"`
+	// Since is when the device was first seen in this state.
+	Since time.Time `json:"since"`
+}
+
+// GetDeviceState returns the state of the heater's device. The second return
+// value is false if it has never been checked.
+func (h *Store) GetDeviceState(owner, heater string) (DeviceState, bool, error) {
+	states := make(map[string]DeviceState)
+	err := readJSON(filepath.Join(h.Dir, owner, DevicesFilename), &states)
+	state, ok := states[heater]
+	return state, ok, err
+}
+
+// SetDeviceState saves the state of the heater's device.
+func (h *Store) SetDeviceState(owner, heater string, state DeviceState) error {
+	h.Lock()
+	defer h.Unlock()
+	states := make(map[string]DeviceState)
+	path := filepath.Join(h.Dir, owner, DevicesFilename)
+	err := readJSON(path, &states)
+	if err != nil {
+		return err
+	}
+	states[heater] = state
+	return writeJSON(path, states)
+}
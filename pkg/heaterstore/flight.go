@@ -0,0 +1,126 @@
+package heaterstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FlightsFilename holds the planned flights for the heaters in a namespace as
+// a JSON list of Flight.
+const FlightsFilename = ".flights"
+
+// Flight is a planned departure of the aircraft that a heater warms.
+type Flight struct {
+	ID     string    `json:"id"`
+	Heater string    `json:"heater"`
+	At     time.Time `json:"at"`
+	// CreatedBy is the user who planned the flight, on whose behalf any
+	// preheat is started.
+	CreatedBy string `json:"createdBy"`
+	// Advised is true once the weather has been checked and any preheat
+	// suggested or started.
+	Advised bool `json:"advised,omitempty"`
+}
+
+// Flights returns the namespace's flights, earliest first.
+func (h *Store) Flights(owner string) ([]Flight, error) {
+	flights := []Flight{}
+	data, err := ioutil.ReadFile(filepath.Join(h.Dir, owner, FlightsFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return flights, nil
+		}
+		return flights, err
+	}
+	err = json.Unmarshal(data, &flights)
+	sort.SliceStable(flights, func(i, j int) bool { return flights[i].At.Before(flights[j].At) })
+	return flights, err
+}
+
+// FindFlight returns the flight with the given ID and the namespace it belongs
+// to.
+func (h *Store) FindFlight(id string) (string, Flight, error) {
+	namespaces, err := h.Namespaces()
+	if err != nil {
+		return "", Flight{}, err
+	}
+	for _, owner := range namespaces {
+		flights, err := h.Flights(owner)
+		if err != nil {
+			return "", Flight{}, err
+		}
+		for _, flight := range flights {
+			if flight.ID == id {
+				return owner, flight, nil
+			}
+		}
+	}
+	return "", Flight{}, os.ErrNotExist
+}
+
+// AddFlight saves a new flight, giving it an ID.
+func (h *Store) AddFlight(owner string, flight Flight) (Flight, error) {
+	flight.ID = strings.ReplaceAll(uuid.New().String(), "-", "")
+	return flight, h.updateFlights(owner, func(flights []Flight) []Flight {
+		return append(flights, flight)
+	})
+}
+
+// SetFlight replaces the flight that has the same ID.
+func (h *Store) SetFlight(owner string, flight Flight) error {
+	return h.updateFlights(owner, func(flights []Flight) []Flight {
+		for i := range flights {
+			if flights[i].ID == flight.ID {
+				flights[i] = flight
+			}
+		}
+		return flights
+	})
+}
+
+// RemoveFlight removes the flight with the given ID.
+func (h *Store) RemoveFlight(owner, id string) error {
+	return h.updateFlights(owner, func(flights []Flight) []Flight {
+		kept := []Flight{}
+		for _, flight := range flights {
+			if flight.ID != id {
+				kept = append(kept, flight)
+			}
+		}
+		return kept
+	})
+}
+
+// PruneFlights removes flights that departed before the given time.
+func (h *Store) PruneFlights(owner string, before time.Time) error {
+	return h.updateFlights(owner, func(flights []Flight) []Flight {
+		kept := []Flight{}
+		for _, flight := range flights {
+			if !flight.At.Before(before) {
+				kept = append(kept, flight)
+			}
+		}
+		return kept
+	})
+}
+
+func (h *Store) updateFlights(owner string, update func([]Flight) []Flight) error {
+	h.Lock()
+	defer h.Unlock()
+	flights, err := h.Flights(owner)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(update(flights))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(h.Dir, owner, FlightsFilename), data, 0644)
+}
@@ -0,0 +1,345 @@
+package heaterstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GroupsDirname is the directory within the data dir that holds one
+// directory per group. Telegram usernames cannot start with a ".", so it
+// cannot collide with a user's directory.
+const GroupsDirname = ".groups"
+
+// MembersFilename holds a group's membership as a JSON object mapping
+// username to Role.
+const MembersFilename = ".members"
+
+// Role describes what a user may do with a heater.
+type Role string
+
+const (
+	// RoleOwner can control the heater and manage who else has access.
+	RoleOwner Role = "owner"
+	// RoleOperator can turn the heater on and off.
+	RoleOperator Role = "operator"
+	// RoleViewer can see the heater's state but not change it.
+	RoleViewer Role = "viewer"
+)
+
+// ParseRole returns the Role named by s, or an error if it is not one of the
+// known roles.
+func ParseRole(s string) (Role, error) {
+	switch r := Role(strings.ToLower(s)); r {
+	case RoleOwner, RoleOperator, RoleViewer:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown role %q; must be one of owner, operator, viewer", s)
+}
+
+// CanControl returns true if the role is allowed to change a heater's value.
+func (r Role) CanControl() bool {
+	return r == RoleOwner || r == RoleOperator
+}
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidName returns true if name is safe to use as a group or heater name.
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// GroupNamespace returns the value to pass as the username argument of Get,
+// Set and IDs in order to act on a group's heaters.
+func GroupNamespace(group string) string {
+	return GroupsDirname + "/" + group
+}
+
+// GroupFromNamespace returns the group name if owner was created by
+// GroupNamespace.
+func GroupFromNamespace(owner string) (string, bool) {
+	if !strings.HasPrefix(owner, GroupsDirname+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(owner, GroupsDirname+"/"), true
+}
+
+// HeaterRef identifies a heater that a user has access to.
+type HeaterRef struct {
+	// Owner is the namespace that holds the heater: either a username or a
+	// value returned by GroupNamespace.
+	Owner  string
+	Heater string
+	Role   Role
+}
+
+// Name returns how the heater should be presented to username. The user's
+// own heaters are shown by bare name, and all others are prefixed with the
+// group or user that owns them.
+func (r HeaterRef) Name(username string) string {
+	if r.Owner == username {
+		return r.Heater
+	}
+	if group, ok := GroupFromNamespace(r.Owner); ok {
+		return group + "/" + r.Heater
+	}
+	return r.Owner + "/" + r.Heater
+}
+
+// GroupExists returns true if the named group has been created.
+func (h *Store) GroupExists(group string) bool {
+	if !ValidName(group) {
+		return false
+	}
+	fileinfo, err := os.Stat(filepath.Join(h.Dir, GroupsDirname, group))
+	return err == nil && fileinfo.IsDir()
+}
+
+// CreateGroup creates a new group with owner as its only member.
+func (h *Store) CreateGroup(group, owner string) error {
+	if !ValidName(group) {
+		return fmt.Errorf("invalid group name %q", group)
+	}
+	if h.GroupExists(group) {
+		return fmt.Errorf("group %s already exists", group)
+	}
+	err := os.MkdirAll(filepath.Join(h.Dir, GroupsDirname, group), 0755)
+	if err != nil {
+		return err
+	}
+	return h.SetMember(group, owner, RoleOwner)
+}
+
+// Members returns the group's members and their roles.
+func (h *Store) Members(group string) (map[string]Role, error) {
+	members := make(map[string]Role)
+	if !ValidName(group) {
+		return members, fmt.Errorf("invalid group name %q", group)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(h.Dir, GroupsDirname, group, MembersFilename))
+	if err != nil {
+		if os.IsNotExist(err) && h.GroupExists(group) {
+			return members, nil
+		}
+		return members, err
+	}
+	err = json.Unmarshal(data, &members)
+	return members, err
+}
+
+// SetMember adds username to the group with the given role, or changes the
+// role of an existing member. Membership alone is enough for the bot to
+// recognize a user who has no account. It is an error to demote the group's
+// last owner.
+func (h *Store) SetMember(group, username string, role Role) error {
+	h.Lock()
+	defer h.Unlock()
+	if !ValidName(username) {
+		return fmt.Errorf("invalid username %q", username)
+	}
+	members, err := h.Members(group)
+	if err != nil {
+		return err
+	}
+	members[username] = role
+	if !hasOwner(members) {
+		return fmt.Errorf("cannot demote the last owner of %s", group)
+	}
+	return h.writeMembers(group, members)
+}
+
+// RemoveMember removes username from the group. It is an error to remove the
+// group's last owner.
+func (h *Store) RemoveMember(group, username string) error {
+	h.Lock()
+	defer h.Unlock()
+	members, err := h.Members(group)
+	if err != nil {
+		return err
+	}
+	if _, ok := members[username]; !ok {
+		return fmt.Errorf("%s is not a member of %s", username, group)
+	}
+	delete(members, username)
+	if !hasOwner(members) {
+		return fmt.Errorf("cannot remove the last owner of %s", group)
+	}
+	return h.writeMembers(group, members)
+}
+
+func hasOwner(members map[string]Role) bool {
+	for _, role := range members {
+		if role == RoleOwner {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Store) writeMembers(group string, members map[string]Role) error {
+	data, err := json.Marshal(members)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(h.Dir, GroupsDirname, group, MembersFilename), data, 0644)
+}
+
+// Groups returns a map of the names of groups that username belongs to and
+// their role in each.
+func (h *Store) Groups(username string) (map[string]Role, error) {
+	groups := make(map[string]Role)
+	files, err := ioutil.ReadDir(filepath.Join(h.Dir, GroupsDirname))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return groups, nil
+		}
+		return groups, err
+	}
+	for _, file := range files {
+		if !file.IsDir() || !ValidName(file.Name()) {
+			continue
+		}
+		members, err := h.Members(file.Name())
+		if err != nil {
+			return groups, err
+		}
+		if role, ok := members[username]; ok {
+			groups[file.Name()] = role
+		}
+	}
+	return groups, nil
+}
+
+// Heaters returns every heater that username has access to: their own
+// heaters, then those of each group they belong to, then any they have been
+// invited to.
+func (h *Store) Heaters(username string) ([]HeaterRef, error) {
+	refs := []HeaterRef{}
+	ids, err := h.IDs(username)
+	if err != nil && !os.IsNotExist(err) {
+		return refs, err
+	}
+	for _, id := range ids {
+		refs = append(refs, HeaterRef{Owner: username, Heater: id, Role: RoleOwner})
+	}
+
+	groups, err := h.Groups(username)
+	if err != nil {
+		return refs, err
+	}
+	names := make([]string, 0, len(groups))
+	for group := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+	for _, group := range names {
+		ids, err := h.IDs(GroupNamespace(group))
+		if err != nil {
+			return refs, err
+		}
+		for _, id := range ids {
+			refs = append(refs, HeaterRef{Owner: GroupNamespace(group), Heater: id, Role: groups[group]})
+		}
+	}
+
+	grants, err := h.grants(username)
+	if err != nil {
+		return refs, err
+	}
+	for _, grant := range grants {
+		if !containsHeater(refs, grant.Owner, grant.Heater) {
+			refs = append(refs, grant)
+		}
+	}
+	return refs, nil
+}
+
+func containsHeater(refs []HeaterRef, owner, heater string) bool {
+	for _, ref := range refs {
+		if ref.Owner == owner && ref.Heater == heater {
+			return true
+		}
+	}
+	return false
+}
+
+// Role returns the role username has for the heater identified by owner and
+// heater. The second return value is false if the user has no access.
+func (h *Store) Role(username, owner, heater string) (Role, bool) {
+	refs, err := h.Heaters(username)
+	if err != nil {
+		return "", false
+	}
+	for _, ref := range refs {
+		if ref.Owner == owner && ref.Heater == heater {
+			return ref.Role, true
+		}
+	}
+	return "", false
+}
+
+// Audience returns the users who have access to the heater: the user or
+// group members that own it, plus anyone who has accepted an invite to it.
+func (h *Store) Audience(owner, heater string) ([]string, error) {
+	usernames := []string{}
+	if group, ok := GroupFromNamespace(owner); ok {
+		members, err := h.Members(group)
+		if err != nil {
+			return usernames, err
+		}
+		for username := range members {
+			usernames = append(usernames, username)
+		}
+	} else {
+		usernames = append(usernames, owner)
+	}
+
+	invites, err := h.Invites(time.Now())
+	if err != nil {
+		return usernames, err
+	}
+	for _, invite := range invites {
+		if invite.Owner == owner && invite.Heater == heater {
+			usernames = append(usernames, invite.AcceptedBy...)
+		}
+	}
+	return dedup(usernames), nil
+}
+
+// Owners returns the users who own the namespace: the user, or the group's
+// members with the owner role.
+func (h *Store) Owners(owner string) ([]string, error) {
+	group, ok := GroupFromNamespace(owner)
+	if !ok {
+		return []string{owner}, nil
+	}
+	usernames := []string{}
+	members, err := h.Members(group)
+	if err != nil {
+		return usernames, err
+	}
+	for username, role := range members {
+		if role == RoleOwner {
+			usernames = append(usernames, username)
+		}
+	}
+	return dedup(usernames), nil
+}
+
+// dedup sorts the strings and removes duplicates.
+func dedup(s []string) []string {
+	sort.Strings(s)
+	out := []string{}
+	for i, v := range s {
+		if i == 0 || v != s[i-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 const PendingValueFilename = ".pendingvalue"
@@ -38,7 +39,24 @@ func (h *Store) Get(username, id string) (Record, error) {
 	return r, nil
 }
 
-func (h *Store) Set(username, id, value string) (Record, error) {
+// Modified returns when the heater's record was last written.
+func (h *Store) Modified(username, id string) (time.Time, error) {
+	info, err := os.Stat(filepath.Join(h.Dir, username, id))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// Set changes the heater's value, increments its version, and records the
+// change in the heater's history on behalf of by.
+func (h *Store) Set(username, id, value, by string) (Record, error) {
+	return h.SetFor(username, id, value, by, "")
+}
+
+// SetFor is like Set, but also records the user that the subsystem by made
+// the change for, such as the user who set a thermostat's hold.
+func (h *Store) SetFor(username, id, value, by, forUser string) (Record, error) {
 	h.Lock()
 	defer h.Unlock()
 	r, err := h.Get(username, id)
@@ -56,6 +74,10 @@ func (h *Store) Set(username, id, value string) (Record, error) {
 	if err != nil {
 		return r, err
 	}
+	err = h.appendHistory(username, id, Change{Time: time.Now(), Value: r.Value, Version: r.Version, By: by, For: forUser})
+	if err != nil {
+		return r, err
+	}
 	return r, nil
 }
 
@@ -66,24 +88,88 @@ func (h *Store) IDs(username string) ([]string, error) {
 	}
 	ids := []string{}
 	for _, file := range files {
-		if file.Name() != PendingValueFilename {
+		// dotfiles such as PendingValueFilename hold metadata, not heaters
+		if !file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
 			ids = append(ids, file.Name())
 		}
 	}
 	return ids, nil
 }
 
+// AllHeaters returns every heater in the store, whether it belongs to a user
+// or a group. The Role of each is RoleOwner.
+func (h *Store) AllHeaters() ([]HeaterRef, error) {
+	refs := []HeaterRef{}
+	namespaces := []string{}
+	files, err := ioutil.ReadDir(h.Dir)
+	if err != nil {
+		return refs, err
+	}
+	for _, file := range files {
+		if file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
+			namespaces = append(namespaces, file.Name())
+		}
+	}
+	groups, err := ioutil.ReadDir(filepath.Join(h.Dir, GroupsDirname))
+	if err != nil && !os.IsNotExist(err) {
+		return refs, err
+	}
+	for _, group := range groups {
+		if group.IsDir() && ValidName(group.Name()) {
+			namespaces = append(namespaces, GroupNamespace(group.Name()))
+		}
+	}
+
+	for _, namespace := range namespaces {
+		ids, err := h.IDs(namespace)
+		if err != nil {
+			return refs, err
+		}
+		for _, id := range ids {
+			refs = append(refs, HeaterRef{Owner: namespace, Heater: id, Role: RoleOwner})
+		}
+	}
+	return refs, nil
+}
+
+// CheckDir returns an error if the data directory can't be read or written.
+func (h *Store) CheckDir() error {
+	_, err := ioutil.ReadDir(h.Dir)
+	if err != nil {
+		return err
+	}
+	// a dotfile, so that it is never mistaken for a user
+	f, err := ioutil.TempFile(h.Dir, ".healthcheck")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString("ok")
+	closeErr := f.Close()
+	removeErr := os.Remove(f.Name())
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return removeErr
+}
+
 func (h *Store) UserExists(username string) bool {
 	fileinfo, err := os.Stat(filepath.Join(h.Dir, username))
 	return !(os.IsNotExist(err) || fileinfo.IsDir() != true)
 }
 
 func (h *Store) SetPendingValue(username, value string) error {
-	return ioutil.WriteFile(filepath.Join(h.Dir, username, PendingValueFilename), []byte(value), 0644)
+	path, err := h.prepareUserFile(username, PendingValueFilename)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(value), 0644)
 }
 
 func (h *Store) GetPendingValue(username string) (string, error) {
-	data, err := ioutil.ReadFile(filepath.Join(h.Dir, username, PendingValueFilename))
+	data, err := ioutil.ReadFile(h.userFile(username, PendingValueFilename))
 	if err != nil {
 		return "", err
 	}
@@ -91,7 +177,7 @@ func (h *Store) GetPendingValue(username string) (string, error) {
 }
 
 func (h *Store) DelPendingValue(username string) error {
-	err := os.Remove(filepath.Join(h.Dir, username, PendingValueFilename))
+	err := os.Remove(h.userFile(username, PendingValueFilename))
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
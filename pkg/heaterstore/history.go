@@ -0,0 +1,136 @@
+package heaterstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// HistoryDirname is the directory within each namespace that holds one file
+// per heater, recording every change to that heater as a line of JSON.
+const HistoryDirname = ".history"
+
+// Change is one entry in a heater's history.
+type Change struct {
+	Time    time.Time `json:"time"`
+	Value   string    `json:"value"`
+	Version int       `json:"version"`
+	// By is the user or subsystem that made the change.
+	By string `json:"by,omitempty"`
+	// For is the user that a subsystem made the change for, if any.
+	For string `json:"for,omitempty"`
+}
+
+// History returns the heater's changes, oldest first, that happened at or
+// after since.
+func (h *Store) History(owner, heater string, since time.Time) ([]Change, error) {
+	changes := []Change{}
+	err := readLines(filepath.Join(h.Dir, owner, HistoryDirname, heater), func(line []byte) {
+		c := Change{}
+		err := json.Unmarshal(line, &c)
+		if err != nil {
+			// skip a partially written line rather than losing the rest
+			return
+		}
+		if !c.Time.Before(since) {
+			changes = append(changes, c)
+		}
+	})
+	return changes, err
+}
+
+// LastChange returns the most recent change to the heater. If the heater has
+// no history, the error satisfies IsNotExist.
+func (h *Store) LastChange(owner, heater string) (Change, error) {
+	changes, err := h.History(owner, heater, time.Time{})
+	if err != nil {
+		return Change{}, err
+	}
+	if len(changes) == 0 {
+		return Change{}, os.ErrNotExist
+	}
+	return changes[len(changes)-1], nil
+}
+
+// Period is a span of time during which a heater was on.
+type Period struct {
+	Start time.Time
+	// End is when the heater was turned off, or the time OnPeriods was
+	// given if it is still on.
+	End     time.Time
+	Ongoing bool
+	// By is who turned the heater on, and For is the user they did it for,
+	// if any.
+	By  string
+	For string
+}
+
+// OnPeriods returns the periods during which the heater was on, according to
+// its history. now is used as the end of a period that has not ended.
+func OnPeriods(history []Change, now time.Time) []Period {
+	periods := []Period{}
+	var current *Period
+	for _, change := range history {
+		if change.Value == "on" && current == nil {
+			current = &Period{Start: change.Time, By: change.By, For: change.For}
+		} else if change.Value != "on" && current != nil {
+			current.End = change.Time
+			periods = append(periods, *current)
+			current = nil
+		}
+	}
+	if current != nil {
+		current.End = now
+		current.Ongoing = true
+		periods = append(periods, *current)
+	}
+	return periods
+}
+
+func (h *Store) appendHistory(owner, heater string, c Change) error {
+	return appendLine(filepath.Join(h.Dir, owner, HistoryDirname), heater, c)
+}
+
+// appendLine adds v to the named file in dir as a line of JSON, creating
+// both if needed.
+func appendLine(dir, name string, v interface{}) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readLines calls each with every line of the file. A file that does not
+// exist has no lines.
+func readLines(path string, each func([]byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		each(scanner.Bytes())
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,161 @@
+package heaterstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// InvitesDirname is the directory within the data dir that holds one JSON
+// file per invite, named by the invite's ID.
+const InvitesDirname = ".invites"
+
+// Invite grants temporary access to a single heater to anyone who accepts it.
+// The access ends when the invite expires or is revoked.
+type Invite struct {
+	ID string `json:"id"`
+	// Owner and Heater identify the heater, as in HeaterRef.
+	Owner      string    `json:"owner"`
+	Heater     string    `json:"heater"`
+	Role       Role      `json:"role"`
+	CreatedBy  string    `json:"createdBy"`
+	Expires    time.Time `json:"expires"`
+	AcceptedBy []string  `json:"acceptedBy"`
+}
+
+// Expired returns true if the invite no longer grants access.
+func (i Invite) Expired(now time.Time) bool {
+	return !now.Before(i.Expires)
+}
+
+var validInviteID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// CreateInvite saves a new invite for the heater and returns it.
+func (h *Store) CreateInvite(ref HeaterRef, role Role, createdBy string, expires time.Time) (Invite, error) {
+	invite := Invite{
+		// telegram deep link payloads are limited to 64 characters of
+		// [A-Za-z0-9_-], so use the compact form of the UUID
+		ID:         strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Owner:      ref.Owner,
+		Heater:     ref.Heater,
+		Role:       role,
+		CreatedBy:  createdBy,
+		Expires:    expires,
+		AcceptedBy: []string{},
+	}
+	err := os.MkdirAll(filepath.Join(h.Dir, InvitesDirname), 0755)
+	if err != nil {
+		return invite, err
+	}
+	return invite, h.writeInvite(invite)
+}
+
+// GetInvite returns the invite with the given ID.
+func (h *Store) GetInvite(id string) (Invite, error) {
+	invite := Invite{}
+	if !validInviteID.MatchString(id) {
+		return invite, os.ErrNotExist
+	}
+	data, err := ioutil.ReadFile(filepath.Join(h.Dir, InvitesDirname, id))
+	if err != nil {
+		return invite, err
+	}
+	err = json.Unmarshal(data, &invite)
+	return invite, err
+}
+
+// AcceptInvite grants username access to the invite's heater until the
+// invite expires.
+func (h *Store) AcceptInvite(id, username string, now time.Time) (Invite, error) {
+	h.Lock()
+	defer h.Unlock()
+	invite, err := h.GetInvite(id)
+	if err != nil {
+		return invite, err
+	}
+	if invite.Expired(now) {
+		return invite, fmt.Errorf("invite has expired")
+	}
+	if !ValidName(username) {
+		return invite, fmt.Errorf("invalid username %q", username)
+	}
+	for _, accepted := range invite.AcceptedBy {
+		if accepted == username {
+			return invite, nil
+		}
+	}
+	invite.AcceptedBy = append(invite.AcceptedBy, username)
+	return invite, h.writeInvite(invite)
+}
+
+// RevokeInvite deletes the invite, which immediately ends the access of
+// everyone who accepted it.
+func (h *Store) RevokeInvite(id string) error {
+	if !validInviteID.MatchString(id) {
+		return os.ErrNotExist
+	}
+	return os.Remove(filepath.Join(h.Dir, InvitesDirname, id))
+}
+
+// Invites returns every invite that has not expired, ordered by expiration.
+// Expired invites are deleted along the way.
+func (h *Store) Invites(now time.Time) ([]Invite, error) {
+	invites := []Invite{}
+	files, err := ioutil.ReadDir(filepath.Join(h.Dir, InvitesDirname))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return invites, nil
+		}
+		return invites, err
+	}
+	for _, file := range files {
+		invite, err := h.GetInvite(file.Name())
+		if err != nil {
+			continue
+		}
+		if invite.Expired(now) {
+			err = h.RevokeInvite(invite.ID)
+			if err != nil && !os.IsNotExist(err) {
+				return invites, err
+			}
+			continue
+		}
+		invites = append(invites, invite)
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].Expires.Before(invites[j].Expires) })
+	return invites, nil
+}
+
+// grants returns a HeaterRef for each heater that username has access to by
+// way of an accepted invite.
+func (h *Store) grants(username string) ([]HeaterRef, error) {
+	refs := []HeaterRef{}
+	invites, err := h.Invites(time.Now())
+	if err != nil {
+		return refs, err
+	}
+	for _, invite := range invites {
+		for _, accepted := range invite.AcceptedBy {
+			if accepted == username {
+				refs = append(refs, HeaterRef{Owner: invite.Owner, Heater: invite.Heater, Role: invite.Role})
+			}
+		}
+	}
+	return refs, nil
+}
+
+func (h *Store) writeInvite(invite Invite) error {
+	data, err := json.Marshal(invite)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(h.Dir, InvitesDirname, invite.ID), data, 0644)
+}
@@ -0,0 +1,74 @@
+package heaterstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PreheatStatsFilename holds what has been learned about how long each heater
+// in a namespace takes to warm its engine, as a JSON object mapping heater ID
+// to PreheatStats.
+const PreheatStatsFilename = ".preheatstats"
+
+// Observation is one past preheat, measured from device telemetry.
+// Temperatures are in degrees Celsius.
+type Observation struct {
+	Start time.Time `json:"start"`
+	// Ambient is the ambient temperature when the heater was turned on.
+	Ambient float64 `json:"ambient"`
+	// Engine is the engine temperature when the heater was turned on.
+	Engine float64 `json:"engine"`
+	// Target is the engine temperature that was reached.
+	Target float64 `json:"target"`
+	// Duration is how long it took to reach Target.
+	Duration Duration `json:"duration"`
+}
+
+// PreheatStats holds the observations of one heater.
+type PreheatStats struct {
+	Observations []Observation `json:"observations"`
+	// AnalyzedThrough is the time up to which the heater's history has been
+	// searched for preheats.
+	AnalyzedThrough time.Time `json:"analyzedThrough"`
+}
+
+// GetPreheatStats returns what has been learned about the heater.
+func (h *Store) GetPreheatStats(owner, heater string) (PreheatStats, error) {
+	all, err := h.readPreheatStats(owner)
+	if err != nil {
+		return PreheatStats{}, err
+	}
+	return all[heater], nil
+}
+
+// SetPreheatStats saves what has been learned about the heater.
+func (h *Store) SetPreheatStats(owner, heater string, stats PreheatStats) error {
+	h.Lock()
+	defer h.Unlock()
+	all, err := h.readPreheatStats(owner)
+	if err != nil {
+		return err
+	}
+	all[heater] = stats
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(h.Dir, owner, PreheatStatsFilename), data, 0644)
+}
+
+func (h *Store) readPreheatStats(owner string) (map[string]PreheatStats, error) {
+	all := make(map[string]PreheatStats)
+	data, err := ioutil.ReadFile(filepath.Join(h.Dir, owner, PreheatStatsFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return all, nil
+		}
+		return all, err
+	}
+	err = json.Unmarshal(data, &all)
+	return all, err
+}
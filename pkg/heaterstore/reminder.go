@@ -0,0 +1,115 @@
+package heaterstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RemindersFilename holds the reminder state for each heater in a namespace
+// as a JSON object mapping heater ID to ReminderState.
+const RemindersFilename = ".reminders"
+
+// DefaultReminderAfter is how long a heater may be on before the bot asks
+// whether it is still needed, unless the heater or user says otherwise.
+const DefaultReminderAfter = 3 * time.Hour
+
+// ReminderState tracks the "still needed?" reminder for one period during
+// which a heater is on.
+type ReminderState struct {
+	// Version is the Record version that turned the heater on. State for any
+	// other version is stale.
+	Version int `json:"version"`
+	// NextAt is when the next reminder should be sent.
+	NextAt time.Time `json:"nextAt"`
+	// SentAt is when the outstanding reminder was sent, or zero if there is
+	// none.
+	SentAt time.Time `json:"sentAt,omitempty"`
+	// SentTo lists who received the outstanding reminder.
+	SentTo []string `json:"sentTo,omitempty"`
+	// Escalated is true once the outstanding reminder has also been sent to
+	// the heater's other users.
+	Escalated bool `json:"escalated,omitempty"`
+	// OffAt is when the heater will be turned off because someone extended
+	// it, or zero.
+	OffAt time.Time `json:"offAt,omitempty"`
+}
+
+// GetReminder returns the heater's reminder state. The second return value is
+// false if there is none.
+func (h *Store) GetReminder(owner, heater string) (ReminderState, bool, error) {
+	reminders, err := h.readReminders(owner)
+	if err != nil {
+		return ReminderState{}, false, err
+	}
+	state, ok := reminders[heater]
+	return state, ok, nil
+}
+
+// UpdateReminder replaces the heater's reminder state with the result of
+// update, which is passed the current state and whether there is one. The
+// state is removed if update returns false. update must not use the store,
+// which is locked while it runs.
+func (h *Store) UpdateReminder(owner, heater string, update func(state ReminderState, ok bool) (ReminderState, bool)) error {
+	return h.updateReminders(owner, func(reminders map[string]ReminderState) {
+		state, ok := reminders[heater]
+		state, keep := update(state, ok)
+		if keep {
+			reminders[heater] = state
+		} else {
+			delete(reminders, heater)
+		}
+	})
+}
+
+// DelReminder removes the heater's reminder state.
+func (h *Store) DelReminder(owner, heater string) error {
+	return h.updateReminders(owner, func(reminders map[string]ReminderState) {
+		delete(reminders, heater)
+	})
+}
+
+// ReminderAfter returns how long the heater may be on before username, who
+// turned it on, is asked whether it is still needed. The heater's setting
+// takes precedence over the user's. A negative value means never.
+func (h *Store) ReminderAfter(owner, heater, username string) time.Duration {
+	config, err := h.GetConfig(owner, heater)
+	if err == nil && config.ReminderAfter != 0 {
+		return time.Duration(config.ReminderAfter)
+	}
+	profile, err := h.GetProfile(username)
+	if err == nil && profile.ReminderAfter != 0 {
+		return time.Duration(profile.ReminderAfter)
+	}
+	return DefaultReminderAfter
+}
+
+func (h *Store) updateReminders(owner string, update func(map[string]ReminderState)) error {
+	h.Lock()
+	defer h.Unlock()
+	reminders, err := h.readReminders(owner)
+	if err != nil {
+		return err
+	}
+	update(reminders)
+	data, err := json.Marshal(reminders)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(h.Dir, owner, RemindersFilename), data, 0644)
+}
+
+func (h *Store) readReminders(owner string) (map[string]ReminderState, error) {
+	reminders := make(map[string]ReminderState)
+	data, err := ioutil.ReadFile(filepath.Join(h.Dir, owner, RemindersFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return reminders, nil
+		}
+		return reminders, err
+	}
+	err = json.Unmarshal(data, &reminders)
+	return reminders, err
+}
@@ -0,0 +1,119 @@
+package heaterstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ScheduleFilename holds the scheduled actions for the heaters in a namespace
+// as a JSON list of Action.
+const ScheduleFilename = ".schedule"
+
+// Action is a change to a heater's value that will be made at a later time.
+type Action struct {
+	ID     string    `json:"id"`
+	Heater string    `json:"heater"`
+	At     time.Time `json:"at"`
+	Value  string    `json:"value"`
+	// CreatedBy is the user on whose behalf the change will be made.
+	CreatedBy string `json:"createdBy"`
+	// Source names the feature that scheduled the action, such as "ready".
+	// Actions from one source can be replaced without affecting others.
+	Source string `json:"source"`
+	// Reason is shown to users to explain the action.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Schedule returns the namespace's scheduled actions, earliest first.
+func (h *Store) Schedule(owner string) ([]Action, error) {
+	actions := []Action{}
+	data, err := ioutil.ReadFile(filepath.Join(h.Dir, owner, ScheduleFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return actions, nil
+		}
+		return actions, err
+	}
+	err = json.Unmarshal(data, &actions)
+	sort.SliceStable(actions, func(i, j int) bool { return actions[i].At.Before(actions[j].At) })
+	return actions, err
+}
+
+// ReplaceActions removes the heater's actions from source and schedules the
+// given ones in their place. Each new action gets an ID, and its Heater and
+// Source are set.
+func (h *Store) ReplaceActions(owner, heater, source string, actions []Action) ([]Action, error) {
+	h.Lock()
+	defer h.Unlock()
+	existing, err := h.Schedule(owner)
+	if err != nil {
+		return actions, err
+	}
+	kept := []Action{}
+	for _, action := range existing {
+		if action.Heater != heater || action.Source != source {
+			kept = append(kept, action)
+		}
+	}
+	for i := range actions {
+		actions[i].ID = strings.ReplaceAll(uuid.New().String(), "-", "")
+		actions[i].Heater = heater
+		actions[i].Source = source
+	}
+	return actions, h.writeSchedule(owner, append(kept, actions...))
+}
+
+// TakeDueActions removes and returns the namespace's actions that are due at
+// now, earliest first.
+func (h *Store) TakeDueActions(owner string, now time.Time) ([]Action, error) {
+	h.Lock()
+	defer h.Unlock()
+	existing, err := h.Schedule(owner)
+	if err != nil {
+		return []Action{}, err
+	}
+	due := []Action{}
+	kept := []Action{}
+	for _, action := range existing {
+		if action.At.After(now) {
+			kept = append(kept, action)
+		} else {
+			due = append(due, action)
+		}
+	}
+	if len(due) == 0 {
+		return due, nil
+	}
+	return due, h.writeSchedule(owner, kept)
+}
+
+// Namespaces returns the owner namespace of every user and group that has at
+// least one heater.
+func (h *Store) Namespaces() ([]string, error) {
+	refs, err := h.AllHeaters()
+	if err != nil {
+		return []string{}, err
+	}
+	namespaces := []string{}
+	for _, ref := range refs {
+		if len(namespaces) == 0 || namespaces[len(namespaces)-1] != ref.Owner {
+			namespaces = append(namespaces, ref.Owner)
+		}
+	}
+	return namespaces, nil
+}
+
+func (h *Store) writeSchedule(owner string, actions []Action) error {
+	data, err := json.Marshal(actions)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(h.Dir, owner, ScheduleFilename), data, 0644)
+}
@@ -0,0 +1,85 @@
+package heaterstore
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ShortcutsFilename holds a user's shortcuts as a JSON list of Shortcut.
+const ShortcutsFilename = ".shortcuts"
+
+// Shortcut is a command that a user can run by opening a signed URL, such as
+// from an NFC tag or a phone shortcut, without talking to the bot.
+type Shortcut struct {
+	ID     string `json:"id"`
+	Owner  string `json:"owner"`
+	Heater string `json:"heater"`
+	// Value is what the heater is set to.
+	Value string `json:"value"`
+	// For, if set, is how long the heater stays on before it is turned off.
+	For Duration `json:"for,omitempty"`
+	// Secret is the key with which the shortcut's URLs are signed.
+	Secret    string    `json:"secret"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Shortcuts returns the user's shortcuts, oldest first.
+func (h *Store) Shortcuts(username string) ([]Shortcut, error) {
+	shortcuts := []Shortcut{}
+	err := readJSON(h.userFile(username, ShortcutsFilename), &shortcuts)
+	return shortcuts, err
+}
+
+// GetShortcut returns the user's shortcut with the given ID. The second return
+// value is false if there is none.
+func (h *Store) GetShortcut(username, id string) (Shortcut, bool, error) {
+	shortcuts, err := h.Shortcuts(username)
+	if err != nil {
+		return Shortcut{}, false, err
+	}
+	for _, shortcut := range shortcuts {
+		if shortcut.ID == id {
+			return shortcut, true, nil
+		}
+	}
+	return Shortcut{}, false, nil
+}
+
+// AddShortcut saves a new shortcut for the user, giving it an ID and a
+// secret.
+func (h *Store) AddShortcut(username string, shortcut Shortcut) (Shortcut, error) {
+	secret, err := NewToken()
+	if err != nil {
+		return shortcut, err
+	}
+	shortcut.ID = strings.ReplaceAll(uuid.New().String(), "-", "")
+	shortcut.Secret = secret
+	shortcut.CreatedAt = time.Now()
+	h.Lock()
+	defer h.Unlock()
+	shortcuts, err := h.Shortcuts(username)
+	if err != nil {
+		return shortcut, err
+	}
+	return shortcut, h.writeUserJSON(username, ShortcutsFilename, append(shortcuts, shortcut))
+}
+
+// RemoveShortcut removes the user's shortcut with the given ID, so that its
+// URLs stop working.
+func (h *Store) RemoveShortcut(username, id string) error {
+	h.Lock()
+	defer h.Unlock()
+	shortcuts, err := h.Shortcuts(username)
+	if err != nil {
+		return err
+	}
+	kept := []Shortcut{}
+	for _, shortcut := range shortcuts {
+		if shortcut.ID != id {
+			kept = append(kept, shortcut)
+		}
+	}
+	return h.writeUserJSON(username, ShortcutsFilename, kept)
+}
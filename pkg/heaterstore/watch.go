@@ -0,0 +1,153 @@
+package heaterstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WatchersFilename holds, for each heater in a namespace, the list of users
+// who want to be told when it changes. It is a JSON object mapping heater ID
+// to a list of usernames.
+const WatchersFilename = ".watchers"
+
+// NotifyPreference controls which heater changes a user is told about.
+type NotifyPreference string
+
+const (
+	// NotifyAll sends a message for every change, including the user's own.
+	NotifyAll NotifyPreference = "all"
+	// NotifyOthers sends a message only for changes made by someone else. It
+	// is the default.
+	NotifyOthers NotifyPreference = "others"
+	// NotifyNone never sends a message about changes.
+	NotifyNone NotifyPreference = "none"
+)
+
+// ParseNotifyPreference returns the NotifyPreference named by s.
+func ParseNotifyPreference(s string) (NotifyPreference, error) {
+	switch p := NotifyPreference(strings.ToLower(s)); p {
+	case NotifyAll, NotifyOthers, NotifyNone:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown notification preference %q; must be one of all, others, none", s)
+}
+
+// Wants returns true if a user with this preference should be told about a
+// change that was made by the user named by. username is the user whose
+// preference this is.
+func (p NotifyPreference) Wants(username, by string) bool {
+	switch p {
+	case NotifyAll:
+		return true
+	case NotifyNone:
+		return false
+	default:
+		return username != by
+	}
+}
+
+// Watchers returns the users watching the heater.
+func (h *Store) Watchers(owner, heater string) ([]string, error) {
+	watchers, err := h.readWatchers(owner)
+	if err != nil {
+		return []string{}, err
+	}
+	if watchers[heater] == nil {
+		return []string{}, nil
+	}
+	return watchers[heater], nil
+}
+
+// Watching returns the heaters that username watches. Their Role is empty,
+// since watching a heater doesn't give access to it.
+func (h *Store) Watching(username string) ([]HeaterRef, error) {
+	refs := []HeaterRef{}
+	all, err := h.AllHeaters()
+	if err != nil {
+		return refs, err
+	}
+	byNamespace := make(map[string]map[string][]string)
+	for _, ref := range all {
+		watchers, ok := byNamespace[ref.Owner]
+		if !ok {
+			watchers, err = h.readWatchers(ref.Owner)
+			if err != nil {
+				return refs, err
+			}
+			byNamespace[ref.Owner] = watchers
+		}
+		for _, watcher := range watchers[ref.Heater] {
+			if watcher == username {
+				refs = append(refs, HeaterRef{Owner: ref.Owner, Heater: ref.Heater})
+				break
+			}
+		}
+	}
+	return refs, nil
+}
+
+// AddWatcher adds username to the heater's watchers.
+func (h *Store) AddWatcher(owner, heater, username string) error {
+	h.Lock()
+	defer h.Unlock()
+	if !ValidName(username) {
+		return fmt.Errorf("invalid username %q", username)
+	}
+	watchers, err := h.readWatchers(owner)
+	if err != nil {
+		return err
+	}
+	for _, watcher := range watchers[heater] {
+		if watcher == username {
+			return nil
+		}
+	}
+	watchers[heater] = append(watchers[heater], username)
+	return h.writeWatchers(owner, watchers)
+}
+
+// RemoveWatcher removes username from the heater's watchers.
+func (h *Store) RemoveWatcher(owner, heater, username string) error {
+	h.Lock()
+	defer h.Unlock()
+	watchers, err := h.readWatchers(owner)
+	if err != nil {
+		return err
+	}
+	remaining := []string{}
+	for _, watcher := range watchers[heater] {
+		if watcher != username {
+			remaining = append(remaining, watcher)
+		}
+	}
+	if len(remaining) == len(watchers[heater]) {
+		return fmt.Errorf("%s is not watching %s", username, heater)
+	}
+	watchers[heater] = remaining
+	return h.writeWatchers(owner, watchers)
+}
+
+func (h *Store) readWatchers(owner string) (map[string][]string, error) {
+	watchers := make(map[string][]string)
+	data, err := ioutil.ReadFile(filepath.Join(h.Dir, owner, WatchersFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return watchers, nil
+		}
+		return watchers, err
+	}
+	err = json.Unmarshal(data, &watchers)
+	return watchers, err
+}
+
+func (h *Store) writeWatchers(owner string, watchers map[string][]string) error {
+	data, err := json.Marshal(watchers)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(h.Dir, owner, WatchersFilename), data, 0644)
+}
@@ -0,0 +1,158 @@
+package heaterstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// WebhooksFilename holds a user's webhooks as a JSON list of Webhook.
+	WebhooksFilename = ".webhooks"
+	// DeliveriesFilename holds the webhook deliveries waiting to be made
+	// to a user's webhooks, as a JSON list of Delivery.
+	DeliveriesFilename = ".deliveries"
+	// MaxDeliveries is how many deliveries may wait for a user. Once there
+	// are more, the oldest are dropped.
+	MaxDeliveries = 1000
+)
+
+// Webhook is a URL to which events about a user's heaters are posted.
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Secret is the key with which payloads are signed.
+	Secret    string    `json:"secret"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Delivery is an event waiting to be posted to a webhook.
+type Delivery struct {
+	ID        string          `json:"id"`
+	WebhookID string          `json:"webhookID"`
+	Event     string          `json:"event"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"createdAt"`
+	// Attempts counts the failed attempts so far.
+	Attempts int `json:"attempts,omitempty"`
+	// NextAt is when the next attempt is due.
+	NextAt    time.Time `json:"nextAt"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// Webhooks returns the user's webhooks, oldest first.
+func (h *Store) Webhooks(username string) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	err := readJSON(h.userFile(username, WebhooksFilename), &webhooks)
+	return webhooks, err
+}
+
+// AddWebhook saves a new webhook for the user, giving it an ID and a secret.
+func (h *Store) AddWebhook(username, url string) (Webhook, error) {
+	secret, err := NewToken()
+	if err != nil {
+		return Webhook{}, err
+	}
+	webhook := Webhook{
+		ID:        strings.ReplaceAll(uuid.New().String(), "-", ""),
+		URL:       url,
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	}
+	h.Lock()
+	defer h.Unlock()
+	webhooks, err := h.Webhooks(username)
+	if err != nil {
+		return webhook, err
+	}
+	return webhook, h.writeUserJSON(username, WebhooksFilename, append(webhooks, webhook))
+}
+
+// RemoveWebhook removes the user's webhook with the given ID, along with any
+// deliveries waiting for it.
+func (h *Store) RemoveWebhook(username, id string) error {
+	h.Lock()
+	webhooks, err := h.Webhooks(username)
+	if err != nil {
+		h.Unlock()
+		return err
+	}
+	kept := []Webhook{}
+	for _, webhook := range webhooks {
+		if webhook.ID != id {
+			kept = append(kept, webhook)
+		}
+	}
+	err = h.writeUserJSON(username, WebhooksFilename, kept)
+	h.Unlock()
+	if err != nil {
+		return err
+	}
+	return h.UpdateDeliveries(username, func(deliveries []Delivery) []Delivery {
+		kept := []Delivery{}
+		for _, delivery := range deliveries {
+			if delivery.WebhookID != id {
+				kept = append(kept, delivery)
+			}
+		}
+		return kept
+	})
+}
+
+// Deliveries returns the deliveries waiting for the user's webhooks, oldest
+// first.
+func (h *Store) Deliveries(username string) ([]Delivery, error) {
+	deliveries := []Delivery{}
+	err := readJSON(h.userFile(username, DeliveriesFilename), &deliveries)
+	return deliveries, err
+}
+
+// UpdateDeliveries replaces the user's waiting deliveries with the result of
+// update, keeping at most MaxDeliveries.
+func (h *Store) UpdateDeliveries(username string, update func([]Delivery) []Delivery) error {
+	h.Lock()
+	defer h.Unlock()
+	deliveries, err := h.Deliveries(username)
+	if err != nil {
+		return err
+	}
+	deliveries = update(deliveries)
+	if len(deliveries) > MaxDeliveries {
+		deliveries = deliveries[len(deliveries)-MaxDeliveries:]
+	}
+	return h.writeUserJSON(username, DeliveriesFilename, deliveries)
+}
+
+// readJSON unmarshals the file into v, leaving v as it is if the file does not
+// exist.
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// writeUserJSON writes v to one of username's own files.
+func (h *Store) writeUserJSON(username, filename string, v interface{}) error {
+	path, err := h.prepareUserFile(username, filename)
+	if err != nil {
+		return err
+	}
+	return writeJSON(path, v)
+}
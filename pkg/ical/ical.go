@@ -0,0 +1,276 @@
+// Package ical parses the events in an iCalendar (RFC 5545) feed and expands
+// recurring events into their occurrences.
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is a VEVENT.
+type Event struct {
+	UID         string
+	Summary     string
+	Description string
+	Start       time.Time
+	End         time.Time
+	AllDay      bool
+	// Rule is the parsed RRULE, or nil if the event doesn't recur.
+	Rule *Rule
+	// ExDates are the starts of occurrences excluded from Rule.
+	ExDates []time.Time
+	// RecurrenceID, if not zero, means this event replaces the occurrence
+	// of the recurring event with the same UID that would have started then.
+	RecurrenceID time.Time
+	Cancelled    bool
+}
+
+// Occurrence is one instance of an event.
+type Occurrence struct {
+	UID     string
+	Summary string
+	Start   time.Time
+	End     time.Time
+}
+
+// Parse reads the events from a feed. Times without a time zone, and times
+// whose TZID is not a known IANA name, are in loc.
+func Parse(r io.Reader, loc *time.Location) ([]Event, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+	events := []Event{}
+	var current *Event
+	var duration time.Duration
+	for _, line := range lines {
+		name, params, value := splitProperty(line)
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			current = &Event{}
+			duration = -1
+			continue
+		case name == "END" && value == "VEVENT":
+			if current == nil {
+				continue
+			}
+			if current.Start.IsZero() {
+				return events, fmt.Errorf("event %q has no DTSTART", current.UID)
+			}
+			if current.End.IsZero() {
+				switch {
+				case duration >= 0:
+					current.End = current.Start.Add(duration)
+				case current.AllDay:
+					current.End = current.Start.AddDate(0, 0, 1)
+				default:
+					current.End = current.Start
+				}
+			}
+			events = append(events, *current)
+			current = nil
+			continue
+		}
+		if current == nil {
+			continue
+		}
+
+		switch name {
+		case "UID":
+			current.UID = value
+		case "SUMMARY":
+			current.Summary = unescape(value)
+		case "DESCRIPTION":
+			current.Description = unescape(value)
+		case "STATUS":
+			current.Cancelled = value == "CANCELLED"
+		case "DTSTART":
+			current.Start, current.AllDay, err = parseTime(value, params, loc)
+		case "DTEND":
+			current.End, _, err = parseTime(value, params, loc)
+		case "DURATION":
+			duration, err = parseDuration(value)
+		case "RECURRENCE-ID":
+			current.RecurrenceID, _, err = parseTime(value, params, loc)
+		case "RRULE":
+			current.Rule, err = parseRule(value, loc)
+		case "EXDATE":
+			for _, v := range strings.Split(value, ",") {
+				var t time.Time
+				t, _, err = parseTime(v, params, loc)
+				if err != nil {
+					break
+				}
+				current.ExDates = append(current.ExDates, t)
+			}
+		}
+		if err != nil {
+			return events, fmt.Errorf("invalid %s in event %q: %w", name, current.UID, err)
+		}
+	}
+	return events, nil
+}
+
+// Occurrences returns the occurrences of the events that overlap the period
+// from from to to, earliest first. Cancelled events are left out.
+func Occurrences(events []Event, from, to time.Time) []Occurrence {
+	// occurrences that were moved or cancelled, by UID and original start
+	overridden := make(map[string]bool)
+	for _, e := range events {
+		if !e.RecurrenceID.IsZero() {
+			overridden[e.UID+"|"+e.RecurrenceID.UTC().Format(time.RFC3339)] = true
+		}
+	}
+
+	occurrences := []Occurrence{}
+	add := func(e Event, start time.Time) {
+		end := start.Add(e.End.Sub(e.Start))
+		if end.After(from) && start.Before(to) {
+			occurrences = append(occurrences, Occurrence{UID: e.UID, Summary: e.Summary, Start: start, End: end})
+		}
+	}
+	for _, e := range events {
+		if e.Cancelled {
+			continue
+		}
+		if e.Rule == nil || !e.RecurrenceID.IsZero() {
+			add(e, e.Start)
+			continue
+		}
+		excluded := make(map[int64]bool)
+		for _, t := range e.ExDates {
+			excluded[t.Unix()] = true
+		}
+		for _, start := range e.Rule.expand(e.Start, to) {
+			if excluded[start.Unix()] || overridden[e.UID+"|"+start.UTC().Format(time.RFC3339)] {
+				continue
+			}
+			add(e, start)
+		}
+	}
+	sort.SliceStable(occurrences, func(i, j int) bool { return occurrences[i].Start.Before(occurrences[j].Start) })
+	return occurrences
+}
+
+// unfold reads content lines, joining lines that were folded onto the next.
+func unfold(r io.Reader) ([]string, error) {
+	lines := []string{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// splitProperty splits a content line into its name, parameters and value.
+func splitProperty(line string) (string, map[string]string, string) {
+	params := make(map[string]string)
+	quoted := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return strings.ToUpper(line), params, ""
+	}
+	parts := strings.Split(line[:colon], ";")
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return strings.ToUpper(parts[0]), params, line[colon+1:]
+}
+
+func unescape(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s)
+}
+
+// parseTime parses a DATE or DATE-TIME value. The second return value is true
+// for a DATE.
+func parseTime(value string, params map[string]string, loc *time.Location) (time.Time, bool, error) {
+	if tzid, ok := params["TZID"]; ok {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	if params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err := time.ParseInLocation("20060102", value, loc)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
+
+// parseDuration parses a DURATION value such as "PT1H30M" or "P1D".
+func parseDuration(value string) (time.Duration, error) {
+	s := value
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimLeft(s, "+-")
+	if !strings.HasPrefix(s, "P") {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	s = s[1:]
+	var d time.Duration
+	inTime := false
+	number := ""
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			number += string(c)
+			continue
+		case c == 'T':
+			inTime = true
+			continue
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		number = ""
+		switch {
+		case c == 'W':
+			d += time.Duration(n) * 7 * 24 * time.Hour
+		case c == 'D':
+			d += time.Duration(n) * 24 * time.Hour
+		case c == 'H' && inTime:
+			d += time.Duration(n) * time.Hour
+		case c == 'M' && inTime:
+			d += time.Duration(n) * time.Minute
+		case c == 'S' && inTime:
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+	}
+	if number != "" {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	if negative {
+		d = -d
+	}
+	return d, nil
+}
@@ -0,0 +1,215 @@
+package ical
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func parse(t *testing.T, loc *time.Location, events ...string) []Event {
+	t.Helper()
+	feed := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" + strings.Join(events, "") + "END:VCALENDAR\r\n"
+	parsed, err := Parse(strings.NewReader(feed), loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func checkStarts(t *testing.T, occurrences []Occurrence, expected ...time.Time) {
+	t.Helper()
+	if len(occurrences) != len(expected) {
+		t.Fatalf("expected %d occurrences, got %d: %v", len(expected), len(occurrences), occurrences)
+	}
+	for i := range expected {
+		if !occurrences[i].Start.Equal(expected[i]) {
+			t.Errorf("occurrence %d: expected start %s, got %s", i, expected[i], occurrences[i].Start)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	anchorage := loadLocation(t, "America/Anchorage")
+	events := parse(t, anchorage,
+		"BEGIN:VEVENT\r\nUID:1\r\nSUMMARY:Lesson\\, N123 \r\n with an instructor\r\nDTSTART:20210115T170000Z\r\nDTEND:20210115T190000Z\r\nEND:VEVENT\r\n",
+		// no time zone, so in the given location
+		"BEGIN:VEVENT\r\nUID:2\r\nDTSTART:20210116T080000\r\nDURATION:PT1H30M\r\nEND:VEVENT\r\n",
+		// an unknown TZID is also in the given location
+		"BEGIN:VEVENT\r\nUID:3\r\nDTSTART;TZID=Club Time:20210117T080000\r\nEND:VEVENT\r\n",
+		"BEGIN:VEVENT\r\nUID:4\r\nDTSTART;VALUE=DATE:20210118\r\nSTATUS:CANCELLED\r\nEND:VEVENT\r\n",
+		"BEGIN:VEVENT\r\nUID:5\r\nDTSTART;TZID=Europe/Berlin:20210119T080000\r\nDTEND;TZID=Europe/Berlin:20210119T090000\r\nEND:VEVENT\r\n",
+	)
+	if len(events) != 5 {
+		t.Fatalf("expected 5 events, got %d", len(events))
+	}
+	for i, tc := range []struct {
+		start, end time.Time
+		allDay     bool
+	}{
+		{start: time.Date(2021, time.January, 15, 17, 0, 0, 0, time.UTC), end: time.Date(2021, time.January, 15, 19, 0, 0, 0, time.UTC)},
+		{start: time.Date(2021, time.January, 16, 8, 0, 0, 0, anchorage), end: time.Date(2021, time.January, 16, 9, 30, 0, 0, anchorage)},
+		{start: time.Date(2021, time.January, 17, 8, 0, 0, 0, anchorage), end: time.Date(2021, time.January, 17, 8, 0, 0, 0, anchorage)},
+		{start: time.Date(2021, time.January, 18, 0, 0, 0, 0, anchorage), end: time.Date(2021, time.January, 19, 0, 0, 0, 0, anchorage), allDay: true},
+		{start: time.Date(2021, time.January, 19, 7, 0, 0, 0, time.UTC), end: time.Date(2021, time.January, 19, 8, 0, 0, 0, time.UTC)},
+	} {
+		e := events[i]
+		if !e.Start.Equal(tc.start) || !e.End.Equal(tc.end) || e.AllDay != tc.allDay {
+			t.Errorf("event %s: expected %s to %s (all day %v), got %s to %s (all day %v)",
+				e.UID, tc.start, tc.end, tc.allDay, e.Start, e.End, e.AllDay)
+		}
+	}
+	if events[0].Summary != "Lesson, N123 with an instructor" {
+		t.Errorf("unexpected summary %q", events[0].Summary)
+	}
+	if !events[3].Cancelled {
+		t.Error("expected event 4 to be cancelled")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, event := range []string{
+		"BEGIN:VEVENT\r\nUID:1\r\nSUMMARY:no start\r\nEND:VEVENT\r\n",
+		"BEGIN:VEVENT\r\nUID:1\r\nDTSTART:2021-01-15\r\nEND:VEVENT\r\n",
+		"BEGIN:VEVENT\r\nUID:1\r\nDTSTART:20210115T170000Z\r\nRRULE:FREQ=HOURLY\r\nEND:VEVENT\r\n",
+		"BEGIN:VEVENT\r\nUID:1\r\nDTSTART:20210115T170000Z\r\nRRULE:FREQ=DAILY;INTERVAL=0\r\nEND:VEVENT\r\n",
+		"BEGIN:VEVENT\r\nUID:1\r\nDTSTART:20210115T170000Z\r\nRRULE:FREQ=WEEKLY;BYDAY=XX\r\nEND:VEVENT\r\n",
+		"BEGIN:VEVENT\r\nUID:1\r\nDTSTART:20210115T170000Z\r\nDURATION:1H\r\nEND:VEVENT\r\n",
+	} {
+		_, err := Parse(strings.NewReader("BEGIN:VCALENDAR\r\n"+event+"END:VCALENDAR\r\n"), time.UTC)
+		if err == nil {
+			t.Errorf("expected an error parsing %q", event)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"PT1H30M":   90 * time.Minute,
+		"P1D":       24 * time.Hour,
+		"P1W":       7 * 24 * time.Hour,
+		"P1DT2H":    26 * time.Hour,
+		"PT45S":     45 * time.Second,
+		"-PT15M":    -15 * time.Minute,
+		"+PT1H":     time.Hour,
+		"P0D":       0,
+		"PT1H30M0S": 90 * time.Minute,
+	} {
+		d, err := parseDuration(value)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", value, err.Error())
+			continue
+		}
+		if d != expected {
+			t.Errorf("%s: expected %s, got %s", value, expected, d)
+		}
+	}
+	for _, value := range []string{"", "1H", "P1H", "PT1", "P1X"} {
+		_, err := parseDuration(value)
+		if err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+}
+
+func TestWeeklyByDayUntilAcrossDST(t *testing.T) {
+	newYork := loadLocation(t, "America/New_York")
+	// DST starts on 2021-03-14; bookings stay at 09:00 local time
+	events := parse(t, time.UTC,
+		"BEGIN:VEVENT\r\nUID:lesson\r\nDTSTART;TZID=America/New_York:20210301T090000\r\nDTEND;TZID=America/New_York:20210301T100000\r\nRRULE:FREQ=WEEKLY;BYDAY=MO,WE;UNTIL=20210317T130000Z\r\nEND:VEVENT\r\n")
+	occurrences := Occurrences(events, time.Date(2021, time.February, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, time.April, 1, 0, 0, 0, 0, time.UTC))
+	checkStarts(t, occurrences,
+		time.Date(2021, time.March, 1, 9, 0, 0, 0, newYork),
+		time.Date(2021, time.March, 3, 9, 0, 0, 0, newYork),
+		time.Date(2021, time.March, 8, 9, 0, 0, 0, newYork),
+		time.Date(2021, time.March, 10, 9, 0, 0, 0, newYork),
+		time.Date(2021, time.March, 15, 9, 0, 0, 0, newYork),
+		// UNTIL is inclusive
+		time.Date(2021, time.March, 17, 9, 0, 0, 0, newYork),
+	)
+	if occurrences[0].Start.UTC().Hour() != 14 || occurrences[4].Start.UTC().Hour() != 13 {
+		t.Errorf("expected the UTC hour to change with DST, got %s and %s", occurrences[0].Start.UTC(), occurrences[4].Start.UTC())
+	}
+	for _, o := range occurrences {
+		if o.End.Sub(o.Start) != time.Hour {
+			t.Errorf("expected each occurrence to last an hour, got %s to %s", o.Start, o.End)
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	events := parse(t, time.UTC,
+		"BEGIN:VEVENT\r\nUID:1\r\nDTSTART:20210115T170000Z\r\nRRULE:FREQ=DAILY;INTERVAL=2;COUNT=3\r\nEND:VEVENT\r\n")
+	occurrences := Occurrences(events, time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC))
+	checkStarts(t, occurrences,
+		time.Date(2021, time.January, 15, 17, 0, 0, 0, time.UTC),
+		time.Date(2021, time.January, 17, 17, 0, 0, 0, time.UTC),
+		time.Date(2021, time.January, 19, 17, 0, 0, 0, time.UTC),
+	)
+
+	// COUNT counts from the start of the series, not the queried period
+	occurrences = Occurrences(events, time.Date(2021, time.January, 18, 0, 0, 0, 0, time.UTC), time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC))
+	checkStarts(t, occurrences, time.Date(2021, time.January, 19, 17, 0, 0, 0, time.UTC))
+}
+
+func TestMonthlyByDay(t *testing.T) {
+	events := parse(t, time.UTC,
+		"BEGIN:VEVENT\r\nUID:1\r\nDTSTART:20210129T170000Z\r\nRRULE:FREQ=MONTHLY;BYDAY=-1FR;COUNT=3\r\nEND:VEVENT\r\n",
+		"BEGIN:VEVENT\r\nUID:2\r\nDTSTART:20210112T180000Z\r\nRRULE:FREQ=MONTHLY;BYDAY=2TU;UNTIL=20210331\r\nEND:VEVENT\r\n",
+	)
+	occurrences := Occurrences(events, time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, time.December, 1, 0, 0, 0, 0, time.UTC))
+	checkStarts(t, occurrences,
+		time.Date(2021, time.January, 12, 18, 0, 0, 0, time.UTC),
+		time.Date(2021, time.January, 29, 17, 0, 0, 0, time.UTC),
+		time.Date(2021, time.February, 9, 18, 0, 0, 0, time.UTC),
+		time.Date(2021, time.February, 26, 17, 0, 0, 0, time.UTC),
+		time.Date(2021, time.March, 9, 18, 0, 0, 0, time.UTC),
+		time.Date(2021, time.March, 26, 17, 0, 0, 0, time.UTC),
+	)
+}
+
+func TestExDateAndRecurrenceID(t *testing.T) {
+	anchorage := loadLocation(t, "America/Anchorage")
+	events := parse(t, anchorage,
+		"BEGIN:VEVENT\r\nUID:daily\r\nSUMMARY:Rental\r\nDTSTART:20210115T080000\r\nDTEND:20210115T100000\r\nRRULE:FREQ=DAILY;COUNT=5\r\nEXDATE:20210116T080000,20210117T080000\r\nEND:VEVENT\r\n",
+		// moves the occurrence on the 18th later in the day
+		"BEGIN:VEVENT\r\nUID:daily\r\nSUMMARY:Moved\r\nRECURRENCE-ID:20210118T080000\r\nDTSTART:20210118T130000\r\nDTEND:20210118T150000\r\nEND:VEVENT\r\n",
+		// cancels the occurrence on the 19th
+		"BEGIN:VEVENT\r\nUID:daily\r\nRECURRENCE-ID:20210119T080000\r\nDTSTART:20210119T080000\r\nSTATUS:CANCELLED\r\nEND:VEVENT\r\n",
+	)
+	occurrences := Occurrences(events, time.Date(2021, time.January, 1, 0, 0, 0, 0, anchorage), time.Date(2021, time.February, 1, 0, 0, 0, 0, anchorage))
+	checkStarts(t, occurrences,
+		time.Date(2021, time.January, 15, 8, 0, 0, 0, anchorage),
+		time.Date(2021, time.January, 18, 13, 0, 0, 0, anchorage),
+	)
+	if occurrences[1].Summary != "Moved" {
+		t.Errorf("expected the moved occurrence, got %q", occurrences[1].Summary)
+	}
+}
+
+func TestOccurrencesOverlapPeriod(t *testing.T) {
+	events := parse(t, time.UTC,
+		"BEGIN:VEVENT\r\nUID:1\r\nDTSTART:20210115T170000Z\r\nDTEND:20210115T190000Z\r\nEND:VEVENT\r\n")
+	for _, tc := range []struct {
+		from, to time.Time
+		expected int
+	}{
+		{from: time.Date(2021, time.January, 15, 18, 0, 0, 0, time.UTC), to: time.Date(2021, time.January, 16, 0, 0, 0, 0, time.UTC), expected: 1},
+		{from: time.Date(2021, time.January, 15, 0, 0, 0, 0, time.UTC), to: time.Date(2021, time.January, 15, 18, 0, 0, 0, time.UTC), expected: 1},
+		{from: time.Date(2021, time.January, 15, 19, 0, 0, 0, time.UTC), to: time.Date(2021, time.January, 16, 0, 0, 0, 0, time.UTC), expected: 0},
+		{from: time.Date(2021, time.January, 15, 0, 0, 0, 0, time.UTC), to: time.Date(2021, time.January, 15, 17, 0, 0, 0, time.UTC), expected: 0},
+	} {
+		occurrences := Occurrences(events, tc.from, tc.to)
+		if len(occurrences) != tc.expected {
+			t.Errorf("%s to %s: expected %d occurrences, got %d", tc.from, tc.to, tc.expected, len(occurrences))
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package ical
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPeriods bounds how many days, weeks, months or years of a rule are
+// expanded.
+const maxPeriods = 5000
+
+// Rule is a recurrence rule. Only the parts that booking systems commonly use
+// are supported: FREQ, INTERVAL, COUNT, UNTIL, BYDAY, BYMONTHDAY and
+// BYMONTH.
+type Rule struct {
+	Freq     string
+	Interval int
+	Count    int
+	Until    time.Time
+	// ByDay holds weekdays, each with an ordinal within the month or year
+	// such as -1 for the last one, or 0 for every one.
+	ByDay      []WeekdayNum
+	ByMonthDay []int
+	ByMonth    []time.Month
+}
+
+// WeekdayNum is a BYDAY entry such as "2TU" or "MO".
+type WeekdayNum struct {
+	N       int
+	Weekday time.Weekday
+}
+
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+func parseRule(value string, loc *time.Location) (*Rule, error) {
+	r := &Rule{Interval: 1}
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid rule part %q", part)
+		}
+		var err error
+		switch kv[0] {
+		case "FREQ":
+			r.Freq = kv[1]
+		case "INTERVAL":
+			r.Interval, err = strconv.Atoi(kv[1])
+			if err == nil && r.Interval < 1 {
+				err = fmt.Errorf("invalid interval %d", r.Interval)
+			}
+		case "COUNT":
+			r.Count, err = strconv.Atoi(kv[1])
+		case "UNTIL":
+			r.Until, _, err = parseTime(kv[1], nil, loc)
+		case "BYDAY":
+			for _, v := range strings.Split(kv[1], ",") {
+				if len(v) < 2 {
+					return nil, fmt.Errorf("invalid BYDAY %q", v)
+				}
+				day, ok := weekdays[v[len(v)-2:]]
+				if !ok {
+					return nil, fmt.Errorf("invalid BYDAY %q", v)
+				}
+				n := 0
+				if len(v) > 2 {
+					n, err = strconv.Atoi(v[:len(v)-2])
+					if err != nil {
+						return nil, err
+					}
+				}
+				r.ByDay = append(r.ByDay, WeekdayNum{N: n, Weekday: day})
+			}
+		case "BYMONTHDAY":
+			for _, v := range strings.Split(kv[1], ",") {
+				day, err := strconv.Atoi(v)
+				if err != nil {
+					return nil, err
+				}
+				r.ByMonthDay = append(r.ByMonthDay, day)
+			}
+		case "BYMONTH":
+			for _, v := range strings.Split(kv[1], ",") {
+				month, err := strconv.Atoi(v)
+				if err != nil {
+					return nil, err
+				}
+				r.ByMonth = append(r.ByMonth, time.Month(month))
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch r.Freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+	default:
+		return nil, fmt.Errorf("unsupported frequency %q", r.Freq)
+	}
+	return r, nil
+}
+
+// expand returns the starts of the rule's occurrences, beginning with start
+// and ending before to. Each keeps start's time of day in start's location.
+func (r *Rule) expand(start, to time.Time) []time.Time {
+	out := []time.Time{}
+	hour, minute, second := start.Clock()
+	for period := 0; period < maxPeriods; period++ {
+		for _, day := range r.days(start, period) {
+			t := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, second, 0, start.Location())
+			if t.Before(start) {
+				continue
+			}
+			if (!r.Until.IsZero() && t.After(r.Until)) || !t.Before(to) {
+				return out
+			}
+			out = append(out, t)
+			if r.Count > 0 && len(out) >= r.Count {
+				return out
+			}
+		}
+	}
+	return out
+}
+
+// days returns the days, at midnight UTC and in order, on which the rule
+// recurs during the numbered period after the one that contains start.
+func (r *Rule) days(start time.Time, period int) []time.Time {
+	year, month, day := start.Date()
+	candidates := []time.Time{}
+	switch r.Freq {
+	case "DAILY":
+		candidates = append(candidates, date(year, month, day+period*r.Interval))
+	case "WEEKLY":
+		// weeks start on Monday
+		offset := (int(start.Weekday()) + 6) % 7
+		monday := date(year, month, day-offset+period*r.Interval*7)
+		for i := 0; i < 7; i++ {
+			d := monday.AddDate(0, 0, i)
+			if len(r.ByDay) == 0 && d.Weekday() != start.Weekday() {
+				continue
+			}
+			candidates = append(candidates, d)
+		}
+	case "MONTHLY":
+		first := date(year, month+time.Month(period*r.Interval), 1)
+		candidates = r.monthDays(first, day)
+	case "YEARLY":
+		months := r.ByMonth
+		if len(months) == 0 {
+			months = []time.Month{month}
+		}
+		for _, m := range months {
+			candidates = append(candidates, r.monthDays(date(year+period*r.Interval, m, 1), day)...)
+		}
+	}
+
+	days := []time.Time{}
+	for _, d := range candidates {
+		if r.matches(d) {
+			days = append(days, d)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days
+}
+
+// monthDays returns the days of first's month selected by BYDAY or
+// BYMONTHDAY, or else the given day of the month if it exists.
+func (r *Rule) monthDays(first time.Time, day int) []time.Time {
+	length := first.AddDate(0, 1, -1).Day()
+	days := []time.Time{}
+	switch {
+	case len(r.ByDay) > 0:
+		for _, wd := range r.ByDay {
+			matching := []time.Time{}
+			for d := 1; d <= length; d++ {
+				t := first.AddDate(0, 0, d-1)
+				if t.Weekday() == wd.Weekday {
+					matching = append(matching, t)
+				}
+			}
+			switch {
+			case wd.N == 0:
+				days = append(days, matching...)
+			case wd.N > 0 && wd.N <= len(matching):
+				days = append(days, matching[wd.N-1])
+			case wd.N < 0 && -wd.N <= len(matching):
+				days = append(days, matching[len(matching)+wd.N])
+			}
+		}
+	case len(r.ByMonthDay) > 0:
+		for _, d := range r.ByMonthDay {
+			if d < 0 {
+				d = length + d + 1
+			}
+			if d >= 1 && d <= length {
+				days = append(days, first.AddDate(0, 0, d-1))
+			}
+		}
+	case day <= length:
+		days = append(days, first.AddDate(0, 0, day-1))
+	}
+	return days
+}
+
+// matches applies the BYMONTH, BYMONTHDAY and BYDAY filters to a day.
+func (r *Rule) matches(d time.Time) bool {
+	if len(r.ByMonth) > 0 && !containsMonth(r.ByMonth, d.Month()) {
+		return false
+	}
+	if (r.Freq == "DAILY" || r.Freq == "WEEKLY") && len(r.ByMonthDay) > 0 {
+		found := false
+		for _, md := range r.ByMonthDay {
+			found = found || md == d.Day()
+		}
+		if !found {
+			return false
+		}
+	}
+	if (r.Freq == "DAILY" || r.Freq == "WEEKLY") && len(r.ByDay) > 0 {
+		found := false
+		for _, wd := range r.ByDay {
+			found = found || wd.Weekday == d.Weekday()
+		}
+		return found
+	}
+	return true
+}
+
+func containsMonth(months []time.Month, m time.Month) bool {
+	for _, v := range months {
+		if v == m {
+			return true
+		}
+	}
+	return false
+}
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,66 @@
+package ical
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxLineLength is the length in octets after which content lines are folded.
+const maxLineLength = 75
+
+const utcFormat = "20060102T150405Z"
+
+// Encode writes a calendar of the events, which must not recur. name is the
+// calendar's name for clients to show. stamp is when the calendar was
+// generated.
+func Encode(w io.Writer, name string, events []Event, stamp time.Time) error {
+	bw := bufio.NewWriter(w)
+	write := func(line string) {
+		bw.WriteString(fold(line))
+	}
+	write("BEGIN:VCALENDAR")
+	write("VERSION:2.0")
+	write("PRODID:-//preheatbot//EN")
+	write("CALSCALE:GREGORIAN")
+	write("X-WR-CALNAME:" + escape(name))
+	for _, e := range events {
+		write("BEGIN:VEVENT")
+		write("UID:" + e.UID)
+		write("DTSTAMP:" + stamp.UTC().Format(utcFormat))
+		write("DTSTART:" + e.Start.UTC().Format(utcFormat))
+		write("DTEND:" + e.End.UTC().Format(utcFormat))
+		write("SUMMARY:" + escape(e.Summary))
+		if e.Description != "" {
+			write("DESCRIPTION:" + escape(e.Description))
+		}
+		write("END:VEVENT")
+	}
+	write("END:VCALENDAR")
+	return bw.Flush()
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// fold splits a content line into lines of at most maxLineLength octets,
+// without splitting a UTF-8 sequence, and terminates it with CRLF.
+func fold(line string) string {
+	var sb strings.Builder
+	limit := maxLineLength
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		sb.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		// continuation lines start with a space
+		limit = maxLineLength - 1
+	}
+	sb.WriteString(line + "\r\n")
+	return sb.String()
+}
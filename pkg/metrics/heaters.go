@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+)
+
+// HeaterLabels are the labels that identify a heater. Exactly one of user
+// and group is set.
+var HeaterLabels = []string{"user", "group", "heater"}
+
+// HeaterLabelValues returns the values of HeaterLabels for the heater.
+func HeaterLabelValues(ref heaterstore.HeaterRef) []string {
+	if group, ok := heaterstore.GroupFromNamespace(ref.Owner); ok {
+		return []string{"", group, ref.Heater}
+	}
+	return []string{ref.Owner, "", ref.Heater}
+}
+
+// RegisterHeaters registers gauges in Default that report whether each heater
+// is on, and how long ago each heater's device last reported telemetry.
+func RegisterHeaters(store *heaterstore.Store, ts *telemetry.Store) {
+	NewGaugeFunc("preheatbot_heater_on", "Whether the heater is set to on (1) or off (0).", HeaterLabels, func(emit func(float64, ...string)) {
+		refs, err := store.AllHeaters()
+		if err != nil {
+			log.WithError(err).Error("error listing heaters for metrics")
+			return
+		}
+		for _, ref := range refs {
+			record, err := store.Get(ref.Owner, ref.Heater)
+			if err != nil {
+				log.WithError(err).Error("error reading heater for metrics")
+				continue
+			}
+			on := 0.0
+			if record.Value == "on" {
+				on = 1
+			}
+			emit(on, HeaterLabelValues(ref)...)
+		}
+	})
+
+	NewGaugeFunc("preheatbot_device_last_seen_age_seconds", "Seconds since the heater's device last reported telemetry. Heaters whose devices have never reported are left out.", HeaterLabels, func(emit func(float64, ...string)) {
+		refs, err := store.AllHeaters()
+		if err != nil {
+			log.WithError(err).Error("error listing heaters for metrics")
+			return
+		}
+		now := time.Now()
+		for _, ref := range refs {
+			last, ok, err := ts.LastReport(ref.Owner, ref.Heater)
+			if err != nil {
+				log.WithError(err).Error("error reading telemetry for metrics")
+				continue
+			}
+			if ok {
+				emit(now.Sub(last).Seconds(), HeaterLabelValues(ref)...)
+			}
+		}
+	})
+}
@@ -0,0 +1,330 @@
+// Package metrics exports metrics in the Prometheus text exposition format.
+// It covers only what preheatbot needs: counters and histograms that are
+// updated as things happen, and gauges that are read when metrics are
+// scraped.
+package metrics
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are histogram bucket upper bounds in seconds, wide enough to
+// include long polls.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Default is the registry that the package functions use.
+var Default = New()
+
+// family is a metric and all of its series.
+type family interface {
+	write(w io.Writer) error
+}
+
+// Registry holds metrics and writes them when scraped.
+type Registry struct {
+	sync.Mutex
+	families map[string]family
+	token    string
+}
+
+// New returns an empty Registry.
+func New() *Registry {
+	return &Registry{families: make(map[string]family)}
+}
+
+// register adds f under name, replacing any metric already registered with
+// that name.
+func (r *Registry) register(name string, f family) {
+	r.Lock()
+	defer r.Unlock()
+	r.families[name] = f
+}
+
+// SetToken makes ServeHTTP require token as a bearer token. An empty token
+// lets anyone scrape.
+func (r *Registry) SetToken(token string) {
+	r.Lock()
+	defer r.Unlock()
+	r.token = token
+}
+
+// Write writes every metric, sorted by name.
+func (r *Registry) Write(w io.Writer) error {
+	r.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	families := make([]family, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		families[i] = r.families[name]
+	}
+	r.Unlock()
+
+	for _, f := range families {
+		err := f.write(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	token := r.token
+	r.Unlock()
+	if token != "" {
+		given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, "invalid metrics token")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(http.StatusOK)
+	r.Write(w)
+}
+
+// Counter is a count of events, with one series for each combination of
+// label values.
+type Counter struct {
+	sync.Mutex
+	name, help string
+	labels     []string
+	values     map[string]float64
+}
+
+// NewCounter registers a Counter with the given label names in Default.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// NewCounter registers a Counter with the given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	r.register(name, c)
+	return c
+}
+
+// Inc adds one to the series with the given label values, which must be in
+// the order the labels were given.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the series with the given label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.Lock()
+	defer c.Unlock()
+	c.values[key] += v
+}
+
+func (c *Counter) write(w io.Writer) error {
+	c.Lock()
+	defer c.Unlock()
+	err := writeHeader(w, c.name, c.help, "counter")
+	if err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(c.values) {
+		_, err = fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatValue(c.values[key]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Histogram counts observations, such as durations, in buckets.
+type Histogram struct {
+	sync.Mutex
+	name, help string
+	labels     []string
+	buckets    []float64
+	series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	// counts[i] is the number of observations in bucket i, not including
+	// those in smaller buckets. The last is for those above every bound.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a Histogram in Default.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// NewHistogram registers a Histogram with the given bucket upper bounds,
+// which must be sorted, and label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+	r.register(name, h)
+	return h
+}
+
+// Observe records v in the series with the given label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := formatLabels(h.labels, labelValues)
+	h.Lock()
+	defer h.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.counts[sort.SearchFloat64s(h.buckets, v)]++
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.Lock()
+	defer h.Unlock()
+	err := writeHeader(w, h.name, h.help, "histogram")
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	bucketLabels := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			bound := math.Inf(1)
+			if i < len(h.buckets) {
+				bound = h.buckets[i]
+			}
+			labels := formatLabels(bucketLabels, append(append([]string{}, s.labelValues...), formatValue(bound)))
+			_, err = fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, cumulative)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", h.name, key, formatValue(s.sum), h.name, key, s.count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GaugeFunc is a gauge whose series are read by a function each time
+// metrics are written, for values that are cheaper to look up than to track.
+type GaugeFunc struct {
+	name, help string
+	labels     []string
+	collect    func(emit func(v float64, labelValues ...string))
+}
+
+// NewGaugeFunc registers a GaugeFunc in Default.
+func NewGaugeFunc(name, help string, labels []string, collect func(emit func(v float64, labelValues ...string))) {
+	Default.NewGaugeFunc(name, help, labels, collect)
+}
+
+// NewGaugeFunc registers a gauge whose series are those that collect emits.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func(emit func(v float64, labelValues ...string))) {
+	r.register(name, &GaugeFunc{name: name, help: help, labels: labels, collect: collect})
+}
+
+func (g *GaugeFunc) write(w io.Writer) error {
+	values := make(map[string]float64)
+	g.collect(func(v float64, labelValues ...string) {
+		values[formatLabels(g.labels, labelValues)] = v
+	})
+	err := writeHeader(w, g.name, g.help, "gauge")
+	if err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(values) {
+		_, err = fmt.Fprintf(w, "%s%s %s\n", g.name, key, formatValue(values[key]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler returns a handler that serves Default.
+func Handler() http.Handler {
+	return Default
+}
+
+func writeHeader(w io.Writer, name, help, kind string) error {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	return err
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels returns the label set as it appears after a metric name, such
+// as `{route="/v1",status="200"}`, or "" if there are no labels. Missing
+// values are empty.
+func formatLabels(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	b := strings.Builder{}
+	b.WriteByte('{')
+	for i, label := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		b.WriteString(label)
+		b.WriteString(`="`)
+		b.WriteString(labelValueReplacer.Replace(value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := New()
+	c := r.NewCounter("changes_total", "Changes.\nBy source.", "source")
+	c.Inc("user")
+	c.Add(2, `a "quoted"\name`)
+	h := r.NewHistogram("duration_seconds", "Durations.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "/a")
+	h.Observe(1, "/a")
+	h.Observe(5, "/a")
+	r.NewGaugeFunc("on", "On.", []string{"heater"}, func(emit func(float64, ...string)) {
+		emit(1, "plane")
+		emit(0, "boat")
+	})
+	r.NewCounter("empty_total", "Nothing yet.")
+
+	buf := bytes.Buffer{}
+	err := r.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP changes_total Changes.\nBy source.
+# TYPE changes_total counter
+changes_total{source="a \"quoted\"\\name"} 2
+changes_total{source="user"} 1
+# HELP duration_seconds Durations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{route="/a",le="0.1"} 1
+duration_seconds_bucket{route="/a",le="1"} 2
+duration_seconds_bucket{route="/a",le="+Inf"} 3
+duration_seconds_sum{route="/a"} 6.05
+duration_seconds_count{route="/a"} 3
+# HELP empty_total Nothing yet.
+# TYPE empty_total counter
+# HELP on On.
+# TYPE on gauge
+on{heater="boat"} 0
+on{heater="plane"} 1
+`
+	if buf.String() != expected {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), expected)
+	}
+}
+
+func TestToken(t *testing.T) {
+	r := New()
+	r.NewCounter("requests_total", "Requests.").Inc()
+	r.SetToken("secret")
+	for _, tc := range []struct {
+		auth   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("with %q: got %d, want %d", tc.auth, w.Code, tc.status)
+		}
+	}
+}
@@ -0,0 +1,495 @@
+// Package mqtt bridges heaters to MQTT brokers for home automation systems.
+// Each user who configures a broker gets a connection that publishes the
+// retained state of every heater they can see, accepts commands for those
+// they can control, and announces them to Home Assistant through its MQTT
+// discovery protocol.
+//
+// Topics are, under the configured prefix:
+//
+//	<prefix>/status                        "online" or "offline", retained
+//	<prefix>/users/<owner>/<heater>/state  "on" or "off", retained
+//	<prefix>/users/<owner>/<heater>/set    commands: "on" or "off"
+//	<prefix>/groups/<group>/<heater>/...   the same for a group's heaters
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/netguard"
+)
+
+const (
+	DefaultPrefix          = "preheatbot"
+	DefaultDiscoveryPrefix = "homeassistant"
+
+	// MinBackoff is how long after a failed connection the bridge tries
+	// again. The wait doubles after each failure up to MaxBackoff.
+	MinBackoff = 5 * time.Second
+	MaxBackoff = 5 * time.Minute
+
+	reconcileInterval = time.Minute
+	outboxSize        = 100
+)
+
+// Controller changes heaters.
+type Controller interface {
+	SetHeater(ref heaterstore.HeaterRef, value, by string) (heaterstore.Record, error)
+}
+
+// Status describes a user's connection to their broker.
+type Status struct {
+	Connected bool
+	// Since is when the connection was made, if Connected.
+	Since time.Time
+	// Err is why the last attempt to connect failed or the connection was
+	// lost, if not Connected.
+	Err error
+}
+
+// Bridge keeps a connection to the broker of each user who has configured
+// one.
+type Bridge struct {
+	store      *heaterstore.Store
+	controller Controller
+	// minBackoff and maxBackoff are MinBackoff and MaxBackoff, except in
+	// tests.
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// control is the dialer's Control function, which refuses private
+	// addresses except in tests.
+	control func(network, address string, c syscall.RawConn) error
+
+	lock     sync.Mutex
+	sessions map[string]*session
+}
+
+func New(store *heaterstore.Store, controller Controller) *Bridge {
+	return &Bridge{
+		store:      store,
+		controller: controller,
+		minBackoff: MinBackoff,
+		maxBackoff: MaxBackoff,
+		control:    netguard.Control,
+		sessions:   make(map[string]*session),
+	}
+}
+
+// Run reconciles connections with users' profiles every minute. It never
+// returns.
+func (b *Bridge) Run() {
+	b.Reconcile()
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		b.Reconcile()
+	}
+}
+
+// Reconcile connects users who have configured a broker, disconnects those
+// who no longer have, and has connected sessions republish their heaters in
+// case the heaters a user can see have changed.
+func (b *Bridge) Reconcile() {
+	users, err := b.store.Users()
+	if err != nil {
+		log.Errorf("error listing users for mqtt: %s", err.Error())
+		return
+	}
+	configs := make(map[string]heaterstore.MQTTConfig)
+	for _, username := range users {
+		profile, err := b.store.GetProfile(username)
+		if err != nil {
+			log.Errorf("error getting profile for %s: %s", username, err.Error())
+			continue
+		}
+		if profile.MQTT != nil {
+			configs[username] = *profile.MQTT
+		}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for username, s := range b.sessions {
+		if config, ok := configs[username]; !ok || config != s.config {
+			s.close()
+			delete(b.sessions, username)
+		}
+	}
+	for username, config := range configs {
+		s, ok := b.sessions[username]
+		if !ok {
+			s = newSession(b, username, config)
+			b.sessions[username] = s
+			go s.run()
+			continue
+		}
+		s.refresh()
+	}
+}
+
+// HeaterChanged publishes the heater's new state to the broker of each
+// connected user who can see it. It does not wait for the messages to be
+// sent.
+func (b *Bridge) HeaterChanged(ref heaterstore.HeaterRef, r heaterstore.Record, by string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, s := range b.sessions {
+		s.heaterChanged(ref, r)
+	}
+}
+
+// Status returns the state of the user's connection. The second return value
+// is false if the user has no broker configured.
+func (b *Bridge) Status(username string) (Status, bool) {
+	b.lock.Lock()
+	s, ok := b.sessions[username]
+	b.lock.Unlock()
+	if !ok {
+		return Status{}, false
+	}
+	return s.status(), true
+}
+
+// session is one user's connection to their broker. Everything it publishes
+// is sent from its run goroutine so that messages keep their order.
+type session struct {
+	bridge   *Bridge
+	username string
+	config   heaterstore.MQTTConfig
+
+	lock    sync.Mutex
+	state   Status
+	heaters []heaterstore.HeaterRef
+
+	outbox   chan Message
+	resync   chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newSession(b *Bridge, username string, config heaterstore.MQTTConfig) *session {
+	return &session{
+		bridge:   b,
+		username: username,
+		config:   config,
+		outbox:   make(chan Message, outboxSize),
+		resync:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *session) close() {
+	s.stopOnce.Do(func() { close(s.done) })
+}
+
+// refresh asks the session to republish its heaters.
+func (s *session) refresh() {
+	select {
+	case s.resync <- struct{}{}:
+	default:
+	}
+}
+
+func (s *session) status() Status {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state
+}
+
+func (s *session) setStatus(state Status) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state = state
+}
+
+func (s *session) prefix() string {
+	if s.config.Prefix != "" {
+		return strings.TrimSuffix(s.config.Prefix, "/")
+	}
+	return DefaultPrefix
+}
+
+func (s *session) discoveryPrefix() string {
+	if s.config.DiscoveryPrefix != "" {
+		return strings.TrimSuffix(s.config.DiscoveryPrefix, "/")
+	}
+	return DefaultDiscoveryPrefix
+}
+
+func (s *session) run() {
+	backoff := s.bridge.minBackoff
+	for {
+		err := s.connect()
+		if err == nil {
+			backoff = s.bridge.minBackoff
+		} else {
+			log.Errorf("error with mqtt connection for %s: %s", s.username, err.Error())
+		}
+		select {
+		case <-s.done:
+			return
+		case <-time.After(backoff):
+		}
+		if err != nil {
+			backoff *= 2
+			if backoff > s.bridge.maxBackoff {
+				backoff = s.bridge.maxBackoff
+			}
+		}
+	}
+}
+
+// connect runs one connection until it is lost or the session is closed. It
+// returns nil if the session was closed.
+func (s *session) connect() error {
+	statusTopic := s.prefix() + "/status"
+	opts := Options{
+		ClientID: "preheatbot-" + s.username,
+		Will:     &Message{Topic: statusTopic, Payload: []byte("offline"), Retain: true},
+	}
+	client, err := dial(s.config.URL, opts, s.handle, s.bridge.control)
+	if err != nil {
+		s.setStatus(Status{Err: err})
+		return err
+	}
+	defer client.Close()
+	s.setStatus(Status{Connected: true, Since: time.Now()})
+
+	// changes made while disconnected are covered by publishing everything
+	for len(s.outbox) > 0 {
+		<-s.outbox
+	}
+	err = client.Publish(statusTopic, []byte("online"), true)
+	if err == nil {
+		err = s.sync(client)
+	}
+	if err == nil {
+		err = client.Subscribe(s.prefix()+"/+/+/+/set", 1)
+	}
+
+	for err == nil {
+		select {
+		case m := <-s.outbox:
+			err = client.Publish(m.Topic, m.Payload, m.Retain)
+		case <-s.resync:
+			err = s.sync(client)
+		case <-client.Done():
+			err = client.Err()
+		case <-s.done:
+			s.unpublish(client)
+			client.Publish(statusTopic, []byte("offline"), true)
+			s.setStatus(Status{})
+			return nil
+		}
+	}
+	s.setStatus(Status{Err: err})
+	return err
+}
+
+// sync publishes discovery configs and states for the heaters the user can
+// see, and removes the discovery configs of heaters they no longer see.
+func (s *session) sync(client *Client) error {
+	heaters, err := s.bridge.store.Heaters(s.username)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	previous := s.heaters
+	s.heaters = heaters
+	s.lock.Unlock()
+
+	current := make(map[string]bool)
+	for _, ref := range heaters {
+		current[s.discoveryTopic(ref)] = true
+	}
+	for _, ref := range previous {
+		// a heater whose role changed moves to another component
+		if topic := s.discoveryTopic(ref); !current[topic] {
+			err = client.Publish(topic, nil, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, ref := range heaters {
+		config, err := json.Marshal(s.discoveryConfig(ref))
+		if err != nil {
+			return err
+		}
+		err = client.Publish(s.discoveryTopic(ref), config, true)
+		if err != nil {
+			return err
+		}
+		record, err := s.bridge.store.Get(ref.Owner, ref.Heater)
+		if err != nil {
+			return err
+		}
+		err = client.Publish(s.topic(ref, "state"), []byte(record.Value), true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unpublish removes the discovery configs of all heaters so that Home
+// Assistant forgets them when the user stops bridging.
+func (s *session) unpublish(client *Client) {
+	s.lock.Lock()
+	heaters := s.heaters
+	s.lock.Unlock()
+	for _, ref := range heaters {
+		client.Publish(s.discoveryTopic(ref), nil, true)
+	}
+}
+
+func (s *session) heaterChanged(ref heaterstore.HeaterRef, r heaterstore.Record) {
+	s.lock.Lock()
+	visible := s.state.Connected && containsRef(s.heaters, ref)
+	s.lock.Unlock()
+	if !visible {
+		return
+	}
+	select {
+	case s.outbox <- Message{Topic: s.topic(ref, "state"), Payload: []byte(r.Value), Retain: true}:
+	default:
+		log.Errorf("error publishing %s/%s to mqtt for %s: outbox full", ref.Owner, ref.Heater, s.username)
+	}
+}
+
+// handle applies a command received on a set topic.
+func (s *session) handle(m Message) {
+	// a retained command was sent before this connection, and may be stale
+	if m.Retain {
+		return
+	}
+	ref, ok := s.parseTopic(m.Topic)
+	if !ok {
+		return
+	}
+	value := strings.ToLower(strings.TrimSpace(string(m.Payload)))
+	if value != "on" && value != "off" {
+		log.Infof("ignoring mqtt command %q for %s from %s", value, m.Topic, s.username)
+		return
+	}
+	role, ok := s.bridge.store.Role(s.username, ref.Owner, ref.Heater)
+	if !ok || !role.CanControl() {
+		log.Infof("ignoring mqtt command for %s from %s, who may not control it", m.Topic, s.username)
+		return
+	}
+	ref.Role = role
+	_, err := s.bridge.controller.SetHeater(ref, value, s.username)
+	if err != nil {
+		log.Errorf("error setting heater from mqtt: %s", err.Error())
+	}
+}
+
+// topic returns the topic for the heater with the given last level.
+func (s *session) topic(ref heaterstore.HeaterRef, leaf string) string {
+	if group, ok := heaterstore.GroupFromNamespace(ref.Owner); ok {
+		return fmt.Sprintf("%s/groups/%s/%s/%s", s.prefix(), group, ref.Heater, leaf)
+	}
+	return fmt.Sprintf("%s/users/%s/%s/%s", s.prefix(), ref.Owner, ref.Heater, leaf)
+}
+
+// parseTopic returns the heater whose set topic is given.
+func (s *session) parseTopic(topic string) (heaterstore.HeaterRef, bool) {
+	parts := strings.Split(strings.TrimPrefix(topic, s.prefix()+"/"), "/")
+	if len(parts) != 4 || parts[3] != "set" {
+		return heaterstore.HeaterRef{}, false
+	}
+	switch parts[0] {
+	case "users":
+		return heaterstore.HeaterRef{Owner: parts[1], Heater: parts[2]}, true
+	case "groups":
+		return heaterstore.HeaterRef{Owner: heaterstore.GroupNamespace(parts[1]), Heater: parts[2]}, true
+	}
+	return heaterstore.HeaterRef{}, false
+}
+
+var unsafeID = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// uniqueID identifies the heater to Home Assistant. It includes the user so
+// that users who share a heater and a broker get an entity each.
+func (s *session) uniqueID(ref heaterstore.HeaterRef) string {
+	return unsafeID.ReplaceAllString(fmt.Sprintf("preheatbot_%s_%s_%s", s.username, ref.Owner, ref.Heater), "_")
+}
+
+// component is the kind of Home Assistant entity for the heater: a switch if
+// the user may control it, or else a binary sensor.
+func component(ref heaterstore.HeaterRef) string {
+	if ref.Role.CanControl() {
+		return "switch"
+	}
+	return "binary_sensor"
+}
+
+func (s *session) discoveryTopic(ref heaterstore.HeaterRef) string {
+	return fmt.Sprintf("%s/%s/%s/config", s.discoveryPrefix(), component(ref), s.uniqueID(ref))
+}
+
+// discoveryConfig is the payload that announces a heater to Home Assistant.
+type discoveryConfig struct {
+	Name                string `json:"name"`
+	UniqueID            string `json:"unique_id"`
+	StateTopic          string `json:"state_topic"`
+	CommandTopic        string `json:"command_topic,omitempty"`
+	PayloadOn           string `json:"payload_on"`
+	PayloadOff          string `json:"payload_off"`
+	StateOn             string `json:"state_on,omitempty"`
+	StateOff            string `json:"state_off,omitempty"`
+	AvailabilityTopic   string `json:"availability_topic"`
+	PayloadAvailable    string `json:"payload_available"`
+	PayloadNotAvailable string `json:"payload_not_available"`
+	Icon                string `json:"icon"`
+	Device              device `json:"device"`
+}
+
+type device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+func (s *session) discoveryConfig(ref heaterstore.HeaterRef) discoveryConfig {
+	id := s.uniqueID(ref)
+	config := discoveryConfig{
+		Name:                ref.Name(s.username),
+		UniqueID:            id,
+		StateTopic:          s.topic(ref, "state"),
+		PayloadOn:           "on",
+		PayloadOff:          "off",
+		AvailabilityTopic:   s.prefix() + "/status",
+		PayloadAvailable:    "online",
+		PayloadNotAvailable: "offline",
+		Icon:                "mdi:radiator",
+		Device: device{
+			Identifiers:  []string{id},
+			Name:         ref.Name(s.username),
+			Manufacturer: "preheatbot",
+		},
+	}
+	if ref.Role.CanControl() {
+		config.CommandTopic = s.topic(ref, "set")
+		config.StateOn = "on"
+		config.StateOff = "off"
+	}
+	return config
+}
+
+func containsRef(refs []heaterstore.HeaterRef, ref heaterstore.HeaterRef) bool {
+	for _, r := range refs {
+		if r.Owner == ref.Owner && r.Heater == ref.Heater {
+			return true
+		}
+	}
+	return false
+}
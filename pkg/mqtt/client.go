@@ -0,0 +1,309 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mhrivnak/preheatbot/pkg/netguard"
+)
+
+// DefaultKeepAlive is how often the client pings the broker when it has
+// nothing else to send.
+const DefaultKeepAlive = time.Minute
+
+// ErrClosed is returned by a Client that has been closed.
+var ErrClosed = errors.New("connection closed")
+
+// Message is an application message published to a topic.
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+// Options configure a connection to a broker.
+type Options struct {
+	ClientID string
+	Username string
+	Password string
+	// KeepAlive defaults to DefaultKeepAlive.
+	KeepAlive time.Duration
+	// Will, if set, is published by the broker if the connection is lost
+	// without the client disconnecting.
+	Will *Message
+	// Timeout bounds how long the broker may take to acknowledge the
+	// connection and subscriptions. It defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+// Client is a connection to an MQTT 3.1.1 broker. It publishes at QoS 0 and
+// acknowledges messages it receives at QoS 1 and 2. It does not reconnect;
+// once Done is closed, a new Client is needed.
+type Client struct {
+	conn    net.Conn
+	opts    Options
+	handler func(Message)
+
+	// writeLock serializes writes to conn
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	nextID  uint16
+	pending map[uint16]chan packet
+	err     error
+	done    chan struct{}
+}
+
+// Dial connects to the broker at the URL, which has the scheme mqtt or tcp,
+// or mqtts or ssl for TLS. Any user name and password in the URL are added to
+// opts. The broker must be at a public address, since users choose it.
+func Dial(rawurl string, opts Options, handler func(Message)) (*Client, error) {
+	return dial(rawurl, opts, handler, netguard.Control)
+}
+
+// dial is Dial with the dialer's Control function, which tests clear to reach
+// a broker on loopback.
+func dial(rawurl string, opts Options, handler func(Message), control func(network, address string, c syscall.RawConn) error) (*Client, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.User != nil {
+		opts.Username = u.User.Username()
+		opts.Password, _ = u.User.Password()
+	}
+	host := u.Hostname()
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: control}
+	var conn net.Conn
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		conn, err = dialer.Dial("tcp", net.JoinHostPort(host, portOr(u, "1883")))
+	case "mqtts", "ssl", "tls":
+		conn, err = tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, portOr(u, "8883")), &tls.Config{ServerName: host})
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q; use mqtt or mqtts", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Connect(conn, opts, handler)
+}
+
+func portOr(u *url.URL, port string) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+	return port
+}
+
+// Connect starts an MQTT session over conn. handler is called, one message at
+// a time, for each message received on a subscription.
+func Connect(conn net.Conn, opts Options, handler func(Message)) (*Client, error) {
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = DefaultKeepAlive
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	c := &Client{
+		conn:    conn,
+		opts:    opts,
+		handler: handler,
+		pending: make(map[uint16]chan packet),
+		done:    make(chan struct{}),
+	}
+
+	r := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(opts.Timeout))
+	err := c.write(connectPacket(opts))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ack, err := readPacket(r)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ack.kind() != typeConnack || len(ack.body) != 2 {
+		conn.Close()
+		return nil, errors.New("expected CONNACK")
+	}
+	if ack.body[1] != 0 {
+		conn.Close()
+		return nil, connackError(ack.body[1])
+	}
+	conn.SetDeadline(time.Time{})
+
+	go c.read(r)
+	go c.ping()
+	return c, nil
+}
+
+// Publish sends a message at QoS 0.
+func (c *Client) Publish(topic string, payload []byte, retain bool) error {
+	return c.write(publishPacket(Message{Topic: topic, Payload: payload, Retain: retain}, 0))
+}
+
+// Subscribe asks the broker for messages on topics matching the filter, at up
+// to the given QoS, and waits for it to agree.
+func (c *Client) Subscribe(filter string, qos byte) error {
+	id, acked := c.expect()
+	err := c.write(subscribePacket(id, filter, qos))
+	if err != nil {
+		c.forget(id)
+		return err
+	}
+	select {
+	case ack := <-acked:
+		if len(ack.body) < 3 || ack.body[2] == 0x80 {
+			return fmt.Errorf("subscription to %s refused", filter)
+		}
+		return nil
+	case <-c.done:
+		return c.Err()
+	case <-time.After(c.opts.Timeout):
+		c.forget(id)
+		return fmt.Errorf("no reply to subscription to %s", filter)
+	}
+}
+
+// Close disconnects from the broker. The will is not published.
+func (c *Client) Close() error {
+	c.write(packet{header: typeDisconnect << 4})
+	c.fail(ErrClosed)
+	return nil
+}
+
+// Done is closed when the connection ends.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection ended, or nil if it has not.
+func (c *Client) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// expect allocates a packet ID and returns the channel on which its
+// acknowledgement will be sent.
+func (c *Client) expect() (uint16, chan packet) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for {
+		c.nextID++
+		if _, used := c.pending[c.nextID]; c.nextID != 0 && !used {
+			break
+		}
+	}
+	acked := make(chan packet, 1)
+	c.pending[c.nextID] = acked
+	return c.nextID, acked
+}
+
+func (c *Client) forget(id uint16) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.pending, id)
+}
+
+func (c *Client) write(p packet) error {
+	data, err := p.encode()
+	if err != nil {
+		return err
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	select {
+	case <-c.done:
+		return c.Err()
+	default:
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.opts.Timeout))
+	_, err = c.conn.Write(data)
+	if err != nil {
+		c.fail(err)
+	}
+	return err
+}
+
+// fail ends the connection, recording the first reason given.
+func (c *Client) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+}
+
+func (c *Client) read(r *bufio.Reader) {
+	for {
+		// the broker must answer each ping within the keep alive period
+		c.conn.SetReadDeadline(time.Now().Add(c.opts.KeepAlive * 3 / 2))
+		p, err := readPacket(r)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		switch p.kind() {
+		case typePublish:
+			m, id, err := parsePublish(p)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			switch m.QoS {
+			case 1:
+				c.write(ackPacket(typePuback, id))
+			case 2:
+				c.write(ackPacket(typePubrec, id))
+			}
+			if c.handler != nil {
+				c.handler(m)
+			}
+		case typePubrel:
+			r := reader{body: p.body}
+			c.write(ackPacket(typePubcomp, r.uint16()))
+		case typeSuback, typePuback:
+			r := reader{body: p.body}
+			id := r.uint16()
+			c.lock.Lock()
+			acked, ok := c.pending[id]
+			delete(c.pending, id)
+			c.lock.Unlock()
+			if ok {
+				acked <- p
+			}
+		case typePingresp:
+		default:
+			c.fail(fmt.Errorf("unexpected packet type %d", p.kind()))
+			return
+		}
+	}
+}
+
+func (c *Client) ping() {
+	ticker := time.NewTicker(c.opts.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.write(packet{header: typePingreq << 4})
+		case <-c.done:
+			return
+		}
+	}
+}
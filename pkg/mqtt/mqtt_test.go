@@ -0,0 +1,513 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+)
+
+// broker is a minimal in-process MQTT broker. It accepts every connection
+// unless refuse is set, records what each client publishes and subscribes
+// to, and can send messages to a client.
+type broker struct {
+	t      *testing.T
+	ln     net.Listener
+	refuse byte
+
+	lock  sync.Mutex
+	conns []*brokerConn
+}
+
+// brokerConn is one client's connection to the broker.
+type brokerConn struct {
+	broker   *broker
+	conn     net.Conn
+	clientID string
+	username string
+	password string
+	will     *Message
+
+	lock       sync.Mutex
+	published  []Message
+	subscribed []string
+	nextID     uint16
+	closed     bool
+}
+
+func newBroker(t *testing.T) *broker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &broker{t: t, ln: ln}
+	t.Cleanup(func() {
+		ln.Close()
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		for _, c := range b.conns {
+			c.conn.Close()
+		}
+	})
+	go b.accept()
+	return b
+}
+
+func (b *broker) url() string {
+	return "mqtt://" + b.ln.Addr().String()
+}
+
+func (b *broker) accept() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.serve(conn)
+	}
+}
+
+func (b *broker) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	p, err := readPacket(r)
+	if err != nil || p.kind() != typeConnect {
+		conn.Close()
+		return
+	}
+	c := &brokerConn{broker: b, conn: conn}
+	c.parseConnect(p)
+	c.write(packet{header: typeConnack << 4, body: []byte{0, b.refuse}})
+	if b.refuse != 0 {
+		conn.Close()
+		return
+	}
+	b.lock.Lock()
+	b.conns = append(b.conns, c)
+	b.lock.Unlock()
+
+	defer c.markClosed()
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch p.kind() {
+		case typePublish:
+			m, _, err := parsePublish(p)
+			if err != nil {
+				return
+			}
+			c.lock.Lock()
+			c.published = append(c.published, m)
+			c.lock.Unlock()
+		case typeSubscribe:
+			rd := reader{body: p.body}
+			id := rd.uint16()
+			filter := rd.string()
+			c.lock.Lock()
+			c.subscribed = append(c.subscribed, filter)
+			c.lock.Unlock()
+			c.write(packet{header: typeSuback << 4, body: append(appendUint16(nil, id), 1)})
+		case typePingreq:
+			c.write(packet{header: typePingresp << 4})
+		case typeDisconnect:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (c *brokerConn) parseConnect(p packet) {
+	r := reader{body: p.body}
+	r.string()
+	r.body = r.body[1:] // protocol level
+	flags := r.body[0]
+	r.body = r.body[1:]
+	r.uint16()
+	c.clientID = r.string()
+	if flags&0x04 != 0 {
+		c.will = &Message{Topic: r.string(), Payload: []byte(r.string()), Retain: flags&0x20 != 0}
+	}
+	if flags&0x80 != 0 {
+		c.username = r.string()
+	}
+	if flags&0x40 != 0 {
+		c.password = r.string()
+	}
+	if r.err != nil {
+		c.broker.t.Errorf("malformed CONNECT: %s", r.err)
+	}
+}
+
+func (c *brokerConn) write(p packet) {
+	data, err := p.encode()
+	if err != nil {
+		c.broker.t.Error(err)
+		return
+	}
+	c.conn.Write(data)
+}
+
+// send publishes a message to the client at QoS 1.
+func (c *brokerConn) send(topic, payload string, retain bool) {
+	c.lock.Lock()
+	c.nextID++
+	id := c.nextID
+	c.lock.Unlock()
+	c.write(publishPacket(Message{Topic: topic, Payload: []byte(payload), QoS: 1, Retain: retain}, id))
+}
+
+func (c *brokerConn) markClosed() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+}
+
+func (c *brokerConn) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+// last returns the last message published to topic.
+func (c *brokerConn) last(topic string) (Message, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i := len(c.published) - 1; i >= 0; i-- {
+		if c.published[i].Topic == topic {
+			return c.published[i], true
+		}
+	}
+	return Message{}, false
+}
+
+func (c *brokerConn) isSubscribed(filter string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, s := range c.subscribed {
+		if s == filter {
+			return true
+		}
+	}
+	return false
+}
+
+// conn returns the nth connection made to the broker, waiting for it.
+func (b *broker) conn(n int) *brokerConn {
+	var c *brokerConn
+	waitFor(b.t, "connection", func() bool {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if len(b.conns) > n {
+			c = b.conns[n]
+		}
+		return c != nil
+	})
+	return c
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForMessage waits for a message on topic with the given payload and
+// retain flag.
+func waitForMessage(t *testing.T, c *brokerConn, topic, payload string, retain bool) Message {
+	t.Helper()
+	var m Message
+	waitFor(t, topic+" "+payload, func() bool {
+		var ok bool
+		m, ok = c.last(topic)
+		return ok && string(m.Payload) == payload && m.Retain == retain
+	})
+	return m
+}
+
+func TestConnect(t *testing.T) {
+	b := newBroker(t)
+	will := &Message{Topic: "status", Payload: []byte("offline"), Retain: true}
+	client, err := dial("mqtt://alice:secret@"+b.ln.Addr().String(), Options{ClientID: "test", Will: will}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	c := b.conn(0)
+	if c.clientID != "test" || c.username != "alice" || c.password != "secret" {
+		t.Errorf("got client %q, user %q, password %q", c.clientID, c.username, c.password)
+	}
+	if c.will == nil || c.will.Topic != "status" || string(c.will.Payload) != "offline" || !c.will.Retain {
+		t.Errorf("got will %+v", c.will)
+	}
+
+	err = client.Subscribe("a/+/b", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Publish("a/x/b", []byte("hi"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForMessage(t, c, "a/x/b", "hi", true)
+	if !c.isSubscribed("a/+/b") {
+		t.Error("expected a subscription")
+	}
+
+	client.Close()
+	waitFor(t, "disconnect", c.isClosed)
+	if client.Err() != ErrClosed {
+		t.Errorf("got %v", client.Err())
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	b := newBroker(t)
+	b.refuse = 5
+	_, err := dial(b.url(), Options{ClientID: "test"}, nil, nil)
+	if err == nil || err.Error() != "connection refused: not authorized" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestDialRefusesPrivateAddresses(t *testing.T) {
+	b := newBroker(t)
+	_, err := Dial(b.url(), Options{ClientID: "test"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestReadPacketLimit(t *testing.T) {
+	// a PUBLISH claiming to be 1MB long
+	data := append([]byte{typePublish << 4}, appendRemainingLength(nil, 1<<20)...)
+	_, err := readPacket(bufio.NewReader(bytes.NewReader(data)))
+	if err == nil {
+		t.Error("expected an error for an oversized packet")
+	}
+
+	p := packet{header: typePublish << 4, body: make([]byte, MaxPacketSize)}
+	data, err = p.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readPacket(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil || len(got.body) != MaxPacketSize {
+		t.Errorf("got %d bytes and %v", len(got.body), err)
+	}
+}
+
+// controller sets heaters the way the bot does, telling the bridge.
+type controller struct {
+	store  *heaterstore.Store
+	bridge *Bridge
+
+	lock  sync.Mutex
+	calls []string
+}
+
+func (c *controller) SetHeater(ref heaterstore.HeaterRef, value, by string) (heaterstore.Record, error) {
+	c.lock.Lock()
+	c.calls = append(c.calls, ref.Owner+"/"+ref.Heater+"="+value+" by "+by)
+	c.lock.Unlock()
+	r, err := c.store.Set(ref.Owner, ref.Heater, value, by)
+	if err == nil {
+		c.bridge.HeaterChanged(ref, r, by)
+	}
+	return r, err
+}
+
+func (c *controller) getCalls() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string{}, c.calls...)
+}
+
+// newBridge returns a bridge for a store in which alice owns plane and may
+// only view the club's hangar, and bridges alice's heaters to the broker.
+func newBridge(t *testing.T, b *broker) (*Bridge, *controller, *heaterstore.Store) {
+	dir, err := ioutil.TempDir("", "mqtt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	store := &heaterstore.Store{Dir: dir}
+	for _, path := range []string{"alice", "bob"} {
+		err = os.MkdirAll(filepath.Join(dir, path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "alice", "plane"), []byte(`{"value":"off","version":1}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.CreateGroup("club", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SetMember("club", "alice", heaterstore.RoleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, heaterstore.GroupNamespace("club"), "hangar"), []byte(`{"value":"on","version":3}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SetProfile("alice", heaterstore.Profile{MQTT: &heaterstore.MQTTConfig{URL: b.url()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &controller{store: store}
+	bridge := New(store, c)
+	bridge.minBackoff = 10 * time.Millisecond
+	bridge.control = nil
+	c.bridge = bridge
+	t.Cleanup(func() {
+		bridge.lock.Lock()
+		defer bridge.lock.Unlock()
+		for _, s := range bridge.sessions {
+			s.close()
+		}
+	})
+	return bridge, c, store
+}
+
+const (
+	planeConfig  = "homeassistant/switch/preheatbot_alice_alice_plane/config"
+	hangarConfig = "homeassistant/binary_sensor/preheatbot_alice__groups_club_hangar/config"
+)
+
+func TestBridgePublishes(t *testing.T) {
+	b := newBroker(t)
+	bridge, _, _ := newBridge(t, b)
+	bridge.Reconcile()
+	c := b.conn(0)
+
+	if c.clientID != "preheatbot-alice" || c.will == nil || c.will.Topic != "preheatbot/status" || string(c.will.Payload) != "offline" {
+		t.Errorf("got client %q with will %+v", c.clientID, c.will)
+	}
+	waitForMessage(t, c, "preheatbot/status", "online", true)
+	waitForMessage(t, c, "preheatbot/users/alice/plane/state", "off", true)
+	waitForMessage(t, c, "preheatbot/groups/club/hangar/state", "on", true)
+	waitFor(t, "subscription", func() bool { return c.isSubscribed("preheatbot/+/+/+/set") })
+
+	m, _ := c.last(planeConfig)
+	if !m.Retain {
+		t.Error("expected the discovery config to be retained")
+	}
+	config := discoveryConfig{}
+	err := json.Unmarshal(m.Payload, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Name != "plane" || config.UniqueID != "preheatbot_alice_alice_plane" ||
+		config.StateTopic != "preheatbot/users/alice/plane/state" || config.CommandTopic != "preheatbot/users/alice/plane/set" ||
+		config.AvailabilityTopic != "preheatbot/status" || config.PayloadOn != "on" || config.StateOn != "on" {
+		t.Errorf("got %+v", config)
+	}
+
+	m, _ = c.last(hangarConfig)
+	config = discoveryConfig{}
+	err = json.Unmarshal(m.Payload, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Name != "club/hangar" || config.StateTopic != "preheatbot/groups/club/hangar/state" || config.CommandTopic != "" {
+		t.Errorf("got %+v", config)
+	}
+
+	status, ok := bridge.Status("alice")
+	if !ok || !status.Connected {
+		t.Errorf("got %+v", status)
+	}
+	if _, ok := bridge.Status("bob"); ok {
+		t.Error("bob has no broker")
+	}
+}
+
+func TestBridgeCommands(t *testing.T) {
+	b := newBroker(t)
+	bridge, controller, store := newBridge(t, b)
+	bridge.Reconcile()
+	c := b.conn(0)
+	waitFor(t, "subscription", func() bool { return c.isSubscribed("preheatbot/+/+/+/set") })
+
+	// ignored: retained, may not control, not a value, not a heater topic
+	c.send("preheatbot/users/alice/plane/set", "on", true)
+	c.send("preheatbot/groups/club/hangar/set", "off", false)
+	c.send("preheatbot/users/alice/plane/set", "toasty", false)
+	c.send("preheatbot/users/alice/set", "on", false)
+	// applied
+	c.send("preheatbot/users/alice/plane/set", " ON\n", false)
+
+	waitForMessage(t, c, "preheatbot/users/alice/plane/state", "on", true)
+	calls := controller.getCalls()
+	if len(calls) != 1 || calls[0] != "alice/plane=on by alice" {
+		t.Errorf("got %v", calls)
+	}
+	record, err := store.Get(heaterstore.GroupNamespace("club"), "hangar")
+	if err != nil || record.Value != "on" {
+		t.Errorf("the hangar changed to %+v (%v)", record, err)
+	}
+}
+
+func TestBridgeReconnects(t *testing.T) {
+	b := newBroker(t)
+	bridge, controller, _ := newBridge(t, b)
+	bridge.Reconcile()
+	first := b.conn(0)
+	waitForMessage(t, first, "preheatbot/users/alice/plane/state", "off", true)
+
+	// a change while disconnected is published on reconnecting
+	first.conn.Close()
+	waitFor(t, "disconnect", func() bool {
+		status, _ := bridge.Status("alice")
+		return !status.Connected
+	})
+	_, err := controller.store.Set("alice", "plane", "on", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := b.conn(1)
+	waitForMessage(t, second, "preheatbot/status", "online", true)
+	waitForMessage(t, second, "preheatbot/users/alice/plane/state", "on", true)
+	waitFor(t, "subscription", func() bool { return second.isSubscribed("preheatbot/+/+/+/set") })
+}
+
+func TestBridgeStops(t *testing.T) {
+	b := newBroker(t)
+	bridge, _, store := newBridge(t, b)
+	bridge.Reconcile()
+	c := b.conn(0)
+	waitForMessage(t, c, "preheatbot/users/alice/plane/state", "off", true)
+
+	err := store.SetProfile("alice", heaterstore.Profile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridge.Reconcile()
+	waitForMessage(t, c, planeConfig, "", true)
+	waitForMessage(t, c, hangarConfig, "", true)
+	waitForMessage(t, c, "preheatbot/status", "offline", true)
+	waitFor(t, "disconnect", c.isClosed)
+	if _, ok := bridge.Status("alice"); ok {
+		t.Error("expected no session")
+	}
+}
@@ -0,0 +1,240 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types from MQTT 3.1.1.
+const (
+	typeConnect     = 1
+	typeConnack     = 2
+	typePublish     = 3
+	typePuback      = 4
+	typePubrec      = 5
+	typePubrel      = 6
+	typePubcomp     = 7
+	typeSubscribe   = 8
+	typeSuback      = 9
+	typeUnsubscribe = 10
+	typeUnsuback    = 11
+	typePingreq     = 12
+	typePingresp    = 13
+	typeDisconnect  = 14
+)
+
+// maxRemainingLength is the largest remaining length that can be encoded.
+const maxRemainingLength = 268435455
+
+// MaxPacketSize is the largest remaining length accepted from a broker. It is
+// far more than any command or discovery config needs, and keeps a broker
+// that a user chose from making the bot allocate up to maxRemainingLength.
+const MaxPacketSize = 64 << 10
+
+// packet is an MQTT control packet split into the first byte of its fixed
+// header and everything after the remaining length.
+type packet struct {
+	header byte
+	body   []byte
+}
+
+func (p packet) kind() byte {
+	return p.header >> 4
+}
+
+func (p packet) flags() byte {
+	return p.header & 0x0f
+}
+
+// encode returns the packet as sent on the wire.
+func (p packet) encode() ([]byte, error) {
+	if len(p.body) > maxRemainingLength {
+		return nil, errors.New("packet too large")
+	}
+	out := []byte{p.header}
+	out = appendRemainingLength(out, len(p.body))
+	return append(out, p.body...), nil
+}
+
+func appendRemainingLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// readPacket reads one control packet.
+func readPacket(r *bufio.Reader) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return packet{}, errors.New("malformed remaining length")
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	if length > MaxPacketSize {
+		return packet{}, fmt.Errorf("packet of %d bytes is larger than the limit of %d", length, MaxPacketSize)
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return packet{header: header, body: body}, err
+}
+
+func appendString(b []byte, s string) []byte {
+	return appendBytes(b, []byte(s))
+}
+
+func appendBytes(b []byte, data []byte) []byte {
+	b = appendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func appendUint16(b []byte, n uint16) []byte {
+	return append(b, byte(n>>8), byte(n))
+}
+
+// reader consumes the fields of a packet body.
+type reader struct {
+	body []byte
+	err  error
+}
+
+func (r *reader) uint16() uint16 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.body) < 2 {
+		r.err = errors.New("packet too short")
+		return 0
+	}
+	n := binary.BigEndian.Uint16(r.body)
+	r.body = r.body[2:]
+	return n
+}
+
+func (r *reader) string() string {
+	n := int(r.uint16())
+	if r.err != nil {
+		return ""
+	}
+	if len(r.body) < n {
+		r.err = errors.New("packet too short")
+		return ""
+	}
+	s := string(r.body[:n])
+	r.body = r.body[n:]
+	return s
+}
+
+func connectPacket(opts Options) packet {
+	body := appendString(nil, "MQTT")
+	body = append(body, 4) // protocol level 3.1.1
+	flags := byte(0x02)    // clean session
+	if opts.Will != nil {
+		flags |= 0x04 | (opts.Will.QoS&0x03)<<3
+		if opts.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if opts.Password != "" {
+		flags |= 0x40
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+	}
+	body = append(body, flags)
+	body = appendUint16(body, uint16(opts.KeepAlive.Seconds()))
+	body = appendString(body, opts.ClientID)
+	if opts.Will != nil {
+		body = appendString(body, opts.Will.Topic)
+		body = appendBytes(body, opts.Will.Payload)
+	}
+	if opts.Username != "" {
+		body = appendString(body, opts.Username)
+	}
+	if opts.Password != "" {
+		body = appendString(body, opts.Password)
+	}
+	return packet{header: typeConnect << 4, body: body}
+}
+
+// connackError describes a CONNACK return code other than zero.
+func connackError(code byte) error {
+	reasons := map[byte]string{
+		1: "unacceptable protocol version",
+		2: "client identifier rejected",
+		3: "server unavailable",
+		4: "bad user name or password",
+		5: "not authorized",
+	}
+	if reason, ok := reasons[code]; ok {
+		return fmt.Errorf("connection refused: %s", reason)
+	}
+	return fmt.Errorf("connection refused: code %d", code)
+}
+
+func publishPacket(m Message, id uint16) packet {
+	header := byte(typePublish<<4) | (m.QoS&0x03)<<1
+	if m.Retain {
+		header |= 0x01
+	}
+	body := appendString(nil, m.Topic)
+	if m.QoS > 0 {
+		body = appendUint16(body, id)
+	}
+	return packet{header: header, body: append(body, m.Payload...)}
+}
+
+// parsePublish returns the message in a PUBLISH packet and its packet ID,
+// which is zero at QoS 0.
+func parsePublish(p packet) (Message, uint16, error) {
+	m := Message{
+		QoS:    (p.flags() >> 1) & 0x03,
+		Retain: p.flags()&0x01 != 0,
+	}
+	r := reader{body: p.body}
+	m.Topic = r.string()
+	var id uint16
+	if m.QoS > 0 {
+		id = r.uint16()
+	}
+	m.Payload = r.body
+	return m, id, r.err
+}
+
+func subscribePacket(id uint16, filter string, qos byte) packet {
+	body := appendUint16(nil, id)
+	body = appendString(body, filter)
+	body = append(body, qos)
+	return packet{header: typeSubscribe<<4 | 0x02, body: body}
+}
+
+func ackPacket(kind byte, id uint16) packet {
+	header := kind << 4
+	if kind == typePubrel {
+		header |= 0x02
+	}
+	return packet{header: header, body: appendUint16(nil, id)}
+}
@@ -0,0 +1,76 @@
+// Package netguard keeps the server from connecting, on a user's behalf, to
+// addresses that only make sense from inside its own network, such as
+// loopback, private and link-local addresses.
+package netguard
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// blocked holds the ranges that net.IP has no method for.
+var blocked = parseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10", // carrier-grade NAT
+	"fc00::/7",      // unique local
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// Allowed reports whether ip is a public address that users may have the
+// server connect to.
+func Allowed(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, n := range blocked {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckHost resolves host, a name or an IP address, and returns an error if
+// it doesn't resolve or any of its addresses isn't Allowed.
+func CheckHost(host string) error {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !Allowed(ip) {
+			return fmt.Errorf("%s resolves to %s, which is not a public address", host, ip)
+		}
+	}
+	return nil
+}
+
+// Control can be used as a net.Dialer's Control function. It refuses to
+// connect to an address that isn't Allowed, which also covers names that
+// resolve differently than when they were checked with CheckHost.
+func Control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !Allowed(ip) {
+		return fmt.Errorf("refusing to connect to %s, which is not a public address", host)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package netguard
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAllowed(t *testing.T) {
+	for address, allowed := range map[string]bool{
+		"8.8.8.8":          true,
+		"172.32.0.1":       true,
+		"2001:4860::8888":  true,
+		"127.0.0.1":        false,
+		"127.1.2.3":        false,
+		"::1":              false,
+		"0.0.0.0":          false,
+		"::":               false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"172.31.255.255":   false,
+		"192.168.1.1":      false,
+		"100.64.0.1":       false,
+		"169.254.169.254":  false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"::ffff:127.0.0.1": false,
+		"::ffff:10.0.0.1":  false,
+	} {
+		if got := Allowed(net.ParseIP(address)); got != allowed {
+			t.Errorf("Allowed(%s) = %t, want %t", address, got, allowed)
+		}
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "localhost", "10.0.0.1", "::1"} {
+		if CheckHost(host) == nil {
+			t.Errorf("expected %s to be refused", host)
+		}
+	}
+	if err := CheckHost("8.8.8.8"); err != nil {
+		t.Errorf("expected a public address to be allowed: %s", err.Error())
+	}
+}
+
+func TestControl(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	dialer := &net.Dialer{Timeout: time.Second, Control: Control}
+	conn, err := dialer.Dial("tcp", server.Listener.Addr().String())
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected the dial to be refused")
+	}
+}
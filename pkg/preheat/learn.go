@@ -0,0 +1,290 @@
+package preheat
+
+import (
+	"math"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+)
+
+const (
+	// MinObservations is how many past preheats a heater needs before its
+	// learned curve is used for planning.
+	MinObservations = 3
+	// MaxObservations is how many past preheats are kept per heater.
+	MaxObservations = 100
+
+	learnInterval = time.Hour
+	// startWindow is how far from the moment the heater turned on a reading
+	// may be and still count as the starting temperature.
+	startWindow = 15 * time.Minute
+	// ambientWindow is how long before the heater turned on an ambient
+	// reading may be and still be used.
+	ambientWindow = time.Hour
+	// minWarming is the least warming, in degrees Celsius, that counts as a
+	// preheat worth learning from.
+	minWarming = 2.0
+)
+
+// Fit is a straight line fitted to past preheats, giving the minutes needed to
+// reach Target as a function of the ambient temperature in degrees Celsius.
+type Fit struct {
+	Target       float64 `json:"target"`
+	Observations int     `json:"observations"`
+	// Intercept is the number of minutes at 0°C ambient.
+	Intercept float64 `json:"intercept"`
+	// Slope is the change in minutes per degree of ambient temperature.
+	Slope float64 `json:"slope"`
+	// RSquared is the coefficient of determination of the fit.
+	RSquared float64 `json:"rSquared"`
+	// MinAmbient and MaxAmbient bound the ambient temperatures observed.
+	// Estimates outside that range use the nearest bound.
+	MinAmbient float64 `json:"minAmbient"`
+	MaxAmbient float64 `json:"maxAmbient"`
+}
+
+// Duration estimates the preheat duration at the ambient temperature.
+func (f Fit) Duration(ambient float64) time.Duration {
+	ambient = math.Max(f.MinAmbient, math.Min(f.MaxAmbient, ambient))
+	return clamp(time.Duration((f.Intercept + f.Slope*ambient) * float64(time.Minute)))
+}
+
+// Model expresses the fit as a PreheatModel, with a curve point at each end
+// of the observed range and every 10°C between.
+func (f Fit) Model() heaterstore.PreheatModel {
+	model := heaterstore.PreheatModel{Target: f.Target, Curve: []heaterstore.CurvePoint{}}
+	ambients := []float64{f.MinAmbient}
+	for a := math.Floor(f.MinAmbient/10)*10 + 10; a < f.MaxAmbient; a += 10 {
+		ambients = append(ambients, a)
+	}
+	if f.MaxAmbient > f.MinAmbient {
+		ambients = append(ambients, f.MaxAmbient)
+	}
+	for _, a := range ambients {
+		degrees := math.Max(1, f.Target-a)
+		model.Curve = append(model.Curve, heaterstore.CurvePoint{
+			Ambient:          a,
+			MinutesPerDegree: f.Duration(a).Minutes() / degrees,
+		})
+	}
+	return model
+}
+
+// FitObservations fits a line to the observations using least squares.
+// Durations are first scaled to the warming needed to reach target. The
+// second return value is false if there are no observations.
+func FitObservations(observations []heaterstore.Observation, target float64) (Fit, bool) {
+	fit := Fit{Target: target, Observations: len(observations)}
+	if len(observations) == 0 {
+		return fit, false
+	}
+	xs := make([]float64, len(observations))
+	ys := make([]float64, len(observations))
+	fit.MinAmbient, fit.MaxAmbient = math.Inf(1), math.Inf(-1)
+	for i, o := range observations {
+		scale := (target - o.Engine) / (o.Target - o.Engine)
+		xs[i] = o.Ambient
+		ys[i] = time.Duration(o.Duration).Minutes() * math.Max(0, scale)
+		fit.MinAmbient = math.Min(fit.MinAmbient, o.Ambient)
+		fit.MaxAmbient = math.Max(fit.MaxAmbient, o.Ambient)
+	}
+
+	n := float64(len(xs))
+	var sumX, sumY float64
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+	}
+	meanX, meanY := sumX/n, sumY/n
+	var sxx, sxy, syy float64
+	for i := range xs {
+		sxx += (xs[i] - meanX) * (xs[i] - meanX)
+		sxy += (xs[i] - meanX) * (ys[i] - meanY)
+		syy += (ys[i] - meanY) * (ys[i] - meanY)
+	}
+	if sxx == 0 {
+		// every observation had the same ambient temperature
+		fit.Intercept = meanY
+		return fit, true
+	}
+	fit.Slope = sxy / sxx
+	fit.Intercept = meanY - fit.Slope*meanX
+	if syy > 0 {
+		fit.RSquared = sxy * sxy / (sxx * syy)
+	}
+	return fit, true
+}
+
+// Learned returns the fit of the heater's past preheats to its model's
+// target. The second return value is false if there are fewer than
+// MinObservations.
+func (p *Planner) Learned(ref heaterstore.HeaterRef) (Fit, bool, error) {
+	model, _, err := p.Model(ref)
+	if err != nil {
+		return Fit{}, false, err
+	}
+	stats, err := p.store.GetPreheatStats(ref.Owner, ref.Heater)
+	if err != nil {
+		return Fit{}, false, err
+	}
+	fit, ok := FitObservations(stats.Observations, model.Target)
+	return fit, ok && fit.Observations >= MinObservations, nil
+}
+
+// Learner finds past preheats in each heater's history and telemetry and
+// records them as observations.
+type Learner struct {
+	planner *Planner
+}
+
+func NewLearner(store *heaterstore.Store, telemetry *telemetry.Store) *Learner {
+	return &Learner{planner: NewPlanner(store, telemetry)}
+}
+
+// Run learns from every heater periodically. It never returns.
+func (l *Learner) Run() {
+	ticker := time.NewTicker(learnInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		refs, err := l.planner.store.AllHeaters()
+		if err != nil {
+			log.Errorf("error listing heaters to learn from: %s", err.Error())
+			continue
+		}
+		for _, ref := range refs {
+			err = l.LearnHeater(ref, now)
+			if err != nil {
+				log.Errorf("error learning preheat curve for %s/%s: %s", ref.Owner, ref.Heater, err.Error())
+			}
+		}
+	}
+}
+
+// LearnHeater records an observation for each preheat of the heater that
+// started since it was last analyzed. Only full-resolution telemetry is
+// useful, so preheats older than the raw telemetry retention are not found.
+func (l *Learner) LearnHeater(ref heaterstore.HeaterRef, now time.Time) error {
+	store := l.planner.store
+	stats, err := store.GetPreheatStats(ref.Owner, ref.Heater)
+	if err != nil {
+		return err
+	}
+	model, _, err := l.planner.Model(ref)
+	if err != nil {
+		return err
+	}
+	from := stats.AnalyzedThrough
+	if earliest := now.Add(-telemetry.DefaultRawRetention); from.Before(earliest) {
+		from = earliest
+	}
+	history, err := store.History(ref.Owner, ref.Heater, from)
+	if err != nil {
+		return err
+	}
+
+	analyzedThrough := now
+	for _, period := range heaterstore.OnPeriods(history, now) {
+		observation, done, err := l.observe(ref, period, model.Target, now)
+		if err != nil {
+			return err
+		}
+		if !done {
+			// still warming; look at it again next time
+			analyzedThrough = period.Start
+			break
+		}
+		if observation != nil {
+			stats.Observations = append(stats.Observations, *observation)
+		}
+	}
+	if len(stats.Observations) > MaxObservations {
+		stats.Observations = stats.Observations[len(stats.Observations)-MaxObservations:]
+	}
+	stats.AnalyzedThrough = analyzedThrough
+	return store.SetPreheatStats(ref.Owner, ref.Heater, stats)
+}
+
+// observe measures how long the preheat took to reach target. done is false
+// if the preheat is ongoing and has not reached target yet. The observation
+// is nil if the preheat can't be measured.
+func (l *Learner) observe(ref heaterstore.HeaterRef, p heaterstore.Period, target float64, now time.Time) (*heaterstore.Observation, bool, error) {
+	ts := l.planner.telemetry
+	end := p.End
+	if limit := p.Start.Add(MaxDuration); end.After(limit) {
+		end = limit
+	}
+	engine, err := ts.Query(ref.Owner, ref.Heater, telemetry.MetricEngineTemp, p.Start.Add(-startWindow), end)
+	if err != nil {
+		return nil, false, err
+	}
+	startTemp, ok := startingTemp(engine, p.Start)
+	if !ok || target-startTemp.Value < minWarming {
+		return nil, true, nil
+	}
+	var reached *telemetry.Sample
+	for i := range engine {
+		if engine[i].Time.After(p.Start) && engine[i].Value >= target {
+			reached = &engine[i]
+			break
+		}
+	}
+	if reached == nil {
+		return nil, !p.Ongoing || now.Sub(p.Start) > MaxDuration, nil
+	}
+
+	ambient, err := ts.Query(ref.Owner, ref.Heater, telemetry.MetricAmbientTemp, p.Start.Add(-ambientWindow), p.Start.Add(startWindow))
+	if err != nil {
+		return nil, false, err
+	}
+	ambientTemp, ok := closest(ambient, p.Start, ambientWindow)
+	if !ok {
+		return nil, true, nil
+	}
+	return &heaterstore.Observation{
+		Start:    p.Start,
+		Ambient:  ambientTemp.Value,
+		Engine:   startTemp.Value,
+		Target:   target,
+		Duration: heaterstore.Duration(reached.Time.Sub(p.Start)),
+	}, true, nil
+}
+
+// startingTemp returns the last sample taken before t, or failing that the
+// first one shortly after, before the heater could have had much effect.
+func startingTemp(samples []telemetry.Sample, t time.Time) (telemetry.Sample, bool) {
+	before, ok := telemetry.Sample{}, false
+	for _, s := range samples {
+		if s.Time.After(t) {
+			break
+		}
+		before, ok = s, t.Sub(s.Time) <= startWindow
+	}
+	if ok {
+		return before, true
+	}
+	for _, s := range samples {
+		if s.Time.After(t) {
+			return s, s.Time.Sub(t) <= 5*time.Minute
+		}
+	}
+	return telemetry.Sample{}, false
+}
+
+// closest returns the sample nearest to t, if any is within window of it.
+func closest(samples []telemetry.Sample, t time.Time, window time.Duration) (telemetry.Sample, bool) {
+	best := telemetry.Sample{}
+	bestDistance := window + 1
+	for _, s := range samples {
+		distance := s.Time.Sub(t)
+		if distance < 0 {
+			distance = -distance
+		}
+		if distance < bestDistance {
+			best, bestDistance = s, distance
+		}
+	}
+	return best, bestDistance <= window
+}
@@ -0,0 +1,167 @@
+// Package preheat estimates how long a heater needs to warm an engine, and
+// plans when to turn it on so the engine is warm by a given time.
+package preheat
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+)
+
+// Source identifies scheduled actions that carry out a preheat plan. A heater
+// has at most one plan at a time.
+const Source = "ready"
+
+const (
+	// DefaultDuration is used when there is no recent ambient temperature to
+	// base an estimate on.
+	DefaultDuration = 2 * time.Hour
+	// MinDuration and MaxDuration bound every estimate.
+	MinDuration = 30 * time.Minute
+	MaxDuration = 8 * time.Hour
+	// KeepOn is how long the heater stays on after the ready time, in case
+	// the pilot is running late.
+	KeepOn = 30 * time.Minute
+	// AmbientMaxAge is how old an ambient temperature reading may be and
+	// still be used.
+	AmbientMaxAge = 6 * time.Hour
+)
+
+// DefaultModel is used for heaters that do not configure their own. It is a
+// rough, conservative guess for a typical engine preheater.
+var DefaultModel = heaterstore.PreheatModel{
+	Target: 15,
+	Curve: []heaterstore.CurvePoint{
+		{Ambient: -30, MinutesPerDegree: 4},
+		{Ambient: 0, MinutesPerDegree: 3},
+		{Ambient: 10, MinutesPerDegree: 2},
+	},
+}
+
+// MinutesPerDegree interpolates the curve at the ambient temperature.
+func MinutesPerDegree(curve []heaterstore.CurvePoint, ambient float64) float64 {
+	if len(curve) == 0 {
+		return 0
+	}
+	points := make([]heaterstore.CurvePoint, len(curve))
+	copy(points, curve)
+	sort.Slice(points, func(i, j int) bool { return points[i].Ambient < points[j].Ambient })
+	if ambient <= points[0].Ambient {
+		return points[0].MinutesPerDegree
+	}
+	for i := 1; i < len(points); i++ {
+		if ambient <= points[i].Ambient {
+			a, b := points[i-1], points[i]
+			frac := (ambient - a.Ambient) / (b.Ambient - a.Ambient)
+			return a.MinutesPerDegree + frac*(b.MinutesPerDegree-a.MinutesPerDegree)
+		}
+	}
+	return points[len(points)-1].MinutesPerDegree
+}
+
+// Duration estimates how long the model takes to warm an engine that starts
+// at the ambient temperature.
+func Duration(model heaterstore.PreheatModel, ambient float64) time.Duration {
+	degrees := model.Target - ambient
+	if degrees < 0 {
+		degrees = 0
+	}
+	d := time.Duration(MinutesPerDegree(model.Curve, ambient) * degrees * float64(time.Minute))
+	return clamp(d)
+}
+
+func clamp(d time.Duration) time.Duration {
+	if d < MinDuration {
+		return MinDuration
+	}
+	if d > MaxDuration {
+		return MaxDuration
+	}
+	return d
+}
+
+// Plan says when to turn a heater on and off so the engine is warm at
+// ReadyAt.
+type Plan struct {
+	Start    time.Time
+	ReadyAt  time.Time
+	Off      time.Time
+	Duration time.Duration
+	// Ambient is the temperature the estimate is based on. It is only
+	// meaningful if HaveAmbient is true.
+	Ambient     float64
+	HaveAmbient bool
+	// Basis briefly describes how Duration was estimated.
+	Basis string
+}
+
+// Planner plans preheats using the most recent ambient temperature each
+// heater's device reported, and either what has been learned from the
+// heater's past preheats or, until enough is known, the heater's model.
+type Planner struct {
+	store     *heaterstore.Store
+	telemetry *telemetry.Store
+}
+
+func NewPlanner(store *heaterstore.Store, telemetry *telemetry.Store) *Planner {
+	return &Planner{store: store, telemetry: telemetry}
+}
+
+// Model returns the heater's configured model, or DefaultModel.
+func (p *Planner) Model(ref heaterstore.HeaterRef) (heaterstore.PreheatModel, bool, error) {
+	config, err := p.store.GetConfig(ref.Owner, ref.Heater)
+	if err != nil {
+		return DefaultModel, false, err
+	}
+	if config.Preheat == nil {
+		return DefaultModel, false, nil
+	}
+	return *config.Preheat, true, nil
+}
+
+// Plan returns a plan for the heater to be warm at readyAt. If there is not
+// enough time, the plan starts at now.
+func (p *Planner) Plan(ref heaterstore.HeaterRef, readyAt, now time.Time) (Plan, error) {
+	plan := Plan{ReadyAt: readyAt, Off: readyAt.Add(KeepOn)}
+	model, configured, err := p.Model(ref)
+	if err != nil {
+		return plan, err
+	}
+	latest, ok, err := p.telemetry.Latest(ref.Owner, ref.Heater, telemetry.MetricAmbientTemp)
+	if err != nil {
+		return plan, err
+	}
+
+	fit, learned, err := p.Learned(ref)
+	if err != nil {
+		return plan, err
+	}
+
+	switch {
+	case ok && now.Sub(latest.Time) <= AmbientMaxAge && learned:
+		plan.Ambient = latest.Value
+		plan.HaveAmbient = true
+		plan.Duration = fit.Duration(latest.Value)
+		plan.Basis = fmt.Sprintf("what was learned from %d past preheats", fit.Observations)
+	case ok && now.Sub(latest.Time) <= AmbientMaxAge:
+		plan.Ambient = latest.Value
+		plan.HaveAmbient = true
+		plan.Duration = Duration(model, latest.Value)
+		plan.Basis = "the default model"
+		if configured {
+			plan.Basis = "the heater's model"
+		}
+	default:
+		plan.Duration = DefaultDuration
+		plan.Basis = "no recent ambient temperature, so a default duration"
+	}
+
+	plan.Start = readyAt.Add(-plan.Duration)
+	if plan.Start.Before(now) {
+		plan.Start = now
+	}
+	return plan, nil
+}
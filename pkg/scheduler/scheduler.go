@@ -0,0 +1,127 @@
+// Package scheduler makes the heater changes that other features schedule
+// ahead of time, such as turning a heater on so an engine is warm by a
+// given time.
+package scheduler
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mhrivnak/preheatbot/pkg/health"
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+)
+
+const interval = 30 * time.Second
+
+// MaxRunAge is how long the scheduler may go without a successful run
+// before it is reported as not ready.
+const MaxRunAge = 3 * interval
+
+// Setter changes a heater's value and wakes anyone waiting on it.
+type Setter interface {
+	SetHeater(ref heaterstore.HeaterRef, value, by string) (heaterstore.Record, error)
+}
+
+// Notifier sends a message to a user.
+type Notifier interface {
+	Notify(username, message string, options ...interface{})
+}
+
+// Scheduler fires scheduled actions when they are due.
+type Scheduler struct {
+	store    *heaterstore.Store
+	setter   Setter
+	notifier Notifier
+	// mu guards status.
+	mu     sync.Mutex
+	status health.Loop
+}
+
+func New(store *heaterstore.Store, setter Setter, notifier Notifier) *Scheduler {
+	return &Scheduler{
+		store:    store,
+		setter:   setter,
+		notifier: notifier,
+	}
+}
+
+// Run fires due actions periodically. It never returns.
+func (s *Scheduler) Run() {
+	s.mu.Lock()
+	s.status.Running = true
+	s.status.Started = time.Now()
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.RunOnce(now)
+	}
+}
+
+// RunOnce fires every action that is due at now. Actions that were missed,
+// for example while the server was down, are fired in order so the heater
+// ends up as the most recent one intended. Then the next time each sun rule
+// fires is scheduled.
+func (s *Scheduler) RunOnce(now time.Time) {
+	namespaces, err := s.store.Namespaces()
+	if err != nil {
+		log.Errorf("error listing namespaces for scheduler: %s", err.Error())
+		s.finishRun(now, err)
+		return
+	}
+	var runErr error
+	for _, owner := range namespaces {
+		due, err := s.store.TakeDueActions(owner, now)
+		if err != nil {
+			log.Errorf("error getting scheduled actions for %s: %s", owner, err.Error())
+			runErr = err
+			continue
+		}
+		for _, action := range due {
+			s.fire(owner, action)
+		}
+	}
+	s.planSun(now)
+	s.finishRun(now, runErr)
+}
+
+// finishRun records the outcome of a run for Status.
+func (s *Scheduler) finishRun(now time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Err = err
+	if err == nil {
+		s.status.LastSuccess = now
+	}
+}
+
+// Status returns the state of the loop started by Run.
+func (s *Scheduler) Status() health.Loop {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+func (s *Scheduler) fire(owner string, action heaterstore.Action) {
+	ref := heaterstore.HeaterRef{Owner: owner, Heater: action.Heater}
+	// the creator may have lost access since scheduling the action
+	role, ok := s.store.Role(action.CreatedBy, owner, action.Heater)
+	if !ok || !role.CanControl() {
+		log.Infof("skipping scheduled action %s for %s/%s: %s can no longer control it", action.ID, owner, action.Heater, action.CreatedBy)
+		return
+	}
+	_, err := s.setter.SetHeater(ref, action.Value, action.CreatedBy)
+	if err != nil {
+		log.Errorf("error firing scheduled action %s for %s/%s: %s", action.ID, owner, action.Heater, err.Error())
+		return
+	}
+	message := fmt.Sprintf("As scheduled, I set %s to %s", ref.Name(action.CreatedBy), action.Value)
+	if action.Reason != "" {
+		message += " (" + action.Reason + ")"
+	}
+	s.notifier.Notify(action.CreatedBy, message)
+}
@@ -0,0 +1,126 @@
+package scheduler
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/solar"
+)
+
+// SunSource identifies scheduled actions created from a heater's sun rules.
+const SunSource = "sun"
+
+// DescribeSunRule returns a description of when the rule fires, such as
+// "1h30m0s before sunrise".
+func DescribeSunRule(rule heaterstore.SunRule) string {
+	offset := time.Duration(rule.Offset)
+	switch {
+	case offset < 0:
+		return (-offset).String() + " before " + rule.Event
+	case offset > 0:
+		return offset.String() + " after " + rule.Event
+	}
+	return "at " + rule.Event
+}
+
+// NextSunTime returns the first time after now at which the rule fires at
+// the site. The second return value is false if it won't fire in the next few
+// days, which happens near the poles.
+func NextSunTime(rule heaterstore.SunRule, site heaterstore.Site, now time.Time) (time.Time, bool) {
+	event, err := solar.ParseEvent(rule.Event)
+	if err != nil {
+		return time.Time{}, false
+	}
+	local := now.In(site.Location())
+	// start from yesterday in case a positive offset pushes its event past now
+	for days := -1; days <= 2; days++ {
+		t, ok := solar.Time(event, local.AddDate(0, 0, days), site.Latitude, site.Longitude)
+		if !ok {
+			continue
+		}
+		t = t.Add(time.Duration(rule.Offset))
+		if t.After(now) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// planSun makes sure that the next time each heater's sun rules fire is on the
+// schedule.
+func (s *Scheduler) planSun(now time.Time) {
+	refs, err := s.store.AllHeaters()
+	if err != nil {
+		log.Errorf("error listing heaters for sun rules: %s", err.Error())
+		return
+	}
+	for _, ref := range refs {
+		config, err := s.store.GetConfig(ref.Owner, ref.Heater)
+		if err != nil {
+			log.Errorf("error getting config for %s/%s: %s", ref.Owner, ref.Heater, err.Error())
+			continue
+		}
+		actions := []heaterstore.Action{}
+		if config.Site != nil {
+			for _, rule := range config.SunRules {
+				at, ok := NextSunTime(rule, *config.Site, now)
+				if !ok {
+					continue
+				}
+				actions = append(actions, heaterstore.Action{
+					At:        at,
+					Value:     rule.Value,
+					CreatedBy: rule.CreatedBy,
+					Reason:    DescribeSunRule(rule),
+				})
+			}
+		}
+		scheduled, err := s.store.Schedule(ref.Owner)
+		if err != nil {
+			log.Errorf("error getting schedule for %s: %s", ref.Owner, err.Error())
+			continue
+		}
+		if sameActions(filterActions(scheduled, ref.Heater, SunSource), actions) {
+			continue
+		}
+		_, err = s.store.ReplaceActions(ref.Owner, ref.Heater, SunSource, actions)
+		if err != nil {
+			log.Errorf("error scheduling sun rules for %s/%s: %s", ref.Owner, ref.Heater, err.Error())
+		}
+	}
+}
+
+// filterActions returns the actions for the heater from source.
+func filterActions(actions []heaterstore.Action, heater, source string) []heaterstore.Action {
+	filtered := []heaterstore.Action{}
+	for _, action := range actions {
+		if action.Heater == heater && action.Source == source {
+			filtered = append(filtered, action)
+		}
+	}
+	return filtered
+}
+
+// sameActions returns true if a and b make the same changes at the same
+// times, ignoring order and IDs.
+func sameActions(a, b []heaterstore.Action) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	used := make([]bool, len(b))
+	for _, x := range a {
+		found := false
+		for i, y := range b {
+			if !used[i] && x.At.Equal(y.At) && x.Value == y.Value && x.CreatedBy == y.CreatedBy && x.Reason == y.Reason {
+				used[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+)
+
+func TestDescribeSunRule(t *testing.T) {
+	for _, tc := range []struct {
+		offset   time.Duration
+		expected string
+	}{
+		{-90 * time.Minute, "1h30m0s before sunrise"},
+		{15 * time.Minute, "15m0s after sunrise"},
+		{0, "at sunrise"},
+	} {
+		got := DescribeSunRule(heaterstore.SunRule{Event: "sunrise", Offset: heaterstore.Duration(tc.offset)})
+		if got != tc.expected {
+			t.Errorf("expected %q, got %q", tc.expected, got)
+		}
+	}
+}
+
+func TestNextSunTime(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone data: %s", err.Error())
+	}
+	nyc := heaterstore.Site{Latitude: 40.7128, Longitude: -74.006, Timezone: "America/New_York"}
+	tromso := heaterstore.Site{Latitude: 69.6492, Longitude: 18.9553, Timezone: "Europe/Oslo"}
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2024, month, day, hour, minute, 0, 0, newYork)
+	}
+	for _, tc := range []struct {
+		name   string
+		rule   heaterstore.SunRule
+		site   heaterstore.Site
+		now    time.Time
+		ok     bool
+		approx time.Time
+	}{
+		{
+			name:   "before sunrise today",
+			rule:   heaterstore.SunRule{Event: "sunrise", Offset: heaterstore.Duration(-30 * time.Minute)},
+			site:   nyc,
+			now:    at(time.June, 21, 3, 0),
+			ok:     true,
+			approx: at(time.June, 21, 4, 55),
+		},
+		{
+			name:   "after sunrise today",
+			rule:   heaterstore.SunRule{Event: "sunrise"},
+			site:   nyc,
+			now:    at(time.June, 21, 6, 0),
+			ok:     true,
+			approx: at(time.June, 22, 5, 25),
+		},
+		{
+			name:   "offset past midnight",
+			rule:   heaterstore.SunRule{Event: "sunset", Offset: heaterstore.Duration(4 * time.Hour)},
+			site:   nyc,
+			now:    at(time.June, 22, 0, 10),
+			ok:     true,
+			approx: at(time.June, 22, 0, 31),
+		},
+		{
+			name:   "dusk",
+			rule:   heaterstore.SunRule{Event: "dusk"},
+			site:   nyc,
+			now:    at(time.June, 21, 12, 0),
+			ok:     true,
+			approx: at(time.June, 21, 21, 3),
+		},
+		{
+			name: "polar night",
+			rule: heaterstore.SunRule{Event: "sunrise"},
+			site: tromso,
+			now:  at(time.December, 21, 12, 0),
+		},
+		{
+			name: "polar day",
+			rule: heaterstore.SunRule{Event: "sunset"},
+			site: tromso,
+			now:  at(time.June, 21, 12, 0),
+		},
+		{
+			name: "unknown event",
+			rule: heaterstore.SunRule{Event: "noon"},
+			site: nyc,
+			now:  at(time.June, 21, 12, 0),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := NextSunTime(tc.rule, tc.site, tc.now)
+			if ok != tc.ok {
+				t.Fatalf("expected ok to be %t, got %t at %s", tc.ok, ok, got)
+			}
+			if !ok {
+				return
+			}
+			if !got.After(tc.now) {
+				t.Errorf("expected a time after %s, got %s", tc.now, got)
+			}
+			if d := got.Sub(tc.approx); d > 2*time.Minute || d < -2*time.Minute {
+				t.Errorf("expected about %s, got %s", tc.approx, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+// Package shortcut signs, checks and runs shortcuts: URLs that set a heater
+// when opened, so that users can control heaters from an NFC tag or a phone
+// shortcut without talking to the bot.
+package shortcut
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+)
+
+// Source identifies the scheduled actions that turn a heater off after a
+// shortcut turned it on for a while.
+const Source = "shortcut"
+
+var (
+	ErrSignature = errors.New("invalid signature")
+	ErrExpired   = errors.New("this link has expired")
+	// ErrNotAllowed means the user who made the shortcut may no longer
+	// control its heater.
+	ErrNotAllowed = errors.New("not allowed to control this heater")
+)
+
+// Controller changes heaters and tells users about it.
+type Controller interface {
+	SetHeater(ref heaterstore.HeaterRef, value, by string) (heaterstore.Record, error)
+	Notify(username, message string, options ...interface{})
+}
+
+// Sign returns the signature of a URL for the shortcut that expires at the
+// given Unix time, or never if it is zero.
+func Sign(s heaterstore.Shortcut, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(s.Secret))
+	mac.Write([]byte(s.ID + "." + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// URL returns a signed URL for the shortcut under the API's base URL. If
+// expires is the zero time, the URL works until the shortcut is removed.
+func URL(base, username string, s heaterstore.Shortcut, expires time.Time) string {
+	var unix int64
+	query := url.Values{}
+	if !expires.IsZero() {
+		unix = expires.Unix()
+		query.Set("expires", strconv.FormatInt(unix, 10))
+	}
+	query.Set("sig", Sign(s, unix))
+	return fmt.Sprintf("%s/v1/users/%s/shortcuts/%s?%s", base, url.PathEscape(username), s.ID, query.Encode())
+}
+
+// Verify checks the "sig" and "expires" query parameters of a request for the
+// shortcut.
+func Verify(s heaterstore.Shortcut, query url.Values, now time.Time) error {
+	var expires int64
+	if e := query.Get("expires"); e != "" {
+		var err error
+		expires, err = strconv.ParseInt(e, 10, 64)
+		if err != nil {
+			return ErrSignature
+		}
+	}
+	if !hmac.Equal([]byte(Sign(s, expires)), []byte(query.Get("sig"))) {
+		return ErrSignature
+	}
+	if expires != 0 && now.Unix() > expires {
+		return ErrExpired
+	}
+	return nil
+}
+
+// Run sets the heater as the shortcut says on behalf of username, who must
+// still be allowed to control it, and tells them. For a shortcut that turns
+// the heater on for a while, it schedules the heater to be turned off. It
+// returns a description of what it did.
+func Run(store *heaterstore.Store, controller Controller, username string, s heaterstore.Shortcut, now time.Time) (string, error) {
+	role, ok := store.Role(username, s.Owner, s.Heater)
+	if !ok || !role.CanControl() {
+		return "", ErrNotAllowed
+	}
+	ref := heaterstore.HeaterRef{Owner: s.Owner, Heater: s.Heater, Role: role}
+	_, err := controller.SetHeater(ref, s.Value, username)
+	if err != nil {
+		return "", err
+	}
+
+	// a later shortcut replaces the off time of an earlier one
+	actions := []heaterstore.Action{}
+	message := fmt.Sprintf("I set %s to %s", ref.Name(username), s.Value)
+	if s.Value == "on" && s.For > 0 {
+		offAt := now.Add(time.Duration(s.For))
+		actions = append(actions, heaterstore.Action{At: offAt, Value: "off", CreatedBy: username, Reason: "shortcut"})
+		profile, err := store.GetProfile(username)
+		if err != nil {
+			return "", err
+		}
+		message += fmt.Sprintf(" and will turn it off at %s", offAt.In(profile.Location()).Format("15:04"))
+	}
+	_, err = store.ReplaceActions(s.Owner, s.Heater, Source, actions)
+	if err != nil {
+		return "", err
+	}
+	controller.Notify(username, "From your shortcut: "+message+".")
+	return message + ".", nil
+}
+
+// Describe describes what the shortcut does for username.
+func Describe(s heaterstore.Shortcut, username string) string {
+	ref := heaterstore.HeaterRef{Owner: s.Owner, Heater: s.Heater}
+	if s.Value == "on" && s.For > 0 {
+		return fmt.Sprintf("turn %s on for %s", ref.Name(username), time.Duration(s.For))
+	}
+	return fmt.Sprintf("turn %s %s", ref.Name(username), s.Value)
+}
@@ -0,0 +1,100 @@
+// Package solar calculates the times of sunrise, sunset and civil twilight,
+// using the sunrise equation with corrections for the equation of time,
+// atmospheric refraction and the size of the sun's disk. Times are accurate to
+// about a minute away from the polar regions.
+package solar
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Event is a daily solar event.
+type Event string
+
+const (
+	// Dawn is the beginning of morning civil twilight, when the center of
+	// the sun is 6° below the horizon.
+	Dawn Event = "dawn"
+	// Sunrise is when the top of the sun appears on the horizon.
+	Sunrise Event = "sunrise"
+	// Sunset is when the top of the sun disappears below the horizon.
+	Sunset Event = "sunset"
+	// Dusk is the end of evening civil twilight.
+	Dusk Event = "dusk"
+)
+
+// Events lists every event in the order they happen each day.
+var Events = []Event{Dawn, Sunrise, Sunset, Dusk}
+
+// ParseEvent returns the event with the given name.
+func ParseEvent(s string) (Event, error) {
+	for _, e := range Events {
+		if string(e) == s {
+			return e, nil
+		}
+	}
+	return "", fmt.Errorf("unknown solar event %q", s)
+}
+
+const (
+	// j2000 is the Julian date of 2000-01-01 12:00 UTC.
+	j2000 = 2451545.0
+	// obliquity is the tilt of the earth's axis, in degrees.
+	obliquity = 23.4397
+)
+
+var epoch = time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// altitude returns the altitude, in degrees, of the center of the sun at the
+// event.
+func (e Event) altitude() float64 {
+	if e == Dawn || e == Dusk {
+		return -6
+	}
+	return -0.833
+}
+
+func (e Event) morning() bool {
+	return e == Dawn || e == Sunrise
+}
+
+// Time returns when the event happens on date's calendar day in date's
+// location, at the given latitude and longitude in degrees, with north and
+// east positive. The second return value is false if the event doesn't
+// happen that day, such as sunrise during a polar night.
+func Time(event Event, date time.Time, latitude, longitude float64) (time.Time, bool) {
+	year, month, day := date.Date()
+	noon := time.Date(year, month, day, 12, 0, 0, 0, time.UTC)
+	n := math.Round(noon.Sub(epoch).Hours() / 24)
+
+	// mean solar noon, as days since j2000
+	meanNoon := n - longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*meanNoon, 360)
+	center := 1.9148*sin(anomaly) + 0.02*sin(2*anomaly) + 0.0003*sin(3*anomaly)
+	eclipticLongitude := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := meanNoon + 0.0053*sin(anomaly) - 0.0069*sin(2*eclipticLongitude)
+	declination := math.Asin(sin(eclipticLongitude) * sin(obliquity))
+
+	cosHourAngle := (sin(event.altitude()) - sin(latitude)*math.Sin(declination)) /
+		(cos(latitude) * math.Cos(declination))
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+	days := transit + hourAngle/360
+	if event.morning() {
+		days = transit - hourAngle/360
+	}
+	t := epoch.Add(time.Duration(days * 24 * float64(time.Hour)))
+	return t.In(date.Location()).Round(time.Second), true
+}
+
+func sin(degrees float64) float64 {
+	return math.Sin(degrees * math.Pi / 180)
+}
+
+func cos(degrees float64) float64 {
+	return math.Cos(degrees * math.Pi / 180)
+}
@@ -0,0 +1,82 @@
+package solar
+
+import (
+	"testing"
+	"time"
+)
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("no time zone data: %s", err.Error())
+	}
+	return loc
+}
+
+func TestTime(t *testing.T) {
+	newYork := loadLocation(t, "America/New_York")
+	reykjavik := loadLocation(t, "Atlantic/Reykjavik")
+	tromso := loadLocation(t, "Europe/Oslo")
+	longyearbyen := loadLocation(t, "Arctic/Longyearbyen")
+	sydney := loadLocation(t, "Australia/Sydney")
+	at := func(loc *time.Location, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2024, month, day, hour, minute, 0, 0, loc)
+	}
+	for _, tc := range []struct {
+		name      string
+		event     Event
+		date      time.Time
+		latitude  float64
+		longitude float64
+		// expected is zero if the event doesn't happen that day
+		expected  time.Time
+		tolerance time.Duration
+	}{
+		// expected times are from the NOAA solar calculator
+		{"new york dawn", Dawn, at(newYork, time.June, 21, 0, 0), 40.7128, -74.006, at(newYork, time.June, 21, 4, 53), 2 * time.Minute},
+		{"new york sunrise", Sunrise, at(newYork, time.June, 21, 0, 0), 40.7128, -74.006, at(newYork, time.June, 21, 5, 25), 2 * time.Minute},
+		{"new york sunset", Sunset, at(newYork, time.June, 21, 0, 0), 40.7128, -74.006, at(newYork, time.June, 21, 20, 31), 2 * time.Minute},
+		{"new york dusk", Dusk, at(newYork, time.June, 21, 0, 0), 40.7128, -74.006, at(newYork, time.June, 21, 21, 3), 2 * time.Minute},
+		{"new york winter sunrise", Sunrise, at(newYork, time.December, 21, 23, 0), 40.7128, -74.006, at(newYork, time.December, 21, 7, 17), 2 * time.Minute},
+		{"reykjavik sunrise", Sunrise, at(reykjavik, time.December, 21, 12, 0), 64.1466, -21.9426, at(reykjavik, time.December, 21, 11, 22), 5 * time.Minute},
+		{"reykjavik sunset", Sunset, at(reykjavik, time.December, 21, 12, 0), 64.1466, -21.9426, at(reykjavik, time.December, 21, 15, 29), 5 * time.Minute},
+		{"polar night sunrise", Sunrise, at(tromso, time.December, 21, 12, 0), 69.6492, 18.9553, time.Time{}, 0},
+		{"polar night sunset", Sunset, at(tromso, time.December, 21, 12, 0), 69.6492, 18.9553, time.Time{}, 0},
+		{"polar night dawn", Dawn, at(longyearbyen, time.December, 21, 12, 0), 78.2232, 15.6267, time.Time{}, 0},
+		{"polar day sunrise", Sunrise, at(tromso, time.June, 21, 12, 0), 69.6492, 18.9553, time.Time{}, 0},
+		{"polar day sunset", Sunset, at(tromso, time.June, 21, 12, 0), 69.6492, 18.9553, time.Time{}, 0},
+		{"sydney summer sunrise", Sunrise, at(sydney, time.December, 21, 12, 0), -33.8688, 151.2093, at(sydney, time.December, 21, 5, 41), 2 * time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := Time(tc.event, tc.date, tc.latitude, tc.longitude)
+			if tc.expected.IsZero() {
+				if ok {
+					t.Errorf("expected no %s, got %s", tc.event, got)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("expected %s at %s, got none", tc.event, tc.expected)
+			}
+			if d := got.Sub(tc.expected); d > tc.tolerance || d < -tc.tolerance {
+				t.Errorf("expected %s, got %s", tc.expected, got)
+			}
+			if got.Location() != tc.date.Location() {
+				t.Errorf("expected a time in %s, got %s", tc.date.Location(), got.Location())
+			}
+		})
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	for _, e := range Events {
+		got, err := ParseEvent(string(e))
+		if err != nil || got != e {
+			t.Errorf("expected %s, got %s, %v", e, got, err)
+		}
+	}
+	_, err := ParseEvent("noon")
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,452 @@
+// Package telemetry stores readings reported by devices, such as
+// temperatures and current draw, as compact on-disk time series.
+//
+// Each series is identified by a heater and a metric name. Recent samples
+// are kept at full resolution in one file per UTC day. Older samples are
+// downsampled into hourly rollups, which are themselves discarded after a
+// longer retention period. See Compact.
+package telemetry
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+)
+
+// Well-known metric names. Temperatures are in degrees Celsius and current
+// is in amps. Devices may report other metrics too.
+const (
+	MetricAmbientTemp = "ambient_temp"
+	MetricEngineTemp  = "engine_temp"
+	MetricCurrent     = "current"
+)
+
+// Dirname is the conventional name of the telemetry directory within the
+// data dir.
+const Dirname = ".telemetry"
+
+const (
+	// DefaultRawRetention is how long full-resolution samples are kept.
+	DefaultRawRetention = 7 * 24 * time.Hour
+	// DefaultRollupRetention is how long hourly rollups are kept.
+	DefaultRollupRetention = 2 * 365 * 24 * time.Hour
+	// MaxClockSkew is how far ahead of the server's clock a sample's time
+	// may be. A device whose clock runs further ahead would otherwise leave
+	// a sample that looks like the latest reading until its time passes.
+	MaxClockSkew = 5 * time.Minute
+
+	rawPrefix      = "raw-"
+	rawDayLayout   = "20060102"
+	rollupFilename = "hourly"
+	// a raw sample is an int64 unix time in milliseconds and a float64 value
+	rawSize = 16
+	// a rollup is an int64 unix time in seconds of the start of the hour,
+	// float64 min, max and sum, and a uint32 count
+	rollupSize = 36
+)
+
+// Sample is one reading of one metric.
+type Sample struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// Rollup summarizes the samples of one metric during one hour.
+type Rollup struct {
+	Hour  time.Time
+	Min   float64
+	Max   float64
+	Sum   float64
+	Count uint32
+}
+
+// Mean returns the average value during the hour.
+func (r Rollup) Mean() float64 {
+	if r.Count == 0 {
+		return 0
+	}
+	return r.Sum / float64(r.Count)
+}
+
+// Store keeps time series under Dir. Retention periods of zero mean the
+// defaults.
+type Store struct {
+	sync.Mutex
+	Dir             string
+	RawRetention    time.Duration
+	RollupRetention time.Duration
+}
+
+// Validate returns an error if the metric name or any of the samples is not
+// valid: a sample must have a time that is not in the future, and a finite
+// value.
+func Validate(metric string, samples []Sample) error {
+	if !heaterstore.ValidName(metric) {
+		return fmt.Errorf("invalid metric name %q", metric)
+	}
+	latest := time.Now().Add(MaxClockSkew)
+	for _, sample := range samples {
+		if sample.Time.IsZero() {
+			return fmt.Errorf("sample of %s is missing a time", metric)
+		}
+		if sample.Time.After(latest) {
+			return fmt.Errorf("sample of %s at %s is in the future", metric, sample.Time.UTC().Format(time.RFC3339))
+		}
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			return fmt.Errorf("invalid value %v of %s", sample.Value, metric)
+		}
+	}
+	return nil
+}
+
+// Append adds samples to the heater's series for metric. Samples may arrive
+// in any order. Nothing is stored unless they pass Validate.
+func (s *Store) Append(owner, heater, metric string, samples []Sample) error {
+	err := Validate(metric, samples)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	dir := s.seriesDir(owner, heater, metric)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// group by day so each file is opened once
+	byDay := make(map[string][]byte)
+	for _, sample := range samples {
+		day := sample.Time.UTC().Format(rawDayLayout)
+		buf := make([]byte, rawSize)
+		binary.LittleEndian.PutUint64(buf[0:8], uint64(sample.Time.UnixNano()/int64(time.Millisecond)))
+		binary.LittleEndian.PutUint64(buf[8:16], math.Float64bits(sample.Value))
+		byDay[day] = append(byDay[day], buf...)
+	}
+	for day, data := range byDay {
+		err = appendFile(filepath.Join(dir, rawPrefix+day), data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query returns the samples for metric between from and to, inclusive,
+// oldest first. Where full-resolution samples are no longer available, each
+// hourly rollup is returned as a single sample of its mean at the start of
+// the hour.
+func (s *Store) Query(owner, heater, metric string, from, to time.Time) ([]Sample, error) {
+	s.Lock()
+	defer s.Unlock()
+	samples := []Sample{}
+	dir := s.seriesDir(owner, heater, metric)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return samples, nil
+		}
+		return samples, err
+	}
+
+	rawFrom := time.Time{}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), rawPrefix) {
+			continue
+		}
+		day, err := time.Parse(rawDayLayout, strings.TrimPrefix(file.Name(), rawPrefix))
+		if err != nil {
+			continue
+		}
+		if rawFrom.IsZero() || day.Before(rawFrom) {
+			rawFrom = day
+		}
+		if day.After(to) || day.Add(24*time.Hour).Before(from) {
+			continue
+		}
+		raw, err := readRaw(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return samples, err
+		}
+		for _, sample := range raw {
+			if !sample.Time.Before(from) && !sample.Time.After(to) {
+				samples = append(samples, sample)
+			}
+		}
+	}
+
+	rollups, err := readRollups(filepath.Join(dir, rollupFilename))
+	if err != nil {
+		return samples, err
+	}
+	for _, rollup := range rollups {
+		// prefer raw samples where both exist
+		if !rawFrom.IsZero() && !rollup.Hour.Before(rawFrom) {
+			continue
+		}
+		if !rollup.Hour.Before(from) && !rollup.Hour.After(to) {
+			samples = append(samples, Sample{Time: rollup.Hour, Value: rollup.Mean()})
+		}
+	}
+
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+	return samples, nil
+}
+
+// Latest returns the most recent sample of metric. The second return value is
+// false if there are no samples.
+func (s *Store) Latest(owner, heater, metric string) (Sample, bool, error) {
+	s.Lock()
+	dir := s.seriesDir(owner, heater, metric)
+	files, err := ioutil.ReadDir(dir)
+	s.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Sample{}, false, nil
+		}
+		return Sample{}, false, err
+	}
+	// ReadDir sorts by name, so the last raw file is the most recent day
+	for i := len(files) - 1; i >= 0; i-- {
+		if !strings.HasPrefix(files[i].Name(), rawPrefix) {
+			continue
+		}
+		day, err := time.Parse(rawDayLayout, strings.TrimPrefix(files[i].Name(), rawPrefix))
+		if err != nil {
+			continue
+		}
+		samples, err := s.Query(owner, heater, metric, day, day.Add(24*time.Hour))
+		if err != nil {
+			return Sample{}, false, err
+		}
+		if len(samples) > 0 {
+			return samples[len(samples)-1], true, nil
+		}
+	}
+	return Sample{}, false, nil
+}
+
+// LastReport returns the time of the most recent sample of any metric from
+// the heater's device. The second return value is false if it has never
+// reported.
+func (s *Store) LastReport(owner, heater string) (time.Time, bool, error) {
+	metrics, err := s.Metrics(owner, heater)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	var last time.Time
+	for _, metric := range metrics {
+		sample, ok, err := s.Latest(owner, heater, metric)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		if ok && sample.Time.After(last) {
+			last = sample.Time
+		}
+	}
+	return last, !last.IsZero(), nil
+}
+
+// Metrics returns the names of the metrics that have been reported for the
+// heater.
+func (s *Store) Metrics(owner, heater string) ([]string, error) {
+	metrics := []string{}
+	files, err := ioutil.ReadDir(filepath.Join(s.Dir, owner, heater))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return metrics, nil
+		}
+		return metrics, err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			metrics = append(metrics, file.Name())
+		}
+	}
+	return metrics, nil
+}
+
+// Compact downsamples raw samples older than the raw retention period into
+// hourly rollups, and discards rollups older than the rollup retention
+// period.
+func (s *Store) Compact(now time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	rawRetention := s.RawRetention
+	if rawRetention == 0 {
+		rawRetention = DefaultRawRetention
+	}
+	rollupRetention := s.RollupRetention
+	if rollupRetention == 0 {
+		rollupRetention = DefaultRollupRetention
+	}
+
+	return filepath.Walk(s.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if info.Name() == rollupFilename {
+			return pruneRollups(path, now.Add(-rollupRetention))
+		}
+		if !strings.HasPrefix(info.Name(), rawPrefix) {
+			return nil
+		}
+		day, err := time.Parse(rawDayLayout, strings.TrimPrefix(info.Name(), rawPrefix))
+		if err != nil {
+			return nil
+		}
+		// keep the file until all of its samples are past retention
+		if day.Add(24 * time.Hour).After(now.Add(-rawRetention)) {
+			return nil
+		}
+		return rollUp(path, filepath.Join(filepath.Dir(path), rollupFilename))
+	})
+}
+
+// RunCompactor calls Compact once an hour. It never returns.
+func (s *Store) RunCompactor(logError func(error)) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		err := s.Compact(now)
+		if err != nil {
+			logError(err)
+		}
+	}
+}
+
+func (s *Store) seriesDir(owner, heater, metric string) string {
+	return filepath.Join(s.Dir, owner, heater, metric)
+}
+
+// rollUp summarizes the raw file into hourly rollups, appends them to the
+// rollup file, and removes the raw file.
+func rollUp(rawPath, rollupPath string) error {
+	samples, err := readRaw(rawPath)
+	if err != nil {
+		return err
+	}
+	hours := make(map[int64]*Rollup)
+	for _, sample := range samples {
+		hour := sample.Time.Truncate(time.Hour)
+		r, ok := hours[hour.Unix()]
+		if !ok {
+			r = &Rollup{Hour: hour, Min: sample.Value, Max: sample.Value}
+			hours[hour.Unix()] = r
+		}
+		r.Min = math.Min(r.Min, sample.Value)
+		r.Max = math.Max(r.Max, sample.Value)
+		r.Sum += sample.Value
+		r.Count++
+	}
+	keys := make([]int64, 0, len(hours))
+	for k := range hours {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	data := []byte{}
+	for _, k := range keys {
+		data = append(data, encodeRollup(*hours[k])...)
+	}
+	err = appendFile(rollupPath, data)
+	if err != nil {
+		return err
+	}
+	return os.Remove(rawPath)
+}
+
+func pruneRollups(path string, before time.Time) error {
+	rollups, err := readRollups(path)
+	if err != nil {
+		return err
+	}
+	data := []byte{}
+	pruned := false
+	for _, r := range rollups {
+		if r.Hour.Before(before) {
+			pruned = true
+			continue
+		}
+		data = append(data, encodeRollup(r)...)
+	}
+	if !pruned {
+		return nil
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func readRaw(path string) ([]Sample, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]Sample, 0, len(data)/rawSize)
+	// ignore a trailing partial record from an interrupted write
+	for i := 0; i+rawSize <= len(data); i += rawSize {
+		ms := int64(binary.LittleEndian.Uint64(data[i : i+8]))
+		samples = append(samples, Sample{
+			Time:  time.Unix(0, ms*int64(time.Millisecond)),
+			Value: math.Float64frombits(binary.LittleEndian.Uint64(data[i+8 : i+16])),
+		})
+	}
+	return samples, nil
+}
+
+func readRollups(path string) ([]Rollup, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Rollup{}, nil
+		}
+		return nil, err
+	}
+	rollups := make([]Rollup, 0, len(data)/rollupSize)
+	for i := 0; i+rollupSize <= len(data); i += rollupSize {
+		rollups = append(rollups, Rollup{
+			Hour:  time.Unix(int64(binary.LittleEndian.Uint64(data[i:i+8])), 0),
+			Min:   math.Float64frombits(binary.LittleEndian.Uint64(data[i+8 : i+16])),
+			Max:   math.Float64frombits(binary.LittleEndian.Uint64(data[i+16 : i+24])),
+			Sum:   math.Float64frombits(binary.LittleEndian.Uint64(data[i+24 : i+32])),
+			Count: binary.LittleEndian.Uint32(data[i+32 : i+36]),
+		})
+	}
+	return rollups, nil
+}
+
+func encodeRollup(r Rollup) []byte {
+	buf := make([]byte, rollupSize)
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(r.Hour.Unix()))
+	binary.LittleEndian.PutUint64(buf[8:16], math.Float64bits(r.Min))
+	binary.LittleEndian.PutUint64(buf[16:24], math.Float64bits(r.Max))
+	binary.LittleEndian.PutUint64(buf[24:32], math.Float64bits(r.Sum))
+	binary.LittleEndian.PutUint32(buf[32:36], r.Count)
+	return buf
+}
+
+func appendFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,251 @@
+package telemetry
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *Store {
+	dir, err := ioutil.TempDir("", "telemetry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &Store{Dir: dir}
+}
+
+func checkSamples(t *testing.T, got, expected []Sample) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d samples, got %d: %v", len(expected), len(got), got)
+	}
+	for i := range expected {
+		if !got[i].Time.Equal(expected[i].Time) || got[i].Value != expected[i].Value {
+			t.Errorf("sample %d: expected %v, got %v", i, expected[i], got[i])
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name    string
+		metric  string
+		sample  Sample
+		invalid bool
+	}{
+		{name: "valid", metric: MetricEngineTemp, sample: Sample{Time: now, Value: 3}},
+		{name: "past", metric: MetricEngineTemp, sample: Sample{Time: now.Add(-48 * time.Hour), Value: 3}},
+		{name: "slightly ahead", metric: MetricEngineTemp, sample: Sample{Time: now.Add(time.Minute), Value: 3}},
+		{name: "future", metric: MetricEngineTemp, sample: Sample{Time: now.Add(time.Hour), Value: 3}, invalid: true},
+		{name: "no time", metric: MetricEngineTemp, sample: Sample{Value: 3}, invalid: true},
+		{name: "NaN", metric: MetricEngineTemp, sample: Sample{Time: now, Value: math.NaN()}, invalid: true},
+		{name: "infinite", metric: MetricEngineTemp, sample: Sample{Time: now, Value: math.Inf(-1)}, invalid: true},
+		{name: "metric name", metric: "../config", sample: Sample{Time: now, Value: 3}, invalid: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Validate(tc.metric, []Sample{tc.sample})
+			if tc.invalid && err == nil {
+				t.Error("expected an error")
+			}
+			if !tc.invalid && err != nil {
+				t.Errorf("unexpected error: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestAppendRejectsFutureSamples(t *testing.T) {
+	s := newTestStore(t)
+	now := time.Now()
+	err := s.Append("alice", "n123", MetricEngineTemp, []Sample{
+		{Time: now.Add(-time.Minute), Value: 1},
+		{Time: now.Add(24 * time.Hour), Value: 2},
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	_, ok, err := s.Latest("alice", "n123", MetricEngineTemp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("expected none of the samples to be stored")
+	}
+}
+
+func TestAppendQuery(t *testing.T) {
+	s := newTestStore(t)
+	day := time.Date(2021, time.January, 15, 0, 0, 0, 0, time.UTC)
+	// out of order and across two days
+	err := s.Append("alice", "n123", MetricEngineTemp, []Sample{
+		{Time: day.Add(25 * time.Hour), Value: 4},
+		{Time: day.Add(time.Hour), Value: 1},
+		{Time: day.Add(23 * time.Hour), Value: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Append("alice", "n123", MetricEngineTemp, []Sample{{Time: day.Add(2 * time.Hour), Value: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples, err := s.Query("alice", "n123", MetricEngineTemp, day, day.Add(48*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSamples(t, samples, []Sample{
+		{Time: day.Add(time.Hour), Value: 1},
+		{Time: day.Add(2 * time.Hour), Value: 2},
+		{Time: day.Add(23 * time.Hour), Value: 3},
+		{Time: day.Add(25 * time.Hour), Value: 4},
+	})
+
+	// both ends are inclusive
+	samples, err = s.Query("alice", "n123", MetricEngineTemp, day.Add(2*time.Hour), day.Add(23*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSamples(t, samples, []Sample{
+		{Time: day.Add(2 * time.Hour), Value: 2},
+		{Time: day.Add(23 * time.Hour), Value: 3},
+	})
+
+	samples, err = s.Query("alice", "n123", MetricAmbientTemp, day, day.Add(48*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSamples(t, samples, []Sample{})
+}
+
+func TestQueryIgnoresPartialRecord(t *testing.T) {
+	s := newTestStore(t)
+	at := time.Date(2021, time.January, 15, 12, 0, 0, 0, time.UTC)
+	err := s.Append("alice", "n123", MetricCurrent, []Sample{{Time: at, Value: 4.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as if a write was interrupted
+	err = appendFile(filepath.Join(s.seriesDir("alice", "n123", MetricCurrent), rawPrefix+"20210115"), []byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples, err := s.Query("alice", "n123", MetricCurrent, at.Add(-time.Hour), at.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSamples(t, samples, []Sample{{Time: at, Value: 4.5}})
+}
+
+func TestLatest(t *testing.T) {
+	s := newTestStore(t)
+	_, ok, err := s.Latest("alice", "n123", MetricEngineTemp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("expected no latest sample before any are reported")
+	}
+	_, ok, err = s.LastReport("alice", "n123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("expected no last report before any are reported")
+	}
+
+	day := time.Date(2021, time.January, 15, 0, 0, 0, 0, time.UTC)
+	err = s.Append("alice", "n123", MetricEngineTemp, []Sample{
+		{Time: day.Add(30 * time.Hour), Value: 8},
+		{Time: day.Add(26 * time.Hour), Value: 6},
+		{Time: day.Add(time.Hour), Value: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Append("alice", "n123", MetricAmbientTemp, []Sample{{Time: day.Add(31 * time.Hour), Value: -5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latest, ok, err := s.Latest("alice", "n123", MetricEngineTemp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected a latest sample")
+	}
+	checkSamples(t, []Sample{latest}, []Sample{{Time: day.Add(30 * time.Hour), Value: 8}})
+
+	last, ok, err := s.LastReport("alice", "n123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !last.Equal(day.Add(31*time.Hour)) {
+		t.Errorf("expected last report at %s, got %s", day.Add(31*time.Hour), last)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	s := newTestStore(t)
+	s.RollupRetention = 30 * 24 * time.Hour
+	day := time.Date(2021, time.January, 15, 0, 0, 0, 0, time.UTC)
+	err := s.Append("alice", "n123", MetricEngineTemp, []Sample{
+		{Time: day.Add(10 * time.Hour), Value: 1},
+		{Time: day.Add(10*time.Hour + 30*time.Minute), Value: 3},
+		{Time: day.Add(11*time.Hour + 15*time.Minute), Value: 5},
+		{Time: day.Add(9*24*time.Hour + 6*time.Hour), Value: 7},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first day is past raw retention; the second is not
+	err = s.Compact(day.Add(10 * 24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := s.seriesDir("alice", "n123", MetricEngineTemp)
+	_, err = os.Stat(filepath.Join(dir, rawPrefix+"20210115"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the old raw file to be removed, got %v", err)
+	}
+	rollups, err := readRollups(filepath.Join(dir, rollupFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rollups) != 2 {
+		t.Fatalf("expected 2 rollups, got %v", rollups)
+	}
+	first := rollups[0]
+	if !first.Hour.Equal(day.Add(10*time.Hour)) || first.Min != 1 || first.Max != 3 || first.Sum != 4 || first.Count != 2 || first.Mean() != 2 {
+		t.Errorf("unexpected rollup %+v", first)
+	}
+
+	samples, err := s.Query("alice", "n123", MetricEngineTemp, day, day.Add(20*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSamples(t, samples, []Sample{
+		{Time: day.Add(10 * time.Hour), Value: 2},
+		{Time: day.Add(11 * time.Hour), Value: 5},
+		{Time: day.Add(9*24*time.Hour + 6*time.Hour), Value: 7},
+	})
+
+	// the first day's rollups are now past rollup retention; the second
+	// day is rolled up but kept
+	err = s.Compact(day.Add(35 * 24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples, err = s.Query("alice", "n123", MetricEngineTemp, day, day.Add(20*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSamples(t, samples, []Sample{{Time: day.Add(9*24*time.Hour + 6*time.Hour), Value: 7}})
+}
@@ -0,0 +1,195 @@
+// Package thermostat turns heaters on and off to hold a temperature, based on
+// temperatures reported by each heater's device.
+package thermostat
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+)
+
+const (
+	// User is recorded as the author of changes made by the thermostat.
+	User = "thermostat"
+
+	// DefaultHysteresis is the width of the band around the target, in
+	// degrees Celsius, used when none is given.
+	DefaultHysteresis = 2.0
+
+	// StaleAfter is how old the latest reading may be before the thermostat
+	// stops trusting it and turns the heater off. A reading from further in
+	// the future than telemetry.MaxClockSkew isn't trusted either.
+	StaleAfter = 10 * time.Minute
+
+	interval = 30 * time.Second
+)
+
+// Setter changes a heater's value and wakes anyone waiting on it.
+type Setter interface {
+	SetHeater(ref heaterstore.HeaterRef, value, by string) (heaterstore.Record, error)
+	SetHeaterQuietly(ref heaterstore.HeaterRef, value, by, forUser string) (heaterstore.Record, error)
+}
+
+// Notifier sends a message to a user.
+type Notifier interface {
+	Notify(username, message string, options ...interface{})
+}
+
+// Controller runs the thermostat of every heater that has one.
+type Controller struct {
+	store     *heaterstore.Store
+	telemetry *telemetry.Store
+	setter    Setter
+	notifier  Notifier
+}
+
+func New(store *heaterstore.Store, telemetry *telemetry.Store, setter Setter, notifier Notifier) *Controller {
+	return &Controller{
+		store:     store,
+		telemetry: telemetry,
+		setter:    setter,
+		notifier:  notifier,
+	}
+}
+
+// Run evaluates every thermostat periodically. It never returns.
+func (c *Controller) Run() {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		c.RunOnce(now)
+	}
+}
+
+// RunOnce evaluates every thermostat once.
+func (c *Controller) RunOnce(now time.Time) {
+	refs, err := c.store.AllHeaters()
+	if err != nil {
+		log.Errorf("error listing heaters for thermostat: %s", err.Error())
+		return
+	}
+	for _, ref := range refs {
+		config, err := c.store.GetConfig(ref.Owner, ref.Heater)
+		if err != nil {
+			log.Errorf("error getting config for %s/%s: %s", ref.Owner, ref.Heater, err.Error())
+			continue
+		}
+		if config.Thermostat == nil {
+			continue
+		}
+		err = c.evaluate(ref, config, now)
+		if err != nil {
+			log.Errorf("error running thermostat for %s/%s: %s", ref.Owner, ref.Heater, err.Error())
+		}
+	}
+}
+
+// Decide returns the value the heater should have given the latest
+// temperature and its current value. Within the hysteresis band the current
+// value is kept.
+func Decide(t heaterstore.Thermostat, temp float64, current string) string {
+	half := t.Hysteresis / 2
+	switch {
+	case temp < t.Target-half:
+		return "on"
+	case temp > t.Target+half:
+		return "off"
+	}
+	return current
+}
+
+func (c *Controller) evaluate(ref heaterstore.HeaterRef, config heaterstore.HeaterConfig, now time.Time) error {
+	t := *config.Thermostat
+	record, err := c.store.Get(ref.Owner, ref.Heater)
+	if err != nil {
+		return err
+	}
+
+	if !now.Before(t.Until) {
+		if record.Value != "off" {
+			_, err = c.setter.SetHeater(ref, "off", User)
+			if err != nil {
+				return err
+			}
+		}
+		ended, err := c.replaceThermostat(ref, t, nil)
+		if err != nil || !ended {
+			return err
+		}
+		c.notifier.Notify(t.SetBy, fmt.Sprintf("The hold on %s has ended and it is off.", ref.Name(t.SetBy)))
+		return nil
+	}
+
+	latest, ok, err := c.telemetry.Latest(ref.Owner, ref.Heater, t.Metric)
+	if err != nil {
+		return err
+	}
+	if !ok || now.Sub(latest.Time) > StaleAfter || latest.Time.After(now.Add(telemetry.MaxClockSkew)) {
+		// fail safe: never leave a heater running unattended on old data
+		if record.Value != "off" {
+			_, err = c.setter.SetHeater(ref, "off", User)
+			if err != nil {
+				return err
+			}
+		}
+		if !t.FailSafe {
+			failSafe := t
+			failSafe.FailSafe = true
+			changed, err := c.replaceThermostat(ref, t, &failSafe)
+			if err != nil || !changed {
+				return err
+			}
+			c.notifier.Notify(t.SetBy, fmt.Sprintf(
+				"I turned %s off because its device hasn't reported %s recently. The hold will resume when readings do.",
+				ref.Name(t.SetBy), t.Metric))
+		}
+		return nil
+	}
+
+	if t.FailSafe {
+		resumed := t
+		resumed.FailSafe = false
+		changed, err := c.replaceThermostat(ref, t, &resumed)
+		if err != nil || !changed {
+			return err
+		}
+		t = resumed
+		c.notifier.Notify(t.SetBy, fmt.Sprintf("Readings for %s are back, so the hold has resumed.", ref.Name(t.SetBy)))
+	}
+
+	want := Decide(t, latest.Value, record.Value)
+	if want == record.Value {
+		return nil
+	}
+	log.Infof("thermostat setting %s/%s to %s at %.1fC", ref.Owner, ref.Heater, want, latest.Value)
+	// the hold's setter is charged for the energy
+	_, err = c.setter.SetHeaterQuietly(ref, want, User, t.SetBy)
+	return err
+}
+
+// replaceThermostat replaces the heater's thermostat, which was read as old,
+// with replacement, leaving its other settings as they are. It does nothing
+// and returns false if the thermostat was changed or cancelled since it was
+// read.
+func (c *Controller) replaceThermostat(ref heaterstore.HeaterRef, old heaterstore.Thermostat, replacement *heaterstore.Thermostat) (bool, error) {
+	replaced := false
+	err := c.store.UpdateConfig(ref.Owner, ref.Heater, func(config heaterstore.HeaterConfig) heaterstore.HeaterConfig {
+		if config.Thermostat != nil && sameThermostat(*config.Thermostat, old) {
+			config.Thermostat = replacement
+			replaced = true
+		}
+		return config
+	})
+	return replaced, err
+}
+
+func sameThermostat(a, b heaterstore.Thermostat) bool {
+	// times read from JSON may differ in their *time.Location alone
+	untilA, untilB := a.Until, b.Until
+	a.Until, b.Until = time.Time{}, time.Time{}
+	return a == b && untilA.Equal(untilB)
+}
@@ -0,0 +1,294 @@
+package usage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+)
+
+// Usage is how long a heater was on and what the energy it used cost.
+type Usage struct {
+	Hours float64 `json:"hours"`
+	KWh   float64 `json:"kWh"`
+	// Cost is zero if the heater has no tariff.
+	Cost float64 `json:"cost"`
+}
+
+func (u *Usage) add(o Usage) {
+	u.Hours += o.Hours
+	u.KWh += o.KWh
+	u.Cost += o.Cost
+}
+
+// HeaterUsage is one heater's usage over the period of a Report.
+type HeaterUsage struct {
+	Owner  string  `json:"owner"`
+	Heater string  `json:"heater"`
+	Watts  float64 `json:"watts"`
+	// Priced is true if the heater has a tariff.
+	Priced   bool   `json:"priced"`
+	Currency string `json:"currency,omitempty"`
+	Usage
+	// ByUser splits the usage by who turned the heater on. Time the
+	// thermostat had it on counts for the user who set the hold.
+	ByUser []UserUsage `json:"byUser"`
+}
+
+// UserUsage is the part of a heater's usage from times a user turned it on.
+type UserUsage struct {
+	Username string `json:"username"`
+	Usage
+}
+
+// Report is the usage of a user's heaters between From and To.
+type Report struct {
+	From    time.Time     `json:"from"`
+	To      time.Time     `json:"to"`
+	Heaters []HeaterUsage `json:"heaters"`
+}
+
+// Reporter computes usage from the history of each heater.
+type Reporter struct {
+	store *heaterstore.Store
+}
+
+func New(store *heaterstore.Store) *Reporter {
+	return &Reporter{store: store}
+}
+
+// Report returns the usage between from and to of every heater the user can
+// see. Time-of-use rates follow the heater's site time zone if it has one, or
+// else loc. A heater that is still on counts as on until now.
+func (r *Reporter) Report(username string, from, to, now time.Time, loc *time.Location) (Report, error) {
+	report := Report{From: from, To: to, Heaters: []HeaterUsage{}}
+	refs, err := r.store.Heaters(username)
+	if err != nil {
+		return report, err
+	}
+	for _, ref := range refs {
+		heater, err := r.Heater(ref, from, to, now, loc)
+		if err != nil {
+			return report, err
+		}
+		report.Heaters = append(report.Heaters, heater)
+	}
+	return report, nil
+}
+
+// Heater returns the usage of one heater between from and to.
+func (r *Reporter) Heater(ref heaterstore.HeaterRef, from, to, now time.Time, loc *time.Location) (HeaterUsage, error) {
+	heater := HeaterUsage{Owner: ref.Owner, Heater: ref.Heater, ByUser: []UserUsage{}}
+	config, err := r.store.GetConfig(ref.Owner, ref.Heater)
+	if err != nil {
+		return heater, err
+	}
+	heater.Watts = config.Watts
+	if config.Tariff != nil {
+		heater.Priced = true
+		heater.Currency = config.Tariff.Currency
+	}
+	if config.Site != nil && config.Site.Timezone != "" {
+		loc = config.Site.Location()
+	}
+	// the whole history is needed to know whether the heater was already on
+	// at from
+	history, err := r.store.History(ref.Owner, ref.Heater, time.Time{})
+	if err != nil {
+		return heater, err
+	}
+	if to.After(now) {
+		to = now
+	}
+
+	byUser := make(map[string]int)
+	for _, period := range heaterstore.OnPeriods(history, now) {
+		u := Measure(period, from, to, config.Watts, config.Tariff, loc)
+		if u.Hours == 0 {
+			continue
+		}
+		heater.add(u)
+		by := period.By
+		if period.For != "" {
+			by = period.For
+		}
+		if by == "" {
+			by = "unknown"
+		}
+		i, ok := byUser[by]
+		if !ok {
+			i = len(heater.ByUser)
+			byUser[by] = i
+			heater.ByUser = append(heater.ByUser, UserUsage{Username: by})
+		}
+		heater.ByUser[i].add(u)
+	}
+	return heater, nil
+}
+
+// Measure returns the usage during the part of the period between from and
+// to. Times of day in the tariff are in loc.
+func Measure(p heaterstore.Period, from, to time.Time, watts float64, tariff *heaterstore.Tariff, loc *time.Location) Usage {
+	start, end := p.Start, p.End
+	if start.Before(from) {
+		start = from
+	}
+	if end.After(to) {
+		end = to
+	}
+	if !end.After(start) {
+		return Usage{}
+	}
+	kW := watts / 1000
+	u := Usage{Hours: end.Sub(start).Hours()}
+	u.KWh = kW * u.Hours
+	if tariff == nil {
+		return u
+	}
+	for t := start; t.Before(end); {
+		next := nextChange(*tariff, t.In(loc))
+		if next.After(end) {
+			next = end
+		}
+		u.Cost += kW * next.Sub(t).Hours() * Rate(*tariff, t.In(loc))
+		t = next
+	}
+	return u
+}
+
+// Rate returns the price of a kWh at t, whose time zone is the one the
+// tariff's times of day are in.
+func Rate(tariff heaterstore.Tariff, t time.Time) float64 {
+	minute := t.Hour()*60 + t.Minute()
+	for _, period := range tariff.Periods {
+		from, err := ParseClock(period.From)
+		if err != nil {
+			continue
+		}
+		to, err := ParseClock(period.To)
+		if err != nil {
+			continue
+		}
+		if from <= to && minute >= from && minute < to {
+			return period.Rate
+		}
+		if from > to && (minute >= from || minute < to) {
+			return period.Rate
+		}
+	}
+	return tariff.Rate
+}
+
+// nextChange returns the first time after t at which a tariff period starts
+// or ends. If there are no periods, it returns the next midnight.
+func nextChange(tariff heaterstore.Tariff, t time.Time) time.Time {
+	year, month, day := t.Date()
+	next := time.Date(year, month, day+1, 0, 0, 0, 0, t.Location())
+	for _, period := range tariff.Periods {
+		for _, clock := range []string{period.From, period.To} {
+			minute, err := ParseClock(clock)
+			if err != nil {
+				continue
+			}
+			for _, d := range []int{day, day + 1} {
+				candidate := time.Date(year, month, d, 0, minute, 0, 0, t.Location())
+				if candidate.After(t) && candidate.Before(next) {
+					next = candidate
+				}
+			}
+		}
+	}
+	return next
+}
+
+// ParseClock parses a time of day such as "22:00" as minutes after midnight.
+func ParseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day like 22:00", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// ParseTariffPeriod parses a period such as "22:00-06:00=0.08".
+func ParseTariffPeriod(s string) (heaterstore.TariffPeriod, error) {
+	period := heaterstore.TariffPeriod{}
+	parts := strings.SplitN(s, "=", 2)
+	times := strings.SplitN(parts[0], "-", 2)
+	if len(parts) != 2 || len(times) != 2 {
+		return period, fmt.Errorf("%q is not a period like 22:00-06:00=0.08", s)
+	}
+	for _, clock := range times {
+		_, err := ParseClock(clock)
+		if err != nil {
+			return period, err
+		}
+	}
+	rate, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || rate < 0 {
+		return period, fmt.Errorf("%q is not a price", parts[1])
+	}
+	period.From, period.To, period.Rate = times[0], times[1], rate
+	return period, nil
+}
+
+// ParseRate parses a price such as "0.15" or "$0.15", returning any currency
+// symbol or code that comes before the number.
+func ParseRate(s string) (float64, string, error) {
+	number := strings.TrimLeftFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	rate, err := strconv.ParseFloat(number, 64)
+	if err != nil || rate < 0 {
+		return 0, "", fmt.Errorf("%q is not a price", s)
+	}
+	return rate, strings.TrimSpace(strings.TrimSuffix(s, number)), nil
+}
+
+// FormatPrice formats an amount of money with the given number of decimal
+// places, or as few as needed if decimals is -1.
+func FormatPrice(currency string, price float64, decimals int) string {
+	amount := strconv.FormatFloat(price, 'f', decimals, 64)
+	if utf8.RuneCountInString(currency) > 1 {
+		return amount + " " + currency
+	}
+	return currency + amount
+}
+
+// Month returns the first moment of the month containing t, and of the month
+// after it, in loc.
+func Month(t time.Time, loc *time.Location) (time.Time, time.Time) {
+	year, month, _ := t.In(loc).Date()
+	start := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// ParseMonth parses a month such as "2021-01", "january" or "jan". A month
+// given by name is the most recent one that has started by now. An empty
+// string means the current month.
+func ParseMonth(s string, now time.Time, loc *time.Location) (time.Time, error) {
+	now = now.In(loc)
+	if s == "" {
+		start, _ := Month(now, loc)
+		return start, nil
+	}
+	t, err := time.ParseInLocation("2006-01", s, loc)
+	if err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"January", "Jan"} {
+		t, err = time.Parse(layout, strings.Title(strings.ToLower(s)))
+		if err != nil {
+			continue
+		}
+		year := now.Year()
+		if t.Month() > now.Month() {
+			year--
+		}
+		return time.Date(year, t.Month(), 1, 0, 0, 0, 0, loc), nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a month like 2021-01 or january", s)
+}
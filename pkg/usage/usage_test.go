@@ -0,0 +1,314 @@
+package usage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+)
+
+func newYork(t *testing.T) *time.Location {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone data: %s", err.Error())
+	}
+	return loc
+}
+
+func TestRate(t *testing.T) {
+	tariff := heaterstore.Tariff{
+		Rate: 0.15,
+		Periods: []heaterstore.TariffPeriod{
+			{From: "22:00", To: "06:00", Rate: 0.08},
+			{From: "17:00", To: "21:00", Rate: 0.3},
+			{From: "18:00", To: "19:00", Rate: 0.5},
+			{From: "12:00", To: "12:00", Rate: 1},
+		},
+	}
+	day := time.Date(2021, time.January, 15, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		clock    string
+		expected float64
+	}{
+		{"00:00", 0.08},
+		{"05:59", 0.08},
+		{"06:00", 0.15},
+		{"12:00", 0.15}, // a period that ends when it starts is empty
+		{"17:00", 0.3},
+		{"18:30", 0.3}, // the first period wins where they overlap
+		{"21:00", 0.15},
+		{"21:59", 0.15},
+		{"22:00", 0.08},
+		{"23:59", 0.08},
+	} {
+		minute, err := ParseClock(tc.clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := Rate(tariff, day.Add(time.Duration(minute)*time.Minute))
+		if got != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.clock, tc.expected, got)
+		}
+	}
+}
+
+func TestNextChange(t *testing.T) {
+	ny := newYork(t)
+	for _, tc := range []struct {
+		name     string
+		periods  []heaterstore.TariffPeriod
+		t        time.Time
+		expected time.Time
+	}{
+		{
+			name:     "no periods",
+			t:        time.Date(2021, time.January, 15, 13, 0, 0, 0, time.UTC),
+			expected: time.Date(2021, time.January, 16, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "start of a period",
+			periods:  []heaterstore.TariffPeriod{{From: "22:00", To: "06:00"}},
+			t:        time.Date(2021, time.January, 15, 13, 0, 0, 0, time.UTC),
+			expected: time.Date(2021, time.January, 15, 22, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "midnight inside a period",
+			periods:  []heaterstore.TariffPeriod{{From: "22:00", To: "06:00"}},
+			t:        time.Date(2021, time.January, 15, 22, 0, 0, 0, time.UTC),
+			expected: time.Date(2021, time.January, 16, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "end of a period",
+			periods:  []heaterstore.TariffPeriod{{From: "22:00", To: "06:00"}},
+			t:        time.Date(2021, time.January, 16, 0, 0, 0, 0, time.UTC),
+			expected: time.Date(2021, time.January, 16, 6, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "overlapping periods",
+			periods:  []heaterstore.TariffPeriod{{From: "17:00", To: "21:00"}, {From: "18:00", To: "19:00"}},
+			t:        time.Date(2021, time.January, 15, 17, 0, 0, 0, time.UTC),
+			expected: time.Date(2021, time.January, 15, 18, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "spring forward",
+			periods:  []heaterstore.TariffPeriod{{From: "01:00", To: "03:00"}},
+			t:        time.Date(2021, time.March, 14, 1, 0, 0, 0, ny),
+			expected: time.Date(2021, time.March, 14, 3, 0, 0, 0, ny),
+		},
+		{
+			name:     "short day",
+			t:        time.Date(2021, time.March, 14, 0, 0, 0, 0, ny),
+			expected: time.Date(2021, time.March, 14, 0, 0, 0, 0, ny).Add(23 * time.Hour),
+		},
+		{
+			name:     "long day",
+			t:        time.Date(2021, time.November, 7, 0, 0, 0, 0, ny),
+			expected: time.Date(2021, time.November, 7, 0, 0, 0, 0, ny).Add(25 * time.Hour),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := nextChange(heaterstore.Tariff{Periods: tc.periods}, tc.t)
+			if !got.Equal(tc.expected) {
+				t.Errorf("expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestMeasure(t *testing.T) {
+	ny := newYork(t)
+	night := &heaterstore.Tariff{
+		Rate:    0.15,
+		Periods: []heaterstore.TariffPeriod{{From: "22:00", To: "06:00", Rate: 0.08}},
+	}
+	peak := &heaterstore.Tariff{
+		Rate:    0.1,
+		Periods: []heaterstore.TariffPeriod{{From: "18:00", To: "19:00", Rate: 0.5}, {From: "17:00", To: "21:00", Rate: 0.3}},
+	}
+	oneAM := &heaterstore.Tariff{
+		Rate:    0.1,
+		Periods: []heaterstore.TariffPeriod{{From: "01:00", To: "02:00", Rate: 0.2}},
+	}
+	earlyMorning := &heaterstore.Tariff{
+		Rate:    0.1,
+		Periods: []heaterstore.TariffPeriod{{From: "01:00", To: "03:00", Rate: 0.2}},
+	}
+	utc := func(day, hour int) time.Time {
+		return time.Date(2021, time.January, day, hour, 0, 0, 0, time.UTC)
+	}
+	allTime := []time.Time{{}, time.Date(3000, time.January, 1, 0, 0, 0, 0, time.UTC)}
+	for _, tc := range []struct {
+		name     string
+		period   heaterstore.Period
+		between  []time.Time
+		watts    float64
+		tariff   *heaterstore.Tariff
+		loc      *time.Location
+		expected Usage
+	}{
+		{
+			name:     "no tariff",
+			period:   heaterstore.Period{Start: utc(15, 6), End: utc(15, 9)},
+			between:  allTime,
+			watts:    1500,
+			loc:      time.UTC,
+			expected: Usage{Hours: 3, KWh: 4.5},
+		},
+		{
+			name:     "clipped to the report",
+			period:   heaterstore.Period{Start: utc(14, 22), End: utc(15, 3)},
+			between:  []time.Time{utc(15, 0), utc(16, 0)},
+			watts:    1000,
+			tariff:   night,
+			loc:      time.UTC,
+			expected: Usage{Hours: 3, KWh: 3, Cost: 0.24},
+		},
+		{
+			name:     "outside the report",
+			period:   heaterstore.Period{Start: utc(14, 6), End: utc(14, 9)},
+			between:  []time.Time{utc(15, 0), utc(16, 0)},
+			watts:    1000,
+			tariff:   night,
+			loc:      time.UTC,
+			expected: Usage{},
+		},
+		{
+			name:     "across midnight",
+			period:   heaterstore.Period{Start: utc(15, 20), End: utc(16, 8)},
+			between:  allTime,
+			watts:    1000,
+			tariff:   night,
+			loc:      time.UTC,
+			expected: Usage{Hours: 12, KWh: 12, Cost: 2*0.15 + 8*0.08 + 2*0.15},
+		},
+		{
+			name:     "in the tariff's time zone",
+			period:   heaterstore.Period{Start: utc(15, 20), End: utc(16, 8)},
+			between:  allTime,
+			watts:    1000,
+			tariff:   night,
+			loc:      ny, // 15:00 to 03:00
+			expected: Usage{Hours: 12, KWh: 12, Cost: 7*0.15 + 5*0.08},
+		},
+		{
+			name:     "overlapping periods",
+			period:   heaterstore.Period{Start: utc(15, 16), End: utc(15, 22)},
+			between:  allTime,
+			watts:    1000,
+			tariff:   peak,
+			loc:      time.UTC,
+			expected: Usage{Hours: 6, KWh: 6, Cost: 0.1 + 0.3 + 0.5 + 2*0.3 + 0.1},
+		},
+		{
+			name: "spring forward",
+			period: heaterstore.Period{
+				Start: time.Date(2021, time.March, 14, 0, 0, 0, 0, ny),
+				End:   time.Date(2021, time.March, 15, 0, 0, 0, 0, ny),
+			},
+			between: allTime,
+			watts:   1000,
+			tariff:  earlyMorning,
+			loc:     ny,
+			// 01:00 to 03:00 is one hour that day
+			expected: Usage{Hours: 23, KWh: 23, Cost: 22*0.1 + 0.2},
+		},
+		{
+			name: "fall back",
+			period: heaterstore.Period{
+				Start: time.Date(2021, time.November, 7, 0, 0, 0, 0, ny),
+				End:   time.Date(2021, time.November, 8, 0, 0, 0, 0, ny),
+			},
+			between: allTime,
+			watts:   1000,
+			tariff:  oneAM,
+			loc:     ny,
+			// 01:00 to 02:00 happens twice that day
+			expected: Usage{Hours: 25, KWh: 25, Cost: 23*0.1 + 2*0.2},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Measure(tc.period, tc.between[0], tc.between[1], tc.watts, tc.tariff, tc.loc)
+			if !closeTo(got.Hours, tc.expected.Hours) || !closeTo(got.KWh, tc.expected.KWh) || !closeTo(got.Cost, tc.expected.Cost) {
+				t.Errorf("expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
+
+// TestHeaterCredits checks that time the thermostat had a heater on counts
+// for the user who set the hold.
+func TestHeaterCredits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	historyDir := filepath.Join(dir, "alice", heaterstore.HistoryDirname)
+	err = os.MkdirAll(historyDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &heaterstore.Store{Dir: dir}
+	err = store.SetConfig("alice", "plane", heaterstore.HeaterConfig{Watts: 1000, Tariff: &heaterstore.Tariff{Rate: 0.1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2021, time.January, 15, 0, 0, 0, 0, time.UTC)
+	history := []heaterstore.Change{
+		{Time: day.Add(1 * time.Hour), Value: "on", By: "alice"},
+		{Time: day.Add(2 * time.Hour), Value: "off", By: "alice"},
+		{Time: day.Add(3 * time.Hour), Value: "on", By: "thermostat", For: "bob"},
+		{Time: day.Add(5 * time.Hour), Value: "off", By: "thermostat"},
+		{Time: day.Add(6 * time.Hour), Value: "on", By: "thermostat", For: "alice"},
+		{Time: day.Add(7 * time.Hour), Value: "off", By: "thermostat"},
+		// recorded before holds were credited to their setter
+		{Time: day.Add(8 * time.Hour), Value: "on", By: "thermostat"},
+		{Time: day.Add(12 * time.Hour), Value: "off", By: "alice"},
+		{Time: day.Add(13 * time.Hour), Value: "on"},
+	}
+	var data []byte
+	for _, change := range history {
+		line, err := json.Marshal(change)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(append(data, line...), '\n')
+	}
+	err = ioutil.WriteFile(filepath.Join(historyDir, "plane"), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref := heaterstore.HeaterRef{Owner: "alice", Heater: "plane", Role: heaterstore.RoleOwner}
+	heater, err := New(store).Heater(ref, day, day.Add(24*time.Hour), day.Add(14*time.Hour), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if heater.Hours != 9 || !closeTo(heater.Cost, 0.9) {
+		t.Errorf("expected 9 hours costing 0.9, got %+v", heater.Usage)
+	}
+	expected := []UserUsage{
+		{Username: "alice", Usage: Usage{Hours: 2, KWh: 2, Cost: 0.2}},
+		{Username: "bob", Usage: Usage{Hours: 2, KWh: 2, Cost: 0.2}},
+		{Username: "thermostat", Usage: Usage{Hours: 4, KWh: 4, Cost: 0.4}},
+		{Username: "unknown", Usage: Usage{Hours: 1, KWh: 1, Cost: 0.1}},
+	}
+	if len(heater.ByUser) != len(expected) {
+		t.Fatalf("expected %+v, got %+v", expected, heater.ByUser)
+	}
+	for i := range expected {
+		got := heater.ByUser[i]
+		if got.Username != expected[i].Username || got.Hours != expected[i].Hours || !closeTo(got.Cost, expected[i].Cost) {
+			t.Errorf("expected %+v, got %+v", expected[i], got)
+		}
+	}
+}
+
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
@@ -0,0 +1,135 @@
+package weather
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultURL is the aviationweather.gov endpoint for the latest METAR. The
+// placeholder {station} is replaced with the ICAO code.
+const DefaultURL = "https://aviationweather.gov/api/data/metar?ids={station}&format=raw"
+
+// CacheFor is how long a fetched report is reused before fetching again.
+const CacheFor = 10 * time.Minute
+
+// Fetcher returns the latest raw METAR for a station, identified by its ICAO
+// code.
+type Fetcher interface {
+	Fetch(station string) (string, error)
+}
+
+// HTTPFetcher fetches METARs over HTTP.
+type HTTPFetcher struct {
+	// URL has the placeholder {station}, which is replaced with the ICAO
+	// code.
+	URL    string
+	Client *http.Client
+}
+
+func (f *HTTPFetcher) Fetch(station string) (string, error) {
+	client := f.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Get(strings.Replace(f.URL, "{station}", url.QueryEscape(station), -1))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching METAR for %s: %s", station, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return findReport(string(body), station)
+}
+
+// FileFetcher reads METARs from files named <station>.TXT in Dir, in the
+// format that NOAA publishes them: a line with the date followed by the
+// report.
+type FileFetcher struct {
+	Dir string
+}
+
+func (f *FileFetcher) Fetch(station string) (string, error) {
+	if !ValidStation(station) {
+		return "", fmt.Errorf("invalid station %q", station)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(f.Dir, station+".TXT"))
+	if err != nil {
+		return "", err
+	}
+	return findReport(string(data), station)
+}
+
+// findReport returns the first line of text that is a report for the
+// station.
+func findReport(text, station string) (string, error) {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(line)
+		if len(fields) > 0 && (fields[0] == "METAR" || fields[0] == "SPECI") {
+			fields = fields[1:]
+		}
+		if len(fields) > 0 && fields[0] == station {
+			return line, nil
+		}
+	}
+	return "", fmt.Errorf("no METAR found for %s: %w", station, os.ErrNotExist)
+}
+
+// Service returns recent reports, fetching them as needed.
+type Service struct {
+	sync.Mutex
+	fetcher Fetcher
+	cache   map[string]cached
+}
+
+type cached struct {
+	report    Report
+	fetchedAt time.Time
+}
+
+func NewService(fetcher Fetcher) *Service {
+	return &Service{
+		fetcher: fetcher,
+		cache:   make(map[string]cached),
+	}
+}
+
+// Latest returns the station's latest report, fetching it if the one on hand
+// is older than CacheFor.
+func (s *Service) Latest(station string, now time.Time) (Report, error) {
+	station = strings.ToUpper(station)
+	if !ValidStation(station) {
+		return Report{}, fmt.Errorf("invalid station %q", station)
+	}
+	s.Lock()
+	c, ok := s.cache[station]
+	s.Unlock()
+	if ok && now.Sub(c.fetchedAt) < CacheFor {
+		return c.report, nil
+	}
+
+	raw, err := s.fetcher.Fetch(station)
+	if err != nil {
+		return Report{}, err
+	}
+	report, err := Parse(raw, now)
+	if err != nil {
+		return report, err
+	}
+	s.Lock()
+	s.cache[station] = cached{report: report, fetchedAt: now}
+	s.Unlock()
+	return report, nil
+}
@@ -0,0 +1,235 @@
+// Package weather fetches and parses METAR aviation weather reports.
+package weather
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Report is a parsed METAR.
+type Report struct {
+	Station string    `json:"station"`
+	Time    time.Time `json:"time"`
+	Raw     string    `json:"raw"`
+	// Wind is a description such as "270° at 12 kt gusting 20 kt".
+	Wind string `json:"wind,omitempty"`
+	// Visibility is as reported, such as "10SM" or "9999".
+	Visibility string `json:"visibility,omitempty"`
+	// Conditions describe present weather, such as "light snow".
+	Conditions []string `json:"conditions,omitempty"`
+	// Clouds describe each cloud layer, such as "overcast at 1500 ft".
+	Clouds []string `json:"clouds,omitempty"`
+	// Temperature and Dewpoint are in degrees Celsius. They are only set if
+	// HaveTemperature is true.
+	Temperature     float64 `json:"temperature"`
+	Dewpoint        float64 `json:"dewpoint"`
+	HaveTemperature bool    `json:"haveTemperature"`
+}
+
+// Summary describes the report in a few words, without the temperature.
+func (r Report) Summary() string {
+	parts := []string{}
+	parts = append(parts, r.Conditions...)
+	if len(r.Clouds) > 0 {
+		parts = append(parts, r.Clouds[len(r.Clouds)-1])
+	}
+	if r.Wind != "" {
+		parts = append(parts, "wind "+r.Wind)
+	}
+	if len(parts) == 0 {
+		return "no significant weather"
+	}
+	return strings.Join(parts, ", ")
+}
+
+var (
+	stationRE     = regexp.MustCompile(`^[A-Z][A-Z0-9]{3}$`)
+	timeRE        = regexp.MustCompile(`^(\d{2})(\d{2})(\d{2})Z$`)
+	windRE        = regexp.MustCompile(`^(\d{3}|VRB)(\d{2,3})(?:G(\d{2,3}))?(KT|MPS)$`)
+	windVarRE     = regexp.MustCompile(`^\d{3}V\d{3}$`)
+	visibilityRE  = regexp.MustCompile(`^(?:M?\d+(?:/\d+)?SM|\d{4}|CAVOK)$`)
+	wholeMilesRE  = regexp.MustCompile(`^\d+$`)
+	rvrRE         = regexp.MustCompile(`^R\d{2}[LCR]?/`)
+	weatherRE     = regexp.MustCompile(`^(-|\+|VC)?(?:(MI|PR|BC|DR|BL|SH|TS|FZ)((?:DZ|RA|SN|SG|IC|PL|GR|GS|UP|BR|FG|FU|VA|DU|SA|HZ|PY|PO|SQ|FC|SS|DS)*)|((?:DZ|RA|SN|SG|IC|PL|GR|GS|UP|BR|FG|FU|VA|DU|SA|HZ|PY|PO|SQ|FC|SS|DS)+))$`)
+	cloudRE       = regexp.MustCompile(`^(FEW|SCT|BKN|OVC|VV)(\d{3}|///)(CB|TCU)?$`)
+	temperatureRE = regexp.MustCompile(`^(M?\d{2})/(M?\d{2})?$`)
+	// the remarks can give the temperature and dewpoint to a tenth of a degree
+	preciseRE = regexp.MustCompile(`^T([01])(\d{3})(?:([01])(\d{3}))?$`)
+)
+
+var (
+	intensities = map[string]string{"-": "light", "+": "heavy", "VC": "nearby"}
+	descriptors = map[string]string{
+		"MI": "shallow", "PR": "partial", "BC": "patches of", "DR": "drifting",
+		"BL": "blowing", "SH": "showers of", "TS": "thunderstorms with", "FZ": "freezing",
+	}
+	phenomena = map[string]string{
+		"DZ": "drizzle", "RA": "rain", "SN": "snow", "SG": "snow grains", "IC": "ice crystals",
+		"PL": "ice pellets", "GR": "hail", "GS": "small hail", "UP": "unknown precipitation",
+		"BR": "mist", "FG": "fog", "FU": "smoke", "VA": "volcanic ash", "DU": "dust",
+		"SA": "sand", "HZ": "haze", "PY": "spray", "PO": "dust whirls", "SQ": "squalls",
+		"FC": "funnel cloud", "SS": "sandstorm", "DS": "duststorm",
+	}
+	coverages = map[string]string{
+		"FEW": "few clouds", "SCT": "scattered clouds", "BKN": "broken clouds",
+		"OVC": "overcast", "VV": "vertical visibility",
+	}
+)
+
+// ValidStation returns true if station is in the form of an ICAO code, such
+// as PANC.
+func ValidStation(station string) bool {
+	return stationRE.MatchString(station)
+}
+
+// Parse parses a METAR. now is used to find the month and year in which it
+// was observed, since the report only gives the day.
+func Parse(raw string, now time.Time) (Report, error) {
+	report := Report{Raw: strings.TrimSpace(raw)}
+	fields := strings.Fields(report.Raw)
+	if len(fields) > 0 && (fields[0] == "METAR" || fields[0] == "SPECI") {
+		fields = fields[1:]
+	}
+	if len(fields) < 2 || !ValidStation(fields[0]) {
+		return report, errors.New("METAR does not start with a station")
+	}
+	report.Station = fields[0]
+	match := timeRE.FindStringSubmatch(fields[1])
+	if match == nil {
+		return report, fmt.Errorf("invalid METAR time %q", fields[1])
+	}
+	report.Time = observed(match, now)
+
+	remarks := false
+	for i := 2; i < len(fields); i++ {
+		field := fields[i]
+		if field == "RMK" {
+			remarks = true
+			continue
+		}
+		if remarks {
+			if match := preciseRE.FindStringSubmatch(field); match != nil {
+				report.Temperature = tenths(match[1], match[2])
+				if match[3] != "" {
+					report.Dewpoint = tenths(match[3], match[4])
+				}
+				report.HaveTemperature = true
+			}
+			continue
+		}
+
+		switch {
+		case field == "AUTO" || field == "COR" || windVarRE.MatchString(field) || rvrRE.MatchString(field):
+		case windRE.MatchString(field):
+			report.Wind = describeWind(windRE.FindStringSubmatch(field))
+		case wholeMilesRE.MatchString(field) && i+1 < len(fields) && strings.HasSuffix(fields[i+1], "SM"):
+			// such as "1 1/2SM"
+			report.Visibility = field + " " + fields[i+1]
+			i++
+		case visibilityRE.MatchString(field):
+			report.Visibility = field
+		case weatherRE.MatchString(field):
+			report.Conditions = append(report.Conditions, describeWeather(weatherRE.FindStringSubmatch(field)))
+		case cloudRE.MatchString(field):
+			match := cloudRE.FindStringSubmatch(field)
+			layer := coverages[match[1]]
+			if height, err := strconv.Atoi(match[2]); err == nil {
+				layer = fmt.Sprintf("%s at %d ft", layer, height*100)
+			}
+			report.Clouds = append(report.Clouds, layer)
+		case field == "CLR" || field == "SKC" || field == "NSC" || field == "NCD":
+			report.Clouds = append(report.Clouds, "clear")
+		case temperatureRE.MatchString(field):
+			match := temperatureRE.FindStringSubmatch(field)
+			report.Temperature = whole(match[1])
+			if match[2] != "" {
+				report.Dewpoint = whole(match[2])
+			}
+			report.HaveTemperature = true
+		}
+	}
+	return report, nil
+}
+
+// observed resolves the day, hour and minute of a report to the most recent
+// such time that isn't more than a day after now.
+func observed(match []string, now time.Time) time.Time {
+	day, _ := strconv.Atoi(match[1])
+	hour, _ := strconv.Atoi(match[2])
+	minute, _ := strconv.Atoi(match[3])
+	now = now.UTC()
+	t := time.Date(now.Year(), now.Month(), day, hour, minute, 0, 0, time.UTC)
+	for months := 1; months <= 12 && (t.Sub(now) > 24*time.Hour || t.Day() != day); months++ {
+		// the report is from a previous month
+		t = time.Date(now.Year(), now.Month()-time.Month(months), day, hour, minute, 0, 0, time.UTC)
+	}
+	return t
+}
+
+func whole(s string) float64 {
+	v, _ := strconv.Atoi(strings.TrimPrefix(s, "M"))
+	if strings.HasPrefix(s, "M") {
+		return -float64(v)
+	}
+	return float64(v)
+}
+
+func tenths(sign, digits string) float64 {
+	v, _ := strconv.Atoi(digits)
+	if sign == "1" {
+		return -float64(v) / 10
+	}
+	return float64(v) / 10
+}
+
+func describeWind(match []string) string {
+	unit := "kt"
+	if match[4] == "MPS" {
+		unit = "m/s"
+	}
+	speed, _ := strconv.Atoi(match[2])
+	if speed == 0 {
+		return "calm"
+	}
+	direction := match[1] + "°"
+	if match[1] == "VRB" {
+		direction = "variable"
+	}
+	wind := fmt.Sprintf("%s at %d %s", direction, speed, unit)
+	if match[3] != "" {
+		gust, _ := strconv.Atoi(match[3])
+		wind += fmt.Sprintf(" gusting %d %s", gust, unit)
+	}
+	return wind
+}
+
+func describeWeather(match []string) string {
+	words := []string{}
+	if match[1] != "" && match[1] != "VC" {
+		words = append(words, intensities[match[1]])
+	}
+	codes := match[3] + match[4]
+	switch {
+	case match[2] == "TS" && codes == "":
+		words = append(words, "thunderstorms")
+	case match[2] == "SH" && codes == "":
+		words = append(words, "showers")
+	case match[2] != "":
+		words = append(words, descriptors[match[2]])
+	}
+	kinds := []string{}
+	for i := 0; i+2 <= len(codes); i += 2 {
+		kinds = append(kinds, phenomena[codes[i:i+2]])
+	}
+	if len(kinds) > 0 {
+		words = append(words, strings.Join(kinds, " and "))
+	}
+	if match[1] == "VC" {
+		words = append(words, intensities["VC"])
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,148 @@
+package weather
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Date(2021, time.January, 15, 18, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		raw      string
+		expected Report
+	}{
+		{
+			raw: "PANC 151653Z 36008KT 10SM FEW045 BKN100 M07/M12 A2990 RMK AO2 SLP128 T10721122",
+			expected: Report{
+				Station:         "PANC",
+				Time:            time.Date(2021, time.January, 15, 16, 53, 0, 0, time.UTC),
+				Wind:            "360° at 8 kt",
+				Visibility:      "10SM",
+				Clouds:          []string{"few clouds at 4500 ft", "broken clouds at 10000 ft"},
+				Temperature:     -7.2,
+				Dewpoint:        -12.2,
+				HaveTemperature: true,
+			},
+		},
+		{
+			raw: "METAR PAFA 151756Z AUTO VRB03G15KT 1 1/2SM -SN BR OVC008 M23/",
+			expected: Report{
+				Station:         "PAFA",
+				Time:            time.Date(2021, time.January, 15, 17, 56, 0, 0, time.UTC),
+				Wind:            "variable at 3 kt gusting 15 kt",
+				Visibility:      "1 1/2SM",
+				Conditions:      []string{"light snow", "mist"},
+				Clouds:          []string{"overcast at 800 ft"},
+				Temperature:     -23,
+				HaveTemperature: true,
+			},
+		},
+		{
+			raw: "SPECI EGLL 150950Z 00000KT 250V310 R27L/0600 0800 +TSRA VCSH FZFG VV002 CLR 03/02",
+			expected: Report{
+				Station:         "EGLL",
+				Time:            time.Date(2021, time.January, 15, 9, 50, 0, 0, time.UTC),
+				Wind:            "calm",
+				Visibility:      "0800",
+				Conditions:      []string{"heavy thunderstorms with rain", "showers nearby", "freezing fog"},
+				Clouds:          []string{"vertical visibility at 200 ft", "clear"},
+				Temperature:     3,
+				Dewpoint:        2,
+				HaveTemperature: true,
+			},
+		},
+		{
+			// a report from the end of the previous month
+			raw: "PANC 312353Z 18005MPS CAVOK",
+			expected: Report{
+				Station:    "PANC",
+				Time:       time.Date(2020, time.December, 31, 23, 53, 0, 0, time.UTC),
+				Wind:       "180° at 5 m/s",
+				Visibility: "CAVOK",
+			},
+		},
+	} {
+		report, err := Parse(tc.raw, now)
+		if err != nil {
+			t.Errorf("%s: %s", tc.raw, err.Error())
+			continue
+		}
+		tc.expected.Raw = tc.raw
+		if !reflect.DeepEqual(report, tc.expected) {
+			t.Errorf("%s:\ngot  %+v\nwant %+v", tc.raw, report, tc.expected)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	now := time.Now()
+	for _, raw := range []string{
+		"",
+		"METAR",
+		"PANC",
+		"panc 151653Z",
+		"../etc/passwd 151653Z",
+		"PANC 1516Z",
+		"PANC 151653 36008KT",
+	} {
+		if _, err := Parse(raw, now); err == nil {
+			t.Errorf("expected %q not to parse", raw)
+		}
+	}
+}
+
+func TestValidStation(t *testing.T) {
+	for station, valid := range map[string]bool{
+		"PANC":        true,
+		"K1G4":        true,
+		"panc":        false,
+		"PAN":         false,
+		"PANCC":       false,
+		"1ANC":        false,
+		"../X":        false,
+		"PA/C":        false,
+		"PANC&ids=X":  false,
+		"":            false,
+		"PANC\n":      false,
+		"..%2F..%2FX": false,
+	} {
+		if got := ValidStation(station); got != valid {
+			t.Errorf("ValidStation(%q) = %t, want %t", station, got, valid)
+		}
+	}
+}
+
+// countingFetcher returns report for every station and counts its calls.
+type countingFetcher struct {
+	report string
+	calls  int
+}
+
+func (f *countingFetcher) Fetch(station string) (string, error) {
+	f.calls++
+	return f.report, nil
+}
+
+func TestServiceRejectsInvalidStations(t *testing.T) {
+	fetcher := &countingFetcher{report: "PANC 151653Z 36008KT 10SM M07/M12"}
+	s := NewService(fetcher)
+	for _, station := range []string{"../../etc/passwd", "PANC&ids=KSEA", "PA"} {
+		if _, err := s.Latest(station, time.Now()); err == nil {
+			t.Errorf("expected %q to be rejected", station)
+		}
+	}
+	if fetcher.calls != 0 {
+		t.Errorf("fetched %d times", fetcher.calls)
+	}
+	if _, err := s.Latest("panc", time.Now()); err != nil || fetcher.calls != 1 {
+		t.Errorf("got %v after %d calls", err, fetcher.calls)
+	}
+}
+
+func TestFileFetcherRejectsInvalidStations(t *testing.T) {
+	f := &FileFetcher{Dir: t.TempDir()}
+	if _, err := f.Fetch("../PANC"); err == nil {
+		t.Error("expected the station to be rejected")
+	}
+}
@@ -0,0 +1,431 @@
+// Package webhook posts events about heaters, such as changes to their state
+// and their devices going offline, to URLs that users register. Each payload
+// is signed with the webhook's secret. Deliveries are queued in the store and
+// retried with exponential backoff until they succeed or too many attempts
+// have failed.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/netguard"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+)
+
+// Event types.
+const (
+	HeaterChanged = "heater.changed"
+	DeviceOffline = "device.offline"
+	DeviceOnline  = "device.online"
+	Test          = "test"
+)
+
+// Headers sent with each delivery.
+const (
+	EventHeader     = "X-Preheatbot-Event"
+	DeliveryHeader  = "X-Preheatbot-Delivery"
+	TimestampHeader = "X-Preheatbot-Timestamp"
+	// SignatureHeader is "sha256=" followed by the hex encoded HMAC-SHA256,
+	// keyed with the webhook's secret, of the timestamp header, a period and
+	// the body.
+	SignatureHeader = "X-Preheatbot-Signature"
+)
+
+const (
+	// MaxAttempts is how many times a delivery is tried before it is
+	// dropped, along with every delivery queued after it for the same
+	// webhook.
+	MaxAttempts = 12
+	// MaxQueued is how many deliveries may wait for each webhook. Beyond
+	// that, the oldest that hasn't been tried yet is dropped.
+	MaxQueued = 100
+	// RetryAfter is how long after the first failed attempt the delivery
+	// is retried. The wait doubles after each failure up to MaxRetryAfter.
+	RetryAfter    = 30 * time.Second
+	MaxRetryAfter = time.Hour
+	// OfflineAfter is how long a device that reports telemetry may go
+	// without reporting before it is considered offline.
+	OfflineAfter = 15 * time.Minute
+
+	deliverInterval = 10 * time.Second
+	deviceInterval  = time.Minute
+)
+
+// Event is the payload posted to webhooks.
+type Event struct {
+	ID   string    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Owner is set for heaters that belong to a user, and Group for heaters
+	// that belong to a group.
+	Owner  string `json:"owner,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Heater string `json:"heater,omitempty"`
+	// Value, Version and By are set for heater.changed events.
+	Value   string `json:"value,omitempty"`
+	Version int    `json:"version,omitempty"`
+	By      string `json:"by,omitempty"`
+	// LastSeen is set for device events, and is when the device last
+	// reported.
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+// NewEvent returns an event of the given type about the heater.
+func NewEvent(eventType string, ref heaterstore.HeaterRef, now time.Time) Event {
+	event := Event{
+		ID:     uuid.New().String(),
+		Type:   eventType,
+		Time:   now,
+		Heater: ref.Heater,
+	}
+	if group, ok := heaterstore.GroupFromNamespace(ref.Owner); ok {
+		event.Group = group
+	} else {
+		event.Owner = ref.Owner
+	}
+	return event
+}
+
+// Dispatcher queues and delivers events.
+type Dispatcher struct {
+	store     *heaterstore.Store
+	telemetry *telemetry.Store
+	client    *http.Client
+}
+
+func New(store *heaterstore.Store, telemetry *telemetry.Store) *Dispatcher {
+	return &Dispatcher{
+		store:     store,
+		telemetry: telemetry,
+		client:    newClient(),
+	}
+}
+
+// newClient returns a client that only connects to public addresses, so that
+// webhooks can't reach services on the server's own network. It doesn't use
+// a proxy, since the check would then apply to the proxy instead.
+func newClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: netguard.Control}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
+
+// HeaterChanged queues a heater.changed event for the webhooks of everyone
+// who can see the heater.
+func (d *Dispatcher) HeaterChanged(ref heaterstore.HeaterRef, record heaterstore.Record, by string) {
+	event := NewEvent(HeaterChanged, ref, time.Now())
+	event.Value = record.Value
+	event.Version = record.Version
+	event.By = by
+	err := d.Enqueue(ref, event)
+	if err != nil {
+		log.Errorf("error queueing webhooks for %s/%s: %s", ref.Owner, ref.Heater, err.Error())
+	}
+}
+
+// Enqueue queues the event for the webhooks of everyone who can see the
+// heater.
+func (d *Dispatcher) Enqueue(ref heaterstore.HeaterRef, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	audience, err := d.store.Audience(ref.Owner, ref.Heater)
+	if err != nil {
+		return err
+	}
+	watchers, err := d.store.Watchers(ref.Owner, ref.Heater)
+	if err != nil {
+		return err
+	}
+	queued := make(map[string]bool)
+	for _, username := range append(audience, watchers...) {
+		if queued[username] {
+			continue
+		}
+		queued[username] = true
+		webhooks, err := d.store.Webhooks(username)
+		if err != nil {
+			return err
+		}
+		if len(webhooks) == 0 {
+			continue
+		}
+		err = d.store.UpdateDeliveries(username, func(deliveries []heaterstore.Delivery) []heaterstore.Delivery {
+			for _, webhook := range webhooks {
+				deliveries = trimQueue(deliveries, webhook.ID)
+				deliveries = append(deliveries, heaterstore.Delivery{
+					ID:        uuid.New().String(),
+					WebhookID: webhook.ID,
+					Event:     event.Type,
+					Payload:   payload,
+					CreatedAt: event.Time,
+					NextAt:    event.Time,
+				})
+			}
+			return deliveries
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trimQueue makes room for one more delivery to the webhook by dropping its
+// oldest untried deliveries.
+func trimQueue(deliveries []heaterstore.Delivery, webhookID string) []heaterstore.Delivery {
+	queued := 0
+	for _, delivery := range deliveries {
+		if delivery.WebhookID == webhookID {
+			queued++
+		}
+	}
+	drop := queued - MaxQueued + 1
+	if drop <= 0 {
+		return deliveries
+	}
+	log.Warnf("dropping %d queued deliveries to webhook %s, which has fallen behind", drop, webhookID)
+	kept := make([]heaterstore.Delivery, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		if drop > 0 && delivery.WebhookID == webhookID && delivery.Attempts == 0 {
+			drop--
+			continue
+		}
+		kept = append(kept, delivery)
+	}
+	return kept
+}
+
+// Run delivers queued events and watches for devices going offline and
+// coming back. It never returns.
+func (d *Dispatcher) Run() {
+	deliverTicker := time.NewTicker(deliverInterval)
+	defer deliverTicker.Stop()
+	deviceTicker := time.NewTicker(deviceInterval)
+	defer deviceTicker.Stop()
+	for {
+		select {
+		case now := <-deliverTicker.C:
+			d.DeliverDue(now)
+		case now := <-deviceTicker.C:
+			d.CheckDevices(now)
+		}
+	}
+}
+
+// DeliverDue attempts every delivery that is due.
+func (d *Dispatcher) DeliverDue(now time.Time) {
+	users, err := d.store.Users()
+	if err != nil {
+		log.Errorf("error listing users for webhooks: %s", err.Error())
+		return
+	}
+	for _, username := range users {
+		err = d.deliverUser(username, now)
+		if err != nil {
+			log.Errorf("error delivering webhooks for %s: %s", username, err.Error())
+		}
+	}
+}
+
+func (d *Dispatcher) deliverUser(username string, now time.Time) error {
+	deliveries, err := d.store.Deliveries(username)
+	if err != nil || len(deliveries) == 0 {
+		return err
+	}
+	webhooks, err := d.store.Webhooks(username)
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]heaterstore.Webhook)
+	for _, webhook := range webhooks {
+		byID[webhook.ID] = webhook
+	}
+
+	// done holds deliveries to remove, and retry those to try again later
+	done := make(map[string]bool)
+	retry := make(map[string]heaterstore.Delivery)
+	// once a webhook fails, its later deliveries wait so they stay in order
+	failed := make(map[string]bool)
+	// once one gives up, the webhook's later deliveries are dropped too
+	gaveUp := make(map[string]bool)
+	for _, delivery := range deliveries {
+		if failed[delivery.WebhookID] {
+			continue
+		}
+		if delivery.NextAt.After(now) {
+			// one waiting to be retried holds back those queued after it
+			if delivery.Attempts > 0 {
+				failed[delivery.WebhookID] = true
+			}
+			continue
+		}
+		webhook, ok := byID[delivery.WebhookID]
+		if !ok {
+			done[delivery.ID] = true
+			continue
+		}
+		err = d.Send(webhook, delivery.ID, delivery.Event, delivery.Payload, now)
+		if err == nil {
+			done[delivery.ID] = true
+			continue
+		}
+		failed[delivery.WebhookID] = true
+		delivery.Attempts++
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= MaxAttempts {
+			log.Warnf("giving up on webhook delivery %s and those queued after it to %s after %d attempts: %s",
+				delivery.ID, webhook.URL, delivery.Attempts, err.Error())
+			gaveUp[delivery.WebhookID] = true
+			continue
+		}
+		delivery.NextAt = now.Add(Backoff(delivery.Attempts))
+		retry[delivery.ID] = delivery
+	}
+
+	return d.store.UpdateDeliveries(username, func(deliveries []heaterstore.Delivery) []heaterstore.Delivery {
+		kept := []heaterstore.Delivery{}
+		for _, delivery := range deliveries {
+			if done[delivery.ID] || gaveUp[delivery.WebhookID] {
+				continue
+			}
+			if updated, ok := retry[delivery.ID]; ok {
+				delivery = updated
+			}
+			kept = append(kept, delivery)
+		}
+		return kept
+	})
+}
+
+// Backoff returns how long to wait before retrying a delivery that has
+// failed the given number of times.
+func Backoff(attempts int) time.Duration {
+	wait := RetryAfter
+	for i := 1; i < attempts && wait < MaxRetryAfter; i++ {
+		wait *= 2
+	}
+	if wait > MaxRetryAfter {
+		wait = MaxRetryAfter
+	}
+	return wait
+}
+
+// Send posts the payload to the webhook. Any response other than a 2xx status
+// is an error.
+func (d *Dispatcher) Send(webhook heaterstore.Webhook, deliveryID, eventType string, payload []byte, now time.Time) error {
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "preheatbot")
+	req.Header.Set(EventHeader, eventType)
+	req.Header.Set(DeliveryHeader, deliveryID)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, timestamp, payload))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", webhook.URL, resp.Status)
+	}
+	return nil
+}
+
+// SendTest posts a test event to the webhook right away.
+func (d *Dispatcher) SendTest(webhook heaterstore.Webhook, username string) error {
+	now := time.Now()
+	event := Event{ID: uuid.New().String(), Type: Test, Time: now, Owner: username}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return d.Send(webhook, event.ID, event.Type, payload, now)
+}
+
+// Sign returns the value of the SignatureHeader for a payload sent at
+// timestamp.
+func Sign(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is a valid SignatureHeader for the
+// payload and timestamp. Receivers may use it to check deliveries.
+func Verify(secret, timestamp string, payload []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, payload)), []byte(strings.TrimSpace(signature)))
+}
+
+// CheckDevices queues a device.offline event for each heater whose device has
+// stopped reporting telemetry, and a device.online event when it starts
+// again. Heaters whose devices have never reported are skipped.
+func (d *Dispatcher) CheckDevices(now time.Time) {
+	refs, err := d.store.AllHeaters()
+	if err != nil {
+		log.Errorf("error listing heaters to check devices: %s", err.Error())
+		return
+	}
+	for _, ref := range refs {
+		err = d.checkDevice(ref, now)
+		if err != nil {
+			log.Errorf("error checking device of %s/%s: %s", ref.Owner, ref.Heater, err.Error())
+		}
+	}
+}
+
+func (d *Dispatcher) checkDevice(ref heaterstore.HeaterRef, now time.Time) error {
+	lastSeen, ok, err := d.telemetry.LastReport(ref.Owner, ref.Heater)
+	if err != nil || !ok {
+		return err
+	}
+	online := now.Sub(lastSeen) <= OfflineAfter
+	state, known, err := d.store.GetDeviceState(ref.Owner, ref.Heater)
+	if err != nil {
+		return err
+	}
+	if known && state.Online == online {
+		return nil
+	}
+	since := lastSeen
+	if !online {
+		since = lastSeen.Add(OfflineAfter)
+	}
+	err = d.store.SetDeviceState(ref.Owner, ref.Heater, heaterstore.DeviceState{Online: online, Since: since})
+	if err != nil || !known {
+		return err
+	}
+
+	eventType := DeviceOffline
+	if online {
+		eventType = DeviceOnline
+	}
+	event := NewEvent(eventType, ref, now)
+	event.LastSeen = &lastSeen
+	return d.Enqueue(ref, event)
+}
@@ -0,0 +1,277 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mhrivnak/preheatbot/pkg/heaterstore"
+	"github.com/mhrivnak/preheatbot/pkg/telemetry"
+)
+
+func TestSignVerify(t *testing.T) {
+	payload := []byte(`{"type":"test"}`)
+	signature := Sign("secret", "1610000000", payload)
+	// echo -n '1610000000.{"type":"test"}' | openssl dgst -sha256 -hmac secret
+	if signature != "sha256=1113550c196e1e809967585c128ed5aad57e0bcc34fd3bc50ef285338b33fe18" {
+		t.Errorf("got %s", signature)
+	}
+	if !Verify("secret", "1610000000", payload, signature) {
+		t.Error("expected the signature to verify")
+	}
+	if !Verify("secret", "1610000000", payload, " "+signature+"\n") {
+		t.Error("expected surrounding space to be ignored")
+	}
+	for _, tc := range []struct {
+		secret, timestamp, payload, signature string
+	}{
+		{"other", "1610000000", string(payload), signature},
+		{"secret", "1610000001", string(payload), signature},
+		{"secret", "1610000000", `{"type":"tset"}`, signature},
+		{"secret", "1610000000", string(payload), ""},
+		{"secret", "1610000000", string(payload), signature[7:]},
+	} {
+		if Verify(tc.secret, tc.timestamp, []byte(tc.payload), tc.signature) {
+			t.Errorf("expected %+v not to verify", tc)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		attempts int
+		wait     time.Duration
+	}{
+		{1, RetryAfter},
+		{2, 2 * RetryAfter},
+		{3, 4 * RetryAfter},
+		{7, 64 * RetryAfter},
+		{8, MaxRetryAfter},
+		{MaxAttempts, MaxRetryAfter},
+	} {
+		if got := Backoff(tc.attempts); got != tc.wait {
+			t.Errorf("Backoff(%d) = %s, want %s", tc.attempts, got, tc.wait)
+		}
+	}
+}
+
+// receiver is a webhook endpoint that fails while failing is set, and
+// records the event IDs of every delivery attempt.
+type receiver struct {
+	lock     sync.Mutex
+	failing  bool
+	attempts []string
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	data, _ := ioutil.ReadAll(req.Body)
+	event := Event{}
+	json.Unmarshal(data, &event)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.attempts = append(r.attempts, event.Value)
+	if r.failing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+func (r *receiver) setFailing(failing bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failing = failing
+}
+
+func (r *receiver) got() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string{}, r.attempts...)
+}
+
+func TestDeliveryOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(filepath.Join(dir, "alice"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &heaterstore.Store{Dir: dir}
+	r := &receiver{failing: true}
+	server := httptest.NewServer(r)
+	defer server.Close()
+	_, err = store.AddWebhook("alice", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := New(store, &telemetry.Store{Dir: filepath.Join(dir, telemetry.Dirname)})
+	// the test server is on loopback, which New's client refuses
+	d.client = server.Client()
+
+	ref := heaterstore.HeaterRef{Owner: "alice", Heater: "plane"}
+	start := time.Now()
+	for _, value := range []string{"on", "off"} {
+		event := NewEvent(HeaterChanged, ref, start)
+		event.Value = value
+		err = d.Enqueue(ref, event)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first fails, and holds back the second
+	d.DeliverDue(start)
+	// neither is due to be tried: the first is waiting to be retried
+	d.DeliverDue(start.Add(time.Second))
+	r.setFailing(false)
+	d.DeliverDue(start.Add(2 * time.Second))
+	// both are delivered in order once the first is retried
+	d.DeliverDue(start.Add(Backoff(1)))
+
+	got := r.got()
+	expected := []string{"on", "on", "off"}
+	if len(got) != len(expected) {
+		t.Fatalf("got %v, want %v", got, expected)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("got %v, want %v", got, expected)
+		}
+	}
+	deliveries, err := store.Deliveries("alice")
+	if err != nil || len(deliveries) != 0 {
+		t.Errorf("expected an empty queue, got %+v (%v)", deliveries, err)
+	}
+}
+
+func TestSendRefusesPrivateAddresses(t *testing.T) {
+	r := &receiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+	d := New(&heaterstore.Store{}, &telemetry.Store{})
+	webhook := heaterstore.Webhook{ID: "1", URL: server.URL, Secret: "secret"}
+	if d.SendTest(webhook, "alice") == nil {
+		t.Error("expected the delivery to be refused")
+	}
+	if len(r.got()) != 0 {
+		t.Errorf("got %v", r.got())
+	}
+}
+
+func TestDeliveryGivesUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(filepath.Join(dir, "alice"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &heaterstore.Store{Dir: dir}
+	r := &receiver{failing: true}
+	server := httptest.NewServer(r)
+	defer server.Close()
+	_, err = store.AddWebhook("alice", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := New(store, &telemetry.Store{Dir: filepath.Join(dir, telemetry.Dirname)})
+	// the test server is on loopback, which New's client refuses
+	d.client = server.Client()
+
+	ref := heaterstore.HeaterRef{Owner: "alice", Heater: "plane"}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		err = d.Enqueue(ref, NewEvent(HeaterChanged, ref, now))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= MaxAttempts; i++ {
+		d.DeliverDue(now)
+		deliveries, err := store.Deliveries("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < MaxAttempts {
+			if len(deliveries) != 2 || deliveries[0].Attempts != i || !deliveries[0].NextAt.Equal(now.Add(Backoff(i))) || deliveries[0].LastError == "" {
+				t.Fatalf("after %d attempts got %+v", i, deliveries)
+			}
+			now = deliveries[0].NextAt
+		} else if len(deliveries) != 0 {
+			// the one waiting behind it is dropped too
+			t.Fatalf("expected the deliveries to be dropped, got %+v", deliveries)
+		}
+	}
+	if len(r.got()) != MaxAttempts {
+		t.Errorf("got %d attempts", len(r.got()))
+	}
+}
+
+func TestQueueLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(filepath.Join(dir, "alice"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &heaterstore.Store{Dir: dir}
+	r := &receiver{failing: true}
+	server := httptest.NewServer(r)
+	defer server.Close()
+	_, err = store.AddWebhook("alice", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := New(store, &telemetry.Store{Dir: filepath.Join(dir, telemetry.Dirname)})
+	// the test server is on loopback, which New's client refuses
+	d.client = server.Client()
+
+	ref := heaterstore.HeaterRef{Owner: "alice", Heater: "plane"}
+	now := time.Now()
+	enqueue := func(version int) {
+		event := NewEvent(HeaterChanged, ref, now)
+		event.Version = version
+		err := d.Enqueue(ref, event)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	enqueue(1)
+	// the first is tried and waits to be retried
+	d.DeliverDue(now)
+	for version := 2; version <= MaxQueued+5; version++ {
+		enqueue(version)
+	}
+
+	deliveries, err := store.Deliveries("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != MaxQueued {
+		t.Fatalf("expected %d queued deliveries, got %d", MaxQueued, len(deliveries))
+	}
+	// the one being retried stays at the head, and the oldest untried are
+	// dropped
+	for i, expected := range []int{1, 7, 8} {
+		event := Event{}
+		err = json.Unmarshal(deliveries[i].Payload, &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Version != expected {
+			t.Errorf("delivery %d: expected version %d, got %d", i, expected, event.Version)
+		}
+	}
+}